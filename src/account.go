@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// AccountConfig is a named ACME account in 'configs.accounts', which
+// certificates select with 'account'. Each has its own key per CA.
+type AccountConfig struct {
+	Email string `yaml:"email"`
+}
+
+var (
+	// accountsMutex guards accountSettings
+	accountsMutex = &sync.Mutex{}
+	// accountSettings holds the named accounts of the current cycle
+	accountSettings map[string]AccountConfig
+)
+
+// configureAccounts applies the named accounts of the configuration.
+func configureAccounts(global GlobalConfig) {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	accountSettings = global.Accounts
+}
+
+// accountEmail returns the contact address of a named account.
+func accountEmail(account string) string {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	return accountSettings[account].Email
+}
+
+// validateAccount checks that a certificate's account is defined.
+func validateAccount(config CertConfig, global GlobalConfig) error {
+	if config.Account == "" {
+		return nil
+	}
+	if _, ok := global.Accounts[config.Account]; !ok {
+		return fmt.Errorf("unknown account '%s', define it in 'configs.accounts'", config.Account)
+	}
+	return nil
+}
+
+// acmeShAccountHome returns the acme.sh config home of a named account, which
+// keeps its account keys and registration apart from the default account's.
+func acmeShAccountHome(account string) string {
+	base := envOrDefault("LE_CONFIG_HOME", filepath.Dir(acmeShPath))
+	return filepath.Join(base, "accounts", account)
+}
+
+// acmeShAccountArgs returns the acme.sh arguments selecting a certificate's
+// named account, if it has one.
+func acmeShAccountArgs(account string) []string {
+	if account == "" {
+		return nil
+	}
+	args := []string{"--config-home", acmeShAccountHome(account)}
+	if email := accountEmail(account); email != "" {
+		args = append(args, "-m", email)
+	}
+	return args
+}
+
+// accountRef is an ACME account: an issuer together with the backend holding
+// the account key, and the named account if not the default one.
+type accountRef struct {
+	backend string
+	issuer  string
+	account string
+}
+
+// String names the account in logs, e.g. "'letsencrypt' (account team-a)".
+func (ref accountRef) String() string {
+	if ref.account == "" {
+		return fmt.Sprintf("'%s'", ref.issuer)
+	}
+	return fmt.Sprintf("'%s' (account %s)", ref.issuer, ref.account)
+}
+
+// configuredAccounts returns the accounts used by the certificates of a
+// configuration, sorted by backend and issuer.
+func configuredAccounts(fullConfig FullConfig) []accountRef {
+	seen := map[accountRef]bool{}
+	var accounts []accountRef
+	for _, config := range fullConfig.Certificates {
+		if config.Monitor != "" || config.Issuer == "" {
+			continue
+		}
+		ref := accountRef{backend: backendFor(config), issuer: config.Issuer, account: config.Account}
+		if !seen[ref] {
+			seen[ref] = true
+			accounts = append(accounts, ref)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].backend != accounts[j].backend {
+			return accounts[i].backend < accounts[j].backend
+		}
+		if accounts[i].issuer != accounts[j].issuer {
+			return accounts[i].issuer < accounts[j].issuer
+		}
+		return accounts[i].account < accounts[j].account
+	})
+	return accounts
+}
+
+// deactivateAccounts deactivates the ACME accounts of all issuers used in the
+// configuration, or only those for issuer and of the named account. An
+// issuer no certificate uses anymore is looked up with the default backend.
+func deactivateAccounts(fullConfig FullConfig, issuer, account string) error {
+	configureIssuers(fullConfig.Configs)
+
+	accounts := configuredAccounts(fullConfig)
+	if issuer != "" || account != "" {
+		var selected []accountRef
+		for _, ref := range accounts {
+			if (issuer == "" || ref.issuer == issuer) && (account == "" || ref.account == account) {
+				selected = append(selected, ref)
+			}
+		}
+		if len(selected) == 0 && issuer != "" {
+			selected = []accountRef{{backend: backendFor(CertConfig{}), issuer: issuer, account: account}}
+		}
+		accounts = selected
+	}
+	if len(accounts) == 0 {
+		return fmt.Errorf("no certificate uses an ACME issuer")
+	}
+
+	failed := 0
+	for _, ref := range accounts {
+		backend, err := issuerFor(CertConfig{Backend: ref.backend})
+		if err == nil {
+			log.Printf("Deactivating the %s account for %s...", ref.backend, ref)
+			err = backend.DeactivateAccount(ref.issuer, ref.account)
+		}
+		if err != nil {
+			log.Printf("ERROR: Failed to deactivate the %s account for %s: %v", ref.backend, ref, err)
+			failed++
+			continue
+		}
+		log.Printf("Deactivated the %s account for %s.", ref.backend, ref)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d accounts could not be deactivated", failed, len(accounts))
+	}
+	return nil
+}
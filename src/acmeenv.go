@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// acmeShBaseEnv lists the variables of the daemon's environment every acme.sh
+// run gets: what a shell script needs to run, proxies and the acme.sh
+// directories. Credentials aren't among them.
+var acmeShBaseEnv = []string{
+	"PATH", "HOME", "USER", "SHELL", "TMPDIR", "TZ", "LANG", "LC_ALL",
+	"http_proxy", "https_proxy", "no_proxy", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+	"SSL_CERT_FILE", "SSL_CERT_DIR", "CA_BUNDLE",
+	"LE_WORKING_DIR", "LE_CONFIG_HOME",
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var (
+	// unknownProviderWarned holds the DNS providers already reported as
+	// getting no credentials
+	unknownProviderWarned = map[string]bool{}
+	// unknownProviderMutex guards unknownProviderWarned
+	unknownProviderMutex = &sync.Mutex{}
+)
+
+// validateCertEnv checks the names of 'env' and 'pass_env' and the secret
+// references among the values of 'env'.
+func validateCertEnv(config CertConfig) error {
+	for name, value := range config.Env {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid variable name '%s' in 'env'", name)
+		}
+		if isSecretRef(value) {
+			if err := validateSecretRef(value); err != nil {
+				return fmt.Errorf("'env.%s': %w", name, err)
+			}
+		}
+	}
+	for _, name := range config.PassEnv {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid variable name '%s' in 'pass_env'", name)
+		}
+	}
+	return nil
+}
+
+// resolveCertEnv returns the variables of a certificate's 'env_file' and
+// 'env', with the secret references of 'env' resolved.
+func resolveCertEnv(config CertConfig) (map[string]string, error) {
+	env := make(map[string]string, len(config.Env))
+	if config.EnvFile != "" {
+		fileEnv, err := readEnvFile(config.EnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("'env_file': %w", err)
+		}
+		env = fileEnv
+	}
+	for key, value := range config.Env {
+		if isSecretRef(value) {
+			resolved, err := resolveSecret(context.Background(), value)
+			if err != nil {
+				return nil, fmt.Errorf("'env.%s': %w", key, err)
+			}
+			value = resolved
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// readEnvFile reads a file of KEY=VALUE lines, as written for Docker's
+// --env-file or a Kubernetes Secret mounted as a file. Blank lines and lines
+// starting with '#' are skipped, an 'export ' prefix and quotes around the
+// value are removed.
+func readEnvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || !envNamePattern.MatchString(key) {
+			return nil, fmt.Errorf("%s, line %d: expected KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[key] = value
+	}
+	return env, scanner.Err()
+}
+
+// lookupCredentialEnv returns a credential variable of the daemon's
+// environment, or else the content of the file named by <key>_FILE, the
+// convention for Docker and Kubernetes secrets. The file is read each time,
+// so a rotated secret is used from the next issuance on.
+func lookupCredentialEnv(key string) (string, bool, error) {
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true, nil
+	}
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return "", false, nil
+	}
+	value, err := readFileSecret(context.Background(), path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", key, err)
+	}
+	return value, true, nil
+}
+
+// credentialGetenv is os.Getenv for credential variables, falling back to
+// <key>_FILE like lookupCredentialEnv. A file that can't be read is logged
+// and yields an empty value, which the DNS provider then reports as missing.
+func credentialGetenv(key string) string {
+	value, _, err := lookupCredentialEnv(key)
+	if err != nil {
+		slog.Warn("Failed to read a credential file", "error", err)
+	}
+	return value
+}
+
+// isSecretRef reports whether a value has the form of a secret reference
+// such as 'vault:kv/dns#token', rather than being a literal value.
+func isSecretRef(value string) bool {
+	backend, _, ok := strings.Cut(value, ":")
+	_, known := secretBackends[backend]
+	return ok && known
+}
+
+// acmeShEnv builds the environment of an acme.sh run for a certificate
+// instead of passing on the daemon's: the base variables and those named in
+// 'pass_env' as far as the daemon has them, the credentials of its DNS
+// provider scoped to the certificate's zone or else the daemon's credential
+// variables, and the certificate's own 'env_file' and 'env'. Credential
+// variables may also be read from the files <key>_FILE names, and secret
+// references are resolved now, so one entry's DNS token is never handed to
+// another entry's provider script.
+func acmeShEnv(name string, config CertConfig) ([]string, error) {
+	scoped, err := certZoneCredentials(config, zoneCredentialsFor(config.Type))
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]string{}
+	for _, key := range acmeShBaseEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			env[key] = value
+		}
+	}
+	pass := append([]string{}, config.PassEnv...)
+	sets, known := dnsCredentialVars[config.Type]
+	if scoped == nil {
+		for _, set := range sets {
+			pass = append(pass, set...)
+		}
+	}
+	for _, key := range pass {
+		value, ok, err := lookupCredentialEnv(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			env[key] = value
+		}
+	}
+	if scoped != nil {
+		zoneEnv, err := resolveZoneEnv(context.Background(), *scoped)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range zoneEnv {
+			env[key] = value
+		}
+	}
+
+	certEnv, err := resolveCertEnv(config)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range certEnv {
+		env[key] = value
+	}
+
+	if !known && scoped == nil && len(config.Env) == 0 && config.EnvFile == "" && len(config.PassEnv) == 0 && config.Type != challengeHTTP {
+		unknownProviderMutex.Lock()
+		if !unknownProviderWarned[config.Type] {
+			unknownProviderWarned[config.Type] = true
+			certLogger(name, config).Warn(fmt.Sprintf("acme.sh gets no credentials for DNS provider '%s': set them in 'env' or 'env_file', or name them in 'pass_env'", config.Type))
+		}
+		unknownProviderMutex.Unlock()
+	}
+
+	list := make([]string, 0, len(env))
+	for key, value := range env {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return list, nil
+}
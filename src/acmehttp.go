@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Retries of a failed ACME request before giving up
+	acmeMaxRetries = 5
+	// Initial delay between retries, doubled after every attempt
+	acmeRetryBaseDelay = 1 * time.Second
+	// Upper bound for the delay between retries
+	acmeRetryMaxDelay = 30 * time.Second
+)
+
+// acmeTransport is the connection pool shared by all ACME clients of the
+// native backend, with timeouts for every stage of a request.
+var acmeTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   10,
+}
+
+// newACMEHTTPClient returns the HTTP client for an ACME directory: requests
+// share acmeTransport, count towards the directory's rate limit and are
+// retried on network errors and 5xx responses when that is safe.
+func newACMEHTTPClient(dirURL string) *http.Client {
+	return &http.Client{
+		Transport: retryTransport{base: throttledTransport{dirURL: dirURL, base: acmeTransport}},
+	}
+}
+
+// providerHTTPClient is used for the DNS provider APIs of the native backend.
+var providerHTTPClient = &http.Client{
+	Transport: retryTransport{base: acmeTransport},
+	Timeout:   2 * time.Minute,
+}
+
+// retryBackoff returns the jittered exponential delay before retry n (1-based).
+func retryBackoff(n int) time.Duration {
+	d := acmeRetryBaseDelay << (n - 1)
+	if d <= 0 || d > acmeRetryMaxDelay {
+		d = acmeRetryMaxDelay
+	}
+	return devScaled(d/2 + rand.N(d/2+1))
+}
+
+// acmeRetryBackoff implements acme.Client.RetryBackoff. The ACME client
+// retries POST requests itself, signing them with a fresh nonce, on 5xx,
+// 429 and badNonce responses; this bounds the retries and honors Retry-After.
+func acmeRetryBackoff(n int, r *http.Request, resp *http.Response) time.Duration {
+	if n > acmeMaxRetries {
+		return -1
+	}
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			return devScaled(min(time.Duration(secs)*time.Second, acmeRetryMaxDelay))
+		}
+	}
+	return retryBackoff(n)
+}
+
+// retryTransport retries GET and HEAD requests, which carry no single-use
+// nonce, on network errors and 5xx responses. The ACME client only retries
+// these on HTTP errors, so this also covers dropped connections, e.g. while
+// fetching a fresh nonce.
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+
+	for n := 1; ; n++ {
+		resp, err := t.base.RoundTrip(req)
+		if n > acmeMaxRetries || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(retryBackoff(n)):
+		}
+	}
+}
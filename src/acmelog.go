@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// File in the certificate directory collecting the output of acme.sh
+	acmeShLogName = "acme.sh.log"
+	// acme.sh.log is moved to acme.sh.log.1 once it grows beyond this size
+	acmeShLogLimit = 1 << 20
+	// Lines of acme.sh output quoted in the error of a failed run
+	acmeShErrorLines = 5
+	// Stored issuance runs per certificate
+	issueRunsKept = 20
+)
+
+var (
+	// acmeOutputsMutex guards acmeOutputs
+	acmeOutputsMutex = &sync.Mutex{}
+	// acmeOutputs holds the acme.sh output of issuances in progress, keyed
+	// by certificate name, until renewCertificate stores it
+	acmeOutputs = map[string]string{}
+)
+
+// runAcmeSh runs acme.sh for a certificate with the environment env, see
+// acmeShEnv. Its combined output goes to acme.sh.log in the certificate
+// directory instead of the daemon's output, where concurrent runs would
+// interleave; only a summary line is logged. The error of a failed run quotes
+// the last lines of the output. A run taking longer than timeout is killed
+// with the processes it started, such as a hung DNS API call, and fails with
+// errIssueTimeout.
+func runAcmeSh(name, dir string, args, env []string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var output limitedBuffer
+	cmd := exec.CommandContext(ctx, acmeShPath, args...)
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = acmeShKillGrace
+	live := io.MultiWriter(&output, liveWriter{name: name})
+	cmd.Stdout = live
+	cmd.Stderr = live
+
+	started := time.Now()
+	done := trackAcmeSh()
+	err := cmd.Run()
+	done()
+	duration := time.Since(started).Round(time.Millisecond)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s, acme.sh was killed", errIssueTimeout, timeout)
+	}
+
+	logPath := filepath.Join(dir, acmeShLogName)
+	if logErr := appendAcmeShLog(logPath, args, started, output.String(), err); logErr != nil {
+		slog.Warn("Could not write acme.sh log", "cert", name, "error", logErr)
+		logPath = ""
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+		if tail := lastLines(output.String(), acmeShErrorLines); tail != "" {
+			err = fmt.Errorf("%w: %s", err, tail)
+		}
+	}
+	slog.Info("acme.sh finished", "cert", name, "command", args[0], "result", result, "duration", duration, "log", logPath)
+	return output.String(), err
+}
+
+// appendAcmeShLog appends the output of one acme.sh run to the log file of
+// a certificate, rotating it when it gets too big.
+func appendAcmeShLog(path string, args []string, started time.Time, output string, runErr error) error {
+	if info, err := os.Stat(path); err == nil && info.Size() > acmeShLogLimit {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	result := "ok"
+	if runErr != nil {
+		result = runErr.Error()
+	}
+	_, err = fmt.Fprintf(file, "=== %s acme.sh %s (%s)\n%s\n\n", started.Format(time.RFC3339), strings.Join(args, " "), result, output)
+	return errors.Join(err, file.Close())
+}
+
+// lastLines returns the last n non-empty lines of s, joined by " | ".
+func lastLines(s string, n int) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " | ")
+}
+
+// addAcmeOutput keeps the output of an acme.sh issuance run for
+// takeAcmeOutput; runs for several key types are concatenated.
+func addAcmeOutput(name, output string) {
+	acmeOutputsMutex.Lock()
+	defer acmeOutputsMutex.Unlock()
+	if previous := acmeOutputs[name]; previous != "" {
+		output = previous + "\n" + output
+	}
+	acmeOutputs[name] = output
+}
+
+// takeAcmeOutput returns and forgets the acme.sh output of the last issuance
+// of a certificate.
+func takeAcmeOutput(name string) string {
+	acmeOutputsMutex.Lock()
+	defer acmeOutputsMutex.Unlock()
+	output := acmeOutputs[name]
+	delete(acmeOutputs, name)
+	return output
+}
+
+// issueRun is the stored result of an issuance attempt.
+type issueRun struct {
+	ID         int64     `json:"id"`
+	Backend    string    `json:"backend"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output,omitempty"`
+}
+
+// recordIssueRun stores the result and captured output of an issuance
+// attempt and drops the oldest runs of the certificate beyond issueRunsKept.
+func recordIssueRun(db *sql.DB, name, backend string, started time.Time, duration time.Duration, output string, runErr error) error {
+	var errText sql.NullString
+	if runErr != nil {
+		errText = sql.NullString{String: runErr.Error(), Valid: true}
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT INTO issue_runs (name, backend, started_at, duration_ms, success, error, output)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		name, backend, started, duration.Milliseconds(), runErr == nil, errText, output)
+	if err != nil {
+		return fmt.Errorf("failed to record issuance of '%s': %w", name, err)
+	}
+	_, err = db.Exec(`
+		DELETE FROM issue_runs WHERE name = ? AND id NOT IN (
+			SELECT id FROM issue_runs WHERE name = ? ORDER BY id DESC LIMIT ?)`, name, name, issueRunsKept)
+	return err
+}
+
+// listIssueRuns returns the stored issuance runs of a certificate, newest first.
+func listIssueRuns(db *sql.DB, name string) ([]issueRun, error) {
+	rows, err := db.Query(`
+		SELECT id, backend, started_at, duration_ms, success, error, output
+		FROM issue_runs WHERE name = ? ORDER BY id DESC`, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query issuance runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []issueRun{}
+	for rows.Next() {
+		var run issueRun
+		var errText sql.NullString
+		if err := rows.Scan(&run.ID, &run.Backend, &run.StartedAt, &run.DurationMs, &run.Success, &errText, &run.Output); err != nil {
+			return nil, err
+		}
+		run.Error = errText.String
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default look-ahead window for POST /maintenance/prepare
+const defaultPrepareDays = 30
+
+// apiServer serves the optional HTTP API of the daemon.
+type apiServer struct {
+	yamlFile  string
+	db        *sql.DB
+	certsPath string
+	token     string
+	// reload asks the daemon loop to run a check cycle immediately
+	reload chan<- struct{}
+}
+
+// certView is the JSON representation of a certificate's state.
+type certView struct {
+	Name                string    `json:"name"`
+	Status              string    `json:"status"`
+	Domains             []string  `json:"domains"`
+	Issuer              string    `json:"issuer"`
+	Type                string    `json:"type"`
+	LastIssued          time.Time `json:"last_issued,omitzero"`
+	Expires             time.Time `json:"expires,omitzero"`
+	RemainingDays       *int      `json:"remaining_days,omitempty"`
+	RemainingSeconds    *int64    `json:"remaining_seconds,omitempty"`
+	LifetimeUsedPercent *float64  `json:"lifetime_used_percent,omitempty"`
+	SharedWith          string    `json:"shared_with,omitempty"`
+	KeyType             string    `json:"key_type,omitempty"`
+	// Warnings are non-fatal issues found by the daemon, see checkWarnings
+	Warnings []certWarning `json:"warnings,omitempty"`
+}
+
+// newCertView computes the JSON representation of a database record.
+func newCertView(record CertDBRecord) certView {
+	return newCertViewAt(record, time.Now())
+}
+
+// newCertViewAt computes the JSON representation of a record with the
+// remaining days counted from the given time.
+func newCertViewAt(record CertDBRecord, now time.Time) certView {
+	view := certView{
+		Name:       record.Name,
+		Status:     record.Status,
+		Domains:    []string{},
+		Issuer:     record.Issuer,
+		Type:       record.Type,
+		LastIssued: record.LastIssued,
+		SharedWith: record.SharedWith,
+		KeyType:    record.KeyType,
+	}
+	if record.Domains != "" {
+		view.Domains = strings.Split(record.Domains, ",")
+	}
+	if !record.LastIssued.IsZero() {
+		view.Expires = certExpiry(record)
+		remaining := view.Expires.Sub(now)
+		remainingDays := int(remaining.Hours() / 24)
+		remainingSeconds := int64(remaining.Seconds())
+		view.RemainingDays = &remainingDays
+		view.RemainingSeconds = &remainingSeconds
+		// Rows from before the validity start was recorded use the issue time.
+		start := record.NotBefore
+		if start.IsZero() {
+			start = record.LastIssued
+		}
+		if lifetime := view.Expires.Sub(start); lifetime > 0 {
+			used := math.Round(float64(now.Sub(start))/float64(lifetime)*1000) / 10
+			used = min(max(used, 0), 100)
+			view.LifetimeUsedPercent = &used
+		}
+	}
+	return view
+}
+
+// prepareResult reports the outcome of the maintenance preparation for one certificate.
+type prepareResult struct {
+	Name     string    `json:"name"`
+	Action   string    `json:"action"`
+	Expires  time.Time `json:"expires,omitzero"`
+	Verified bool      `json:"verified"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// prepareResponse is the body returned by POST /maintenance/prepare.
+type prepareResponse struct {
+	Days         int             `json:"days"`
+	Ready        bool            `json:"ready"`
+	Certificates []prepareResult `json:"certificates"`
+}
+
+// startAPIServer starts the HTTP API in the background.
+func startAPIServer(addr string, yamlFile string, db *sql.DB, certsPath string, reload chan<- struct{}) {
+	s := &apiServer{
+		yamlFile:  yamlFile,
+		db:        db,
+		certsPath: certsPath,
+		token:     os.Getenv("GOCERT_API_TOKEN"),
+		reload:    reload,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /certs", s.handleListCerts)
+	mux.HandleFunc("GET /certs/{name}", s.handleGetCert)
+	mux.HandleFunc("POST /certs/{name}/renew", s.handleRenewCert)
+	mux.HandleFunc("GET /certs/{name}/hooks", s.handleHookRuns)
+	mux.HandleFunc("GET /certs/{name}/issuances", s.handleIssueRuns)
+	mux.HandleFunc("POST /certs:batch", s.handleBatch)
+	mux.HandleFunc("GET /certs:export", s.handleExport)
+	mux.HandleFunc("POST /reload", s.handleReload)
+	mux.HandleFunc("POST /maintenance/prepare", s.handlePrepare)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /pool", s.handlePool)
+	s.registerDefinitionRoutes(mux)
+
+	listener, err := apiListener(addr)
+	if err != nil {
+		log.Printf("ERROR: API server stopped: %v", err)
+		return
+	}
+	serveAPI(listener, s.authenticate(mux))
+}
+
+// serveAPI serves the API on a listener until it is shut down for an upgrade.
+func serveAPI(listener net.Listener, handler http.Handler) {
+	srv := &http.Server{Handler: handler}
+	apiServerMutex.Lock()
+	activeAPIServer, activeAPIListener, activeAPIHandler = srv, listener, handler
+	apiServerMutex.Unlock()
+
+	go func() {
+		log.Printf("API server listening on %s", listener.Addr())
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("ERROR: API server stopped: %v", err)
+		}
+	}()
+}
+
+// writeJSON encodes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Warning: failed to write API response: %v", err)
+	}
+}
+
+// writeError writes a JSON error body with the given status code.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// authenticate rejects requests without the configured bearer token.
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	if s.token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + s.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Upper bound for the 'limit' parameter of GET /certs
+const maxListLimit = 1000
+
+// certListQuery holds the parsed filter, pagination and field selection of GET /certs.
+type certListQuery struct {
+	status        string
+	issuer        string
+	typ           string
+	domain        string
+	expiresBefore time.Time
+	cursor        string
+	limit         int
+	fields        []string
+	ndjson        bool
+}
+
+// parseCertListQuery reads the query parameters of GET /certs.
+func parseCertListQuery(r *http.Request) (certListQuery, error) {
+	q := r.URL.Query()
+	query := certListQuery{
+		status: q.Get("status"),
+		issuer: q.Get("issuer"),
+		typ:    q.Get("type"),
+		domain: q.Get("domain"),
+		cursor: q.Get("cursor"),
+		ndjson: q.Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson"),
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return query, fmt.Errorf("invalid 'limit' value '%s', must be between 1 and %d", v, maxListLimit)
+		}
+		query.limit = n
+	}
+	if v := q.Get("expires_before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", v)
+		}
+		if err != nil {
+			return query, fmt.Errorf("invalid 'expires_before' value '%s', expected RFC3339 or YYYY-MM-DD", v)
+		}
+		query.expiresBefore = t
+	}
+	if v := q.Get("fields"); v != "" {
+		query.fields = strings.Split(v, ",")
+	}
+	return query, nil
+}
+
+// matches reports whether a certificate passes the cursor and the filters
+// other than 'expires_before'.
+func (q certListQuery) matches(record CertDBRecord) bool {
+	if record.Name <= q.cursor {
+		return false
+	}
+	if (q.status != "" && record.Status != q.status) ||
+		(q.issuer != "" && record.Issuer != q.issuer) ||
+		(q.typ != "" && record.Type != q.typ) {
+		return false
+	}
+	if q.domain == "" {
+		return true
+	}
+	for _, domain := range strings.Split(record.Domains, ",") {
+		if strings.EqualFold(domain, q.domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectFields reduces a certificate view to the requested JSON fields.
+func selectFields(view certView, fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return view, nil
+	}
+
+	data, err := json.Marshal(view)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	selected := map[string]interface{}{}
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			selected[f] = v
+		}
+	}
+	return selected, nil
+}
+
+// handleListCerts returns the state of all certificates matching the filters.
+// Results are ordered by name; with 'limit' set, the 'X-Next-Cursor' header and
+// a 'Link: rel="next"' header point at the following page. 'format=ndjson' (or
+// 'Accept: application/x-ndjson') streams one JSON object per line.
+func (s *apiServer) handleListCerts(w http.ResponseWriter, r *http.Request) {
+	query, err := parseCertListQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	records, err := stateCache.list(s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	warnings, err := allWarnings(s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Without a limit, NDJSON is streamed as it is encoded so large
+	// inventories never have to be held in memory twice.
+	streaming := query.ndjson && query.limit == 0
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	if streaming {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	var items []interface{}
+	var lastName string
+	count := 0
+	hasMore := false
+	for _, record := range records {
+		if !query.matches(record) {
+			continue
+		}
+		view := newCertView(record)
+		view.Warnings = warnings[record.Name]
+		if !query.expiresBefore.IsZero() && (view.Expires.IsZero() || !view.Expires.Before(query.expiresBefore)) {
+			continue
+		}
+		if query.limit > 0 && count == query.limit {
+			hasMore = true
+			break
+		}
+
+		item, err := selectFields(view, query.fields)
+		if err != nil {
+			log.Printf("Warning: could not encode certificate '%s': %v", record.Name, err)
+			continue
+		}
+		count++
+		lastName = record.Name
+
+		if streaming {
+			if err := enc.Encode(item); err != nil {
+				log.Printf("Warning: failed to write API response: %v", err)
+				return
+			}
+			if flusher != nil && count%100 == 0 {
+				flusher.Flush()
+			}
+			continue
+		}
+		items = append(items, item)
+	}
+	if streaming {
+		return
+	}
+
+	if hasMore {
+		next := r.URL.Query()
+		next.Set("cursor", lastName)
+		w.Header().Set("X-Next-Cursor", lastName)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, next.Encode()))
+	}
+
+	if !query.ndjson {
+		if items == nil {
+			items = []interface{}{}
+		}
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			log.Printf("Warning: failed to write API response: %v", err)
+			return
+		}
+	}
+}
+
+// handleGetCert returns the state of a single certificate.
+func (s *apiServer) handleGetCert(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	record, found, err := stateCache.get(s.db, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("certificate '%s' not found", name))
+		return
+	}
+	view := newCertView(record)
+	if view.Warnings, err = listWarnings(s.db, name); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// handleHookRuns returns the results of the recent deploy hook runs of a
+// certificate, newest first.
+func (s *apiServer) handleHookRuns(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, found, err := getCertState(s.db, name); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("certificate '%s' not found", name))
+		return
+	}
+	runs, err := listHookRuns(s.db, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// handleIssueRuns returns the recent issuance attempts of a certificate with
+// their captured acme.sh output, newest first.
+func (s *apiServer) handleIssueRuns(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, found, err := getCertState(s.db, name); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("certificate '%s' not found", name))
+		return
+	}
+	runs, err := listIssueRuns(s.db, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// handleRenewCert renews a configured certificate immediately, regardless of
+// its remaining validity, and returns its new state.
+func (s *apiServer) handleRenewCert(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	fullConfig, err := loadEffectiveConfig(s.yamlFile, s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	config, ok := fullConfig.Certificates[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("certificate '%s' is not configured", name))
+		return
+	}
+	if config.Monitor != "" {
+		writeError(w, http.StatusConflict, fmt.Errorf("certificate '%s' is monitor-only and can't be renewed by gocert", name))
+		return
+	}
+
+	// An entry sharing another entry's certificate is renewed through its primary.
+	primaryOf := sharedCertGroups(fullConfig)
+	if !certSelected(name, primaryOf) {
+		writeError(w, http.StatusConflict, fmt.Errorf("certificate '%s' is left out of this instance by --only, --skip or --exclude", name))
+		return
+	}
+	if standbyActive() {
+		writeError(w, http.StatusConflict, fmt.Errorf("this instance is in standby, renew '%s' on the active one or run 'gocert promote'", name))
+		return
+	}
+
+	unlock := lockCycle(s.certsPath, fmt.Sprintf("renewal of '%s'", name))
+	defer unlock()
+
+	primary, isFollower := primaryOf[name]
+	if !isFollower {
+		primary = name
+	}
+
+	state, _, err := getCertState(s.db, primary)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("Renewal of '%s' requested via API", name)
+	renewErr := renewCertificate(primary, fullConfig.Certificates[primary], state, s.db, s.certsPath, true)
+	if renewErr == nil {
+		shareWithFollowers(primary, fullConfig, primaryOf, s.db, s.certsPath)
+	}
+
+	record, _, err := getCertState(s.db, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if renewErr != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{"error": renewErr.Error(), "certificate": newCertView(record)})
+		return
+	}
+	writeJSON(w, http.StatusOK, newCertView(record))
+}
+
+// batchRequest is the body of POST /certs:batch.
+type batchRequest struct {
+	Certificates map[string]json.RawMessage `json:"certificates"`
+}
+
+// handleBatch creates or updates many API-managed certificate definitions at
+// once. All definitions are validated before anything is stored. With
+// 'replace=true', API-managed definitions missing from the request are deleted,
+// which allows declarative management from Terraform or scripts.
+func (s *apiServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+	raw, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var req batchRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	replace := r.URL.Query().Get("replace") == "true"
+
+	fileConfig, err := loadConfig(s.yamlFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	defs := map[string]CertConfig{}
+	errs := map[string]string{}
+	for name, raw := range req.Certificates {
+		if _, exists := fileConfig.Certificates[name]; exists {
+			errs[name] = "already defined in the config file"
+			continue
+		}
+		if err := validateDefinition(name, raw); err != nil {
+			errs[name] = err.Error()
+			continue
+		}
+		var def CertConfig
+		dec := json.NewDecoder(strings.NewReader(string(raw)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&def); err != nil {
+			errs[name] = err.Error()
+			continue
+		}
+		if err := validateAPIDefinition(def); err != nil {
+			errs[name] = err.Error()
+			continue
+		}
+		if _, err := validateCertConfig(name, def, fileConfig.Configs); err != nil {
+			errs[name] = err.Error()
+			continue
+		}
+		defs[name] = def
+	}
+	if len(errs) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"error": "invalid certificate definitions", "certificates": errs})
+		return
+	}
+
+	created, updated, deleted, err := saveDefinitions(s.db, defs, replace)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Batch update via API: %d created, %d updated, %d deleted", len(created), len(updated), len(deleted))
+
+	writeJSON(w, http.StatusOK, map[string][]string{
+		"created": nonNil(created),
+		"updated": nonNil(updated),
+		"deleted": nonNil(deleted),
+	})
+}
+
+// Maximum accepted size of a request body
+const maxRequestBody = 1 << 20
+
+// readBody reads a request body of at most maxRequestBody bytes.
+func readBody(r *http.Request) (json.RawMessage, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if len(data) > maxRequestBody {
+		return nil, fmt.Errorf("request body exceeds %d bytes", maxRequestBody)
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("request body is not valid JSON")
+	}
+	return data, nil
+}
+
+// nonNil returns an empty slice instead of nil so it encodes as a JSON array.
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// exportedDefinition is a certificate definition in the GET /certs:export output.
+type exportedDefinition struct {
+	Name       string     `json:"name"`
+	Source     string     `json:"source"`
+	Definition CertConfig `json:"definition"`
+}
+
+// handleExport returns every certificate definition (from the config file and
+// the API) together with the full state stored in the database.
+func (s *apiServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	fileConfig, err := loadConfig(s.yamlFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	stored, err := listDefinitions(s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	records, err := listCertStates(s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	definitions := []exportedDefinition{}
+	for name, config := range fileConfig.Certificates {
+		definitions = append(definitions, exportedDefinition{Name: name, Source: "config", Definition: redactDefinition(config)})
+	}
+	for _, def := range stored {
+		if _, exists := fileConfig.Certificates[def.Name]; exists {
+			continue
+		}
+		definitions = append(definitions, exportedDefinition{Name: def.Name, Source: "api", Definition: def.Definition})
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+
+	state := []certView{}
+	for _, record := range records {
+		state = append(state, newCertView(record))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"exported_at": time.Now(),
+		"definitions": definitions,
+		"state":       state,
+	})
+}
+
+// handleReload validates the configuration and triggers an immediate check cycle.
+func (s *apiServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := requestReload(s.yamlFile, s.reload); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "reload scheduled"})
+}
+
+// handlePrepare renews every certificate expiring within the requested number of
+// days and only responds once all of them are verified on disk. Orchestrators call
+// it before host reboots or cluster upgrades.
+func (s *apiServer) handlePrepare(w http.ResponseWriter, r *http.Request) {
+	days := defaultPrepareDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'days' value '%s'", v))
+			return
+		}
+		days = n
+	}
+
+	fullConfig, err := loadEffectiveConfig(s.yamlFile, s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Don't race with a running check cycle on the same certificates.
+	unlock := lockCycle(s.certsPath, "maintenance preparation")
+	defer unlock()
+
+	log.Printf("Maintenance prepare requested: renewing certificates expiring within %d days", days)
+	deadline := time.Now().AddDate(0, 0, days)
+
+	primaryOf := sharedCertGroups(fullConfig)
+
+	workers := newWorkerPool(fullConfig.Configs)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	resp := prepareResponse{Days: days, Ready: true}
+	for name, config := range fullConfig.Certificates {
+		if _, ok := primaryOf[name]; ok {
+			continue // Prepared together with its primary
+		}
+		if !certSelected(name, primaryOf) {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, config CertConfig) {
+			defer wg.Done()
+			defer workers.acquire()()
+			results := []prepareResult{s.prepareCert(name, config, deadline)}
+			if results[0].Verified {
+				shareWithFollowers(name, fullConfig, primaryOf, s.db, s.certsPath)
+			}
+			for _, follower := range followersOf(primaryOf, name) {
+				result := results[0]
+				result.Name, result.Action = follower, "shared"
+				// Followers run their own deploy hooks and have their own endpoints.
+				if result.Verified {
+					result.Verified, result.Error = s.verifyFollower(follower, fullConfig.Certificates[follower])
+				}
+				results = append(results, result)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, result := range results {
+				if !result.Verified {
+					resp.Ready = false
+				}
+				resp.Certificates = append(resp.Certificates, result)
+			}
+		}(name, config)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// verifyFollower checks the deployment of an entry sharing the certificate
+// of a verified primary.
+func (s *apiServer) verifyFollower(name string, config CertConfig) (bool, string) {
+	cert, err := readCertificateFile(certFilesFor(s.certsPath, name).Cert)
+	if err == nil {
+		err = verifyDeployment(s.db, name, config, cert)
+	}
+	if err != nil {
+		return false, fmt.Sprintf("verification failed: %v", err)
+	}
+	return true, ""
+}
+
+// prepareCert renews a single certificate if it expires before the deadline and
+// verifies that the certificate on disk is valid past the deadline and
+// deployed: its deploy hooks succeeded and its endpoints serve it.
+func (s *apiServer) prepareCert(name string, config CertConfig, deadline time.Time) prepareResult {
+	result := prepareResult{Name: name, Action: "skipped"}
+
+	if config.Monitor != "" {
+		result.Action = "monitored"
+		chain, err := fetchMonitoredChain(config.Monitor)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		cert := chain[0]
+		result.Expires = cert.NotAfter
+		if cert.NotAfter.Before(deadline) {
+			result.Error = "monitored certificate expires before the requested window"
+			return result
+		}
+		result.Verified = true
+		return result
+	}
+
+	state, found, err := getCertState(s.db, name)
+	if err != nil {
+		result.Action = "failed"
+		result.Error = err.Error()
+		return result
+	}
+
+	if !found || currentExpiry(state, s.certsPath).Before(deadline) {
+		if standbyActive() {
+			result.Error = "standby mode, the renewal is left to the active instance"
+			return result
+		}
+		result.Action = "renewed"
+		if err := renewCertificate(name, config, state, s.db, s.certsPath, false); err != nil {
+			result.Action = "failed"
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	cert, err := readCertificateFile(certFilesFor(s.certsPath, name).Cert)
+	if err != nil {
+		result.Error = fmt.Sprintf("verification failed: %v", err)
+		return result
+	}
+	result.Expires = cert.NotAfter
+	if cert.NotAfter.Before(deadline) {
+		result.Error = "verification failed: certificate on disk expires before the requested window"
+		return result
+	}
+	if err := verifyDeployment(s.db, name, config, cert); err != nil {
+		result.Error = fmt.Sprintf("verification failed: %v", err)
+		return result
+	}
+	result.Verified = true
+	return result
+}
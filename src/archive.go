@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+)
+
+const (
+	// Directory under the certs path holding the previous issuances of each certificate
+	archiveDirName = ".archive"
+	// Archives are named after the issue time of their certificate, so they sort by age
+	archiveTimeLayout = "20060102T150405Z"
+)
+
+// ArchiveConfig controls how previous issuances are kept when a certificate
+// is renewed.
+type ArchiveConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Previous issuances kept per certificate, 0 keeps all of them
+	Keep int `yaml:"keep"`
+	// How long previous issuances are kept, e.g. '8760h'; empty keeps them
+	// until 'keep' is exceeded
+	MaxAge string `yaml:"max_age"`
+	// Age recipients ('age1...') the archives are encrypted to
+	Recipients []string `yaml:"recipients"`
+}
+
+var (
+	// archiveMutex guards archiveSettings
+	archiveMutex = &sync.Mutex{}
+	// archiveSettings is the archive configuration of the current cycle
+	archiveSettings ArchiveConfig
+)
+
+// archivedFile is a file of an issuance, read before it is replaced.
+type archivedFile struct {
+	name string
+	data []byte
+}
+
+// configureArchive applies the archive settings of the global configuration.
+func configureArchive(global GlobalConfig) {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	archiveSettings = global.Archive
+}
+
+// currentArchiveConfig returns the archive settings of the current cycle.
+func currentArchiveConfig() ArchiveConfig {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	return archiveSettings
+}
+
+// validateArchive checks the retention period and the age recipients.
+func validateArchive(config ArchiveConfig) error {
+	if config.MaxAge != "" {
+		if _, err := time.ParseDuration(config.MaxAge); err != nil {
+			return fmt.Errorf("invalid archive max_age '%s': %w", config.MaxAge, err)
+		}
+	}
+	if _, err := archiveRecipients(config); err != nil {
+		return err
+	}
+	return nil
+}
+
+// archiveRecipients parses the age recipients of the archive configuration.
+func archiveRecipients(config ArchiveConfig) ([]age.Recipient, error) {
+	if len(config.Recipients) == 0 {
+		return nil, nil
+	}
+	recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(config.Recipients, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive recipients: %w", err)
+	}
+	return recipients, nil
+}
+
+// archiveDir returns where the previous issuances of a certificate are kept.
+func archiveDir(certsBasePath, name string) string {
+	return filepath.Join(certsBasePath, archiveDirName, name)
+}
+
+// readIssuance reads the current files of a certificate before it is renewed,
+// or returns nil if archiving is disabled or there is nothing to archive.
+func readIssuance(files certFiles) (*x509.Certificate, []archivedFile) {
+	if !currentArchiveConfig().Enabled {
+		return nil, nil
+	}
+	cert, err := readCertificateFile(files.Cert)
+	if err != nil {
+		return nil, nil
+	}
+	var contents []archivedFile
+	for _, path := range []string{files.Cert, files.Key, files.Fullchain} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		contents = append(contents, archivedFile{name: filepath.Base(path), data: data})
+	}
+	return cert, contents
+}
+
+// archiveIssuance stores a previous issuance of a certificate as a
+// compressed, and optionally encrypted, tarball and applies the retention.
+// Failures are logged, as they must not fail the renewal.
+func archiveIssuance(name string, cert *x509.Certificate, contents []archivedFile, certsBasePath string) {
+	if cert == nil {
+		return
+	}
+	config := currentArchiveConfig()
+	dir := archiveDir(certsBasePath, name)
+	path, err := writeArchive(dir, cert, contents, config)
+	if err != nil {
+		log.Printf("Warning: failed to archive the previous certificate of '%s': %v", name, err)
+		return
+	}
+	log.Printf("Archived the previous certificate of '%s' to %s", name, path)
+
+	var maxAge time.Duration
+	if config.MaxAge != "" {
+		maxAge, _ = time.ParseDuration(config.MaxAge)
+	}
+	if err := pruneArchive(dir, config.Keep, maxAge); err != nil {
+		log.Printf("Warning: failed to prune the archive of '%s': %v", name, err)
+	}
+}
+
+// writeArchive writes the files of an issuance to a tar.gz file in dir,
+// encrypted to the configured recipients if there are any.
+func writeArchive(dir string, cert *x509.Certificate, contents []archivedFile, config ArchiveConfig) (string, error) {
+	recipients, err := archiveRecipients(config)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, cert.NotBefore.UTC().Format(archiveTimeLayout)+".tar.gz")
+	if len(recipients) > 0 {
+		path += ".age"
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var out io.WriteCloser = nopWriteCloser{tmp}
+	if len(recipients) > 0 {
+		if out, err = age.Encrypt(tmp, recipients...); err != nil {
+			return "", err
+		}
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for _, file := range contents {
+		header := &tar.Header{Name: file.name, Mode: 0600, Size: int64(len(file.data)), ModTime: cert.NotBefore}
+		if err := tw.WriteHeader(header); err != nil {
+			return "", err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return "", err
+		}
+	}
+	for _, c := range []io.Closer{tw, gz, out, tmp} {
+		if err := c.Close(); err != nil {
+			return "", err
+		}
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// nopWriteCloser adds a no-op Close to a writer.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// pruneArchive deletes the oldest archives beyond keep, and those archived
+// longer than maxAge ago. Zero values disable either limit.
+func pruneArchive(dir string, keep int, maxAge time.Duration) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tar.gz") || strings.HasSuffix(entry.Name(), ".tar.gz.age") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		expired := false
+		if maxAge > 0 {
+			if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > maxAge {
+				expired = true
+			}
+		}
+		if (keep > 0 && i >= keep) || expired {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Status of a certificate that failed 'max_attempts' times in a row. The
+// daemon leaves it alone until 'gocert retry <name>' is run.
+const statusNeedsIntervention = "needs-intervention"
+
+const (
+	// Wait after the first failed issuance of a certificate, doubled with
+	// every further failure
+	defaultRetryBackoff = time.Hour
+	// Longest wait between two retries
+	defaultRetryBackoffMax = 24 * time.Hour
+)
+
+// RetryBackoffConfig controls how long the daemon waits before retrying a
+// certificate whose issuance failed.
+type RetryBackoffConfig struct {
+	// Wait after the first failure, e.g. '30m'
+	Initial string `yaml:"initial"`
+	// Longest wait, e.g. '12h'
+	Max string `yaml:"max"`
+}
+
+var (
+	// issueBackoffMutex guards issueBackoff and issueBackoffMax
+	issueBackoffMutex = &sync.Mutex{}
+	// issueBackoff is the wait after the first failure
+	issueBackoff = defaultRetryBackoff
+	// issueBackoffMax caps the wait between retries
+	issueBackoffMax = defaultRetryBackoffMax
+)
+
+// issueAttempt is the retry state of a certificate whose issuance failed.
+type issueAttempt struct {
+	Failures  int
+	LastError string
+	NextRetry time.Time
+}
+
+// configureRetryBackoff applies the backoff settings of the global
+// configuration. They were checked by validateRetryBackoff.
+func configureRetryBackoff(global GlobalConfig) {
+	issueBackoffMutex.Lock()
+	defer issueBackoffMutex.Unlock()
+	issueBackoff, issueBackoffMax = defaultRetryBackoff, defaultRetryBackoffMax
+	if d, err := time.ParseDuration(global.RetryBackoff.Initial); err == nil && d > 0 {
+		issueBackoff = d
+	}
+	if d, err := time.ParseDuration(global.RetryBackoff.Max); err == nil && d > 0 {
+		issueBackoffMax = d
+	}
+}
+
+// validateRetryBackoff checks the durations of 'retry_backoff'.
+func validateRetryBackoff(config RetryBackoffConfig) error {
+	initial, max := defaultRetryBackoff, defaultRetryBackoffMax
+	for _, value := range []struct {
+		key string
+		raw string
+		d   *time.Duration
+	}{{"initial", config.Initial, &initial}, {"max", config.Max, &max}} {
+		if value.raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value.raw)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid retry_backoff %s '%s': must be a positive duration", value.key, value.raw)
+		}
+		*value.d = d
+	}
+	if max < initial {
+		return fmt.Errorf("retry_backoff max %s is shorter than initial %s", max, initial)
+	}
+	return nil
+}
+
+// issueRetryDelay returns how long to wait before retrying a certificate after
+// its given number of consecutive failures.
+func issueRetryDelay(failures int) time.Duration {
+	issueBackoffMutex.Lock()
+	defer issueBackoffMutex.Unlock()
+	delay := issueBackoff
+	for i := 1; i < failures && delay < issueBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, issueBackoffMax)
+}
+
+// recordIssueFailure counts a failed issuance of a certificate, schedules
+// its next retry and returns the number of consecutive failures and when the
+// daemon retries it.
+func recordIssueFailure(db *sql.DB, name string, issueErr error) (int, time.Time, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT INTO issue_attempts (name, failures, last_error, updated_at)
+		VALUES (?, 1, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			failures = failures + 1,
+			last_error = excluded.last_error,
+			updated_at = excluded.updated_at`,
+		name, issueErr.Error(), time.Now())
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to record failed issuance of '%s': %w", name, err)
+	}
+	var failures int
+	if err := db.QueryRow(`SELECT failures FROM issue_attempts WHERE name = ?`, name).Scan(&failures); err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to read failed issuances of '%s': %w", name, err)
+	}
+	nextRetry := time.Now().Add(issueRetryDelay(failures))
+	if _, err := db.Exec(`UPDATE issue_attempts SET next_retry_at = ? WHERE name = ?`, nextRetry, name); err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to schedule retry of '%s': %w", name, err)
+	}
+	return failures, nextRetry, nil
+}
+
+// resetIssueFailures forgets the failed issuances of a certificate.
+func resetIssueFailures(db *sql.DB, name string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if _, err := db.Exec(`DELETE FROM issue_attempts WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("failed to reset failed issuances of '%s': %w", name, err)
+	}
+	return nil
+}
+
+// issueFailures returns the number of consecutive failed issuances of a
+// certificate and the last error.
+func issueFailures(db *sql.DB, name string) (int, string, error) {
+	var failures int
+	var lastError sql.NullString
+	err := db.QueryRow(`SELECT failures, last_error FROM issue_attempts WHERE name = ?`, name).Scan(&failures, &lastError)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read failed issuances of '%s': %w", name, err)
+	}
+	return failures, lastError.String, nil
+}
+
+// nextIssueRetry returns when the daemon retries a certificate whose
+// issuance failed, or the zero time if nothing is scheduled.
+func nextIssueRetry(db *sql.DB, name string) (time.Time, error) {
+	var nextRetry sql.NullTime
+	err := db.QueryRow(`SELECT next_retry_at FROM issue_attempts WHERE name = ?`, name).Scan(&nextRetry)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read next retry of '%s': %w", name, err)
+	}
+	return nextRetry.Time, nil
+}
+
+// allIssueAttempts returns the retry state of all certificates with failed
+// issuances, keyed by name.
+func allIssueAttempts(db *sql.DB) (map[string]issueAttempt, error) {
+	rows, err := db.Query(`SELECT name, failures, last_error, next_retry_at FROM issue_attempts`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query failed issuances: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := map[string]issueAttempt{}
+	for rows.Next() {
+		var name string
+		var lastError sql.NullString
+		var nextRetry sql.NullTime
+		var attempt issueAttempt
+		if err := rows.Scan(&name, &attempt.Failures, &lastError, &nextRetry); err != nil {
+			return nil, err
+		}
+		attempt.LastError, attempt.NextRetry = lastError.String, nextRetry.Time
+		attempts[name] = attempt
+	}
+	return attempts, rows.Err()
+}
+
+// retryCertificate takes a certificate out of 'needs-intervention' and
+// issues it right away.
+func retryCertificate(yamlFile, name string, db *sql.DB, certsBasePath string) int {
+	state, found, err := getCertState(db, name)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitIssueFailed
+	}
+	if err := resetIssueFailures(db, name); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitIssueFailed
+	}
+	if isQuarantined(db, name) {
+		if err := releaseQuarantine(db, name); err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitIssueFailed
+		}
+		log.Printf("Certificate '%s' is released from quarantine.", name)
+	}
+	if found && state.Status == statusNeedsIntervention {
+		if err := setCertStatus(db, name, "failed"); err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitIssueFailed
+		}
+		log.Printf("Certificate '%s' is no longer waiting for intervention, retrying.", name)
+	}
+	return issueSingleCert(yamlFile, name, db, certsBasePath, false)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Authorizations expiring sooner than this are fetched from the CA again
+// instead of being trusted from the cache
+const authzExpiryMargin = time.Hour
+
+// cachedAuthz is a valid authorization of an account for one domain.
+type cachedAuthz struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// authzCache tracks the valid authorizations of one ACME account, keyed by
+// domain, in 'authorizations.json' next to the account key. CAs such as
+// Let's Encrypt put a still valid authorization into new orders for the same
+// domain (for up to 30 days), so after adding a name to a certificate only
+// that name needs a DNS challenge; the cache saves fetching the others.
+type authzCache struct {
+	path string
+
+	mu     sync.Mutex
+	loaded bool
+	authzs map[string]cachedAuthz
+}
+
+// authzCacheFor returns the authorization cache of an account for an ACME
+// directory.
+func (n *nativeIssuer) authzCacheFor(dirURL, account string) *authzCache {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c, ok := n.authzCaches[accountKey(dirURL, account)]; ok {
+		return c
+	}
+	c := &authzCache{path: filepath.Join(filepath.Dir(n.accountKeyPath(dirURL, account)), "authorizations.json")}
+	n.authzCaches[accountKey(dirURL, account)] = c
+	return c
+}
+
+// load reads the cache file once; a missing or damaged file starts empty.
+// The caller holds c.mu.
+func (c *authzCache) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	c.authzs = map[string]cachedAuthz{}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: failed to read %s: %v", c.path, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &c.authzs); err != nil {
+		log.Printf("Warning: ignoring damaged %s: %v", c.path, err)
+		c.authzs = map[string]cachedAuthz{}
+	}
+}
+
+// valid reports whether authzURL is a known valid authorization that doesn't
+// expire soon, and returns its domain.
+func (c *authzCache) valid(authzURL string) (string, cachedAuthz, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	for domain, authz := range c.authzs {
+		if authz.URL == authzURL && time.Until(authz.Expires) > authzExpiryMargin {
+			return domain, authz, true
+		}
+	}
+	return "", cachedAuthz{}, false
+}
+
+// record stores valid authorizations and drops expired ones.
+func (c *authzCache) record(authzs ...*acme.Authorization) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	for _, authz := range authzs {
+		if authz.Status == acme.StatusValid && !authz.Expires.IsZero() {
+			c.authzs[authz.Identifier.Value] = cachedAuthz{URL: authz.URI, Expires: authz.Expires}
+		}
+	}
+	c.save()
+}
+
+// forget drops the authorizations with the given URLs, e.g. after an order
+// using them failed.
+func (c *authzCache) forget(authzURLs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	for _, authzURL := range authzURLs {
+		for domain, authz := range c.authzs {
+			if authz.URL == authzURL {
+				delete(c.authzs, domain)
+			}
+		}
+	}
+	c.save()
+}
+
+// clear drops all authorizations, e.g. after the account was deactivated.
+func (c *authzCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded = true
+	c.authzs = map[string]cachedAuthz{}
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: failed to remove %s: %v", c.path, err)
+	}
+}
+
+// save writes the cache without its expired entries. The caller holds c.mu.
+func (c *authzCache) save() {
+	for domain, authz := range c.authzs {
+		if time.Now().After(authz.Expires) {
+			delete(c.authzs, domain)
+		}
+	}
+	data, err := json.MarshalIndent(c.authzs, "", "  ")
+	if err == nil {
+		err = os.WriteFile(c.path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to write %s: %v", c.path, err)
+	}
+}
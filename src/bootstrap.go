@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Timeout for registering a single native ACME account during bootstrap
+const bootstrapRegisterTimeout = 2 * time.Minute
+
+// dnsCredentialVars lists, for common acme.sh DNS providers, the alternative
+// sets of environment variables that provide credentials.
+var dnsCredentialVars = map[string][][]string{
+	"dns_aws":       {{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"}},
+	"dns_azure":     {{"AZUREDNS_SUBSCRIPTIONID", "AZUREDNS_TENANTID", "AZUREDNS_APPID", "AZUREDNS_CLIENTSECRET"}},
+	"dns_cf":        {{"CF_Token"}, {"CF_Key", "CF_Email"}},
+	"dns_dgon":      {{"DO_API_KEY"}},
+	"dns_gd":        {{"GD_Key", "GD_Secret"}},
+	"dns_hetzner":   {{"HETZNER_Token"}},
+	"dns_linode_v4": {{"LINODE_V4_API_KEY"}},
+	"dns_namecheap": {{"NAMECHEAP_USERNAME", "NAMECHEAP_API_KEY", "NAMECHEAP_SOURCEIP"}},
+	"dns_ovh":       {{"OVH_AK", "OVH_AS"}},
+}
+
+// bootstrapCheck is one line of the bootstrap readiness report.
+type bootstrapCheck struct {
+	Check  string
+	Result string // "ok", "warning" or "failed"
+	Detail string
+}
+
+// bootstrapReport collects the results of all bootstrap steps.
+type bootstrapReport struct {
+	checks []bootstrapCheck
+}
+
+func (r *bootstrapReport) add(check, result, detail string) {
+	r.checks = append(r.checks, bootstrapCheck{Check: check, Result: result, Detail: detail})
+}
+
+// addErr records a check as ok, or as failed with the error.
+func (r *bootstrapReport) addErr(check string, err error, okDetail string) {
+	if err != nil {
+		r.add(check, "failed", err.Error())
+		return
+	}
+	r.add(check, "ok", okDetail)
+}
+
+// ready reports whether no check failed.
+func (r *bootstrapReport) ready() bool {
+	for _, c := range r.checks {
+		if c.Result == "failed" {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *bootstrapReport) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+	fmt.Fprintln(w, "-----\t------\t------")
+	for _, c := range r.checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Check, c.Result, c.Detail)
+	}
+	w.Flush()
+}
+
+// runBootstrap performs the one-time setup for a configuration: directory
+// structure, account registration for every configured issuer, credential
+// checks and, with staging, a trial issuance against staging CAs. Every step
+// can safely be repeated. The database has already been initialized by the
+// caller. It returns false if anything needed for the daemon is not ready.
+func runBootstrap(yamlFile string, db *sql.DB, dbPath, certsBasePath string, staging bool) bool {
+	report := &bootstrapReport{}
+	defer report.print()
+
+	report.add("database", "ok", dbPath)
+
+	fullConfig, err := loadEffectiveConfig(yamlFile, db)
+	if err != nil {
+		report.add("config", "failed", err.Error())
+		return false
+	}
+	report.add("config", "ok", fmt.Sprintf("%s (%d certificates)", yamlFile, len(fullConfig.Certificates)))
+
+	configureIssuers(fullConfig.Configs)
+	names := make([]string, 0, len(fullConfig.Certificates))
+	for name := range fullConfig.Certificates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Directory structure
+	dirErr := os.MkdirAll(certsBasePath, 0755)
+	for _, name := range names {
+		if dirErr == nil && fullConfig.Certificates[name].Monitor == "" {
+			dirErr = os.MkdirAll(certFilesFor(certsBasePath, name).Dir, 0755)
+		}
+	}
+	report.addErr("directories", dirErr, certsBasePath)
+
+	// Backends and accounts, once per backend and issuer
+	if usesBackend(fullConfig, backendAcmeSh) {
+		if v, err := detectAcmeShVersion(); err != nil {
+			report.add("acme.sh", "failed", err.Error())
+		} else {
+			report.add("acme.sh", "ok", "version "+v)
+			if err := setDaemonState(db, "acmesh_version", v); err != nil {
+				report.add("acme.sh", "warning", err.Error())
+			}
+		}
+	}
+
+	registered := map[string]bool{}
+	for _, name := range names {
+		config := fullConfig.Certificates[name]
+		if config.Monitor != "" {
+			continue
+		}
+		backend := backendFor(config)
+		key := backend + " " + config.Issuer + " " + config.Account
+		if registered[key] {
+			continue
+		}
+		registered[key] = true
+		label, email := config.Issuer, fullConfig.Configs.Email
+		if config.Account != "" {
+			label += " " + config.Account
+			email = fullConfig.Configs.Accounts[config.Account].Email
+		}
+		report.addErr(fmt.Sprintf("account %s (%s)", label, backend),
+			bootstrapAccount(backend, config.Issuer, config.Account, email), email)
+	}
+
+	// Credentials, once per backend and DNS provider
+	checked := map[string]bool{}
+	for _, name := range names {
+		config := fullConfig.Certificates[name]
+		if config.Monitor != "" {
+			continue
+		}
+		backend := backendFor(config)
+		key := backend + " " + config.Type
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+		result, detail := checkDNSCredentials(backend, config.Type)
+		report.add(fmt.Sprintf("credentials %s (%s)", config.Type, backend), result, detail)
+	}
+
+	if staging {
+		for _, name := range names {
+			config := fullConfig.Certificates[name]
+			if config.Monitor != "" {
+				continue
+			}
+			result, detail := stagingIssue(name, config)
+			report.add("staging "+name, result, detail)
+		}
+	}
+
+	return report.ready()
+}
+
+// bootstrapAccount registers the ACME account for an issuer with the given
+// backend; account is a named account or "" for the default one.
+func bootstrapAccount(backend, issuer, account, email string) error {
+	switch backend {
+	case backendAcmeSh:
+		if email == "" {
+			return fmt.Errorf("no email set in 'configs'")
+		}
+		args := []string{"--register-account", "-m", email, "--server", issuer}
+		if account != "" {
+			args = append(args, "--config-home", acmeShAccountHome(account))
+		}
+		out, err := exec.Command(acmeShPath, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("acme.sh --register-account failed: %w: %s", err, lastLine(out))
+		}
+		return nil
+	case backendNative:
+		dirURL, err := directoryURL(issuer)
+		if err != nil {
+			return err
+		}
+		issuersMutex.Lock()
+		native := issuers[backendNative].(*nativeIssuer)
+		issuersMutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), bootstrapRegisterTimeout)
+		defer cancel()
+		_, err = native.client(ctx, dirURL, account)
+		return err
+	default:
+		return fmt.Errorf("unknown backend '%s'", backend)
+	}
+}
+
+// checkDNSCredentials verifies that credentials for a DNS provider are
+// configured. acme.sh may also have credentials saved from earlier runs, so
+// missing variables are only a warning for that backend.
+func checkDNSCredentials(backend, typ string) (string, string) {
+	if typ == challengeHTTP {
+		return "ok", "none needed for HTTP-01, challenges are served at " + http01ProxyTarget()
+	}
+	if backend == backendNative {
+		if _, err := newDNSSolver(typ, credentialGetenv); err != nil {
+			return "failed", err.Error()
+		}
+		return "ok", "credentials found"
+	}
+
+	sets, ok := dnsCredentialVars[typ]
+	if !ok {
+		return "warning", "unknown provider, credentials not checked"
+	}
+	for _, set := range sets {
+		missing := false
+		for _, v := range set {
+			if credentialGetenv(v) == "" {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			return "ok", strings.Join(set, ", ")
+		}
+	}
+	var options []string
+	for _, set := range sets {
+		options = append(options, strings.Join(set, " + "))
+	}
+	return "warning", "not set in the environment (" + strings.Join(options, " or ") + "), relying on credentials saved by acme.sh"
+}
+
+// stagingIssue issues a certificate against the staging CA of its issuer into
+// a scratch directory. The database and the real certificate files are not touched.
+func stagingIssue(name string, config CertConfig) (string, string) {
+	staging, err := stagingIssuer(config.Issuer)
+	if err != nil {
+		return "warning", err.Error() + ", skipped"
+	}
+
+	dir, err := os.MkdirTemp("", "gocert-staging-")
+	if err != nil {
+		return "failed", err.Error()
+	}
+	defer os.RemoveAll(dir)
+
+	config.Issuer = staging
+	if err := issueCertificate(name, config, dir, true); err != nil {
+		return "failed", err.Error()
+	}
+	return "ok", "issued by " + staging
+}
+
+// lastLine returns the last non-empty line of command output.
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}
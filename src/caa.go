@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// DNS type of CAA records (RFC 8659)
+	dnsTypeCAA = 257
+	// Timeout of a single CAA query
+	caaQueryTimeout = 5 * time.Second
+)
+
+// hasCAARecord reports whether CAA records restrict which CAs may issue for
+// a domain. As CAs do, it climbs from the domain to its parents and stops at
+// the first one that has CAA records.
+func hasCAARecord(domain string) (bool, error) {
+	labels := strings.Split(strings.TrimSuffix(strings.TrimPrefix(domain, "*."), "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		count, err := queryCAA(strings.Join(labels[i:], "."))
+		if err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// queryCAA asks the public resolver for the CAA records of a name and returns
+// how many there are. The standard resolver can't query CAA records, so the
+// query is built by hand.
+func queryCAA(name string) (int, error) {
+	id := uint16(rand.Uint32())
+	query := binary.BigEndian.AppendUint16(nil, id)
+	query = append(query, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // recursion desired, one question
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return 0, fmt.Errorf("invalid domain name '%s'", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, dnsTypeCAA)
+	query = binary.BigEndian.AppendUint16(query, 1) // class IN
+
+	conn, err := net.DialTimeout("udp", dnsPropagationResolver, caaQueryTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(caaQueryTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 4096)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, fmt.Errorf("CAA query for %s failed: %w", name, err)
+	}
+	return countCAAAnswers(resp[:n], id)
+}
+
+// countCAAAnswers parses a DNS response and counts its CAA answers. A
+// nonexistent name has none.
+func countCAAAnswers(msg []byte, id uint16) (int, error) {
+	errMalformed := errors.New("malformed DNS response")
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		return 0, errMalformed
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0, 3: // NOERROR, NXDOMAIN
+	default:
+		return 0, fmt.Errorf("DNS query failed with rcode %d", rcode)
+	}
+	questions, answers := binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[6:])
+
+	offset := 12
+	for i := 0; i < int(questions); i++ {
+		if offset = skipDNSName(msg, offset); offset < 0 || offset+4 > len(msg) {
+			return 0, errMalformed
+		}
+		offset += 4
+	}
+	count := 0
+	for i := 0; i < int(answers); i++ {
+		if offset = skipDNSName(msg, offset); offset < 0 || offset+10 > len(msg) {
+			return 0, errMalformed
+		}
+		if binary.BigEndian.Uint16(msg[offset:]) == dnsTypeCAA {
+			count++
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(msg[offset+8:]))
+	}
+	return count, nil
+}
+
+// skipDNSName returns the offset after a possibly compressed name, or -1.
+func skipDNSName(msg []byte, offset int) int {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1
+		case length&0xc0 == 0xc0:
+			return offset + 2
+		}
+		offset += 1 + length
+	}
+	return -1
+}
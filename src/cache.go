@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long the API serves certificate states from memory before reading them
+// again. Writes by the daemon invalidate the cache right away; this only
+// bounds how long changes made by other processes, such as 'gocert remove',
+// take to show up.
+const certCacheTTL = 30 * time.Second
+
+// certCache keeps the certificate states read from the database, so clients
+// polling the API don't query SQLite on every request.
+type certCache struct {
+	mu      sync.Mutex
+	records []CertDBRecord
+	loaded  time.Time
+}
+
+// stateCache is the cache used by the API and the metrics endpoint
+var stateCache = &certCache{}
+
+// invalidateCertCache drops the cached states after a certificate changed.
+func invalidateCertCache() {
+	stateCache.mu.Lock()
+	defer stateCache.mu.Unlock()
+	stateCache.records = nil
+}
+
+// list returns all certificate states ordered by name. The slice is shared
+// and must not be modified.
+func (c *certCache) list(db *sql.DB) ([]CertDBRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.records != nil && time.Since(c.loaded) < certCacheTTL {
+		return c.records, nil
+	}
+	records, err := listCertStates(db)
+	if err != nil {
+		return nil, err
+	}
+	if records == nil {
+		records = []CertDBRecord{}
+	}
+	c.records, c.loaded = records, time.Now()
+	return records, nil
+}
+
+// get returns the state of a single certificate.
+func (c *certCache) get(db *sql.DB, name string) (CertDBRecord, bool, error) {
+	records, err := c.list(db)
+	if err != nil {
+		return CertDBRecord{}, false, err
+	}
+	i := sort.Search(len(records), func(i int) bool { return records[i].Name >= name })
+	if i < len(records) && records[i].Name == name {
+		return records[i], true, nil
+	}
+	return CertDBRecord{}, false, nil
+}
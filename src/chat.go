@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// Maximum time a Slack or Discord webhook request may take
+	chatWebhookTimeout = 30 * time.Second
+	// Discord rejects longer messages
+	discordMessageLimit = 2000
+)
+
+// chatTemplates holds the default message templates of the chat notifiers,
+// keyed by notifier type and event. Events without a template use "*".
+var chatTemplates = map[string]map[string]string{
+	"slack": {
+		"failed":      ":x: Renewal of *{{.Cert}}* failed{{if .Expires}}, it expires in {{.DaysLeft}} days ({{.Expires}}){{end}}\n>{{.Message}}",
+		"not_renewed": ":warning: *{{.Cert}}* wasn't renewed and expires in {{.DaysLeft}} days ({{.Expires}})\n>{{.Message}}",
+		"*":           "*{{.Event}}*{{if .Cert}} `{{.Cert}}`{{end}}: {{.Message}}",
+	},
+	"discord": {
+		"failed":      ":x: Renewal of **{{.Cert}}** failed{{if .Expires}}, it expires in {{.DaysLeft}} days ({{.Expires}}){{end}}\n> {{.Message}}",
+		"not_renewed": ":warning: **{{.Cert}}** wasn't renewed and expires in {{.DaysLeft}} days ({{.Expires}})\n> {{.Message}}",
+		"*":           "**{{.Event}}**{{if .Cert}} `{{.Cert}}`{{end}}: {{.Message}}",
+	},
+}
+
+// chatMessage is the data of message templates: the event plus its expiry
+// in a readable form.
+type chatMessage struct {
+	NotificationEvent
+	// Expires is the expiry date of the certificate, empty if unknown
+	Expires string
+	// DaysLeft is the number of whole days until the certificate expires
+	DaysLeft int
+}
+
+// chatNotifier posts events to a Slack or Discord incoming webhook.
+type chatNotifier struct {
+	typ       string
+	url       string
+	templates map[string]*template.Template
+}
+
+func newSlackNotifier(name string, config NotifierConfig) (Notifier, error) {
+	return newChatNotifier("slack", name, config)
+}
+
+func newDiscordNotifier(name string, config NotifierConfig) (Notifier, error) {
+	return newChatNotifier("discord", name, config)
+}
+
+// newChatNotifier parses the message templates of a channel, its own
+// 'templates' overriding the defaults per event.
+func newChatNotifier(typ, name string, config NotifierConfig) (Notifier, error) {
+	if config.WebhookURL == "" {
+		return nil, fmt.Errorf("channel '%s' requires a 'webhook_url'", name)
+	}
+	texts := map[string]string{}
+	for event, text := range chatTemplates[typ] {
+		texts[event] = text
+	}
+	for event, text := range config.Templates {
+		texts[event] = text
+	}
+
+	n := &chatNotifier{typ: typ, url: config.WebhookURL, templates: map[string]*template.Template{}}
+	sample := newChatMessage(NotificationEvent{Event: "test", Cert: name, Message: "message", Time: time.Now(), NotAfter: time.Now()})
+	for event, text := range texts {
+		t, err := template.New(event).Parse(text)
+		if err == nil {
+			err = t.Execute(io.Discard, sample)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for '%s' in channel '%s': %w", event, name, err)
+		}
+		n.templates[event] = t
+	}
+	return n, nil
+}
+
+// newChatMessage prepares an event for the message templates.
+func newChatMessage(event NotificationEvent) chatMessage {
+	msg := chatMessage{NotificationEvent: event}
+	if !event.NotAfter.IsZero() {
+		msg.Expires = event.NotAfter.Format("2006-01-02")
+		msg.DaysLeft = int(time.Until(event.NotAfter).Hours() / 24)
+	}
+	return msg
+}
+
+func (n *chatNotifier) Notify(event NotificationEvent) error {
+	t, ok := n.templates[event.Event]
+	if !ok {
+		t = n.templates["*"]
+	}
+	var text strings.Builder
+	if err := t.Execute(&text, newChatMessage(event)); err != nil {
+		return fmt.Errorf("failed to render message: %w", err)
+	}
+
+	message := map[string]string{"text": text.String()}
+	if n.typ == "discord" {
+		content := text.String()
+		if runes := []rune(content); len(runes) > discordMessageLimit {
+			content = string(runes[:discordMessageLimit-3]) + "..."
+		}
+		message = map[string]string{"content": content}
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), chatWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Don't quote the URL, it holds the webhook's secret token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("failed to post to the %s webhook: %w", n.typ, err)
+	}
+	defer resp.Body.Close()
+	var output limitedBuffer
+	_, _ = io.Copy(&output, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s webhook returned %s: %s", n.typ, resp.Status, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
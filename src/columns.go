@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultStatusColumns are shown by 'status' unless '--columns' or
+// 'status_columns' selects others.
+var defaultStatusColumns = []string{"name", "status", "issued", "expires", "remaining", "issuer", "type", "key_type", "shared_with", "warnings"}
+
+// statusRow is a certificate as shown in a row of the status table.
+type statusRow struct {
+	record   CertDBRecord
+	expiry   time.Time
+	metadata map[string]string
+	warnings []certWarning
+}
+
+// statusColumn is a built-in column of the status table.
+type statusColumn struct {
+	header string
+	value  func(row statusRow) string
+}
+
+// statusColumns holds the built-in columns, keyed by their name in '--columns'.
+// Any other name is shown from the certificate's 'metadata'.
+var statusColumns = map[string]statusColumn{
+	"name":   {"NAME", func(row statusRow) string { return row.record.Name }},
+	"status": {"STATUS", func(row statusRow) string { return row.record.Status }},
+	"issued": {"ISSUED", func(row statusRow) string {
+		if row.record.LastIssued.IsZero() {
+			return "N/A"
+		}
+		return row.record.LastIssued.Format("2006-01-02")
+	}},
+	"expires": {"EXPIRES", func(row statusRow) string {
+		if row.record.LastIssued.IsZero() {
+			return "N/A"
+		}
+		return row.expiry.Format("2006-01-02")
+	}},
+	"remaining": {"REMAINING", func(row statusRow) string {
+		if row.record.LastIssued.IsZero() {
+			return "N/A"
+		}
+		return formatRemaining(time.Until(row.expiry))
+	}},
+	"issuer":      {"TLS PROVIDER", func(row statusRow) string { return row.record.Issuer }},
+	"type":        {"DNS PROVIDER", func(row statusRow) string { return row.record.Type }},
+	"domains":     {"DOMAINS", func(row statusRow) string { return orDash(row.record.Domains) }},
+	"key_type":    {"KEY TYPE", func(row statusRow) string { return orDash(row.record.KeyType) }},
+	"shared_with": {"SHARED WITH", func(row statusRow) string { return orDash(row.record.SharedWith) }},
+	"warnings": {"WARNINGS", func(row statusRow) string {
+		codes := make([]string, len(row.warnings))
+		for i, warning := range row.warnings {
+			codes[i] = warning.Code
+		}
+		return orDash(strings.Join(codes, ","))
+	}},
+}
+
+// statusColumnAliases maps alternative column names to the built-in ones.
+var statusColumnAliases = map[string]string{
+	"expiry":   "expires",
+	"provider": "issuer",
+	"dns":      "type",
+	"shared":   "shared_with",
+	"key":      "key_type",
+}
+
+// resolveStatusColumns turns column names into table columns. Names that
+// aren't built in become columns showing that metadata field.
+func resolveStatusColumns(names []string) ([]statusColumn, error) {
+	var columns []statusColumn
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			return nil, fmt.Errorf("empty column name")
+		}
+		if alias, ok := statusColumnAliases[name]; ok {
+			name = alias
+		}
+		if column, ok := statusColumns[name]; ok {
+			columns = append(columns, column)
+			continue
+		}
+		key := name
+		columns = append(columns, statusColumn{
+			header: strings.ToUpper(strings.ReplaceAll(key, "_", " ")),
+			value:  func(row statusRow) string { return orDash(row.metadata[key]) },
+		})
+	}
+	return columns, nil
+}
+
+// orDash returns s, or "-" if it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// statusTableLayout returns the columns of the status table, from the
+// '--columns' value or else 'status_columns' in the configuration, and the
+// metadata of every configured certificate. A missing configuration file
+// only means that there is no metadata.
+func statusTableLayout(yamlFile, columnsFlag string, db *sql.DB) ([]statusColumn, map[string]map[string]string, error) {
+	names := defaultStatusColumns
+	metadata := map[string]map[string]string{}
+
+	if _, err := os.Stat(yamlFile); err == nil {
+		fullConfig, err := loadEffectiveConfig(yamlFile, db)
+		if err != nil {
+			log.Printf("Warning: metadata columns are empty: %v", err)
+		} else {
+			if len(fullConfig.Configs.StatusColumns) > 0 {
+				names = fullConfig.Configs.StatusColumns
+			}
+			for name, config := range fullConfig.Certificates {
+				fields := map[string]string{}
+				for key, value := range config.Metadata {
+					fields[strings.ToLower(key)] = value
+				}
+				metadata[name] = fields
+			}
+		}
+	}
+	if columnsFlag != "" {
+		names = strings.Split(columnsFlag, ",")
+	}
+
+	columns, err := resolveStatusColumns(names)
+	return columns, metadata, err
+}
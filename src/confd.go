@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// configPatterns returns the glob patterns matching the files of a
+// configuration: the YAML files of a conf.d directory, or a file and the
+// patterns of its 'include:' list, relative to the file's directory.
+func configPatterns(yamlFile string) ([]string, error) {
+	if info, err := os.Stat(yamlFile); err == nil && info.IsDir() {
+		return []string{filepath.Join(yamlFile, "*.yaml"), filepath.Join(yamlFile, "*.yml")}, nil
+	}
+	patterns := []string{yamlFile}
+	data, err := os.ReadFile(yamlFile)
+	if err != nil {
+		// Reported by loadConfig
+		return patterns, nil
+	}
+	var top struct {
+		Include []string `yaml:"include"`
+	}
+	// Syntax errors are reported by the validation of the file.
+	_ = yaml.Unmarshal(data, &top)
+	for _, pattern := range top.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(yamlFile), pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid include pattern '%s' in %s: %w", pattern, yamlFile, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// configSources returns the files of a configuration in the order they are
+// merged: the main file first, then the matches of each pattern sorted by
+// name. Hidden files, like editors' backups, are left out.
+func configSources(yamlFile string) ([]string, error) {
+	patterns, err := configPatterns(yamlFile)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for i, pattern := range patterns {
+		if i == 0 && pattern == yamlFile {
+			files = append(files, yamlFile)
+			continue
+		}
+		matches, _ := filepath.Glob(pattern)
+		slices.Sort(matches)
+		for _, match := range matches {
+			if isConfigSource(match) && !slices.Contains(files, match) {
+				files = append(files, match)
+			}
+		}
+	}
+	return files, nil
+}
+
+// isConfigSource reports whether a file matched by a pattern is read, i.e.
+// it is a regular file and not hidden.
+func isConfigSource(path string) bool {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// isMultiFileConfig reports whether a configuration is read from more than
+// the single file given, i.e. it is a directory or uses 'include:'.
+func isMultiFileConfig(yamlFile string) bool {
+	patterns, err := configPatterns(yamlFile)
+	return err != nil || len(patterns) > 1 || patterns[0] != yamlFile
+}
+
+// validateConfigFragment validates a file of a multi-file configuration,
+// which needn't have the 'configs:' block.
+func validateConfigFragment(yamlContent []byte) error {
+	return validateConfigExcept(yamlContent, func(desc gojsonschema.ResultError) bool {
+		return desc.Type() == "required" && desc.Details()["property"] == "configs"
+	})
+}
+
+// mergeConfigFiles reads, validates and merges the files of a multi-file
+// configuration. One of them has the 'configs:' block and each certificate
+// is defined in one file only. It also returns the file each certificate is
+// defined in and the file of the 'configs:' block, for error messages.
+func mergeConfigFiles(yamlFile string, files []string) (FullConfig, map[string]string, string, error) {
+	merged := FullConfig{Certificates: map[string]CertConfig{}}
+	sources := map[string]string{}
+	configsFile := ""
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return FullConfig{}, nil, "", fmt.Errorf("failed to read YAML file '%s': %w", file, err)
+		}
+		var top map[string]interface{}
+		if err := yaml.Unmarshal(data, &top); err == nil && top == nil {
+			continue // Empty, e.g. all entries commented out
+		}
+		if err := validateConfigFragment(data); err != nil {
+			return FullConfig{}, nil, "", fmt.Errorf("invalid configuration in %s:\n%w", file, err)
+		}
+		var part FullConfig
+		if err := decodeConfig(data, &part); err != nil {
+			return FullConfig{}, nil, "", fmt.Errorf("failed to parse YAML: %w", err)
+		}
+
+		if _, ok := top["include"]; ok && (i > 0 || file != yamlFile) {
+			return FullConfig{}, nil, "", fmt.Errorf("invalid configuration in %s: 'include' is only allowed in the main file", file)
+		}
+		if _, ok := top["configs"]; ok {
+			if configsFile != "" {
+				return FullConfig{}, nil, "", fmt.Errorf("invalid configuration in %s: the 'configs:' block is already in %s", file, configsFile)
+			}
+			configsFile = file
+			merged.Configs = part.Configs
+		}
+		for name, config := range part.Certificates {
+			if other, ok := sources[name]; ok {
+				return FullConfig{}, nil, "", fmt.Errorf("invalid configuration in %s: certificate '%s' is already defined in %s", file, name, other)
+			}
+			sources[name] = file
+			merged.Certificates[name] = config
+		}
+	}
+	if configsFile == "" {
+		return FullConfig{}, nil, "", fmt.Errorf("invalid configuration in %s: none of its files has the 'configs:' block", yamlFile)
+	}
+	return merged, sources, configsFile, nil
+}
+
+// readConfigSettings parses the files of a configuration without validating
+// them, for settings needed before the first check validates it.
+func readConfigSettings(yamlFile string) FullConfig {
+	var fullConfig FullConfig
+	files, err := configSources(yamlFile)
+	if err != nil {
+		return fullConfig
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var part struct {
+			Configs *GlobalConfig `yaml:"configs"`
+		}
+		if decodeConfig(data, &part) == nil && part.Configs != nil {
+			fullConfig.Configs = *part.Configs
+		}
+	}
+	return fullConfig
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// Encrypted configurations can be kept in Git. They are decrypted when they
+// are loaded, before validation:
+//
+//   - a value that is an ASCII-armored age message, as written by 'age -a',
+//     is decrypted with the identities of GOCERT_AGE_KEY_FILE or
+//     GOCERT_AGE_KEY
+//   - a file encrypted with SOPS, i.e. with a top-level 'sops:' block, is
+//     decrypted as a whole by the sops binary, which finds its keys itself,
+//     e.g. in SOPS_AGE_KEY_FILE
+
+// ageIdentities returns the identities encrypted values are decrypted with.
+func ageIdentities() ([]age.Identity, error) {
+	if path := os.Getenv("GOCERT_AGE_KEY_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GOCERT_AGE_KEY_FILE: %w", err)
+		}
+		defer f.Close()
+		identities, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identities in GOCERT_AGE_KEY_FILE %s: %w", path, err)
+		}
+		return identities, nil
+	}
+	if key := os.Getenv("GOCERT_AGE_KEY"); key != "" {
+		identities, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity in GOCERT_AGE_KEY: %w", err)
+		}
+		return identities, nil
+	}
+	return nil, fmt.Errorf("the configuration has encrypted values, set GOCERT_AGE_KEY_FILE or GOCERT_AGE_KEY to decrypt them")
+}
+
+// isEncryptedValue reports whether a value is an armored age message.
+func isEncryptedValue(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), armor.Header)
+}
+
+// decryptConfigNode decrypts the encrypted values of a YAML document in
+// place. Nodes keep their position, so errors still point at the file.
+func decryptConfigNode(doc *yaml.Node) error {
+	var identities []age.Identity
+	var walk func(node *yaml.Node) error
+	walk = func(node *yaml.Node) error {
+		if node.Kind == yaml.ScalarNode && isEncryptedValue(node.Value) {
+			if identities == nil {
+				var err error
+				if identities, err = ageIdentities(); err != nil {
+					return err
+				}
+			}
+			r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(node.Value))), identities...)
+			if err != nil {
+				return fmt.Errorf("line %d, column %d: failed to decrypt the value: %w", node.Line, node.Column, err)
+			}
+			plaintext, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("line %d, column %d: failed to decrypt the value: %w", node.Line, node.Column, err)
+			}
+			node.Value = strings.TrimSuffix(string(plaintext), "\n")
+			node.Tag = "!!str"
+			return nil
+		}
+		// Aliased nodes are decrypted where they are anchored.
+		for _, child := range node.Content {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(doc)
+}
+
+// isSOPSFile reports whether a configuration file is encrypted with SOPS.
+func isSOPSFile(data []byte) bool {
+	var top struct {
+		SOPS map[string]interface{} `yaml:"sops"`
+	}
+	if yaml.Unmarshal(data, &top) != nil {
+		return false
+	}
+	_, ok := top.SOPS["mac"]
+	return ok
+}
+
+// decryptSOPSFile decrypts a configuration file encrypted with SOPS, and
+// returns other files unchanged.
+func decryptSOPSFile(data []byte) ([]byte, error) {
+	if !isSOPSFile(data) {
+		return data, nil
+	}
+	if _, err := exec.LookPath("sops"); err != nil {
+		return nil, fmt.Errorf("the configuration is encrypted with SOPS, but sops isn't installed: %w", err)
+	}
+	cmd := exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", "/dev/stdin")
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the configuration with sops: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// parseConfigNode parses a configuration file into a YAML document with its
+// encrypted values decrypted.
+func parseConfigNode(data []byte) (*yaml.Node, error) {
+	data, err := decryptSOPSFile(data)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := decryptConfigNode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// decodeConfig is yaml.Unmarshal for configuration files, decrypting their
+// encrypted values.
+func decodeConfig(data []byte, out interface{}) error {
+	doc, err := parseConfigNode(data)
+	if err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	return doc.Decode(out)
+}
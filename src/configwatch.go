@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Quiet period after the last change to the YAML file before it is reloaded,
+// so a deployment writing the file in several steps triggers one reload
+const configWatchDebounce = 2 * time.Second
+
+// watchConfigFile reloads the configuration whenever one of its YAML files
+// changes. The files' directories are watched rather than the files
+// themselves, so changes made by replacing a file (editors, Ansible,
+// ConfigMaps) and files added to a conf.d directory are seen too.
+func watchConfigFile(yamlFile string, reload chan<- struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Warning: cannot watch %s for changes, use SIGHUP to reload: %v", yamlFile, err)
+		return
+	}
+	patterns, err := configPatterns(yamlFile)
+	if err != nil {
+		patterns = []string{yamlFile}
+	}
+	watched := map[string]bool{}
+	for _, pattern := range patterns {
+		dir := filepath.Dir(absPath(pattern))
+		if watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			log.Printf("Warning: cannot watch %s for changes, use SIGHUP to reload: %v", yamlFile, err)
+			return
+		}
+		watched[dir] = true
+	}
+
+	go func() {
+		var debounce *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isConfigChange(yamlFile, event) {
+					continue
+				}
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(configWatchDebounce, func() {
+					log.Printf("Configuration file %s changed, reloading.", yamlFile)
+					if err := requestReload(yamlFile, reload); err != nil {
+						log.Printf("ERROR: Reload failed, keeping the current schedule: %v", err)
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Warning: watching %s failed: %v", yamlFile, err)
+			}
+		}
+	}()
+}
+
+// isConfigChange reports whether an event changed one of the configuration's
+// files. The patterns are read again, since the 'include:' list may have
+// changed. Removing a file of a conf.d directory counts too.
+func isConfigChange(yamlFile string, event fsnotify.Event) bool {
+	if !event.Has(fsnotify.Write | fsnotify.Create | fsnotify.Rename | fsnotify.Remove) {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	if strings.HasPrefix(filepath.Base(name), ".") {
+		return false
+	}
+	patterns, err := configPatterns(yamlFile)
+	if err != nil {
+		patterns = []string{yamlFile}
+	}
+	for i, pattern := range patterns {
+		if i == 0 && pattern == yamlFile {
+			if name == absPath(yamlFile) && !event.Has(fsnotify.Remove) {
+				return true
+			}
+			continue
+		}
+		if matched, _ := filepath.Match(absPath(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// absPath returns the absolute form of a path, or the cleaned path if the
+// working directory is unknown.
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Name of the daemon's control socket, next to the database unless
+	// GOCERT_CONTROL_SOCKET is set
+	controlSocketName = "gocert.sock"
+	// Output chunks buffered per follower before further ones are dropped
+	liveBufferSize = 256
+	// Maximum time a control command may take to arrive
+	controlReadTimeout = 10 * time.Second
+)
+
+var (
+	// liveMutex guards liveFollowers
+	liveMutex = &sync.Mutex{}
+	// liveFollowers holds the channels of clients following the output of
+	// a certificate, keyed by name
+	liveFollowers = map[string]map[chan string]struct{}{}
+)
+
+// controlSocketPath returns where the daemon listens for control commands.
+func controlSocketPath(dbPath string) string {
+	return envOrDefault("GOCERT_CONTROL_SOCKET", filepath.Join(filepath.Dir(dbPath), controlSocketName))
+}
+
+// followLive subscribes to the live output of a certificate and returns the
+// channel it arrives on and the function that ends the subscription.
+func followLive(name string) (chan string, func()) {
+	ch := make(chan string, liveBufferSize)
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	if liveFollowers[name] == nil {
+		liveFollowers[name] = map[chan string]struct{}{}
+	}
+	liveFollowers[name][ch] = struct{}{}
+	return ch, func() {
+		liveMutex.Lock()
+		defer liveMutex.Unlock()
+		delete(liveFollowers[name], ch)
+	}
+}
+
+// publishLive passes output of a certificate's acme.sh run or deploy hook to
+// the clients following it. A client that doesn't keep up misses output
+// rather than holding up the run.
+func publishLive(name, text string) {
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	for ch := range liveFollowers[name] {
+		select {
+		case ch <- text:
+		default:
+		}
+	}
+}
+
+// liveWriter publishes whatever is written to it as live output of a
+// certificate.
+type liveWriter struct {
+	name string
+}
+
+func (w liveWriter) Write(p []byte) (int, error) {
+	publishLive(w.name, string(p))
+	return len(p), nil
+}
+
+// startControlSocket listens for control commands of local clients such as
+// 'gocert logs --follow'. Access is limited to the user running the daemon
+// by the permissions of the socket.
+func startControlSocket(path string, db *sql.DB, reload chan<- struct{}) error {
+	// A socket left behind by a previous daemon, or before an upgrade,
+	// would make listening fail.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale control socket %s: %w", path, err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict control socket %s: %w", path, err)
+	}
+	log.Printf("Control socket listening on %s", path)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("ERROR: Control socket stopped: %v", err)
+				return
+			}
+			go handleControlConn(conn, db, reload)
+		}
+	}()
+	return nil
+}
+
+// handleControlConn serves one control command. 'logs <name>' streams the
+// live output of a certificate until the client disconnects; 'promote' and
+// 'demote' switch standby.
+func handleControlConn(conn net.Conn, db *sql.DB, reload chan<- struct{}) {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(controlReadTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	command, name, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if (command == "promote" || command == "demote") && name == "" {
+		handleStandbyCommand(conn, command, db, reload)
+		return
+	}
+	if command != "logs" || name == "" {
+		fmt.Fprintf(conn, "ERROR unknown command '%s'\n", strings.TrimSpace(line))
+		return
+	}
+	output, stop := followLive(name)
+	defer stop()
+	if _, err := fmt.Fprintln(conn, "OK"); err != nil {
+		return
+	}
+
+	// The client ends following by closing the connection.
+	closed := make(chan struct{})
+	go func() {
+		_, _ = reader.ReadByte()
+		close(closed)
+	}()
+	for {
+		select {
+		case text := <-output:
+			if _, err := conn.Write([]byte(text)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Certificates checked at the same time when 'max_parallel' isn't set
+	defaultMaxParallel = 5
+	// File in the certificates directory locked while certificates are checked
+	// or renewed
+	certsLockName = ".gocert.lock"
+)
+
+// lockCycle serializes check cycles and renewals, both within the daemon and
+// with other gocert processes using the same certificates directory, such as
+// 'gocert renew' or a second daemon: those hold a lock on a file in it. A
+// cycle or renewal waits for the one in progress instead of running against
+// the same certificates at the same time. If the file can't be locked, only
+// the daemon's own cycles are serialized.
+func lockCycle(certsBasePath, what string) func() {
+	cycleMutex.Lock()
+	file, err := lockCertsDir(certsBasePath, what)
+	if err != nil {
+		log.Printf("Warning: could not lock %s, other gocert processes may renew the same certificates meanwhile: %v", certsBasePath, err)
+		return cycleMutex.Unlock
+	}
+	return func() {
+		_ = unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+		cycleMutex.Unlock()
+	}
+}
+
+// lockCertsDir takes the lock on the certificates directory, waiting for the
+// process holding it, whose PID the file contains.
+func lockCertsDir(certsBasePath, what string) (*os.File, error) {
+	if err := os.MkdirAll(certsBasePath, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(certsBasePath, certsLockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		holder, _ := io.ReadAll(file)
+		log.Printf("Another gocert process (PID %s) is checking or renewing certificates in %s, the %s waits for it.", strings.TrimSpace(string(holder)), certsBasePath, what)
+		started := time.Now()
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX)
+		if err == nil {
+			log.Printf("Waited %s for the other gocert process.", time.Since(started).Round(time.Second))
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return file, nil
+}
+
+// maxParallelFor returns how many certificates a check cycle processes at
+// the same time, so mass renewals don't hammer DNS APIs and the CA.
+func maxParallelFor(global GlobalConfig) int {
+	if global.MaxParallel > 0 {
+		return global.MaxParallel
+	}
+	return defaultMaxParallel
+}
+
+// cycleOverran records the duration of a check cycle and reports whether it
+// took longer than the check interval. Then the tick that came due meanwhile
+// is skipped rather than starting the next cycle right away, so cycles never
+// run back to back.
+func cycleOverran(duration, interval time.Duration) bool {
+	metricCycleDuration.Set(duration.Seconds())
+	if duration <= interval {
+		return false
+	}
+	metricCycleOverruns.Inc()
+	log.Printf("Warning: the certificate check took %s, longer than the check interval of %s; the next check starts a full interval from now. Raise 'check_interval' or 'max_parallel'.",
+		duration.Round(time.Second), interval)
+	return true
+}
+
+// certOutcome is a certificate that was renewed, or failed to renew, in a
+// check cycle.
+type certOutcome struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// cycleSummary describes a check cycle. It is passed as JSON to the
+// 'post_check_hook'.
+type cycleSummary struct {
+	mu       sync.Mutex
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Checked  int           `json:"checked"`
+	Renewed  []certOutcome `json:"renewed"`
+	Failed   []certOutcome `json:"failed"`
+	// checked holds the names of the checked certificates
+	checked map[string]bool
+}
+
+// newCycleSummary starts the summary of a check cycle.
+func newCycleSummary() *cycleSummary {
+	return &cycleSummary{Started: time.Now(), Renewed: []certOutcome{}, Failed: []certOutcome{}, checked: map[string]bool{}}
+}
+
+// record adds the result of checking one certificate.
+func (s *cycleSummary) record(name string, config CertConfig, renewed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Checked++
+	s.checked[name] = true
+	outcome := certOutcome{Name: name, Domains: config.Domains}
+	if outcome.Domains == nil {
+		outcome.Domains = []string{}
+	}
+	switch {
+	case err != nil:
+		outcome.Error = err.Error()
+		s.Failed = append(s.Failed, outcome)
+	case renewed:
+		s.Renewed = append(s.Renewed, outcome)
+	}
+}
+
+// runPostCheckHook runs the 'post_check_hook' command with the summary of
+// the cycle on stdin. Its output is logged and failures don't affect the
+// daemon.
+func runPostCheckHook(command []string, summary *cycleSummary) {
+	if len(command) == 0 {
+		return
+	}
+	summary.mu.Lock()
+	input, err := json.Marshal(summary)
+	summary.mu.Unlock()
+	if err != nil {
+		log.Printf("ERROR: Failed to encode the check summary: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := runCommand(cmd)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", defaultHookTimeout)
+	}
+	if output != "" {
+		log.Printf("Post-check hook output:\n%s", output)
+	}
+	if err != nil {
+		log.Printf("ERROR: Post-check hook failed: %v", err)
+		return
+	}
+	log.Printf("Post-check hook finished (%d renewed, %d failed).", len(summary.Renewed), len(summary.Failed))
+}
+
+// failingStatuses are the states of certificates whose last issuance failed.
+var failingStatuses = map[string]bool{"failed": true, statusTimeout: true, statusNeedsIntervention: true}
+
+// runOnce runs a single check cycle for cron jobs and systemd timers and
+// returns the exit code: exitIssueFailed if a certificate failed in this
+// cycle or is still waiting to retry a failed issuance, which the cycle may
+// have skipped, and exitUsage if the configuration is invalid.
+func runOnce(yamlFile string, db *sql.DB, certsBasePath string) int {
+	summary, err := checkAndProcessCertificates(yamlFile, db, certsBasePath, true)
+	if err != nil {
+		return exitUsage
+	}
+
+	failing := map[string]string{}
+	for _, outcome := range summary.Failed {
+		failing[outcome.Name] = outcome.Error
+	}
+	records, err := listCertStates(db)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitIssueFailed
+	}
+	for _, record := range records {
+		// Certificates left out by --only, --skip or --exclude don't count.
+		if certSelectionActive() && !summary.checked[record.Name] && !summary.checked[record.SharedWith] {
+			continue
+		}
+		if _, ok := failing[record.Name]; !ok && failingStatuses[record.Status] {
+			failing[record.Name] = "status " + record.Status
+		}
+	}
+	if len(failing) == 0 {
+		log.Printf("Checked %d certificates, renewed %d, none failing.", summary.Checked, len(summary.Renewed))
+		return exitIssued
+	}
+	names := slices.Sorted(maps.Keys(failing))
+	for _, name := range names {
+		log.Printf("ERROR: certificate '%s' is failing: %s", name, failing[name])
+	}
+	log.Printf("Checked %d certificates, renewed %d, %d failing: %s", summary.Checked, len(summary.Renewed), len(names), strings.Join(names, ", "))
+	return exitIssueFailed
+}
+
+var (
+	// onlyCerts, skipCerts and excludeCerts are set by 'run --only', '--skip'
+	// and '--exclude' and limit the certificates checks process, e.g. during
+	// an incident or to shard a configuration across instances
+	onlyCerts    []string
+	skipCerts    []string
+	excludeCerts []string
+)
+
+// addCertNames adds the names or glob patterns of a comma-separated
+// '--only', '--skip' or '--exclude' value to a list.
+func addCertNames(list *[]string) func(string) error {
+	return func(value string) error {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if _, err := path.Match(name, ""); err != nil {
+					return fmt.Errorf("invalid pattern '%s': %w", name, err)
+				}
+				*list = append(*list, name)
+			}
+		}
+		return nil
+	}
+}
+
+// certSelectionActive reports whether '--only', '--skip' or '--exclude'
+// limit the certificates checks process.
+func certSelectionActive() bool {
+	return len(onlyCerts) > 0 || len(skipCerts) > 0 || len(excludeCerts) > 0
+}
+
+// matchesCertName reports whether one of the names or glob patterns matches
+// a certificate name.
+func matchesCertName(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+// groupSelected reports whether a check processes a certificate and the
+// entries sharing it, which are handled together: if '--only' matches one
+// of them and '--skip' and '--exclude' match none.
+func groupSelected(group []string) bool {
+	if slices.ContainsFunc(group, func(name string) bool {
+		return matchesCertName(skipCerts, name) || matchesCertName(excludeCerts, name)
+	}) {
+		return false
+	}
+	return len(onlyCerts) == 0 || slices.ContainsFunc(group, func(name string) bool { return matchesCertName(onlyCerts, name) })
+}
+
+// certSelected reports whether a check processes a certificate, given which
+// entries share it.
+func certSelected(name string, primaryOf map[string]string) bool {
+	if primary, ok := primaryOf[name]; ok {
+		name = primary
+	}
+	return groupSelected(append([]string{name}, followersOf(primaryOf, name)...))
+}
+
+// logCertSelection logs which certificates '--only', '--skip' and
+// '--exclude' limit a check to, and names or patterns that match no
+// configured certificate.
+func logCertSelection(fullConfig FullConfig) {
+	if !certSelectionActive() {
+		return
+	}
+	for _, pattern := range slices.Concat(onlyCerts, skipCerts, excludeCerts) {
+		matched := false
+		for name := range fullConfig.Certificates {
+			matched = matched || matchesCertName([]string{pattern}, name)
+		}
+		if !matched {
+			log.Printf("Warning: '%s' of --only, --skip or --exclude matches no configured certificate", pattern)
+		}
+	}
+	if len(onlyCerts) > 0 {
+		log.Printf("Only processing %s (--only), with the entries sharing their certificates.", strings.Join(onlyCerts, ", "))
+	}
+	if len(skipCerts) > 0 {
+		log.Printf("Skipping %s (--skip), with the entries sharing their certificates.", strings.Join(skipCerts, ", "))
+	}
+	if len(excludeCerts) > 0 {
+		log.Printf("Excluding %s (--exclude), with the entries sharing their certificates.", strings.Join(excludeCerts, ", "))
+	}
+}
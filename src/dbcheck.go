@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// checkDatabase runs an integrity check of the database at dbPath before it
+// is used. A damaged database is moved aside as '<db>.corrupt-<time>', the
+// rows that can still be read are salvaged into a fresh one, and certificates
+// whose rows are lost are rebuilt from their files under certsPath.
+func checkDatabase(dbPath, certsPath string) error {
+	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	problems, err := integrityProblems(dbPath)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	log.Printf("ERROR: database %s is damaged: %s", dbPath, strings.Join(problems, "; "))
+
+	backup := fmt.Sprintf("%s.corrupt-%s", dbPath, time.Now().UTC().Format("20060102T150405Z"))
+	for i := 2; ; i++ {
+		if _, err := os.Stat(backup); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		backup = fmt.Sprintf("%s.corrupt-%s-%d", dbPath, time.Now().UTC().Format("20060102T150405Z"), i)
+	}
+	if err := os.Rename(dbPath, backup); err != nil {
+		return fmt.Errorf("failed to move the damaged database aside: %w", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Rename(dbPath+suffix, backup+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to move the damaged database aside: %w", err)
+		}
+	}
+	log.Printf("Moved the damaged database to %s", backup)
+
+	db, err := setupDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	salvaged, err := salvageDatabase(db, backup)
+	if err != nil {
+		log.Printf("Warning: could not salvage the damaged database: %v", err)
+	} else {
+		log.Printf("Salvaged %d rows from the damaged database", salvaged)
+	}
+	rebuilt, err := rebuildCertsFromDisk(db, certsPath)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild certificates from %s: %w", certsPath, err)
+	}
+	if rebuilt > 0 {
+		log.Printf("Rebuilt %d certificates from their files in %s; their type and issuer are filled in on the next check", rebuilt, certsPath)
+	}
+	return nil
+}
+
+// integrityProblems returns what 'PRAGMA integrity_check' reports for the
+// database at dbPath, or why it couldn't be read as a database at all. Other
+// errors, such as a locked database, are returned as errors.
+func integrityProblems(dbPath string) ([]string, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		if isCorruption(err) {
+			return []string{err.Error()}, nil
+		}
+		return nil, fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		if isCorruption(err) {
+			return append(problems, err.Error()), nil
+		}
+		return nil, fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	return problems, nil
+}
+
+// isCorruption reports whether err means the file is damaged or isn't a
+// database.
+func isCorruption(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB)
+}
+
+// salvageDatabase copies the rows that can still be read from the damaged
+// database at path into the tables of db, by column name, like the
+// '.recover' command of the sqlite3 shell. Reading a table stops at its first
+// damaged page. It returns the number of rows copied.
+func salvageDatabase(db *sql.DB, path string) (int, error) {
+	damaged, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer damaged.Close()
+
+	tables, err := tableNames(damaged)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, table := range tables {
+		columns, err := commonColumns(db, damaged, table)
+		if err != nil || len(columns) == 0 {
+			continue
+		}
+		copied, err := salvageTable(db, damaged, table, columns)
+		total += copied
+		if err != nil {
+			log.Printf("Warning: salvaged %d rows of table %s before: %v", copied, table, err)
+		}
+	}
+	return total, nil
+}
+
+// tableNames lists the tables of a database, without SQLite's own.
+func tableNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// tableColumns lists the columns of a table; none if it doesn't exist.
+func tableColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%q)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// commonColumns returns the columns a table has in both databases, as the
+// damaged one may predate columns added since.
+func commonColumns(db, damaged *sql.DB, table string) ([]string, error) {
+	fresh, err := tableColumns(db, table)
+	if err != nil {
+		return nil, err
+	}
+	old, err := tableColumns(damaged, table)
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	for _, column := range old {
+		for _, c := range fresh {
+			if c == column {
+				columns = append(columns, fmt.Sprintf("%q", column))
+				break
+			}
+		}
+	}
+	return columns, nil
+}
+
+// salvageTable copies the readable rows of a table in one transaction.
+func salvageTable(db, damaged *sql.DB, table string, columns []string) (int, error) {
+	list := strings.Join(columns, ", ")
+	rows, err := damaged.Query(fmt.Sprintf("SELECT %s FROM %q", list, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	insert, err := tx.Prepare(fmt.Sprintf("INSERT OR IGNORE INTO %q (%s) VALUES (%s)", table, list, placeholders))
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	copied := 0
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			break
+		}
+		if _, err := insert.Exec(values...); err == nil {
+			copied++
+		}
+	}
+	readErr := rows.Err()
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return copied, readErr
+}
+
+// rebuildCertsFromDisk adds a certificates row for every certificate
+// directory under certsPath whose row is missing, with the domains and
+// validity read from its cert.pem. It returns the number of rows added.
+func rebuildCertsFromDisk(db *sql.DB, certsPath string) (int, error) {
+	entries, err := os.ReadDir(certsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	defer invalidateCertCache()
+
+	rebuilt := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		cert, err := readCertificateFile(certFilesFor(certsPath, name).Cert)
+		if err != nil {
+			continue
+		}
+		domains := cert.DNSNames
+		if cn := cert.Subject.CommonName; cn != "" && (len(domains) == 0 || domains[0] != cn) {
+			domains = append([]string{cn}, slices.DeleteFunc(slices.Clone(domains), func(d string) bool { return d == cn })...)
+		}
+		result, err := db.Exec(`
+			INSERT OR IGNORE INTO certificates (name, type, issuer, domains, last_issued, status, not_after, not_before)
+			VALUES (?, '', '', ?, ?, 'issued', ?, ?)`,
+			name, strings.Join(domains, ","), cert.NotBefore, cert.NotAfter, cert.NotBefore)
+		if err != nil {
+			return rebuilt, fmt.Errorf("failed to rebuild certificate '%s': %w", name, err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			rebuilt++
+			if err := recordHistory(db, name, "rebuilt"); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+	return rebuilt, nil
+}
+
+// updateCertSource fills in the type and issuer of a certificate rebuilt from
+// its files.
+func updateCertSource(db *sql.DB, name, typ, issuer string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	defer invalidateCertCache()
+
+	if _, err := db.Exec("UPDATE certificates SET type = ?, issuer = ? WHERE name = ?", typ, issuer, name); err != nil {
+		return fmt.Errorf("failed to update type and issuer for '%s': %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// certDecision is what the last check did with a certificate, and why.
+type certDecision struct {
+	CheckedAt time.Time
+	// Action is 'skip', 'renewed' or 'failed'
+	Action string
+	Reason string
+}
+
+// recordDecision stores what a check did with a certificate, replacing the
+// decision of the previous check.
+func recordDecision(db *sql.DB, name, action, reason string) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT INTO cert_decisions (name, checked_at, action, reason) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET checked_at = excluded.checked_at, action = excluded.action, reason = excluded.reason
+	`, name, time.Now(), action, reason)
+	if err != nil {
+		log.Printf("Warning: failed to record the decision for '%s': %v", name, err)
+	}
+}
+
+// lastDecision returns what the last check did with a certificate.
+func lastDecision(db *sql.DB, name string) (certDecision, bool, error) {
+	var d certDecision
+	err := db.QueryRow(`SELECT checked_at, action, reason FROM cert_decisions WHERE name = ?`, name).Scan(&d.CheckedAt, &d.Action, &d.Reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, false, nil
+	}
+	if err != nil {
+		return d, false, fmt.Errorf("failed to read the last decision for '%s': %w", name, err)
+	}
+	return d, true, nil
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Certificate definitions can come from the YAML file or be created through
+// the API. API definitions are stored in the cert_definitions table and merged
+// into the configuration on every load; the YAML file wins on name conflicts.
+
+// storedDefinition is a certificate definition kept in the database.
+type storedDefinition struct {
+	Name       string     `json:"name"`
+	Definition CertConfig `json:"definition"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// listDefinitions returns all API-managed certificate definitions, ordered by name.
+func listDefinitions(db *sql.DB) ([]storedDefinition, error) {
+	rows, err := db.Query("SELECT name, definition, created_at, updated_at FROM cert_definitions ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query certificate definitions: %w", err)
+	}
+	defer rows.Close()
+
+	var defs []storedDefinition
+	for rows.Next() {
+		var def storedDefinition
+		var raw string
+		if err := rows.Scan(&def.Name, &raw, &def.CreatedAt, &def.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan certificate definition: %w", err)
+		}
+		if err := json.Unmarshal([]byte(raw), &def.Definition); err != nil {
+			return nil, fmt.Errorf("invalid stored definition for '%s': %w", def.Name, err)
+		}
+		defs = append(defs, def)
+	}
+	return defs, rows.Err()
+}
+
+// loadEffectiveConfig loads the YAML configuration and merges in the
+// certificate definitions stored in the database.
+func loadEffectiveConfig(yamlFile string, db *sql.DB) (FullConfig, error) {
+	fullConfig, err := loadConfig(yamlFile)
+	if err != nil {
+		return FullConfig{}, err
+	}
+
+	defs, err := listDefinitions(db)
+	if err != nil {
+		return FullConfig{}, err
+	}
+	if fullConfig.Certificates == nil {
+		fullConfig.Certificates = map[string]CertConfig{}
+	}
+	for _, def := range defs {
+		if _, exists := fullConfig.Certificates[def.Name]; exists {
+			log.Printf("Warning: Certificate '%s' is defined in both %s and the API; using the config file.", def.Name, yamlFile)
+			continue
+		}
+		// Definitions stored before a check was added are left out rather
+		// than failing the whole configuration.
+		// The API check goes first: validateCertConfig would read env_file.
+		err := validateAPIDefinition(def.Definition)
+		config := def.Definition
+		if err == nil {
+			config, err = validateCertConfig(def.Name, def.Definition, fullConfig.Configs)
+		}
+		if err != nil {
+			log.Printf("Warning: Ignoring the invalid API definition of certificate '%s': %v", def.Name, err)
+			continue
+		}
+		fullConfig.Certificates[def.Name] = config
+	}
+	return fullConfig, nil
+}
+
+// definitionSchemaLoader returns a schema for a single certificate entry,
+// taken from the embedded configuration schema.
+func definitionSchemaLoader() (gojsonschema.JSONLoader, error) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(schemaContent), &schema); err != nil {
+		return nil, err
+	}
+	entry, ok := schema["additionalProperties"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("embedded schema has no certificate entry definition")
+	}
+	entry["definitions"] = schema["definitions"]
+	return gojsonschema.NewGoLoader(entry), nil
+}
+
+// certNamePattern restricts certificate names, which are used as directory
+// names under the certificates path, like the schema's 'propertyNames'.
+var certNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// validateDefinition validates a single certificate definition against the embedded schema.
+func validateDefinition(name string, def json.RawMessage) error {
+	if !certNamePattern.MatchString(name) || name == "configs" || name == "include" {
+		return fmt.Errorf("invalid certificate name '%s', expected letters, digits, '_', '.' and '-', starting with a letter or digit", name)
+	}
+
+	schemaLoader, err := definitionSchemaLoader()
+	if err != nil {
+		return err
+	}
+	result, err := gojsonschema.Validate(schemaLoader, gojsonschema.NewBytesLoader(def))
+	if err != nil {
+		return fmt.Errorf("error during schema validation: %w", err)
+	}
+	if !result.Valid() {
+		var errorMessages []string
+		for _, desc := range result.Errors() {
+			errorMessages = append(errorMessages, desc.String())
+		}
+		return fmt.Errorf("%s", strings.Join(errorMessages, "; "))
+	}
+	return nil
+}
+
+// validateAPIDefinition rejects the fields of a certificate entry that only
+// the configuration file may set: whoever can reach the API mustn't run
+// commands on the host, read its files or get the daemon's environment.
+func validateAPIDefinition(config CertConfig) error {
+	if config.EnvFile != "" {
+		return fmt.Errorf("'env_file' is only allowed in the config file")
+	}
+	if len(config.PassEnv) > 0 {
+		return fmt.Errorf("'pass_env' is only allowed in the config file")
+	}
+	for key, value := range config.Env {
+		if err := checkAPISecretRef(value); err != nil {
+			return fmt.Errorf("env '%s': %w", key, err)
+		}
+	}
+	for i, hook := range config.Deploy {
+		if typ := hookType(hook); typ == "exec" || typ == "docker" {
+			return fmt.Errorf("deploy hook %d: type '%s' is only allowed in the config file", i+1, typ)
+		}
+		// An scp hook could log in anywhere with the daemon's own SSH key.
+		if hook.Key != "" {
+			return fmt.Errorf("deploy hook %d: 'key' is only allowed in the config file, use 'key_secret'", i+1)
+		}
+		if hook.KnownHosts != "" {
+			return fmt.Errorf("deploy hook %d: 'known_hosts' is only allowed in the config file", i+1)
+		}
+		// grpcurl would take these for options.
+		if strings.HasPrefix(hook.Address, "-") || strings.HasPrefix(hook.Method, "-") {
+			return fmt.Errorf("deploy hook %d: 'address' and 'method' can't start with '-'", i+1)
+		}
+		for secret, ref := range hook.Secrets {
+			if err := checkAPISecretRef(ref); err != nil {
+				return fmt.Errorf("deploy hook %d: secret '%s': %w", i+1, secret, err)
+			}
+		}
+		if err := checkAPISecretRef(hook.KeySecret); err != nil {
+			return fmt.Errorf("deploy hook %d: 'key_secret': %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkAPISecretRef rejects the secret references that read the daemon's
+// files or environment.
+func checkAPISecretRef(value string) error {
+	if backend, _, _ := strings.Cut(value, ":"); isSecretRef(value) && (backend == "file" || backend == "env") {
+		return fmt.Errorf("'%s:' secret references are only allowed in the config file", backend)
+	}
+	return nil
+}
+
+// saveDefinitions upserts definitions in a single transaction. With replace
+// set, stored definitions missing from defs are deleted.
+func saveDefinitions(db *sql.DB, defs map[string]CertConfig, replace bool) (created, updated, deleted []string, err error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	existing := map[string]bool{}
+	rows, err := tx.Query("SELECT name FROM cert_definitions")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, nil, nil, err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+
+	now := time.Now()
+	for name, def := range defs {
+		raw, err := json.Marshal(def)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		_, err = tx.Exec(`
+		INSERT INTO cert_definitions (name, definition, created_at, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			definition=excluded.definition,
+			updated_at=excluded.updated_at;`, name, string(raw), now, now)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to store definition '%s': %w", name, err)
+		}
+		if existing[name] {
+			updated = append(updated, name)
+		} else {
+			created = append(created, name)
+		}
+	}
+
+	if replace {
+		for name := range existing {
+			if _, keep := defs[name]; keep {
+				continue
+			}
+			if _, err := tx.Exec("DELETE FROM cert_definitions WHERE name = ?", name); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to delete definition '%s': %w", name, err)
+			}
+			deleted = append(deleted, name)
+		}
+	}
+
+	return created, updated, deleted, tx.Commit()
+}
+
+// errPreconditionFailed is returned when an If-Match or If-None-Match condition doesn't hold.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// definitionETag returns the strong ETag of a definition, derived from its
+// canonical JSON encoding so identical definitions always share an ETag.
+func definitionETag(def CertConfig) string {
+	raw, _ := json.Marshal(def)
+	sum := sha256.Sum256(raw)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// getDefinition returns a single API-managed definition.
+func getDefinition(db *sql.DB, name string) (storedDefinition, bool, error) {
+	var def storedDefinition
+	var raw string
+	err := db.QueryRow("SELECT name, definition, created_at, updated_at FROM cert_definitions WHERE name = ?", name).
+		Scan(&def.Name, &raw, &def.CreatedAt, &def.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return storedDefinition{}, false, nil
+	}
+	if err != nil {
+		return storedDefinition{}, false, fmt.Errorf("failed to query definition '%s': %w", name, err)
+	}
+	if err := json.Unmarshal([]byte(raw), &def.Definition); err != nil {
+		return storedDefinition{}, false, fmt.Errorf("invalid stored definition for '%s': %w", name, err)
+	}
+	return def, true, nil
+}
+
+// matchesPrecondition evaluates If-Match / If-None-Match against the current
+// ETag of a definition ("" if it doesn't exist).
+func matchesPrecondition(ifMatch, ifNoneMatch, current string) bool {
+	if ifMatch != "" {
+		if current == "" {
+			return false
+		}
+		if ifMatch != "*" && !etagListContains(ifMatch, current) {
+			return false
+		}
+	}
+	if ifNoneMatch != "" && current != "" {
+		if ifNoneMatch == "*" || etagListContains(ifNoneMatch, current) {
+			return false
+		}
+	}
+	return true
+}
+
+// etagListContains reports whether a comma-separated ETag header lists etag.
+func etagListContains(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// putDefinition creates or replaces a definition if the preconditions hold.
+// Storing an identical definition is a no-op, so repeated PUTs are idempotent.
+func putDefinition(db *sql.DB, name string, def CertConfig, ifMatch, ifNoneMatch string) (created bool, err error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	current := ""
+	var raw string
+	err = tx.QueryRow("SELECT definition FROM cert_definitions WHERE name = ?", name).Scan(&raw)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return false, err
+	default:
+		var existing CertConfig
+		if err := json.Unmarshal([]byte(raw), &existing); err != nil {
+			return false, err
+		}
+		current = definitionETag(existing)
+	}
+
+	if !matchesPrecondition(ifMatch, ifNoneMatch, current) {
+		return false, errPreconditionFailed
+	}
+	if current == definitionETag(def) {
+		return false, nil
+	}
+
+	newRaw, err := json.Marshal(def)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	_, err = tx.Exec(`
+	INSERT INTO cert_definitions (name, definition, created_at, updated_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(name) DO UPDATE SET
+		definition=excluded.definition,
+		updated_at=excluded.updated_at;`, name, string(newRaw), now, now)
+	if err != nil {
+		return false, fmt.Errorf("failed to store definition '%s': %w", name, err)
+	}
+	return current == "", tx.Commit()
+}
+
+// deleteDefinition removes a definition if it exists and the precondition holds.
+func deleteDefinition(db *sql.DB, name string, ifMatch string) (found bool, err error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var raw string
+	err = tx.QueryRow("SELECT definition FROM cert_definitions WHERE name = ?", name).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var existing CertConfig
+	if err := json.Unmarshal([]byte(raw), &existing); err != nil {
+		return false, err
+	}
+	if !matchesPrecondition(ifMatch, "", definitionETag(existing)) {
+		return true, errPreconditionFailed
+	}
+
+	if _, err := tx.Exec("DELETE FROM cert_definitions WHERE name = ?", name); err != nil {
+		return true, fmt.Errorf("failed to delete definition '%s': %w", name, err)
+	}
+	return true, tx.Commit()
+}
+
+// definitionResource is the representation of a definition in the /v1 API.
+type definitionResource struct {
+	Name       string     `json:"name"`
+	Source     string     `json:"source"`
+	ETag       string     `json:"etag"`
+	Definition CertConfig `json:"definition"`
+}
+
+// redactedValue replaces secrets in definitions returned by the API.
+const redactedValue = "REDACTED"
+
+// redactDefinition hides the secrets of a definition from the config file,
+// which may have been decrypted when it was loaded: credentials in 'env',
+// the PKCS#12 password, hook headers and secrets, and passwords in hook URLs.
+// The API only returns what it was given for its own definitions.
+func redactDefinition(config CertConfig) CertConfig {
+	redact := func(values map[string]string) map[string]string {
+		if values == nil {
+			return nil
+		}
+		redacted := make(map[string]string, len(values))
+		for key := range values {
+			redacted[key] = redactedValue
+		}
+		return redacted
+	}
+	config.Env = redact(config.Env)
+	if config.PKCS12Password != "" {
+		config.PKCS12Password = redactedValue
+	}
+	config.Deploy = slices.Clone(config.Deploy)
+	for i, hook := range config.Deploy {
+		hook.Headers = redact(hook.Headers)
+		hook.Secrets = redact(hook.Secrets)
+		if hook.KeySecret != "" {
+			hook.KeySecret = redactedValue
+		}
+		if u, err := url.Parse(hook.URL); err == nil && u.User != nil {
+			hook.URL = u.Redacted()
+		}
+		config.Deploy[i] = hook
+	}
+	return config
+}
+
+// The /v1/definitions endpoints form the stable contract for declarative
+// clients such as a Terraform/OpenTofu provider:
+//
+//   - GET    /v1/definitions        list all definitions (config file and API)
+//   - GET    /v1/definitions/{name} read one definition, with an ETag header
+//   - PUT    /v1/definitions/{name} create (201) or replace (200); idempotent,
+//     honours If-Match and If-None-Match: *
+//   - DELETE /v1/definitions/{name} delete (204), honours If-Match
+//
+// Definitions from the config file are read-only (409 on PUT/DELETE).
+// Failed preconditions return 412.
+
+// registerDefinitionRoutes adds the /v1/definitions endpoints to the mux.
+func (s *apiServer) registerDefinitionRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/definitions", s.handleListDefinitions)
+	mux.HandleFunc("GET /v1/definitions/{name}", s.handleGetDefinition)
+	mux.HandleFunc("PUT /v1/definitions/{name}", s.handlePutDefinition)
+	mux.HandleFunc("DELETE /v1/definitions/{name}", s.handleDeleteDefinition)
+}
+
+func (s *apiServer) handleListDefinitions(w http.ResponseWriter, r *http.Request) {
+	fileConfig, err := loadConfig(s.yamlFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	stored, err := listDefinitions(s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resources := []definitionResource{}
+	for name, def := range fileConfig.Certificates {
+		resources = append(resources, definitionResource{Name: name, Source: "config", ETag: definitionETag(def), Definition: redactDefinition(def)})
+	}
+	for _, def := range stored {
+		if _, exists := fileConfig.Certificates[def.Name]; exists {
+			continue
+		}
+		resources = append(resources, definitionResource{Name: def.Name, Source: "api", ETag: definitionETag(def.Definition), Definition: def.Definition})
+	}
+	sortDefinitionResources(resources)
+	writeJSON(w, http.StatusOK, resources)
+}
+
+func (s *apiServer) handleGetDefinition(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	fileConfig, err := loadConfig(s.yamlFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resource := definitionResource{Name: name}
+	if def, ok := fileConfig.Certificates[name]; ok {
+		resource.Source, resource.Definition = "config", def
+	} else {
+		stored, found, err := getDefinition(s.db, name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Errorf("definition '%s' not found", name))
+			return
+		}
+		resource.Source, resource.Definition = "api", stored.Definition
+	}
+	resource.ETag = definitionETag(resource.Definition)
+	if resource.Source == "config" {
+		resource.Definition = redactDefinition(resource.Definition)
+	}
+
+	w.Header().Set("ETag", resource.ETag)
+	if !matchesPrecondition("", r.Header.Get("If-None-Match"), resource.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, resource)
+}
+
+func (s *apiServer) handlePutDefinition(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	raw, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	fileConfig, err := loadConfig(s.yamlFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, exists := fileConfig.Certificates[name]; exists {
+		writeError(w, http.StatusConflict, fmt.Errorf("definition '%s' is managed in the config file and is read-only", name))
+		return
+	}
+	if err := validateDefinition(name, raw); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	var def CertConfig
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&def); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err := validateAPIDefinition(def); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if _, err := validateCertConfig(name, def, fileConfig.Configs); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	created, err := putDefinition(s.db, name, def, r.Header.Get("If-Match"), r.Header.Get("If-None-Match"))
+	if errors.Is(err, errPreconditionFailed) {
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("definition '%s' does not match the given precondition", name))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		log.Printf("Definition '%s' created via API", name)
+	}
+	resource := definitionResource{Name: name, Source: "api", ETag: definitionETag(def), Definition: def}
+	w.Header().Set("ETag", resource.ETag)
+	writeJSON(w, status, resource)
+}
+
+func (s *apiServer) handleDeleteDefinition(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	fileConfig, err := loadConfig(s.yamlFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, exists := fileConfig.Certificates[name]; exists {
+		writeError(w, http.StatusConflict, fmt.Errorf("definition '%s' is managed in the config file and is read-only", name))
+		return
+	}
+
+	found, err := deleteDefinition(s.db, name, r.Header.Get("If-Match"))
+	if errors.Is(err, errPreconditionFailed) {
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("definition '%s' does not match the given precondition", name))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("definition '%s' not found", name))
+		return
+	}
+	log.Printf("Definition '%s' deleted via API", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sortDefinitionResources orders resources by name.
+func sortDefinitionResources(resources []definitionResource) {
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Name < resources[j].Name })
+}
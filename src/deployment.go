@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long after the certificate files changed an endpoint may still serve
+// the previous certificate, so deploy hooks have time to take effect
+const staleDeploymentGrace = 15 * time.Minute
+
+var (
+	// staleDeploymentsMutex guards staleDeployments
+	staleDeploymentsMutex = &sync.Mutex{}
+	// staleDeployments holds the "name|endpoint" pairs currently found stale,
+	// so each one is only notified once
+	staleDeployments = map[string]bool{}
+)
+
+// checkDeployments compares the certificate served by each endpoint of a
+// certificate with the one on disk. An endpoint still serving an older
+// certificate after it was renewed usually means a deploy hook didn't reload
+// the service, and is reported as a 'stale_deployment'.
+func checkDeployments(name string, config CertConfig, db *sql.DB, certsBasePath string) {
+	if len(config.Endpoints) == 0 || config.Monitor != "" {
+		return
+	}
+	path := certFilesFor(certsBasePath, name).Cert
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	current, err := readCertificateFile(path)
+	if err != nil {
+		return
+	}
+
+	var chainIssues []string
+	defer func() {
+		message := ""
+		if len(chainIssues) > 0 {
+			message = "Served chain: " + strings.Join(chainIssues, "; ")
+		}
+		raiseWarning(db, name, config, warningServedChainExpiry, message)
+	}()
+
+	for _, endpoint := range config.Endpoints {
+		chain, err := fetchServedChain(endpoint)
+		if err != nil {
+			log.Printf("Warning: could not check the certificate deployed at %s for '%s': %v", endpoint, name, err)
+			continue
+		}
+		served := chain[0]
+		trackChain(name, endpoint, chain)
+		if issue := chainExpiryWarning(chain); issue != "" {
+			chainIssues = append(chainIssues, endpoint+": "+issue)
+		}
+		stale := !bytes.Equal(served.Raw, current.Raw) && served.NotAfter.Before(current.NotAfter) &&
+			time.Since(info.ModTime()) > devScaled(staleDeploymentGrace)
+
+		if stale {
+			metricStaleDeployment.Set(1, name, endpoint)
+		} else {
+			metricStaleDeployment.Set(0, name, endpoint)
+		}
+		if !setStaleDeployment(name, endpoint, stale) {
+			continue
+		}
+
+		if !stale {
+			log.Printf("Endpoint %s serves the current certificate of '%s' again.", endpoint, name)
+			continue
+		}
+		state := "an outdated certificate"
+		if time.Now().After(served.NotAfter) {
+			state = "an expired certificate"
+		}
+		message := fmt.Sprintf("Endpoint %s still serves %s for '%s' (expires %s) although it was renewed (expires %s); check its deploy hooks",
+			endpoint, state, name, served.NotAfter.Format("2006-01-02"), current.NotAfter.Format("2006-01-02"))
+		log.Printf("ERROR: %s", message)
+		sendNotification(db, NotificationEvent{Event: "stale_deployment", Cert: name, Message: message})
+	}
+}
+
+// verifyDeployment checks that a certificate is deployed: the last run of
+// each of its deploy hooks succeeded and each of its endpoints serves it.
+func verifyDeployment(db *sql.DB, name string, config CertConfig, current *x509.Certificate) error {
+	if len(config.Deploy) > 0 {
+		runs, err := listHookRuns(db, name)
+		if err != nil {
+			return err
+		}
+		for hook := 1; hook <= len(config.Deploy); hook++ {
+			i := slices.IndexFunc(runs, func(run hookRun) bool { return run.Hook == hook })
+			switch {
+			case i < 0:
+				return fmt.Errorf("deploy hook %d has never run", hook)
+			case !runs[i].Success:
+				return fmt.Errorf("deploy hook %d failed: %s", hook, runs[i].Error)
+			}
+		}
+	}
+	for _, endpoint := range config.Endpoints {
+		chain, err := fetchServedChain(endpoint)
+		if err != nil {
+			return fmt.Errorf("could not check endpoint %s: %w", endpoint, err)
+		}
+		if !bytes.Equal(chain[0].Raw, current.Raw) {
+			return fmt.Errorf("endpoint %s doesn't serve the certificate on disk (it serves one expiring %s)", endpoint, chain[0].NotAfter.Format("2006-01-02"))
+		}
+	}
+	return nil
+}
+
+// setStaleDeployment records whether an endpoint is stale and reports whether that changed.
+func setStaleDeployment(name, endpoint string, stale bool) bool {
+	staleDeploymentsMutex.Lock()
+	defer staleDeploymentsMutex.Unlock()
+
+	key := name + "|" + endpoint
+	if staleDeployments[key] == stale {
+		return false
+	}
+	if stale {
+		staleDeployments[key] = true
+	} else {
+		delete(staleDeployments, key)
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Factor of '--dev-fast' without a value
+const defaultDevFastFactor = 60
+
+// devFastFactor divides the check interval, retry backoffs and propagation
+// waits. The hidden '--dev-fast[=factor]' flag raises it so developers and
+// integration tests can run through renewals in seconds; 1 means normal
+// operation.
+var devFastFactor = 1.0
+
+// extractDevFast removes '--dev-fast' from the command line and sets
+// devFastFactor, so the flag works with every command without showing up
+// in their help.
+func extractDevFast(args []string) ([]string, error) {
+	var rest []string
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "dev-fast" {
+			rest = append(rest, arg)
+			continue
+		}
+		devFastFactor = defaultDevFastFactor
+		if hasValue {
+			factor, err := strconv.ParseFloat(value, 64)
+			if err != nil || factor < 1 {
+				return nil, fmt.Errorf("invalid --dev-fast factor '%s', expected a number of at least 1", value)
+			}
+			devFastFactor = factor
+		}
+	}
+	return rest, nil
+}
+
+// devScaled shortens a duration by devFastFactor.
+func devScaled(d time.Duration) time.Duration {
+	if devFastFactor <= 1 {
+		return d
+	}
+	return time.Duration(float64(d) / devFastFactor)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// Number of endpoints 'discover scan' connects to at the same time
+const discoverConcurrency = 8
+
+// acmeIssuers maps the organization of CAs that issue over ACME to the issuer
+// short name a managed entry would use.
+var acmeIssuers = map[string]string{
+	"Let's Encrypt":         "letsencrypt",
+	"ZeroSSL":               "zerossl",
+	"Google Trust Services": "google",
+	"Buypass AS":            "buypass",
+	"SSL Corporation":       "sslcom",
+}
+
+// discoveredEndpoint is the outcome of scanning one target.
+type discoveredEndpoint struct {
+	Target     string
+	Name       string
+	Cert       *x509.Certificate
+	Err        error
+	Suggestion string
+	// Issuer is the short name for a managed entry, if the CA speaks ACME
+	Issuer string
+}
+
+// readDiscoverTargets reads host[:port] targets, one per line. Blank lines
+// and '#' comments are ignored.
+func readDiscoverTargets(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var targets []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			targets = append(targets, line)
+		}
+	}
+	return targets, scanner.Err()
+}
+
+// normalizeEndpoint lowercases a host[:port] endpoint and adds the default
+// port, so the same endpoint written differently compares equal.
+func normalizeEndpoint(endpoint string) string {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host, port = endpoint, "443"
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+var nonNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// discoveredName derives an entry name from an endpoint, e.g.
+// 'lb-example-com' for 'lb.example.com:443' and 'lb-example-com-8443' for
+// port 8443.
+func discoveredName(endpoint string) string {
+	host, port, _ := net.SplitHostPort(normalizeEndpoint(endpoint))
+	name := strings.Trim(nonNameChars.ReplaceAllString(host, "-"), "-")
+	if port != "443" {
+		name += "-" + port
+	}
+	return name
+}
+
+// hostMatches reports whether a certificate name, possibly a wildcard such as
+// '*.example.com', covers a hostname. A wildcard covers exactly one label.
+func hostMatches(pattern, host string) bool {
+	pattern, host = strings.ToLower(strings.TrimSuffix(pattern, ".")), strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == host {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, found := strings.Cut(host, ".")
+	return found && label != "" && rest == suffix
+}
+
+// managedEntryCovering returns a managed entry whose domains cover all names
+// of a certificate.
+func managedEntryCovering(fullConfig FullConfig, names []string) (string, bool) {
+	for entry, config := range fullConfig.Certificates {
+		if config.Monitor != "" || len(names) == 0 {
+			continue
+		}
+		covered := true
+		for _, name := range names {
+			if !domainsCover(config.Domains, name) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// domainsCover reports whether any of the domains covers a hostname.
+func domainsCover(domains []string, host string) bool {
+	for _, domain := range domains {
+		if hostMatches(domain, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestManagement explains whether the certificate of an endpoint could be
+// issued by gocert instead of only being monitored.
+func suggestManagement(fullConfig FullConfig, d *discoveredEndpoint) {
+	cert := d.Cert
+	if entry, ok := managedEntryCovering(fullConfig, cert.DNSNames); ok {
+		d.Suggestion = fmt.Sprintf("covered by managed entry '%s', check that it is deployed here", entry)
+		return
+	}
+	if len(cert.DNSNames) == 0 {
+		d.Suggestion = "keep monitoring: no DNS names in the certificate"
+		return
+	}
+	if cert.Issuer.String() == cert.Subject.String() {
+		d.Suggestion = "keep monitoring: self-signed"
+		return
+	}
+	for _, org := range cert.Issuer.Organization {
+		if issuer, ok := acmeIssuers[org]; ok {
+			d.Issuer = issuer
+			d.Suggestion = fmt.Sprintf("convert: issued over ACME by %s", org)
+			return
+		}
+	}
+	d.Suggestion = fmt.Sprintf("keep monitoring: issued by %s, which gocert doesn't issue for", certIssuerName(cert))
+}
+
+// certIssuerName returns a readable name of the CA of a certificate.
+func certIssuerName(cert *x509.Certificate) string {
+	if len(cert.Issuer.Organization) > 0 {
+		return cert.Issuer.Organization[0]
+	}
+	return cert.Issuer.CommonName
+}
+
+// runDiscoverScan connects to every target, records the certificates found
+// as monitor-only entries (API-managed definitions, like 'POST /certs:batch')
+// and prints which of them could be managed by gocert. Targets already
+// monitored by an entry are reported but not recorded again.
+func runDiscoverScan(yamlFile, targetsFile string, db *sql.DB, dryRun bool) error {
+	fullConfig, err := loadEffectiveConfig(yamlFile, db)
+	if err != nil {
+		return err
+	}
+	targets, err := readDiscoverTargets(targetsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read targets: %w", err)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no targets in %s", targetsFile)
+	}
+
+	monitoredBy := map[string]string{}
+	for name, config := range fullConfig.Certificates {
+		if scheme, endpoint := splitMonitorSource(config.Monitor); config.Monitor != "" && scheme == "tls" {
+			monitoredBy[normalizeEndpoint(endpoint)] = name
+		}
+	}
+
+	results := make([]discoveredEndpoint, len(targets))
+	sem := make(chan struct{}, discoverConcurrency)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		results[i].Target = target
+		if _, ok := monitoredBy[normalizeEndpoint(target)]; ok {
+			continue
+		}
+		wg.Add(1)
+		go func(d *discoveredEndpoint) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			d.Cert, d.Err = fetchServedCertificate(d.Target)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	defs := map[string]CertConfig{}
+	for i := range results {
+		d := &results[i]
+		endpoint := normalizeEndpoint(d.Target)
+		if name, ok := monitoredBy[endpoint]; ok {
+			d.Name = name
+			d.Suggestion = "already monitored"
+			continue
+		}
+		if d.Err != nil {
+			d.Suggestion = fmt.Sprintf("unreachable, not recorded: %v", d.Err)
+			continue
+		}
+		d.Name = uniqueEntryName(discoveredName(d.Target), fullConfig, defs)
+		defs[d.Name] = CertConfig{Monitor: d.Target}
+		monitoredBy[endpoint] = d.Name
+		suggestManagement(fullConfig, d)
+	}
+
+	if !dryRun && len(defs) > 0 {
+		if _, _, _, err := saveDefinitions(db, defs, false); err != nil {
+			return fmt.Errorf("failed to record monitor-only entries: %w", err)
+		}
+	}
+	printDiscovery(results)
+
+	switch {
+	case len(defs) == 0:
+		fmt.Println("\nNo new endpoints to record.")
+	case dryRun:
+		fmt.Printf("\nDry run: %d new monitor-only entries were not recorded.\n", len(defs))
+	default:
+		fmt.Printf("\nRecorded %d new monitor-only entries; the daemon checks them from its next cycle.\n", len(defs))
+	}
+	printConversionHints(results)
+	return nil
+}
+
+// uniqueEntryName returns name, or name with a numeric suffix if an entry of
+// that name already exists.
+func uniqueEntryName(name string, fullConfig FullConfig, pending map[string]CertConfig) string {
+	candidate := name
+	for i := 2; ; i++ {
+		_, configured := fullConfig.Certificates[candidate]
+		_, recorded := pending[candidate]
+		if !configured && !recorded && candidate != "configs" {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// printDiscovery prints one row per scanned target.
+func printDiscovery(results []discoveredEndpoint) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tNAME\tDOMAINS\tISSUER\tEXPIRES\tSUGGESTION")
+	fmt.Fprintln(w, "------\t----\t-------\t------\t-------\t----------")
+	for _, d := range results {
+		name, domains, issuer, expires := d.Name, "N/A", "N/A", "N/A"
+		if name == "" {
+			name = "-"
+		}
+		if d.Cert != nil {
+			domains = strings.Join(d.Cert.DNSNames, ",")
+			issuer = certIssuerName(d.Cert)
+			expires = d.Cert.NotAfter.Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Target, name, domains, issuer, expires, d.Suggestion)
+	}
+	w.Flush()
+}
+
+// printConversionHints prints managed entries that could replace the
+// monitor-only entries of certificates issued over ACME.
+func printConversionHints(results []discoveredEndpoint) {
+	var hints []discoveredEndpoint
+	for _, d := range results {
+		if d.Issuer != "" {
+			hints = append(hints, d)
+		}
+	}
+	if len(hints) == 0 {
+		return
+	}
+	fmt.Println("\nThese could be issued by gocert: add an entry like the following to the config file and")
+	fmt.Println("remove the monitor-only one with 'gocert remove <name>'.")
+	for _, d := range hints {
+		fmt.Printf("\n%s:\n  domains: [\"%s\"]\n  issuer: %s\n  type: dns_cf  # your DNS provider\n",
+			d.Name, strings.Join(d.Cert.DNSNames, "\", \""), d.Issuer)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Public resolver queried to confirm that challenge records are visible
+	dnsPropagationResolver = "1.1.1.1:53"
+	// How long to wait for a challenge record to become visible
+	dnsPropagationTimeout = 5 * time.Minute
+	// Delay between propagation checks
+	dnsPropagationInterval = 10 * time.Second
+	// TTL of created challenge records, in seconds
+	defaultDNSTTL = 120
+	// Records requested per page when listing records of a zone
+	defaultDNSPageSize = 100
+)
+
+// DNSProviderConfig tunes a DNS provider of the native backend, for
+// registrars slower than the defaults expect.
+type DNSProviderConfig struct {
+	// TTL of the created TXT records in seconds (default: 120)
+	TTL int `yaml:"ttl"`
+	// How long to wait for the records to become visible (default: 5m)
+	PropagationTimeout string `yaml:"propagation_timeout"`
+	// How long to keep the records after validation before removing them
+	CleanupDelay string `yaml:"cleanup_delay"`
+	// Records requested per page of the provider API (default: 100)
+	PageSize int `yaml:"page_size"`
+	// Issuances using the provider at the same time, 0 for no limit; this
+	// and 'per_minute' also apply to acme.sh
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// Issuances started per minute, 0 for no limit
+	PerMinute int `yaml:"per_minute"`
+	// Credentials scoped to zones, chosen per domain by the longest
+	// matching zone; with either backend
+	Credentials []ZoneCredentials `yaml:"credentials"`
+}
+
+// dnsTuning is a DNSProviderConfig with defaults applied.
+type dnsTuning struct {
+	ttl                int
+	propagationTimeout time.Duration
+	cleanupDelay       time.Duration
+	pageSize           int
+}
+
+var (
+	// dnsSettingsMutex guards dnsSettings
+	dnsSettingsMutex = &sync.Mutex{}
+	// dnsSettings holds 'configs.dns', keyed by provider type
+	dnsSettings map[string]DNSProviderConfig
+)
+
+// configureDNS applies the DNS provider settings of the global configuration.
+func configureDNS(global GlobalConfig) {
+	dnsSettingsMutex.Lock()
+	defer dnsSettingsMutex.Unlock()
+	dnsSettings = global.DNS
+}
+
+// validateDNS checks the durations of the DNS provider settings.
+func validateDNS(providers map[string]DNSProviderConfig) error {
+	for typ, provider := range providers {
+		for field, value := range map[string]string{"propagation_timeout": provider.PropagationTimeout, "cleanup_delay": provider.CleanupDelay} {
+			if value == "" {
+				continue
+			}
+			if d, err := time.ParseDuration(value); err != nil || d < 0 {
+				return fmt.Errorf("invalid %s '%s' of DNS provider '%s'", field, value, typ)
+			}
+		}
+	}
+	return nil
+}
+
+// dnsTuningFor returns the settings of a DNS provider type.
+func dnsTuningFor(typ string) dnsTuning {
+	dnsSettingsMutex.Lock()
+	provider := dnsSettings[typ]
+	dnsSettingsMutex.Unlock()
+
+	tuning := dnsTuning{ttl: defaultDNSTTL, propagationTimeout: dnsPropagationTimeout, pageSize: defaultDNSPageSize}
+	if provider.TTL > 0 {
+		tuning.ttl = provider.TTL
+	}
+	if d, err := time.ParseDuration(provider.PropagationTimeout); err == nil && d > 0 {
+		tuning.propagationTimeout = d
+	}
+	if d, err := time.ParseDuration(provider.CleanupDelay); err == nil && d > 0 {
+		tuning.cleanupDelay = d
+	}
+	if provider.PageSize > 0 {
+		tuning.pageSize = provider.PageSize
+	}
+	return tuning
+}
+
+// dnsSolver creates and removes the TXT records of DNS-01 challenges for the native backend.
+type dnsSolver interface {
+	Present(fqdn, value string) error
+	CleanUp(fqdn, value string) error
+}
+
+// dnsSolvers holds the DNS providers supported by the native backend, keyed by
+// the acme.sh provider name used in the 'type' field.
+var dnsSolvers = map[string]func(tuning dnsTuning, getenv func(string) string) (dnsSolver, error){
+	"dns_cf": newCloudflareSolver,
+}
+
+// newDNSSolver returns the native solver for an acme.sh DNS provider type,
+// reading its credentials with getenv.
+func newDNSSolver(typ string, getenv func(string) string) (dnsSolver, error) {
+	factory, ok := dnsSolvers[typ]
+	if !ok {
+		return nil, fmt.Errorf("DNS provider '%s' is not supported by the native backend; use backend 'acmesh' instead", typ)
+	}
+	return factory(dnsTuningFor(typ), getenv)
+}
+
+// waitForTXT polls a public resolver until the TXT record holds the expected
+// value or the timeout passes.
+func waitForTXT(ctx context.Context, fqdn, value string, timeout time.Duration) error {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, dnsPropagationResolver)
+		},
+	}
+
+	timeout = devScaled(timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		records, _ := resolver.LookupTXT(ctx, fqdn)
+		for _, r := range records {
+			if r == value {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT record %s did not propagate within %s", fqdn, timeout)
+		case <-time.After(devScaled(dnsPropagationInterval)):
+		}
+	}
+}
+
+// cloudflareSolver manages challenge records through the Cloudflare API. It
+// reads the same variables as acme.sh's dns_cf: CF_Token (and optionally
+// CF_Zone_ID), or the legacy CF_Key and CF_Email pair.
+type cloudflareSolver struct {
+	token  string
+	key    string
+	email  string
+	zoneID string
+	tuning dnsTuning
+
+	mu      sync.Mutex
+	records map[string]cloudflareRecord
+}
+
+// cloudflareRecord remembers a created record so it can be deleted again.
+type cloudflareRecord struct {
+	zoneID string
+	id     string
+}
+
+// cloudflareResponse is the common envelope of Cloudflare API responses.
+type cloudflareResponse struct {
+	Success    bool                       `json:"success"`
+	Errors     []struct{ Message string } `json:"errors"`
+	Result     json.RawMessage            `json:"result"`
+	ResultInfo struct {
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+func newCloudflareSolver(tuning dnsTuning, getenv func(string) string) (dnsSolver, error) {
+	s := &cloudflareSolver{
+		tuning:  tuning,
+		token:   getenv("CF_Token"),
+		key:     getenv("CF_Key"),
+		email:   getenv("CF_Email"),
+		zoneID:  getenv("CF_Zone_ID"),
+		records: map[string]cloudflareRecord{},
+	}
+	if s.token == "" && (s.key == "" || s.email == "") {
+		return nil, fmt.Errorf("dns_cf requires CF_Token or CF_Key and CF_Email")
+	}
+	return s, nil
+}
+
+// call performs a Cloudflare API request and decodes the result into out.
+func (s *cloudflareSolver) call(method, path string, body interface{}, out interface{}) error {
+	envelope, err := s.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		return json.Unmarshal(envelope.Result, out)
+	}
+	return nil
+}
+
+// do performs a Cloudflare API request and returns the response envelope.
+func (s *cloudflareSolver) do(method, path string, body interface{}) (cloudflareResponse, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return cloudflareResponse{}, err
+		}
+	}
+
+	req, err := http.NewRequest(method, "https://api.cloudflare.com/client/v4"+path, &reqBody)
+	if err != nil {
+		return cloudflareResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	} else {
+		req.Header.Set("X-Auth-Email", s.email)
+		req.Header.Set("X-Auth-Key", s.key)
+	}
+
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return cloudflareResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var envelope cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return cloudflareResponse{}, fmt.Errorf("unexpected response from Cloudflare (HTTP %d): %w", resp.StatusCode, err)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return cloudflareResponse{}, fmt.Errorf("Cloudflare API error (HTTP %d): %s", resp.StatusCode, strings.Join(messages, "; "))
+	}
+	return envelope, nil
+}
+
+// findRecord looks up the ID of a TXT record by name and content, paging
+// through the records of the zone.
+func (s *cloudflareSolver) findRecord(zoneID, fqdn, value string) (string, error) {
+	query := url.Values{"type": {"TXT"}, "name": {strings.TrimSuffix(fqdn, ".")}, "per_page": {strconv.Itoa(s.tuning.pageSize)}}
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		envelope, err := s.do(http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		var records []struct {
+			ID      string `json:"id"`
+			Content string `json:"content"`
+		}
+		if err := json.Unmarshal(envelope.Result, &records); err != nil {
+			return "", err
+		}
+		for _, r := range records {
+			if strings.Trim(r.Content, `"`) == value {
+				return r.ID, nil
+			}
+		}
+		if page >= envelope.ResultInfo.TotalPages {
+			return "", nil
+		}
+	}
+}
+
+// findZone returns the ID of the closest zone containing fqdn.
+func (s *cloudflareSolver) findZone(fqdn string) (string, error) {
+	if s.zoneID != "" {
+		return s.zoneID, nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		candidate := strings.Join(labels[i:], ".")
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := s.call(http.MethodGet, "/zones?name="+candidate, nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no Cloudflare zone found for %s", fqdn)
+}
+
+func (s *cloudflareSolver) Present(fqdn, value string) error {
+	zoneID, err := s.findZone(fqdn)
+	if err != nil {
+		return err
+	}
+
+	var record struct {
+		ID string `json:"id"`
+	}
+	body := map[string]interface{}{"type": "TXT", "name": fqdn, "content": value, "ttl": s.tuning.ttl}
+	if err := s.call(http.MethodPost, "/zones/"+zoneID+"/dns_records", body, &record); err != nil {
+		// A retried order gets the same challenge, whose record an
+		// interrupted run may have left behind; take it over
+		id, findErr := s.findRecord(zoneID, fqdn, value)
+		if findErr != nil || id == "" {
+			return err
+		}
+		record.ID = id
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[fqdn+"|"+value] = cloudflareRecord{zoneID: zoneID, id: record.ID}
+	return nil
+}
+
+func (s *cloudflareSolver) CleanUp(fqdn, value string) error {
+	s.mu.Lock()
+	record, ok := s.records[fqdn+"|"+value]
+	delete(s.records, fqdn+"|"+value)
+	s.mu.Unlock()
+
+	if !ok {
+		log.Printf("Warning: no record to clean up for %s", fqdn)
+		return nil
+	}
+	return s.call(http.MethodDelete, "/zones/"+record.zoneID+"/dns_records/"+record.id, nil, nil)
+}
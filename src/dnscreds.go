@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// credentialsWarned holds the certificates already reported as relying on
+// credentials saved by acme.sh, so the daemon doesn't repeat it every check.
+var credentialsWarned sync.Map
+
+// validateDNSCredentials checks the credentials of a certificate's DNS
+// provider, for the providers in dnsCredentialVars: variable names in 'env'
+// or 'env_file' that only differ in case, a set these or scoped credentials
+// only partly provide, and for the native backend, which reads them from
+// these, scoped credentials or the daemon's environment only, missing ones. acme.sh may still have credentials saved from earlier runs, so for it
+// missing credentials are only logged. acme.sh can only use one set of
+// scoped credentials for all domains of a certificate.
+func validateDNSCredentials(name string, config CertConfig, global GlobalConfig) error {
+	if config.Monitor != "" || config.Type == challengeHTTP {
+		return nil
+	}
+	backend := config.Backend
+	if backend == "" {
+		backend = global.Backend
+	}
+	native := backend == backendNative
+
+	credentials := global.DNS[config.Type].Credentials
+	if !native {
+		if _, err := certZoneCredentials(config, credentials); err != nil {
+			return err
+		}
+	}
+	sets, known := dnsCredentialVars[config.Type]
+	if !known {
+		return nil
+	}
+
+	for key := range config.Env {
+		if v, ok := credentialCaseMismatch(config.Type, key); ok {
+			return fmt.Errorf("'env.%s' isn't a credential of %s, did you mean %s? Variable names are case-sensitive", key, config.Type, v)
+		}
+	}
+	certEnv := maps.Clone(config.Env)
+	if config.EnvFile != "" {
+		fileEnv, err := readEnvFile(config.EnvFile)
+		if err != nil {
+			return fmt.Errorf("'env_file': %w", err)
+		}
+		for key, value := range fileEnv {
+			if v, ok := credentialCaseMismatch(config.Type, key); ok {
+				return fmt.Errorf("'%s' in %s isn't a credential of %s, did you mean %s? Variable names are case-sensitive", key, config.EnvFile, config.Type, v)
+			}
+			if _, ok := certEnv[key]; !ok {
+				if certEnv == nil {
+					certEnv = map[string]string{}
+				}
+				certEnv[key] = value
+			}
+		}
+	}
+
+	groups := credentialGroups(credentials, config.Domains)
+	for _, i := range slices.Sorted(maps.Keys(groups)) {
+		var scoped map[string]string
+		where := ""
+		if i >= 0 {
+			scoped = credentials[i].Env
+			where = fmt.Sprintf(" for %s", strings.Join(credentials[i].Zones, ", "))
+		}
+		if err := checkCredentialSets(name, config.Type, certEnv, sets, scoped, native, where); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credentialCaseMismatch returns the credential variable of a DNS provider
+// that a variable name only differs from in case.
+func credentialCaseMismatch(typ, key string) (string, bool) {
+	for _, set := range dnsCredentialVars[typ] {
+		for _, v := range set {
+			if key != v && strings.EqualFold(key, v) {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkCredentialSets checks that one of the credential sets of a provider is
+// complete for a group of a certificate's domains, from the scoped
+// credentials of their zone if any, or else the daemon's environment, where
+// <key>_FILE may name a file holding a variable. The certificate's 'env' and
+// 'env_file' variables, certEnv, come first.
+func checkCredentialSets(name, typ string, certEnv map[string]string, sets [][]string, scoped map[string]string, native bool, where string) error {
+	explicit := func(v string) bool {
+		return certEnv[v] != "" || scoped[v] != ""
+	}
+	available := func(v string) bool {
+		if explicit(v) {
+			return true
+		}
+		return scoped == nil && credentialGetenv(v) != ""
+	}
+	var partial []string
+	for _, set := range sets {
+		var have, missing []string
+		for _, v := range set {
+			if available(v) {
+				have = append(have, v)
+			} else {
+				missing = append(missing, v)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		// acme.sh may have saved the rest of a set only partly in the
+		// daemon's environment, but not of one set explicitly.
+		if len(have) > 0 && (native || slices.ContainsFunc(have, explicit)) {
+			partial = append(partial, fmt.Sprintf("%s is set but %s is missing", strings.Join(have, ", "), strings.Join(missing, ", ")))
+		}
+	}
+
+	var options []string
+	for _, set := range sets {
+		options = append(options, strings.Join(set, " and "))
+	}
+	needs := fmt.Sprintf("%s needs %s", typ, strings.Join(options, ", or "))
+	switch {
+	case len(partial) > 0:
+		return fmt.Errorf("incomplete DNS credentials%s: %s; %s", where, strings.Join(partial, "; "), needs)
+	case scoped != nil:
+		return fmt.Errorf("no DNS credentials in the credentials%s; %s", where, needs)
+	case native:
+		return fmt.Errorf("no DNS credentials in 'env' or the daemon's environment; %s", needs)
+	}
+	if _, warned := credentialsWarned.LoadOrStore(name, true); !warned {
+		slog.Warn("No DNS credentials in 'env' or the environment, relying on credentials saved by acme.sh", "cert", name, "provider", typ, "expected", strings.Join(options, " or "))
+	}
+	return nil
+}
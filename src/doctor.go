@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Timeout of the request to each issuer's ACME directory in 'doctor'
+const doctorIssuerTimeout = 15 * time.Second
+
+// runDoctor checks the environment the daemon runs in and prints a pass/fail
+// report: the configuration, acme.sh, the database, the certificates path,
+// the connectivity to the configured issuers and the DNS credentials. Unlike
+// bootstrap, it doesn't change anything. It returns false if a check failed.
+func runDoctor(yamlFile, dbPath, certsBasePath string) bool {
+	report := &bootstrapReport{}
+	defer report.print()
+
+	fullConfig, err := loadConfig(yamlFile)
+	if err != nil {
+		report.add("config", "failed", err.Error())
+	} else {
+		report.add("config", "ok", fmt.Sprintf("%s (%d certificates)", yamlFile, len(fullConfig.Certificates)))
+		configureIssuers(fullConfig.Configs)
+	}
+
+	switch {
+	case err == nil && !usesBackend(fullConfig, backendAcmeSh):
+		report.add("acme.sh", "ok", "not used by any certificate")
+	default:
+		result, detail := checkAcmeSh()
+		if result == "failed" && err != nil {
+			// Without a configuration it isn't known whether acme.sh is needed.
+			result = "warning"
+		}
+		report.add("acme.sh", result, detail)
+	}
+
+	result, detail := checkDatabaseWritable(dbPath)
+	report.add("database", result, detail)
+	result, detail = checkCertsPath(certsBasePath)
+	report.add("certs path", result, detail)
+	if err != nil {
+		return report.ready()
+	}
+
+	names := make([]string, 0, len(fullConfig.Certificates))
+	for name, config := range fullConfig.Certificates {
+		if config.Monitor == "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := certFilesFor(certsBasePath, name).Dir
+		if _, err := os.Stat(dir); err == nil {
+			if err := checkWritable(dir); err != nil {
+				report.add("certs "+name, "failed", err.Error())
+			}
+		}
+	}
+
+	// Connectivity, once per issuer
+	var issuerNames []string
+	for _, name := range names {
+		if issuer := fullConfig.Certificates[name].Issuer; !slices.Contains(issuerNames, issuer) {
+			issuerNames = append(issuerNames, issuer)
+		}
+	}
+	sort.Strings(issuerNames)
+	for _, issuer := range issuerNames {
+		result, detail := checkIssuerReachable(issuer)
+		report.add("issuer "+issuer, result, detail)
+	}
+
+	// Credentials, once per backend and DNS provider
+	checked := map[string]bool{}
+	for _, name := range names {
+		config := fullConfig.Certificates[name]
+		backend := backendFor(config)
+		key := backend + " " + config.Type
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+		result, detail := checkDNSCredentials(backend, config.Type)
+		report.add(fmt.Sprintf("credentials %s (%s)", config.Type, backend), result, detail)
+	}
+	return report.ready()
+}
+
+// checkAcmeSh checks that acme.sh is installed, executable and reports its
+// version.
+func checkAcmeSh() (string, string) {
+	info, err := os.Stat(acmeShPath)
+	if err != nil {
+		return "failed", err.Error()
+	}
+	if info.Mode()&0111 == 0 {
+		return "failed", acmeShPath + " is not executable"
+	}
+	v, err := detectAcmeShVersion()
+	if err != nil {
+		return "failed", err.Error()
+	}
+	return "ok", fmt.Sprintf("%s, version %s", acmeShPath, v)
+}
+
+// checkDatabaseWritable checks the integrity of the database and that it can
+// be written, with a write that is rolled back. A missing database only
+// needs a writable directory.
+func checkDatabaseWritable(dbPath string) (string, string) {
+	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
+		if err := checkWritable(existingParent(dbPath)); err != nil {
+			return "failed", fmt.Sprintf("%s doesn't exist and can't be created: %v", dbPath, err)
+		}
+		return "warning", dbPath + " doesn't exist yet, it is created on the first run"
+	}
+
+	problems, err := integrityProblems(dbPath)
+	if err != nil {
+		return "failed", err.Error()
+	}
+	if len(problems) > 0 {
+		return "failed", "damaged: " + strings.Join(problems, "; ")
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return "failed", err.Error()
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return "failed", err.Error()
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`CREATE TABLE gocert_doctor (id INTEGER)`); err != nil {
+		return "failed", "not writable: " + err.Error()
+	}
+	return "ok", dbPath + " is intact and writable"
+}
+
+// checkCertsPath checks that the certificates directory exists and is
+// writable.
+func checkCertsPath(certsBasePath string) (string, string) {
+	info, err := os.Stat(certsBasePath)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := checkWritable(existingParent(certsBasePath)); err != nil {
+			return "failed", fmt.Sprintf("%s doesn't exist and can't be created: %v", certsBasePath, err)
+		}
+		return "warning", certsBasePath + " doesn't exist yet, it is created on the first issuance"
+	}
+	if err != nil {
+		return "failed", err.Error()
+	}
+	if !info.IsDir() {
+		return "failed", certsBasePath + " is not a directory"
+	}
+	if err := checkWritable(certsBasePath); err != nil {
+		return "failed", err.Error()
+	}
+	return "ok", fmt.Sprintf("%s is writable (mode %s)", certsBasePath, info.Mode().Perm())
+}
+
+// checkWritable creates and removes a file in dir, which also catches
+// read-only mounts.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".gocert-doctor-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkIssuerReachable fetches the ACME directory of an issuer.
+func checkIssuerReachable(issuer string) (string, string) {
+	dirURL, err := directoryURL(issuer)
+	if err != nil {
+		return "failed", err.Error()
+	}
+	client := &http.Client{Transport: acmeTransport, Timeout: doctorIssuerTimeout}
+	started := time.Now()
+	resp, err := client.Get(dirURL)
+	if err != nil {
+		return "failed", err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "failed", fmt.Sprintf("%s returned %s", dirURL, resp.Status)
+	}
+	var directory struct {
+		NewNonce string `json:"newNonce"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&directory); err != nil || directory.NewNonce == "" {
+		return "failed", dirURL + " is not an ACME directory"
+	}
+	return "ok", fmt.Sprintf("%s (%s)", dirURL, time.Since(started).Round(time.Millisecond))
+}
+
+// existingParent returns the closest existing directory above path, where
+// the missing directories of the path would be created.
+func existingParent(path string) string {
+	dir := filepath.Dir(path)
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runExplain prints the inputs of the renewal decision for a certificate, what
+// the last check decided and what a check would decide now, the answer to
+// "why didn't this renew?".
+func runExplain(yamlFile, name string, db *sql.DB, certsBasePath string) error {
+	fullConfig, err := loadEffectiveConfig(yamlFile, db)
+	if err != nil {
+		return err
+	}
+	configureIssuers(fullConfig.Configs)
+
+	config, configured := fullConfig.Certificates[name]
+	state, found, err := getCertState(db, name)
+	if err != nil {
+		return err
+	}
+	if !configured && !found {
+		return fmt.Errorf("certificate '%s' is neither configured in %s nor known to the database", name, yamlFile)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+	switch {
+	case !configured:
+		fmt.Fprintf(w, "Certificate '%s' is not configured in %s.\n", name, yamlFile)
+	case config.Monitor != "":
+		fmt.Fprintf(w, "Certificate '%s' is monitor-only, checked at %s.\n", name, config.Monitor)
+	case config.Account != "":
+		fmt.Fprintf(w, "Certificate '%s' (%s backend, %s, issuer %s, account %s)\n", name, backendFor(config), config.Type, config.Issuer, config.Account)
+	default:
+		fmt.Fprintf(w, "Certificate '%s' (%s backend, %s, issuer %s)\n", name, backendFor(config), config.Type, config.Issuer)
+	}
+
+	fmt.Fprintln(w, "\nDatabase:")
+	if !found {
+		fmt.Fprintln(w, "  State:\tnone, never issued by gocert")
+	} else {
+		fmt.Fprintf(w, "  Status:\t%s\n", state.Status)
+		fmt.Fprintf(w, "  Domains:\t%s\n", orNone(state.Domains))
+		fmt.Fprintf(w, "  Key type:\t%s\n", orNone(state.KeyType))
+		fmt.Fprintf(w, "  Issuer:\t%s\n", orNone(state.Issuer))
+		fmt.Fprintf(w, "  Last issued:\t%s\n", formatExplainTime(state.LastIssued))
+		fmt.Fprintf(w, "  NotAfter:\t%s\n", formatExplainTime(state.NotAfter))
+		if state.SharedWith != "" {
+			fmt.Fprintf(w, "  Shared with:\t%s\n", state.SharedWith)
+		}
+	}
+	if !configured || config.Monitor != "" {
+		return nil
+	}
+
+	fmt.Fprintln(w, "\nFiles:")
+	for _, files := range allCertFiles(certsBasePath, name, config) {
+		for _, path := range []string{files.Cert, files.Key, files.Fullchain} {
+			fmt.Fprintf(w, "  %s:\t%s\n", path, fileState(path))
+		}
+	}
+	if cert, err := readCertificateFile(certFilesFor(certsBasePath, name).Cert); err != nil {
+		fmt.Fprintf(w, "  Certificate:\tunreadable: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "  Certificate:\t%s, %s, issued by %s\n", strings.Join(cert.DNSNames, ", "), certKeyType(cert), certIssuerName(cert))
+		fmt.Fprintf(w, "  NotAfter:\t%s (%s)\n", formatExplainTime(cert.NotAfter), formatRemaining(time.Until(cert.NotAfter)))
+	}
+
+	fmt.Fprintln(w, "\nRenewal:")
+	refreshed := state
+	if found {
+		refreshed = certStateFromFiles(name, config, state, certsBasePath)
+	}
+	renewBefore := renewBeforeDays(config)
+	if found && !refreshed.NotAfter.IsZero() {
+		dueFrom := refreshed.NotAfter.AddDate(0, 0, -renewBefore)
+		fmt.Fprintf(w, "  Threshold:\t%d days before expiry, due from %s\n", renewBefore, formatExplainTime(dueFrom))
+		// The same arithmetic as renewalDue
+		remainingDays := int(time.Until(refreshed.NotAfter).Hours() / 24)
+		verdict := "not due"
+		if remainingDays <= renewBefore {
+			verdict = "due"
+		}
+		fmt.Fprintf(w, "  Remaining:\t%d whole days; due at %d or fewer, so %s\n", remainingDays, renewBefore, verdict)
+	} else {
+		fmt.Fprintf(w, "  Threshold:\t%d days before expiry\n", renewBefore)
+	}
+	fmt.Fprintln(w, "  Renewal info:\tnot fetched, gocert doesn't use ACME Renewal Information (ARI); the threshold decides")
+	fmt.Fprintf(w, "  Domains:\t%s\n", domainChanges(state.Domains, config.Domains, found))
+	if keyType := configuredKeyType(config); !found {
+		fmt.Fprintf(w, "  Key type:\tnot issued yet, %s\n", keyTypeFor(config))
+	} else if keyType == "" {
+		fmt.Fprintf(w, "  Key type:\tnot configured, issued as %s\n", orNone(refreshed.KeyType))
+	} else if keyType != refreshed.KeyType {
+		fmt.Fprintf(w, "  Key type:\t%s -> %s\n", orNone(refreshed.KeyType), keyType)
+	} else {
+		fmt.Fprintf(w, "  Key type:\tunchanged (%s)\n", keyType)
+	}
+	renewal, freeze := windowsFor(config)
+	if len(renewal) == 0 && len(freeze) == 0 {
+		fmt.Fprintln(w, "  Windows:\tnone")
+	} else if reason, until, deferred := renewalDeferral(config, time.Now()); deferred {
+		fmt.Fprintf(w, "  Windows:\t%d renewal, %d freeze; renewals wait now (%s) until %s\n", len(renewal), len(freeze), reason, formatExplainTime(until))
+	} else {
+		fmt.Fprintf(w, "  Windows:\t%d renewal, %d freeze; renewals may run now\n", len(renewal), len(freeze))
+	}
+	if found && isStagingIssuer(state.Issuer) && !isStagingIssuer(config.Issuer) {
+		fmt.Fprintf(w, "  Issuer:\t%s -> %s, triggers a renewal since the certificate is from a staging CA\n", state.Issuer, config.Issuer)
+	} else if found && state.Issuer != "" && state.Issuer != config.Issuer {
+		fmt.Fprintf(w, "  Issuer:\t%s -> %s, used from the next renewal on, doesn't trigger one\n", state.Issuer, config.Issuer)
+	} else {
+		fmt.Fprintf(w, "  Issuer:\tunchanged (%s)\n", config.Issuer)
+	}
+	timeout := acmeShTimeout(config)
+	if backendFor(config) == backendNative {
+		timeout = nativeTimeout(config)
+	}
+	fmt.Fprintf(w, "  Timeout:\t%s per issuance\n", timeout)
+
+	fmt.Fprintln(w, "\nFailures:")
+	failures, lastError, err := issueFailures(db, name)
+	if err != nil {
+		return err
+	}
+	if failures == 0 {
+		fmt.Fprintln(w, "  Backoff:\tnone, the last issuance didn't fail")
+	} else {
+		nextRetry, err := nextIssueRetry(db, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  Backoff:\t%d failures in a row, next retry %s\n", failures, formatExplainTime(nextRetry))
+		fmt.Fprintf(w, "  Last error:\t%s\n", lastError)
+	}
+	if limit := maxAttemptsFor(config); limit > 0 {
+		fmt.Fprintf(w, "  Max attempts:\t%d, then it needs intervention\n", limit)
+	} else {
+		fmt.Fprintln(w, "  Max attempts:\tunlimited")
+	}
+	quarantine, quarantined, err := getQuarantine(db, name)
+	if err != nil {
+		return err
+	}
+	if quarantined {
+		fmt.Fprintf(w, "  Quarantine:\tsince %s after %d flaps, next retry %s\n", formatExplainTime(quarantine.Since), quarantine.Flaps, formatExplainTime(quarantine.NextRetry))
+	} else {
+		fmt.Fprintln(w, "  Quarantine:\tnot quarantined")
+	}
+
+	fmt.Fprintln(w, "\nRate limits:")
+	if limit := fullConfig.Configs.RateLimit; limit.RPS > 0 {
+		fmt.Fprintf(w, "  CA:\t%g requests/s, burst %d, shared by all certificates of %s\n", limit.RPS, limit.Burst, config.Issuer)
+	} else {
+		fmt.Fprintln(w, "  CA:\tnone")
+	}
+	if provider := fullConfig.Configs.DNS[config.Type]; provider.MaxConcurrent > 0 || provider.PerMinute > 0 {
+		fmt.Fprintf(w, "  %s:\t%s concurrent, %s per minute\n", config.Type, limitOrNone(provider.MaxConcurrent), limitOrNone(provider.PerMinute))
+	} else {
+		fmt.Fprintf(w, "  %s:\tnone\n", config.Type)
+	}
+
+	fmt.Fprintln(w, "\nLast check:")
+	decision, checked, err := lastDecision(db, name)
+	if err != nil {
+		return err
+	}
+	if !checked {
+		fmt.Fprintln(w, "  Decision:\tnone recorded, not checked by the daemon yet")
+	} else {
+		fmt.Fprintf(w, "  Checked:\t%s\n", formatExplainTime(decision.CheckedAt))
+		fmt.Fprintf(w, "  %s:\t%s\n", decision.Action, decision.Reason)
+	}
+
+	fmt.Fprintln(w, "\nDecision now:")
+	if primary, ok := sharedCertGroups(fullConfig)[name]; ok {
+		fmt.Fprintf(w, "  shared:\tGets the certificate of '%s'.\n", primary)
+		return nil
+	}
+	entry, err := planCertificate(name, config, db, certsBasePath, map[string]crypto.Signer{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "  %s:\t%s\n", entry.Action, entry.Reason)
+	return nil
+}
+
+// domainChanges describes how the configured domains differ from those of
+// the issued certificate.
+func domainChanges(recorded string, configured []string, found bool) string {
+	if !found {
+		return "not issued yet"
+	}
+	if recorded == strings.Join(configured, ",") {
+		return "unchanged"
+	}
+	var before []string
+	if recorded != "" {
+		before = strings.Split(recorded, ",")
+	}
+	var changes []string
+	for _, domain := range configured {
+		if !slices.Contains(before, domain) {
+			changes = append(changes, "+"+domain)
+		}
+	}
+	for _, domain := range before {
+		if !slices.Contains(configured, domain) {
+			changes = append(changes, "-"+domain)
+		}
+	}
+	if len(changes) == 0 {
+		return "reordered, " + recorded + " -> " + strings.Join(configured, ",")
+	}
+	return strings.Join(changes, " ")
+}
+
+// fileState describes whether a certificate file is there.
+func fileState(path string) string {
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return "missing"
+	case err != nil:
+		return "unreadable: " + err.Error()
+	case info.Size() == 0:
+		return "empty"
+	}
+	return fmt.Sprintf("present, %d bytes, modified %s", info.Size(), formatExplainTime(info.ModTime()))
+}
+
+// formatExplainTime formats a time of 'explain', "none" if it is zero.
+func formatExplainTime(t time.Time) string {
+	if t.IsZero() {
+		return "none"
+	}
+	return t.Local().Format("2006-01-02 15:04:05 MST")
+}
+
+// limitOrNone formats a limit, "no limit" if it is 0.
+func limitOrNone(n int) string {
+	if n <= 0 {
+		return "no limit"
+	}
+	return fmt.Sprint(n)
+}
+
+// orNone returns s, or "none" if it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Environment variable holding the PKCS#12 password of entries without
+// 'pkcs12_password'
+const pkcs12PasswordEnv = "GOCERT_PKCS12_PASSWORD"
+
+// exportEncoders holds the supported 'exports' formats. 'pkcs12' uses
+// AES-256 and SHA-256; 'pkcs12-legacy' uses RC2 and 3DES for clients such as
+// Windows Server 2016 and older Java releases.
+var exportEncoders = map[string]*pkcs12.Encoder{
+	"pkcs12":        pkcs12.Modern2023,
+	"pkcs12-legacy": pkcs12.LegacyRC2,
+}
+
+// pkcs12Password returns the password protecting the '.pfx' bundles of a
+// certificate.
+func pkcs12Password(config CertConfig) string {
+	if config.PKCS12Password != "" {
+		return config.PKCS12Password
+	}
+	return os.Getenv(pkcs12PasswordEnv)
+}
+
+// validateExports checks the export formats of a certificate and that a
+// PKCS#12 password is available.
+func validateExports(config CertConfig) error {
+	if len(config.Exports) > 1 {
+		return fmt.Errorf("'exports' may contain only one PKCS#12 format")
+	}
+	for _, format := range config.Exports {
+		if _, ok := exportEncoders[format]; !ok {
+			return fmt.Errorf("unknown export format '%s'", format)
+		}
+		if pkcs12Password(config) == "" {
+			return fmt.Errorf("'exports: [%s]' requires 'pkcs12_password' or %s", format, pkcs12PasswordEnv)
+		}
+	}
+	return nil
+}
+
+// pfxPath returns where the PKCS#12 bundle of a certificate file is written,
+// e.g. 'cert.pfx' next to 'cert.pem'.
+func pfxPath(certFile string) string {
+	return strings.TrimSuffix(certFile, ".pem") + ".pfx"
+}
+
+// writeExports writes the configured export formats of a certificate next to
+// its PEM files. A bundle is only rewritten if it is missing or older than
+// the certificate, so this is cheap to call on every check.
+func writeExports(name string, config CertConfig, certsBasePath string) {
+	for _, format := range config.Exports {
+		encoder, ok := exportEncoders[format]
+		if !ok {
+			continue
+		}
+		for _, files := range allCertFiles(certsBasePath, name, config) {
+			path := pfxPath(files.Cert)
+			if exportCurrent(path, files.Fullchain) {
+				continue
+			}
+			if err := writePKCS12(path, files, encoder, pkcs12Password(config)); err != nil {
+				log.Printf("ERROR: Failed to write %s of '%s': %v", filepath.Base(path), name, err)
+				continue
+			}
+			log.Printf("Wrote %s for '%s'.", filepath.Base(path), name)
+		}
+	}
+}
+
+// exportCurrent reports whether an exported file exists and is at least as
+// new as the certificate it was made from.
+func exportCurrent(path, source string) bool {
+	exported, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(source)
+	return err == nil && !exported.ModTime().Before(info.ModTime())
+}
+
+// writePKCS12 bundles the key, the certificate and its chain into a
+// password-protected PKCS#12 file.
+func writePKCS12(path string, files certFiles, encoder *pkcs12.Encoder, password string) error {
+	chain, err := readCertificateChain(files.Fullchain)
+	if err != nil {
+		return err
+	}
+	key, err := readPrivateKeyFile(files.Key)
+	if err != nil {
+		return err
+	}
+	pfx, err := encoder.Encode(key, chain[0], chain[1:], password)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(pfx); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readCertificateChain parses all certificates of a PEM file, leaf first.
+func readCertificateChain(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificateChain(data, path)
+}
+
+// parseCertificateChain parses the PEM certificates in data, read from
+// source, in order.
+func parseCertificateChain(data []byte, source string) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", source, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found in %s", source)
+	}
+	return chain, nil
+}
+
+// readPrivateKeyFile parses a PEM private key in PKCS#8, SEC 1 (EC) or
+// PKCS#1 (RSA) form.
+func readPrivateKeyFile(path string) (crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found in %s", path)
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+}
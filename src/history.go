@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// queryExecer is implemented by both *sql.DB and *sql.Tx.
+type queryExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// historyEntry is a snapshot of a certificate's state after a change.
+type historyEntry struct {
+	Record     CertDBRecord
+	Event      string
+	RecordedAt time.Time
+}
+
+// recordHistory appends a snapshot of a certificate's current row to the
+// history, unless neither the event nor the state changed since the last
+// snapshot. Callers hold dbMutex and call it after their write, or before it
+// for deletions.
+func recordHistory(q queryExecer, name, event string) error {
+	record, err := scanCertRecord(q.QueryRow("SELECT "+certColumns+" FROM certificates WHERE name = ?", name))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var last CertDBRecord
+	var lastEvent string
+	var lastIssued, notAfter sql.NullTime
+	err = q.QueryRow(`
+		SELECT type, issuer, domains, last_issued, status, not_after, event
+		FROM cert_history WHERE name = ? ORDER BY id DESC LIMIT 1`, name).
+		Scan(&last.Type, &last.Issuer, &last.Domains, &lastIssued, &last.Status, &notAfter, &lastEvent)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && lastEvent == event && last.Type == record.Type && last.Issuer == record.Issuer &&
+		last.Domains == record.Domains && last.Status == record.Status &&
+		lastIssued.Time.Equal(record.LastIssued) && notAfter.Time.Equal(record.NotAfter) {
+		return nil
+	}
+
+	_, err = q.Exec(`
+		INSERT INTO cert_history (name, event, type, issuer, domains, last_issued, status, not_after, recorded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		name, event, record.Type, record.Issuer, record.Domains, nullTime(record.LastIssued), record.Status,
+		nullTime(record.NotAfter), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record history of '%s': %w", name, err)
+	}
+	return nil
+}
+
+// certStatesAsOf reconstructs which certificates existed at the given time and
+// their state then, from the latest history snapshot of each certificate.
+func certStatesAsOf(db *sql.DB, asOf time.Time) ([]CertDBRecord, error) {
+	rows, err := db.Query(`
+		SELECT name, event, type, issuer, domains, last_issued, status, not_after, recorded_at
+		FROM cert_history ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query certificate history: %w", err)
+	}
+	defer rows.Close()
+
+	latest := map[string]historyEntry{}
+	for rows.Next() {
+		var e historyEntry
+		var lastIssued, notAfter sql.NullTime
+		if err := rows.Scan(&e.Record.Name, &e.Event, &e.Record.Type, &e.Record.Issuer, &e.Record.Domains,
+			&lastIssued, &e.Record.Status, &notAfter, &e.RecordedAt); err != nil {
+			return nil, err
+		}
+		if e.RecordedAt.After(asOf) {
+			continue
+		}
+		e.Record.LastIssued, e.Record.NotAfter = lastIssued.Time, notAfter.Time
+		latest[e.Record.Name] = e
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var records []CertDBRecord
+	for _, e := range latest {
+		if e.Event != "deleted" {
+			records = append(records, e.Record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+// parseAsOf parses the '--as-of' argument, either a date (meaning the end of
+// that day, local time) or an RFC3339 timestamp.
+func parseAsOf(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date '%s', expected YYYY-MM-DD or RFC3339", value)
+	}
+	return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
+// displayCertInfoAsOf prints the state of all certificates as it was at the
+// given time, with remaining days counted from that time.
+func displayCertInfoAsOf(db *sql.DB, asOf time.Time, output string) error {
+	records, err := certStatesAsOf(db, asOf)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		views := []certView{}
+		for _, record := range records {
+			views = append(views, newCertViewAt(record, asOf))
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(views)
+	}
+
+	if len(records) == 0 {
+		fmt.Printf("No certificates recorded as of %s.\n", asOf.Format(time.RFC3339))
+		return nil
+	}
+
+	fmt.Printf("State as of %s:\n\n", asOf.Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tISSUED\tEXPIRES\tREMAINING\tTLS PROVIDER\tDNS PROVIDER")
+	fmt.Fprintln(w, "----\t------\t------\t-------\t---------\t------------\t------------")
+	for _, record := range records {
+		issuedStr, expiresStr, remainingStr := "N/A", "N/A", "N/A"
+		if !record.LastIssued.IsZero() {
+			expiryDate := certExpiry(record)
+			issuedStr = record.LastIssued.Format("2006-01-02")
+			expiresStr = expiryDate.Format("2006-01-02")
+			remainingStr = formatRemaining(expiryDate.Sub(asOf))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			record.Name, record.Status, issuedStr, expiresStr, remainingStr, record.Issuer, record.Type)
+	}
+	return w.Flush()
+}
+
+// statusSince returns when a certificate last entered the given status, from
+// its history.
+func statusSince(db *sql.DB, name, status string) (time.Time, bool, error) {
+	var since time.Time
+	err := db.QueryRow(`
+		SELECT recorded_at FROM cert_history WHERE name = ? AND status = ? AND event = ?
+		ORDER BY id DESC LIMIT 1`, name, status, status).Scan(&since)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to query history of '%s': %w", name, err)
+	}
+	return since, true, nil
+}
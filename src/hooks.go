@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// Maximum time a deploy hook may run unless it sets 'timeout'
+	defaultHookTimeout = 2 * time.Minute
+	// Captured output of a hook beyond this many bytes is dropped
+	hookOutputLimit = 64 << 10
+	// Stored hook results per certificate
+	hookRunsKept = 50
+)
+
+// HookConfig defines an action in the 'deploy' list of a certificate, run
+// after the certificate was issued or renewed. String fields are Go templates
+// executed with hookData.
+type HookConfig struct {
+	// Type is 'exec' (default), 'http', 'grpc', 'docker', 'vault', 's3' or
+	// 'scp'
+	Type string `yaml:"type" json:"type,omitempty"`
+	// Command is run locally (exec), inside Container (docker) or on Host
+	// after copying the files (scp)
+	Command   []string `yaml:"command" json:"command,omitempty"`
+	Container string   `yaml:"container" json:"container,omitempty"`
+	// URL, Method (default POST), Headers and Body describe an HTTP request
+	URL     string            `yaml:"url" json:"url,omitempty"`
+	Method  string            `yaml:"method" json:"method,omitempty"`
+	Headers map[string]string `yaml:"headers" json:"headers,omitempty"`
+	Body    string            `yaml:"body" json:"body,omitempty"`
+	// Address, Method and Body describe a gRPC call made with grpcurl, which
+	// must be on the PATH; the server needs reflection enabled.
+	Address   string `yaml:"address" json:"address,omitempty"`
+	Plaintext bool   `yaml:"plaintext" json:"plaintext,omitempty"`
+	// Path is the KV path written by 'vault' hooks, in Mount or else the
+	// mount of 'configs.vault', or the remote directory of 'scp' hooks
+	Path  string `yaml:"path" json:"path,omitempty"`
+	Mount string `yaml:"mount" json:"mount,omitempty"`
+	// Host (host[:port]), User, Key and KnownHosts describe the SSH
+	// connection of 'scp' hooks; CertPath, KeyPath and FullchainPath
+	// override the remote file paths in Path
+	Host          string `yaml:"host" json:"host,omitempty"`
+	User          string `yaml:"user" json:"user,omitempty"`
+	Key           string `yaml:"key" json:"key,omitempty"`
+	KnownHosts    string `yaml:"known_hosts" json:"known_hosts,omitempty"`
+	CertPath      string `yaml:"cert_path" json:"cert_path,omitempty"`
+	KeyPath       string `yaml:"key_path" json:"key_path,omitempty"`
+	FullchainPath string `yaml:"fullchain_path" json:"fullchain_path,omitempty"`
+	// Bucket and Prefix (default: the certificate name) locate the objects
+	// uploaded by 's3' hooks; SSE ('AES256' or 'aws:kms') and KMSKeyID
+	// request server-side encryption
+	Bucket   string `yaml:"bucket" json:"bucket,omitempty"`
+	Prefix   string `yaml:"prefix" json:"prefix,omitempty"`
+	SSE      string `yaml:"sse" json:"sse,omitempty"`
+	KMSKeyID string `yaml:"kms_key_id" json:"kms_key_id,omitempty"`
+	// Secrets maps names to secret references such as
+	// 'vault:kv/prod/api#token', resolved when the hook runs and available
+	// to the templates as '{{ .Secrets.<name> }}'
+	Secrets map[string]string `yaml:"secrets" json:"secrets,omitempty"`
+	// KeySecret is a secret reference to the SSH private key of 'scp' hooks,
+	// instead of the file Key
+	KeySecret string `yaml:"key_secret" json:"key_secret,omitempty"`
+	// Timeout overrides defaultHookTimeout, e.g. '30s'
+	Timeout string `yaml:"timeout" json:"timeout,omitempty"`
+}
+
+// hookData is available to the templates of a hook.
+type hookData struct {
+	Name          string
+	Domains       []string
+	CertFile      string
+	KeyFile       string
+	FullchainFile string
+	NotAfter      time.Time
+	// Secrets holds the resolved secrets of the hook being run
+	Secrets map[string]string
+}
+
+// hookRunner runs one hook with its templates already expanded and returns
+// its output.
+type hookRunner func(ctx context.Context, hook HookConfig, data hookData) (string, error)
+
+// hookTypes holds the supported hook types, keyed by their 'type' value.
+var hookTypes = map[string]hookRunner{}
+
+// registerHookType makes a hook type available to the configuration.
+func registerHookType(typ string, runner hookRunner) {
+	hookTypes[typ] = runner
+}
+
+func init() {
+	registerHookType("exec", runExecHook)
+	registerHookType("http", runHTTPHook)
+	registerHookType("grpc", runGRPCHook)
+	registerHookType("docker", runDockerHook)
+	registerHookType("vault", runVaultHook)
+	registerHookType("s3", runS3Hook)
+	registerHookType("scp", runSCPHook)
+}
+
+// hookType returns the type of a hook, defaulting to 'exec'.
+func hookType(hook HookConfig) string {
+	if hook.Type == "" {
+		return "exec"
+	}
+	return hook.Type
+}
+
+// validateHooks checks that every deploy hook of a certificate has the fields
+// its type needs and that its templates work.
+func validateHooks(name string, config CertConfig) error {
+	for i, hook := range config.Deploy {
+		sample := hookData{Name: name, Domains: config.Domains, NotAfter: time.Now(), Secrets: map[string]string{}}
+		for secret, ref := range hook.Secrets {
+			if err := validateSecretRef(ref); err != nil {
+				return fmt.Errorf("deploy hook %d: secret '%s': %w", i+1, secret, err)
+			}
+			sample.Secrets[secret] = "secret"
+		}
+		if hook.KeySecret != "" {
+			if err := validateSecretRef(hook.KeySecret); err != nil {
+				return fmt.Errorf("deploy hook %d: 'key_secret': %w", i+1, err)
+			}
+		}
+		var missing string
+		switch hookType(hook) {
+		case "exec":
+			if len(hook.Command) == 0 {
+				missing = "command"
+			}
+		case "http":
+			if hook.URL == "" {
+				missing = "url"
+			}
+		case "grpc":
+			if hook.Address == "" {
+				missing = "address"
+			} else if hook.Method == "" {
+				missing = "method"
+			} else if _, err := exec.LookPath("grpcurl"); err != nil {
+				return fmt.Errorf("deploy hook %d: type 'grpc' needs grpcurl on the PATH: %w", i+1, err)
+			}
+		case "docker":
+			if hook.Container == "" {
+				missing = "container"
+			} else if len(hook.Command) == 0 {
+				missing = "command"
+			}
+		case "vault":
+			if hook.Path == "" {
+				missing = "path"
+			}
+		case "s3":
+			if hook.Bucket == "" {
+				missing = "bucket"
+			} else if hook.KMSKeyID != "" && hook.SSE != "aws:kms" {
+				return fmt.Errorf("deploy hook %d: 'kms_key_id' requires 'sse: aws:kms'", i+1)
+			}
+		case "scp":
+			switch {
+			case hook.Host == "":
+				missing = "host"
+			case hook.User == "":
+				missing = "user"
+			case hook.Key == "" && hook.KeySecret == "":
+				missing = "key"
+			case hook.Path == "" && (hook.CertPath == "" || hook.KeyPath == "" || hook.FullchainPath == ""):
+				missing = "path"
+			}
+		default:
+			return fmt.Errorf("deploy hook %d: unknown type '%s'", i+1, hook.Type)
+		}
+		if missing != "" {
+			return fmt.Errorf("deploy hook %d: type '%s' requires '%s'", i+1, hookType(hook), missing)
+		}
+		if hook.Timeout != "" {
+			if d, err := time.ParseDuration(hook.Timeout); err != nil || d <= 0 {
+				return fmt.Errorf("deploy hook %d: invalid timeout '%s'", i+1, hook.Timeout)
+			}
+		}
+		if _, err := expandHook(hook, sample); err != nil {
+			return fmt.Errorf("deploy hook %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// expandHook executes the templates in all string fields of a hook.
+func expandHook(hook HookConfig, data hookData) (HookConfig, error) {
+	var err error
+	expand := func(s string) string {
+		if err != nil || !strings.Contains(s, "{{") {
+			return s
+		}
+		var t *template.Template
+		if t, err = template.New("hook").Option("missingkey=error").Parse(s); err != nil {
+			return s
+		}
+		var out strings.Builder
+		if err = t.Execute(&out, data); err != nil {
+			return s
+		}
+		return out.String()
+	}
+
+	expanded := hook
+	expanded.Command = make([]string, len(hook.Command))
+	for i, arg := range hook.Command {
+		expanded.Command[i] = expand(arg)
+	}
+	expanded.Headers = make(map[string]string, len(hook.Headers))
+	for k, v := range hook.Headers {
+		expanded.Headers[k] = expand(v)
+	}
+	expanded.Container = expand(hook.Container)
+	expanded.URL = expand(hook.URL)
+	expanded.Body = expand(hook.Body)
+	expanded.Address = expand(hook.Address)
+	expanded.Path = expand(hook.Path)
+	expanded.Prefix = expand(hook.Prefix)
+	expanded.Host = expand(hook.Host)
+	expanded.CertPath = expand(hook.CertPath)
+	expanded.KeyPath = expand(hook.KeyPath)
+	expanded.FullchainPath = expand(hook.FullchainPath)
+	return expanded, err
+}
+
+// runDeployHooks runs the deploy hooks of a certificate in order and stores
+// the result of each run. A failed hook is logged and notified, and doesn't
+// stop the hooks after it.
+func runDeployHooks(db *sql.DB, name string, config CertConfig, certsBasePath string, notAfter time.Time) {
+	if len(config.Deploy) == 0 {
+		return
+	}
+	files := certFilesFor(certsBasePath, name)
+	data := hookData{
+		Name:          name,
+		Domains:       config.Domains,
+		CertFile:      files.Cert,
+		KeyFile:       files.Key,
+		FullchainFile: files.Fullchain,
+		NotAfter:      notAfter,
+	}
+
+	var slow []string
+	for i, hook := range config.Deploy {
+		logger := certLogger(name, config).With("hook", i+1, "hook_type", hookType(hook))
+		started := time.Now()
+		output, err := runHook(hook, data)
+		duration := time.Since(started)
+		if timeout := hookTimeout(hook); duration > timeout/2 {
+			slow = append(slow, fmt.Sprintf("hook %d (%s) took %s of its %s timeout", i+1, hookType(hook), duration.Round(time.Second), timeout))
+		}
+		if recErr := recordHookRun(db, name, i+1, hookType(hook), hookTarget(hook, data), started, duration, output, err); recErr != nil {
+			logger.Warn(recErr.Error())
+		}
+		if output != "" {
+			logger.Info("Deploy hook output", "output", output)
+			publishLive(name, fmt.Sprintf("[hook %d (%s)] %s\n", i+1, hookType(hook), output))
+		}
+		if err != nil {
+			logger.Error("Deploy hook failed", "error", err, "duration", duration.Round(time.Millisecond))
+			sendNotification(db, NotificationEvent{
+				Event:   "deploy_failed",
+				Cert:    name,
+				Message: fmt.Sprintf("Deploy hook %d (%s) of certificate '%s' failed: %v", i+1, hookType(hook), name, err),
+			})
+			continue
+		}
+		logger.Info("Deploy hook succeeded", "duration", duration.Round(time.Millisecond))
+	}
+
+	message := ""
+	if len(slow) > 0 {
+		message = "Slow deploy: " + strings.Join(slow, "; ")
+	}
+	raiseWarning(db, name, config, warningHookSlow, message)
+}
+
+// hookTimeout returns how long a hook may run.
+func hookTimeout(hook HookConfig) time.Duration {
+	if d, err := time.ParseDuration(hook.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultHookTimeout
+}
+
+// hookTarget names where a hook deploys to, such as the host of an 'scp'
+// hook or the bucket of an 's3' hook, to tell apart the reliability of
+// deploy targets.
+func hookTarget(hook HookConfig, data hookData) string {
+	expanded, err := expandHook(hook, data)
+	if err != nil {
+		expanded = hook
+	}
+	switch hookType(hook) {
+	case "exec":
+		if len(expanded.Command) > 0 {
+			return filepath.Base(expanded.Command[0])
+		}
+	case "http":
+		if u, err := url.Parse(expanded.URL); err == nil {
+			return u.Host
+		}
+	case "grpc":
+		return expanded.Address
+	case "docker":
+		return expanded.Container
+	case "vault":
+		return expanded.Path
+	case "s3":
+		return expanded.Bucket
+	case "scp":
+		return expanded.Host
+	}
+	return ""
+}
+
+// runHook expands the templates of a hook and runs it with its timeout. It
+// returns the captured output of the hook, also on failure.
+func runHook(hook HookConfig, data hookData) (string, error) {
+	runner, ok := hookTypes[hookType(hook)]
+	if !ok {
+		return "", fmt.Errorf("unknown type '%s'", hook.Type)
+	}
+	timeout := hookTimeout(hook)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if len(hook.Secrets) > 0 {
+		secrets, err := resolveSecrets(ctx, hook.Secrets)
+		if err != nil {
+			return "", err
+		}
+		data.Secrets = secrets
+	}
+	expanded, err := expandHook(hook, data)
+	if err != nil {
+		return "", err
+	}
+	output, err := runner(ctx, expanded, data)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return output, err
+}
+
+// limitedBuffer keeps the first hookOutputLimit bytes written to it.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := hookOutputLimit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		b.buf.Write(p[:max(room, 0)])
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	out := strings.TrimSpace(b.buf.String())
+	if b.truncated {
+		out += "\n[output truncated]"
+	}
+	return out
+}
+
+// runCommand runs a command and returns its combined output.
+func runCommand(cmd *exec.Cmd) (string, error) {
+	var output limitedBuffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.String(), err
+}
+
+// runExecHook runs a local command with the certificate's details in
+// GOCERT_CERT, GOCERT_DOMAINS and GOCERT_*_FILE.
+func runExecHook(ctx context.Context, hook HookConfig, data hookData) (string, error) {
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GOCERT_CERT="+data.Name,
+		"GOCERT_DOMAINS="+strings.Join(data.Domains, ","),
+		"GOCERT_CERT_FILE="+data.CertFile,
+		"GOCERT_KEY_FILE="+data.KeyFile,
+		"GOCERT_FULLCHAIN_FILE="+data.FullchainFile,
+	)
+	return runCommand(cmd)
+}
+
+// runHTTPHook sends an HTTP request and expects a 2xx response. The response
+// body is the hook's output.
+func runHTTPHook(ctx context.Context, hook HookConfig, data hookData) (string, error) {
+	method := hook.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, hook.URL, strings.NewReader(hook.Body))
+	if err != nil {
+		return "", err
+	}
+	for k, v := range hook.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var output limitedBuffer
+	_, _ = io.Copy(&output, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return output.String(), fmt.Errorf("%s %s returned %s", method, hook.URL, resp.Status)
+	}
+	return output.String(), nil
+}
+
+// runGRPCHook calls a gRPC method through grpcurl, with Body as the JSON request message.
+func runGRPCHook(ctx context.Context, hook HookConfig, data hookData) (string, error) {
+	args := []string{}
+	if hook.Plaintext {
+		args = append(args, "-plaintext")
+	}
+	for k, v := range hook.Headers {
+		args = append(args, "-H", k+": "+v)
+	}
+	if hook.Body != "" {
+		args = append(args, "-d", hook.Body)
+	}
+	args = append(args, hook.Address, hook.Method)
+	return runCommand(exec.CommandContext(ctx, "grpcurl", args...))
+}
+
+// runDockerHook runs a command inside a running container with 'docker exec'.
+func runDockerHook(ctx context.Context, hook HookConfig, data hookData) (string, error) {
+	args := append([]string{"exec", hook.Container}, hook.Command...)
+	return runCommand(exec.CommandContext(ctx, "docker", args...))
+}
+
+// hookRun is the stored result of running one deploy hook.
+type hookRun struct {
+	ID         int64     `json:"id"`
+	Hook       int       `json:"hook"`
+	Type       string    `json:"type"`
+	Target     string    `json:"target,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output,omitempty"`
+}
+
+// recordHookRun stores the result of a hook run, adds it to the totals of the
+// hook and its target, and drops the oldest runs of the certificate beyond
+// hookRunsKept.
+func recordHookRun(db *sql.DB, name string, hook int, typ, target string, started time.Time, duration time.Duration, output string, runErr error) error {
+	var errText sql.NullString
+	var lastSuccess, lastFailure sql.NullTime
+	failures := 0
+	if runErr != nil {
+		errText = sql.NullString{String: runErr.Error(), Valid: true}
+		lastFailure = sql.NullTime{Time: started, Valid: true}
+		failures = 1
+	} else {
+		lastSuccess = sql.NullTime{Time: started, Valid: true}
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT INTO hook_runs (name, hook, type, target, started_at, duration_ms, success, error, output)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		name, hook, typ, target, started, duration.Milliseconds(), runErr == nil, errText, output)
+	if err != nil {
+		return fmt.Errorf("failed to record deploy hook result of '%s': %w", name, err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO hook_stats (name, hook, type, target, runs, failures, duration_ms, last_success, last_failure)
+		VALUES (?, ?, ?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT (name, hook, type, target) DO UPDATE SET
+			runs = runs + 1,
+			failures = failures + excluded.failures,
+			duration_ms = duration_ms + excluded.duration_ms,
+			last_success = COALESCE(excluded.last_success, last_success),
+			last_failure = COALESCE(excluded.last_failure, last_failure)`,
+		name, hook, typ, target, failures, duration.Milliseconds(), lastSuccess, lastFailure)
+	if err != nil {
+		return fmt.Errorf("failed to record deploy hook statistics of '%s': %w", name, err)
+	}
+	_, err = db.Exec(`
+		DELETE FROM hook_runs WHERE name = ? AND id NOT IN (
+			SELECT id FROM hook_runs WHERE name = ? ORDER BY id DESC LIMIT ?)`, name, name, hookRunsKept)
+	return err
+}
+
+// listHookRuns returns the stored deploy hook runs of a certificate, newest first.
+func listHookRuns(db *sql.DB, name string) ([]hookRun, error) {
+	rows, err := db.Query(`
+		SELECT id, hook, type, target, started_at, duration_ms, success, error, output
+		FROM hook_runs WHERE name = ? ORDER BY id DESC`, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deploy hook results: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []hookRun{}
+	for rows.Next() {
+		var run hookRun
+		var errText sql.NullString
+		if err := rows.Scan(&run.ID, &run.Hook, &run.Type, &run.Target, &run.StartedAt, &run.DurationMs, &run.Success, &errText, &run.Output); err != nil {
+			return nil, err
+		}
+		run.Error = errText.String
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
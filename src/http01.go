@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Value of a certificate's 'type' that selects the HTTP-01 challenge
+	challengeHTTP = "http"
+	// Address the challenge server listens on unless 'http01.listen' is set
+	defaultHTTP01Listen = "127.0.0.1:8402"
+	// URL path the CA fetches HTTP-01 challenge tokens from
+	http01PathPrefix = "/.well-known/acme-challenge/"
+)
+
+// HTTP01Config configures the challenge server of certificates with
+// 'type: http'. It serves the tokens on a high port, and the web server
+// already running on port 80 proxies '/.well-known/acme-challenge/' to it.
+type HTTP01Config struct {
+	// Listen is the address of the challenge server, e.g. '127.0.0.1:8402'
+	Listen string `yaml:"listen"`
+}
+
+var (
+	// http01Mutex guards the challenge server and its settings
+	http01Mutex = &sync.Mutex{}
+	// http01Listen is the address of the challenge server
+	http01Listen = defaultHTTP01Listen
+	// http01Server is the running challenge server, nil until first needed
+	http01Server net.Listener
+	// http01Tokens holds the key authorizations of the native backend's
+	// pending challenges, keyed by token
+	http01Tokens = map[string]string{}
+)
+
+// http01Token matches valid challenge tokens, which are base64url.
+var http01Token = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// configureHTTP01 applies the 'http01' settings of the global configuration.
+// A running challenge server keeps its address until the process restarts.
+func configureHTTP01(global GlobalConfig) {
+	http01Mutex.Lock()
+	defer http01Mutex.Unlock()
+	http01Listen = defaultHTTP01Listen
+	if global.HTTP01.Listen != "" {
+		http01Listen = global.HTTP01.Listen
+	}
+}
+
+// validateHTTP01 checks the 'http01' settings.
+func validateHTTP01(config HTTP01Config) error {
+	if config.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		return fmt.Errorf("invalid http01 listen address '%s': %w", config.Listen, err)
+	}
+	return nil
+}
+
+// validateHTTPChallenge checks a certificate with 'type: http'. The CA can
+// only validate wildcards with DNS-01.
+func validateHTTPChallenge(config CertConfig) error {
+	if config.Type != challengeHTTP {
+		return nil
+	}
+	for _, domain := range config.Domains {
+		if strings.HasPrefix(domain, "*.") {
+			return fmt.Errorf("wildcard domain '%s' can't use the HTTP-01 challenge, use a DNS provider type", domain)
+		}
+	}
+	return nil
+}
+
+// http01Webroot is the directory acme.sh writes its challenge tokens to with
+// '--webroot'; the challenge server serves them from there. It's kept next to
+// the database rather than in a shared temporary directory, so no other user
+// can create it first and plant tokens.
+func http01Webroot() string {
+	return filepath.Join(filepath.Dir(envOrDefault("GOCERT_DB_PATH", defaultDbPath)), "http01")
+}
+
+// startHTTP01Server starts the challenge server if it isn't running yet. It
+// keeps running for the rest of the process.
+func startHTTP01Server() error {
+	http01Mutex.Lock()
+	defer http01Mutex.Unlock()
+	if http01Server != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(http01Webroot(), http01PathPrefix), 0700); err != nil {
+		return fmt.Errorf("failed to create the HTTP-01 webroot: %w", err)
+	}
+	listener, err := net.Listen("tcp", http01Listen)
+	if err != nil {
+		return fmt.Errorf("failed to start the HTTP-01 challenge server: %w", err)
+	}
+	http01Server = listener
+	srv := &http.Server{Handler: http.HandlerFunc(serveHTTP01Token), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(listener); err != nil {
+			log.Printf("ERROR: HTTP-01 challenge server stopped: %v", err)
+		}
+	}()
+	log.Printf("HTTP-01 challenge server listening on %s", listener.Addr())
+	return nil
+}
+
+// serveHTTP01Token answers the CA's request for a challenge token, with the
+// key authorization of the native backend or the file acme.sh wrote.
+func serveHTTP01Token(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, http01PathPrefix)
+	if !ok || !http01Token.MatchString(token) || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		http.NotFound(w, r)
+		return
+	}
+
+	http01Mutex.Lock()
+	keyAuth, ok := http01Tokens[token]
+	http01Mutex.Unlock()
+	if !ok {
+		data, err := os.ReadFile(filepath.Join(http01Webroot(), http01PathPrefix, token))
+		if err != nil {
+			slog.Debug("Unknown HTTP-01 token requested", "token", token, "remote", r.RemoteAddr)
+			http.NotFound(w, r)
+			return
+		}
+		keyAuth = string(data)
+	}
+	slog.Debug("Served HTTP-01 token", "token", token, "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, keyAuth)
+}
+
+// http01Solver serves the native backend's HTTP-01 challenges through the
+// challenge server. It takes tokens where the DNS solvers take record names.
+type http01Solver struct{}
+
+func (http01Solver) Present(token, keyAuth string) error {
+	if err := startHTTP01Server(); err != nil {
+		return err
+	}
+	http01Mutex.Lock()
+	defer http01Mutex.Unlock()
+	http01Tokens[token] = keyAuth
+	return nil
+}
+
+func (http01Solver) CleanUp(token, keyAuth string) error {
+	http01Mutex.Lock()
+	defer http01Mutex.Unlock()
+	delete(http01Tokens, token)
+	return nil
+}
+
+// http01ProxyTarget returns the URL web servers proxy challenge requests
+// to. A wildcard listen address is reached on the loopback interface.
+func http01ProxyTarget() string {
+	http01Mutex.Lock()
+	listen := http01Listen
+	http01Mutex.Unlock()
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "http://" + listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// http01Stanza returns the configuration that makes a web server proxy the
+// challenge requests of the CA to gocert.
+func http01Stanza(server string) (string, error) {
+	target := http01ProxyTarget()
+	switch server {
+	case "nginx":
+		return fmt.Sprintf(`# gocert HTTP-01 challenges; include in the port 80 server block
+location ^~ %s {
+    proxy_pass %s;
+    proxy_set_header Host $host;
+}
+`, http01PathPrefix, target), nil
+	case "apache":
+		return fmt.Sprintf(`# gocert HTTP-01 challenges; needs mod_proxy_http, include in the port 80 VirtualHost
+ProxyPreserveHost On
+ProxyPass "%s" "%s%s"
+ProxyPassReverse "%s" "%s%s"
+`, http01PathPrefix, target, http01PathPrefix, http01PathPrefix, target, http01PathPrefix), nil
+	}
+	return "", fmt.Errorf("unknown web server '%s', expected 'nginx' or 'apache'", server)
+}
+
+// runHTTP01Stanza prints the proxy configuration for a web server, or writes
+// it to a file to include in the web server's configuration.
+func runHTTP01Stanza(yamlFile, server, install string) error {
+	fullConfig, err := loadConfig(yamlFile)
+	if err != nil {
+		return err
+	}
+	configureHTTP01(fullConfig.Configs)
+	stanza, err := http01Stanza(server)
+	if err != nil {
+		return err
+	}
+	if install == "" {
+		fmt.Print(stanza)
+		return nil
+	}
+	if err := os.WriteFile(install, []byte(stanza), 0644); err != nil {
+		return fmt.Errorf("failed to install the %s configuration: %w", server, err)
+	}
+	fmt.Printf("Wrote %s; include it in the port 80 configuration of %s and reload it.\n", install, server)
+	return nil
+}
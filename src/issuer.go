@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Backend that shells out to acme.sh (the default)
+	backendAcmeSh = "acmesh"
+	// Backend that talks ACME natively from within gocert
+	backendNative = "native"
+	// Default directory for account keys of the native backend
+	defaultAccountsPath = "/var/gocert/accounts"
+	// Exit code of acme.sh when it skips a certificate that isn't due by its
+	// own schedule
+	acmeShSkipExitCode = 2
+)
+
+// certFiles holds the output paths of an issued certificate.
+type certFiles struct {
+	Dir       string
+	Cert      string
+	Key       string
+	Fullchain string
+}
+
+// certFilesFor returns the file layout for a certificate under certsBasePath.
+func certFilesFor(certsBasePath, name string) certFiles {
+	dir := filepath.Join(certsBasePath, name)
+	return certFiles{
+		Dir:       dir,
+		Cert:      filepath.Join(dir, "cert.pem"),
+		Key:       filepath.Join(dir, "key.pem"),
+		Fullchain: filepath.Join(dir, "fullchain.pem"),
+	}
+}
+
+// checkCertFiles verifies that all files of an issued certificate exist and
+// can be read, and that the certificate itself can be parsed.
+func checkCertFiles(files certFiles) error {
+	for _, path := range []string{files.Key, files.Fullchain} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("%s is empty", path)
+		}
+	}
+	_, err := readCertificateFile(files.Cert)
+	return err
+}
+
+// Issuer obtains a certificate from a CA and writes it to the given files,
+// revokes certificates it issued and deactivates its ACME accounts.
+type Issuer interface {
+	// Issue obtains the certificate. With force, a backend that keeps its
+	// own renewal schedule issues even if it considers the certificate not
+	// due yet.
+	Issue(name string, config CertConfig, files certFiles, force bool) error
+	Revoke(name string, config CertConfig, files certFiles) error
+	// DeactivateAccount deactivates the account used with an issuer at the CA
+	// and archives its key; account is a named account or "" for the default.
+	DeactivateAccount(issuer, account string) error
+}
+
+var (
+	// issuersMutex guards the configured backends
+	issuersMutex = &sync.Mutex{}
+	// defaultBackend is used for certificates that don't set 'backend'
+	defaultBackend = backendAcmeSh
+	// renewBefore is the renewal window of certificates that don't set 'renew_before_days'
+	renewBefore = defaultRenewBeforeDays
+	// maxAttempts is the failure limit of certificates that don't set 'max_attempts', 0 for none
+	maxAttempts = 0
+	// issuers holds the available backends, keyed by name
+	issuers = map[string]Issuer{
+		backendAcmeSh: acmeShIssuer{},
+	}
+)
+
+// configureIssuers sets up the issuance backends from the global configuration.
+// The native backend is created once and kept, so its ACME clients and account
+// keys are reused across check cycles.
+func configureIssuers(global GlobalConfig) {
+	issuersMutex.Lock()
+	defer issuersMutex.Unlock()
+
+	defaultBackend = backendAcmeSh
+	if global.Backend != "" {
+		defaultBackend = global.Backend
+	}
+	renewBefore = defaultRenewBeforeDays
+	if global.RenewBeforeDays > 0 {
+		renewBefore = global.RenewBeforeDays
+	}
+	maxAttempts = global.MaxAttempts
+
+	native, ok := issuers[backendNative].(*nativeIssuer)
+	if !ok {
+		native = newNativeIssuer(envOrDefault("GOCERT_ACCOUNTS_PATH", defaultAccountsPath))
+		issuers[backendNative] = native
+	}
+	native.setEmail(global.Email)
+	configureAccounts(global)
+	configureRateLimits(global)
+	configureArchive(global)
+	configureVault(global)
+	configureS3(global)
+	configureFileModes(global)
+	configureDNS(global)
+	configureRetryBackoff(global)
+	configureQuarantine(global)
+	configureWindows(global)
+	configureIssueTimeout(global)
+	configureHTTP01(global)
+}
+
+// backendFor returns the name of the backend responsible for a certificate.
+func backendFor(config CertConfig) string {
+	if config.Backend != "" {
+		return config.Backend
+	}
+	issuersMutex.Lock()
+	defer issuersMutex.Unlock()
+	return defaultBackend
+}
+
+// renewBeforeDays returns how many days before expiry a certificate is renewed.
+func renewBeforeDays(config CertConfig) int {
+	if config.RenewBeforeDays > 0 {
+		return config.RenewBeforeDays
+	}
+	issuersMutex.Lock()
+	defer issuersMutex.Unlock()
+	return renewBefore
+}
+
+// maxAttemptsFor returns after how many consecutive failures a certificate
+// needs intervention, or 0 if it is retried indefinitely.
+func maxAttemptsFor(config CertConfig) int {
+	if config.MaxAttempts > 0 {
+		return config.MaxAttempts
+	}
+	issuersMutex.Lock()
+	defer issuersMutex.Unlock()
+	return maxAttempts
+}
+
+// issuerFor returns the backend responsible for a certificate.
+func issuerFor(config CertConfig) (Issuer, error) {
+	backend := backendFor(config)
+
+	issuersMutex.Lock()
+	defer issuersMutex.Unlock()
+	issuer, ok := issuers[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend '%s'", backend)
+	}
+	return issuer, nil
+}
+
+// usesBackend reports whether any certificate in the config is issued by the given backend.
+func usesBackend(fullConfig FullConfig, backend string) bool {
+	for _, config := range fullConfig.Certificates {
+		if config.Monitor != "" {
+			continue
+		}
+		b := config.Backend
+		if b == "" {
+			b = fullConfig.Configs.Backend
+		}
+		if b == "" {
+			b = backendAcmeSh
+		}
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// acmeShExtraArgs lists the acme.sh options allowed in 'extra_args' and
+// whether each of them takes a value.
+var acmeShExtraArgs = map[string]bool{
+	"--always-force-new-domain-key": false,
+	"--ca-bundle":                   true,
+	"--challenge-alias":             true,
+	"--days":                        true,
+	"--debug":                       false,
+	"--dnssleep":                    true,
+	"--domain-alias":                true,
+	"--insecure":                    false,
+	"--ocsp":                        false,
+	"--ocsp-must-staple":            false,
+	"--preferred-chain":             true,
+	"--valid-from":                  true,
+	"--valid-to":                    true,
+}
+
+// validateExtraArgs checks a certificate's 'extra_args' against the allowlist.
+func validateExtraArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		takesValue, ok := acmeShExtraArgs[args[i]]
+		if !ok {
+			return fmt.Errorf("acme.sh option '%s' is not allowed in extra_args", args[i])
+		}
+		if takesValue {
+			if i+1 >= len(args) || strings.HasPrefix(args[i+1], "--") {
+				return fmt.Errorf("acme.sh option '%s' requires a value", args[i])
+			}
+			i++
+		}
+	}
+	return nil
+}
+
+// acmeShMinVersions lists acme.sh options that only exist in newer releases,
+// with the first version supporting them.
+var acmeShMinVersions = map[string]string{
+	"--preferred-chain": "2.8.8",
+	"--valid-from":      "3.0.6",
+	"--valid-to":        "3.0.6",
+}
+
+// acmeShVersion is the detected acme.sh version, empty if unknown
+var acmeShVersion string
+
+// detectAcmeShVersion runs 'acme.sh --version' and remembers the reported version.
+func detectAcmeShVersion() (string, error) {
+	out, err := exec.Command(acmeShPath, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run '%s --version': %w", acmeShPath, err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if v := strings.TrimPrefix(line, "v"); v != line && parseVersion(v) != nil {
+			issuersMutex.Lock()
+			acmeShVersion = v
+			issuersMutex.Unlock()
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("no version found in acme.sh output %q", strings.TrimSpace(string(out)))
+}
+
+// parseVersion splits a dotted version like '3.0.7' into its numbers, or
+// returns nil if it isn't one.
+func parseVersion(v string) []int {
+	var parts []int
+	for _, field := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// versionAtLeast reports whether version v is the same as or newer than min.
+func versionAtLeast(v, min string) bool {
+	a, b := parseVersion(v), parseVersion(min)
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return true
+}
+
+// checkAcmeShSupport returns an error if the installed acme.sh is too old for
+// any of the given options. Nothing is checked when the version is unknown.
+func checkAcmeShSupport(args []string) error {
+	issuersMutex.Lock()
+	installed := acmeShVersion
+	issuersMutex.Unlock()
+	if installed == "" {
+		return nil
+	}
+
+	for _, arg := range args {
+		if min, ok := acmeShMinVersions[arg]; ok && !versionAtLeast(installed, min) {
+			return fmt.Errorf("acme.sh option '%s' requires acme.sh %s or newer, but %s is installed", arg, min, installed)
+		}
+	}
+	return nil
+}
+
+// acmeShIssuer issues certificates by running the acme.sh script.
+type acmeShIssuer struct{}
+
+// acmeShIssueArgs returns the acme.sh arguments that issue a certificate
+// into the given files.
+func acmeShIssueArgs(config CertConfig, files certFiles, force bool) []string {
+	args := []string{"--issue", "--dns", config.Type}
+	if config.Type == challengeHTTP {
+		args = []string{"--issue", "--webroot", http01Webroot()}
+	}
+	args = append(args,
+		"--cert-file", files.Cert, "--key-file", files.Key, "--fullchain-file", files.Fullchain,
+		"--server", config.Issuer,
+	)
+	args = append(args, acmeShAccountArgs(config.Account)...)
+	if force {
+		args = append(args, "--force")
+	}
+	if config.KeyType != "" {
+		args = append(args, "--keylength", acmeShKeyLength(config.KeyType))
+	}
+	for _, domain := range config.Domains {
+		args = append(args, "-d", domain)
+	}
+	return append(args, config.ExtraArgs...)
+}
+
+func (acmeShIssuer) Issue(name string, config CertConfig, files certFiles, force bool) error {
+	args := acmeShIssueArgs(config, files, force)
+	if err := checkAcmeShSupport(args); err != nil {
+		return err
+	}
+
+	// acme.sh sends its own requests, so each run counts as one towards the
+	// rate limit of the CA's directory.
+	dirKey, err := directoryURL(config.Issuer)
+	if err != nil {
+		dirKey = config.Issuer
+	}
+	env, err := acmeShEnv(name, config)
+	if err != nil {
+		return err
+	}
+	if config.Type == challengeHTTP {
+		if err := startHTTP01Server(); err != nil {
+			return err
+		}
+	}
+	release, err := waitForProvider(context.Background(), config.Type)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := waitForDirectory(context.Background(), dirKey); err != nil {
+		return err
+	}
+
+	output, err := runAcmeSh(name, files.Dir, args, env, acmeShTimeout(config))
+	addAcmeOutput(name, output)
+	// gocert renews by the expiry of the certificate on disk, which wins
+	// over acme.sh's own schedule, e.g. with a longer 'renew_before_days',
+	// a changed key type or deleted files.
+	var exitErr *exec.ExitError
+	if !force && errors.As(err, &exitErr) && exitErr.ExitCode() == acmeShSkipExitCode {
+		certLogger(name, config).Info("acme.sh doesn't consider the certificate due yet, forcing the renewal")
+		if err := waitForDirectory(context.Background(), dirKey); err != nil {
+			return err
+		}
+		output, err = runAcmeSh(name, files.Dir, append(args, "--force"), env, acmeShTimeout(config))
+		addAcmeOutput(name, output)
+	}
+	return err
+}
+
+// Revoke revokes the certificate acme.sh issued for the first domain. ECDSA
+// certificates are kept apart by acme.sh and need '--ecc'.
+func (acmeShIssuer) Revoke(name string, config CertConfig, files certFiles) error {
+	args := []string{"--revoke", "-d", config.Domains[0], "--server", config.Issuer}
+	args = append(args, acmeShAccountArgs(config.Account)...)
+	if cert, err := readCertificateFile(files.Cert); err == nil && cert.PublicKeyAlgorithm == x509.ECDSA {
+		args = append(args, "--ecc")
+	}
+
+	env, err := acmeShEnv(name, config)
+	if err != nil {
+		return err
+	}
+	_, err = runAcmeSh(name, files.Dir, args, env, acmeShTimeout(config))
+	return err
+}
+
+// DeactivateAccount lets acme.sh deactivate its account for the issuer; it
+// moves the account files to 'ca/<server>/deactivated/<account id>' itself.
+func (acmeShIssuer) DeactivateAccount(issuer, account string) error {
+	args := append([]string{"--deactivate-account", "--server", issuer}, acmeShAccountArgs(account)...)
+	cmd := exec.Command(acmeShPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
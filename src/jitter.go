@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// startupJitterFor returns the longest random delay of the daemon's first
+// check: GOCERT_STARTUP_JITTER, else 'startup_jitter', 0 if neither is set.
+func startupJitterFor(global GlobalConfig) time.Duration {
+	value, source := global.StartupJitter, "startup_jitter"
+	if v := os.Getenv("GOCERT_STARTUP_JITTER"); v != "" {
+		value, source = v, "GOCERT_STARTUP_JITTER"
+	}
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("Warning: invalid %s '%s', starting without delay", source, value)
+		return 0
+	}
+	return d
+}
+
+// waitStartupJitter delays the daemon's first check by a random time up to
+// the startup jitter, so a fleet of daemons restarted at the same time, e.g.
+// after a node reboot, doesn't hit the CA and DNS APIs at once. A reload
+// request ends the wait. A daemon re-executed by an upgrade doesn't wait.
+func waitStartupJitter(yamlFile string, reload <-chan struct{}) {
+	if os.Getenv(upgradedEnv) != "" {
+		os.Unsetenv(upgradedEnv)
+		return
+	}
+
+	// Only the setting is read here; the first check validates the file and
+	// reports its errors.
+	fullConfig := readConfigSettings(yamlFile)
+	jitter := devScaled(startupJitterFor(fullConfig.Configs))
+	if jitter <= 0 {
+		return
+	}
+
+	delay := rand.N(jitter)
+	log.Printf("Delaying the first certificate check by %s (startup jitter up to %s).", delay.Round(time.Second), jitter)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-reload:
+		log.Println("Reload requested, running certificate check now.")
+	}
+}
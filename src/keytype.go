@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Key type of certificates that don't set 'key_type', the default of acme.sh
+// 3.x and of the native backend
+const defaultKeyType = "ec-256"
+
+// keyTypeFor returns the key type a certificate is issued with, the first
+// of 'key_types' if there are several.
+func keyTypeFor(config CertConfig) string {
+	if len(config.KeyTypes) > 0 {
+		return config.KeyTypes[0]
+	}
+	if config.KeyType == "" {
+		return defaultKeyType
+	}
+	return config.KeyType
+}
+
+// keyTypesFor returns all key types a certificate is issued with.
+func keyTypesFor(config CertConfig) []string {
+	if len(config.KeyTypes) > 0 {
+		return config.KeyTypes
+	}
+	return []string{keyTypeFor(config)}
+}
+
+// configuredKeyType returns the key types set in the configuration as they
+// are recorded in the database, or "" if the default is used.
+func configuredKeyType(config CertConfig) string {
+	if len(config.KeyTypes) > 0 {
+		return strings.Join(config.KeyTypes, ",")
+	}
+	return config.KeyType
+}
+
+// validateKeyTypes checks that 'key_types' holds at most one ECDSA and one
+// RSA key type, whose files would otherwise have the same names.
+func validateKeyTypes(config CertConfig) error {
+	if len(config.KeyTypes) == 0 {
+		return nil
+	}
+	if config.KeyType != "" {
+		return fmt.Errorf("set either 'key_type' or 'key_types'")
+	}
+	seen := map[string]bool{}
+	for _, keyType := range config.KeyTypes {
+		family := keyTypeFamily(keyType)
+		if seen[family] {
+			return fmt.Errorf("'key_types' may contain only one %s key type", strings.ToUpper(family))
+		}
+		seen[family] = true
+	}
+	return nil
+}
+
+// keyTypeFamily returns 'ecdsa' or 'rsa', the suffix of the files of a key
+// type in 'key_types'.
+func keyTypeFamily(keyType string) string {
+	if strings.HasPrefix(keyType, "rsa-") {
+		return "rsa"
+	}
+	return "ecdsa"
+}
+
+// keyTypeFiles returns where the certificate of one of the 'key_types' of an
+// entry is stored, e.g. 'cert.rsa.pem' next to 'cert.pem'.
+func keyTypeFiles(certsBasePath, name, keyType string) certFiles {
+	files := certFilesFor(certsBasePath, name)
+	suffix := "." + keyTypeFamily(keyType) + ".pem"
+	files.Cert = filepath.Join(files.Dir, "cert"+suffix)
+	files.Key = filepath.Join(files.Dir, "key"+suffix)
+	files.Fullchain = filepath.Join(files.Dir, "fullchain"+suffix)
+	return files
+}
+
+// allCertFiles returns every set of files of a certificate: the default files
+// and, with 'key_types', those of each key type.
+func allCertFiles(certsBasePath, name string, config CertConfig) []certFiles {
+	all := []certFiles{certFilesFor(certsBasePath, name)}
+	for _, keyType := range config.KeyTypes {
+		all = append(all, keyTypeFiles(certsBasePath, name, keyType))
+	}
+	return all
+}
+
+// issuedKeyType describes the keys of the issued certificates of an entry,
+// given its default certificate, as recorded in the database.
+func issuedKeyType(certsBasePath, name string, config CertConfig, cert *x509.Certificate) string {
+	if len(config.KeyTypes) == 0 {
+		return certKeyType(cert)
+	}
+	var types []string
+	for _, keyType := range config.KeyTypes {
+		if typed, err := readCertificateFile(keyTypeFiles(certsBasePath, name, keyType).Cert); err == nil {
+			types = append(types, certKeyType(typed))
+		}
+	}
+	return strings.Join(types, ",")
+}
+
+// acmeShKeyLength converts a key type to the value of acme.sh's '--keylength'.
+func acmeShKeyLength(keyType string) string {
+	return strings.TrimPrefix(keyType, "rsa-")
+}
+
+// generateCertKey creates a new certificate private key of the given type.
+func generateCertKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ec-256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ec-384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "rsa-2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa-4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", keyType)
+}
+
+// encodeCertKey PEM-encodes a certificate private key the way acme.sh writes it.
+func encodeCertKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	}
+	return nil, fmt.Errorf("unsupported key %T", key)
+}
+
+// certKeyType describes the key of a certificate as a key type, e.g. 'rsa-2048'.
+func certKeyType(cert *x509.Certificate) string {
+	if keyType := publicKeyType(cert.PublicKey); keyType != "" {
+		return keyType
+	}
+	return strings.ToLower(cert.PublicKeyAlgorithm.String())
+}
+
+// publicKeyType describes an ECDSA or RSA public key as a key type, or
+// returns "" for other keys.
+func publicKeyType(pub crypto.PublicKey) string {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ec-%d", pub.Curve.Params().BitSize)
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", pub.N.BitLen())
+	}
+	return ""
+}
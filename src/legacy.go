@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// legacyWarned holds the files the legacy format warning was logged for, so
+// the daemon doesn't repeat it on every check.
+var legacyWarned sync.Map
+
+// isLegacyConfig reports whether a configuration uses the earlier flat format:
+// certificate entries at the top level and no 'configs:' block.
+func isLegacyConfig(data []byte) bool {
+	var top map[string]interface{}
+	if err := yaml.Unmarshal(data, &top); err != nil || len(top) == 0 {
+		return false
+	}
+	if _, ok := top["configs"]; ok {
+		return false
+	}
+	for _, entry := range top {
+		if _, ok := entry.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// legacyConfigAllowed reports whether GOCERT_LEGACY_CONFIG, true by default,
+// lets files of the flat format load.
+func legacyConfigAllowed() bool {
+	allowed, err := strconv.ParseBool(envOrDefault("GOCERT_LEGACY_CONFIG", "true"))
+	return err != nil || allowed
+}
+
+// acceptLegacyConfig lets a file of the flat format load with a migration
+// hint, logged once per file, or refuses it if GOCERT_LEGACY_CONFIG is false.
+func acceptLegacyConfig(yamlFile string) error {
+	migrate := fmt.Sprintf("gocert config migrate %s --email <address> --write", yamlFile)
+	if !legacyConfigAllowed() {
+		return fmt.Errorf("%s has no 'configs:' block; the legacy flat format is disabled by GOCERT_LEGACY_CONFIG, convert it with '%s'", yamlFile, migrate)
+	}
+	if _, warned := legacyWarned.LoadOrStore(yamlFile, true); !warned {
+		slog.Warn("Configuration uses the legacy flat format without a 'configs:' block; it still works, but global settings need the new format",
+			"file", yamlFile, "migrate", migrate, "disable", "GOCERT_LEGACY_CONFIG=false")
+	}
+	return nil
+}
+
+// validateLegacyConfig validates a file of the flat format, which lacks the
+// 'configs:' block and the account email the schema requires.
+func validateLegacyConfig(yamlContent []byte) error {
+	return validateConfigExcept(yamlContent, func(desc gojsonschema.ResultError) bool {
+		return desc.Type() == "required" && desc.Details()["property"] == "configs"
+	})
+}
+
+// migrateConfig converts a file of the flat format by adding a 'configs:'
+// block with the account email, keeping entries and comments. The result is
+// printed, or with write replaces the file, which is kept as '<file>.legacy'.
+func migrateConfig(yamlFile, email string, write bool) error {
+	data, err := os.ReadFile(yamlFile)
+	if err != nil {
+		return fmt.Errorf("failed to read YAML file '%s': %w", yamlFile, err)
+	}
+	if !isLegacyConfig(data) {
+		return fmt.Errorf("%s isn't in the legacy flat format, it already has a 'configs:' block or no certificate entries", yamlFile)
+	}
+	if email == "" {
+		return fmt.Errorf("--email is required, the current format keeps the ACME account email in 'configs.email'")
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	root := doc.Content[0]
+	configsKey := &yaml.Node{Kind: yaml.ScalarNode, Value: "configs"}
+	configs := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: "email"},
+		{Kind: yaml.ScalarNode, Value: email},
+	}}
+	// The comment heading the file stays on top.
+	configsKey.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+	root.Content = append([]*yaml.Node{configsKey, configs}, root.Content...)
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	if err := validateConfig(out.Bytes()); err != nil {
+		return fmt.Errorf("the migrated configuration is invalid:\n%w", err)
+	}
+
+	if !write {
+		fmt.Print(out.String())
+		return nil
+	}
+	info, err := os.Stat(yamlFile)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(yamlFile+".legacy", data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", yamlFile, err)
+	}
+	if err := os.WriteFile(yamlFile, out.Bytes(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", yamlFile, err)
+	}
+	fmt.Printf("Migrated %s, the previous file is kept as %s.legacy.\n", yamlFile, yamlFile)
+	return nil
+}
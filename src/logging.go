@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logging goes through log/slog. The certificate lifecycle logs with slog
+// directly and adds structured fields such as the certificate name; messages
+// of the standard log package are passed on with the level taken from their
+// 'ERROR:' or 'Warning:' prefix.
+
+var (
+	// logLevel is the minimum level of messages written, set by '--log-level'
+	logLevel = new(slog.LevelVar)
+	// logPrefixLevels maps the message prefixes of the log package to levels
+	logPrefixLevels = []struct {
+		prefix string
+		level  slog.Level
+	}{
+		{"ERROR: ", slog.LevelError},
+		{"Error: ", slog.LevelError},
+		{"Warning: ", slog.LevelWarn},
+		{"Debug: ", slog.LevelDebug},
+	}
+)
+
+// extractLogFlags removes '--log-level' and '--log-format' from the command
+// line, so they work with every command, and returns their values. They
+// default to GOCERT_LOG_LEVEL and GOCERT_LOG_FORMAT.
+func extractLogFlags(args []string) (rest []string, level, format string, err error) {
+	level = envOrDefault("GOCERT_LOG_LEVEL", "info")
+	format = envOrDefault("GOCERT_LOG_FORMAT", "text")
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || (name != "log-level" && name != "log-format") {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return nil, "", "", fmt.Errorf("flag --%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		if name == "log-level" {
+			level = value
+		} else {
+			format = value
+		}
+	}
+	return rest, level, format, nil
+}
+
+// configureLogging sets up the default slog logger and routes the log
+// package through it.
+func configureLogging(level, format string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level '%s', expected debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format '%s', expected 'text' or 'json'", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+	log.SetOutput(logBridge{handler})
+	return nil
+}
+
+// logBridge writes the messages of the log package to a slog handler.
+type logBridge struct {
+	handler slog.Handler
+}
+
+func (b logBridge) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	level := slog.LevelInfo
+	for _, l := range logPrefixLevels {
+		if rest, ok := strings.CutPrefix(msg, l.prefix); ok {
+			msg, level = rest, l.level
+			break
+		}
+	}
+	ctx := context.Background()
+	if !b.handler.Enabled(ctx, level) {
+		return len(p), nil
+	}
+	if err := b.handler.Handle(ctx, slog.NewRecord(time.Now(), level, msg, 0)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// certLogger returns a logger adding the certificate name and, for managed
+// entries, its issuer and backend to every message.
+func certLogger(name string, config CertConfig) *slog.Logger {
+	if config.Monitor != "" {
+		return slog.With("cert", name, "monitor", config.Monitor)
+	}
+	return slog.With("cert", name, "issuer", config.Issuer, "backend", backendFor(config))
+}
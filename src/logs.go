@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// logEntry is a stored run of acme.sh, the native backend or a deploy hook
+// as shown by 'gocert logs'.
+type logEntry struct {
+	// ID is 'issue-<n>' or 'hook-<n>'
+	ID        string
+	Title     string
+	StartedAt time.Time
+	Duration  time.Duration
+	Success   bool
+	Error     string
+	Output    string
+}
+
+// listLogEntries returns the stored issuance and deploy hook runs of a
+// certificate, oldest first.
+func listLogEntries(db *sql.DB, name string) ([]logEntry, error) {
+	issueRuns, err := listIssueRuns(db, name)
+	if err != nil {
+		return nil, err
+	}
+	hookRuns, err := listHookRuns(db, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []logEntry
+	for _, run := range issueRuns {
+		entries = append(entries, logEntry{
+			ID: fmt.Sprintf("issue-%d", run.ID), Title: "issuance (" + run.Backend + ")",
+			StartedAt: run.StartedAt, Duration: time.Duration(run.DurationMs) * time.Millisecond,
+			Success: run.Success, Error: run.Error, Output: run.Output,
+		})
+	}
+	for _, run := range hookRuns {
+		title := fmt.Sprintf("deploy hook %d (%s)", run.Hook, run.Type)
+		if run.Target != "" {
+			title += " to " + run.Target
+		}
+		entries = append(entries, logEntry{
+			ID: fmt.Sprintf("hook-%d", run.ID), Title: title,
+			StartedAt: run.StartedAt, Duration: time.Duration(run.DurationMs) * time.Millisecond,
+			Success: run.Success, Error: run.Error, Output: run.Output,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartedAt.Before(entries[j].StartedAt) })
+	return entries, nil
+}
+
+// showLogs prints the captured output of a certificate's stored runs, or of
+// the run with the given ID, and with follow goes on with the live output of
+// the running daemon.
+func showLogs(db *sql.DB, name, runID string, follow bool, socketPath string) error {
+	entries, err := listLogEntries(db, name)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, entry := range entries {
+		if runID != "" && entry.ID != runID {
+			continue
+		}
+		found = true
+		printLogEntry(os.Stdout, entry)
+	}
+	if runID != "" && !found {
+		return fmt.Errorf("no run '%s' of '%s' is stored, see 'gocert logs %s'", runID, name, name)
+	}
+	if !found && !follow {
+		fmt.Printf("No runs of '%s' are stored.\n", name)
+	}
+	if !follow {
+		return nil
+	}
+	return followLogs(socketPath, name)
+}
+
+// printLogEntry prints a run with a header line.
+func printLogEntry(w io.Writer, entry logEntry) {
+	result := "ok"
+	if !entry.Success {
+		result = "failed"
+		if entry.Error != "" {
+			result += ": " + entry.Error
+		}
+	}
+	fmt.Fprintf(w, "=== %s %s, %s, took %s, %s\n", entry.ID, entry.Title, entry.StartedAt.Local().Format("2006-01-02 15:04:05"),
+		entry.Duration.Round(time.Millisecond), result)
+	if output := strings.TrimSpace(entry.Output); output != "" {
+		fmt.Fprintln(w, output)
+	}
+	fmt.Fprintln(w)
+}
+
+// followLogs prints the live output of a certificate's runs from the daemon's
+// control socket until the daemon stops or the command is interrupted.
+func followLogs(socketPath, name string) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("can't reach the daemon at %s, is 'gocert run' running? %w", socketPath, err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "logs %s\n", name); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no reply from the daemon: %w", err)
+	}
+	if reply = strings.TrimSpace(reply); reply != "OK" {
+		return fmt.Errorf("the daemon refused to stream logs: %s", reply)
+	}
+	fmt.Fprintf(os.Stderr, "Following live output of '%s', press Ctrl-C to stop.\n", name)
+	if _, err := io.Copy(os.Stdout, reader); err != nil {
+		return err
+	}
+	return fmt.Errorf("the daemon closed the connection")
+}
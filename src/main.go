@@ -1,16 +1,24 @@
 package main
 
 import (
+	"crypto/x509"
 	"database/sql"
 	_ "embed"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
@@ -33,12 +41,15 @@ const (
 	defaultDbPath = "/var/gocert/gocert.db"
 	// Default base path for storing certificate files
 	defaultCertsPath = "/var/gocert/certs"
-	// Renew if the certificate has this many days or fewer remaining
-	renewalThresholdRemainingDays = 10
-	// Standard certificate validity in days
+	// Default configuration file used by commands that take --config
+	defaultConfigPath = "/config/certs.yaml"
+	// Renew if the certificate has this many days or fewer remaining, unless
+	// 'renew_before_days' is set
+	defaultRenewBeforeDays = 10
+	// Assumed certificate validity in days when the certificate file can't be read
 	certValidityDays = 90
-	// How often the daemon checks certificates
-	checkInterval = 1 * time.Hour
+	// How often the daemon checks certificates unless 'check_interval' is set
+	defaultCheckInterval = 1 * time.Hour
 	// Full path to the acme.sh script inside the container
 	acmeShPath = "/root/.acme.sh/acme.sh"
 )
@@ -46,22 +57,121 @@ const (
 // Add a mutex for database write operations to ensure thread safety
 var dbMutex = &sync.Mutex{}
 
+// prune is set by 'run --prune' and removes certificates that are no longer
+// configured, like 'prune: true' in the configuration
+var prune bool
+
+// once is set by 'run --once', which exits after a single check
+var once bool
+
+// checkIntervalOverride is set by 'run --check-interval' or GOCERT_CHECK_INTERVAL
+// and takes precedence over 'check_interval' in the configuration
+var checkIntervalOverride time.Duration
+
+// checkInterval is how often the daemon checks certificates, updated on every check
+var checkInterval = defaultCheckInterval
+
+// cycleMutex serializes check cycles with on-demand renewals triggered via the API
+var cycleMutex = &sync.Mutex{}
+
 // GlobalConfig holds top-level configuration like the account email.
 type GlobalConfig struct {
-	Email string `yaml:"email"`
+	Email             string                    `yaml:"email"`
+	Backend           string                    `yaml:"backend"`
+	Notifiers         map[string]NotifierConfig `yaml:"notifiers"`
+	NotifyRetryPeriod string                    `yaml:"notify_retry_period"`
+	NotRenewedDays    int                       `yaml:"not_renewed_days"`
+	CheckUpdates      bool                      `yaml:"check_updates"`
+	CheckInterval     string                    `yaml:"check_interval"`
+	StartupJitter     string                    `yaml:"startup_jitter"`
+	DeletedRetention  string                    `yaml:"deleted_retention"`
+	Prune             bool                      `yaml:"prune"`
+	RateLimit         RateLimitConfig           `yaml:"rate_limit"`
+	RenewBeforeDays   int                       `yaml:"renew_before_days"`
+	MaxAttempts       int                       `yaml:"max_attempts"`
+	RetryBackoff      RetryBackoffConfig        `yaml:"retry_backoff"`
+	Quarantine        QuarantineConfig          `yaml:"quarantine"`
+	MaxParallel       int                       `yaml:"max_parallel"`
+	RevokeOrphaned    RevokeOrphanedConfig      `yaml:"revoke_orphaned"`
+	StatusColumns     []string                  `yaml:"status_columns"`
+	Archive           ArchiveConfig             `yaml:"archive"`
+	PostCheckHook     []string                  `yaml:"post_check_hook"`
+	Vault             VaultConfig               `yaml:"vault"`
+	S3                S3Config                  `yaml:"s3"`
+	// Staging issues all certificates from the staging CA of their issuer
+	Staging bool `yaml:"staging"`
+	// Accounts are named ACME accounts besides the one of Email
+	Accounts map[string]AccountConfig `yaml:"accounts"`
+	// DNS tunes the DNS providers of the native backend, keyed by type
+	DNS map[string]DNSProviderConfig `yaml:"dns"`
+	// ExpiryNotifications replaces NotRenewedDays with several steps
+	ExpiryNotifications []ExpiryNotificationStep `yaml:"expiry_notifications"`
+	// RenewalWindows and FreezeWindows restrict when due certificates are renewed
+	RenewalWindows []ScheduleWindow `yaml:"renewal_windows"`
+	FreezeWindows  []ScheduleWindow `yaml:"freeze_windows"`
+	// IssueTimeout limits each issuance, e.g. '10m'
+	IssueTimeout string `yaml:"issue_timeout"`
+	// HTTP01 configures the challenge server of certificates with 'type: http'
+	HTTP01    HTTP01Config `yaml:"http01"`
+	FileModes `yaml:",inline"`
 }
 
 // CertConfig defines the structure for each certificate entry in the YAML file.
 type CertConfig struct {
-	Type    string   `yaml:"type"`
-	Issuer  string   `yaml:"issuer"`
-	Domains []string `yaml:"domains"`
+	Type    string   `yaml:"type" json:"type,omitempty"`
+	Issuer  string   `yaml:"issuer" json:"issuer,omitempty"`
+	Domains []string `yaml:"domains" json:"domains,omitempty"`
+	Backend string   `yaml:"backend" json:"backend,omitempty"`
+	// Account selects a named account of 'configs.accounts' instead of the
+	// default one of 'configs.email'
+	Account string `yaml:"account" json:"account,omitempty"`
+	// KeyType is 'ec-256' (default), 'ec-384', 'rsa-2048' or 'rsa-4096'
+	KeyType string `yaml:"key_type" json:"key_type,omitempty"`
+	// KeyTypes issues one certificate per key type instead, e.g. ECDSA and
+	// RSA; the first one is also written to the default files
+	KeyTypes []string `yaml:"key_types" json:"key_types,omitempty"`
+	// RenewBeforeDays overrides 'configs.renew_before_days' for this certificate
+	RenewBeforeDays int `yaml:"renew_before_days" json:"renew_before_days,omitempty"`
+	// MaxAttempts overrides 'configs.max_attempts' for this certificate
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts,omitempty"`
+	// IssueTimeout overrides 'configs.issue_timeout' for this certificate
+	IssueTimeout string `yaml:"issue_timeout" json:"issue_timeout,omitempty"`
+	// ExtraArgs are appended to the acme.sh command line, see acmeShExtraArgs
+	ExtraArgs []string `yaml:"extra_args" json:"extra_args,omitempty"`
+	// Monitor makes this a monitor-only entry: the certificate served at this
+	// host:port, or read from a source such as 'file://' or 's3://' (see
+	// monitorSources), is tracked but never issued by gocert.
+	Monitor string `yaml:"monitor" json:"monitor,omitempty"`
+	// FileModes overrides the file permissions set in 'configs:'
+	FileModes `yaml:",inline"`
+	// Exports lists formats written next to the PEM files: 'pkcs12' or
+	// 'pkcs12-legacy', protected by PKCS12Password
+	Exports        []string `yaml:"exports" json:"exports,omitempty"`
+	PKCS12Password string   `yaml:"pkcs12_password" json:"pkcs12_password,omitempty"`
+	// Deploy lists the hooks run after the certificate was issued or renewed
+	Deploy []HookConfig `yaml:"deploy" json:"deploy,omitempty"`
+	// Endpoints are host:port addresses expected to serve this certificate
+	Endpoints []string `yaml:"endpoints" json:"endpoints,omitempty"`
+	// Metadata holds free-form fields, e.g. an owner, shown by 'status --columns'
+	Metadata map[string]string `yaml:"metadata" json:"metadata,omitempty"`
+	// Env sets variables of the acme.sh runs of this certificate, such as
+	// DNS credentials; values may be secret references, see acmeShEnv
+	Env map[string]string `yaml:"env" json:"env,omitempty"`
+	// EnvFile names a file of KEY=VALUE lines, e.g. a mounted secret, read
+	// for each issuance; 'env' takes precedence over it
+	EnvFile string `yaml:"env_file" json:"env_file,omitempty"`
+	// PassEnv names variables of the daemon's environment acme.sh gets too
+	PassEnv []string `yaml:"pass_env" json:"pass_env,omitempty"`
+	// RenewalWindows and FreezeWindows override those in 'configs:'
+	RenewalWindows []ScheduleWindow `yaml:"renewal_windows" json:"renewal_windows,omitempty"`
+	FreezeWindows  []ScheduleWindow `yaml:"freeze_windows" json:"freeze_windows,omitempty"`
 }
 
 // FullConfig represents the entire structure of the YAML file,
 // using an inline map to handle dynamic certificate names.
 type FullConfig struct {
 	Configs      GlobalConfig           `yaml:"configs"`
+	Include      []string               `yaml:"include"`
 	Certificates map[string]CertConfig  `yaml:",inline"`
 }
 
@@ -74,16 +184,41 @@ type CertDBRecord struct {
 	Domains    string
 	LastIssued time.Time
 	Status     string
+	NotAfter   time.Time
+	SharedWith string
+	KeyType    string
+	// NotBefore is the start of the certificate's validity, which may be
+	// earlier than LastIssued for certificates rebuilt from their files
+	NotBefore time.Time
 }
 
 // validateConfig validates the YAML file content against the JSON schema
 // that has been embedded into the binary.
 func validateConfig(yamlContent []byte) error {
-	// 1. Convert YAML to a generic interface{}
-	var data interface{}
-	if err := yaml.Unmarshal(yamlContent, &data); err != nil {
+	return validateConfigExcept(yamlContent, nil)
+}
+
+// validateConfigExcept validates like validateConfig, but doesn't report the
+// schema errors ignore returns true for.
+func validateConfigExcept(yamlContent []byte, ignore func(gojsonschema.ResultError) bool) error {
+	// 1. Convert YAML to a generic interface{}, decrypting encrypted values
+	yamlContent, err := decryptSOPSFile(yamlContent)
+	if err != nil {
+		return err
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(yamlContent, doc); err != nil {
 		return fmt.Errorf("failed to unmarshal YAML for validation: %w", err)
 	}
+	if err := decryptConfigNode(doc); err != nil {
+		return err
+	}
+	var data interface{}
+	if len(doc.Content) > 0 {
+		if err := doc.Decode(&data); err != nil {
+			return fmt.Errorf("failed to unmarshal YAML for validation: %w", err)
+		}
+	}
 
 	// 2. Convert the generic interface{} to JSON bytes
 	jsonBytes, err := json.Marshal(data)
@@ -103,10 +238,21 @@ func validateConfig(yamlContent []byte) error {
 
 	if !result.Valid() {
 		var errorMessages []string
-		for _, desc := range result.Errors() {
-			errorMessages = append(errorMessages, fmt.Sprintf("- %s", desc))
+		errs := result.Errors()
+		sort.SliceStable(errs, func(i, j int) bool {
+			li, _, _ := schemaErrorPosition(doc, errs[i])
+			lj, _, _ := schemaErrorPosition(doc, errs[j])
+			return li < lj
+		})
+		for _, desc := range errs {
+			if ignore != nil && ignore(desc) {
+				continue
+			}
+			errorMessages = append(errorMessages, "- "+formatSchemaError(doc, desc))
+		}
+		if len(errorMessages) > 0 {
+			return fmt.Errorf("configuration validation failed:\n%s", strings.Join(errorMessages, "\n"))
 		}
-		return fmt.Errorf("configuration validation failed:\n%s", strings.Join(errorMessages, "\n"))
 	}
 
 	log.Println("Configuration syntax is valid.")
@@ -139,21 +285,252 @@ func setupDatabase(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create table: %w", err)
 	}
 
-	alterStatement := `ALTER TABLE certificates ADD COLUMN status TEXT NOT NULL DEFAULT 'unknown'`
-	_, _ = db.Exec(alterStatement)
+	alterStatements := []string{
+		`ALTER TABLE certificates ADD COLUMN status TEXT NOT NULL DEFAULT 'unknown'`,
+		`ALTER TABLE certificates ADD COLUMN not_after TIMESTAMP`,
+		`ALTER TABLE certificates ADD COLUMN shared_with TEXT`,
+		`ALTER TABLE certificates ADD COLUMN key_type TEXT`,
+		`ALTER TABLE deleted_certificates ADD COLUMN key_type TEXT`,
+		`ALTER TABLE certificates ADD COLUMN not_before TIMESTAMP`,
+		`ALTER TABLE deleted_certificates ADD COLUMN not_before TIMESTAMP`,
+	}
+	for _, alterStatement := range alterStatements {
+		// Fails harmlessly if the column already exists.
+		_, _ = db.Exec(alterStatement)
+	}
+
+	definitionsStatement := `
+	CREATE TABLE IF NOT EXISTS cert_definitions (
+		name TEXT PRIMARY KEY,
+		definition TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);`
+
+	if _, err = db.Exec(definitionsStatement); err != nil {
+		return nil, fmt.Errorf("failed to create certificate definitions table: %w", err)
+	}
+
+	queueStatement := `
+	CREATE TABLE IF NOT EXISTS notification_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		channel TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		last_error TEXT
+	);`
+
+	if _, err = db.Exec(queueStatement); err != nil {
+		return nil, fmt.Errorf("failed to create notification queue table: %w", err)
+	}
+
+	deletedStatement := `
+	CREATE TABLE IF NOT EXISTS deleted_certificates (
+		name TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		issuer TEXT NOT NULL,
+		domains TEXT NOT NULL,
+		last_issued TIMESTAMP,
+		status TEXT NOT NULL,
+		not_after TIMESTAMP,
+		shared_with TEXT,
+		definition TEXT,
+		deleted_at TIMESTAMP NOT NULL,
+		reason TEXT,
+		key_type TEXT,
+		not_before TIMESTAMP
+	);`
+
+	if _, err = db.Exec(deletedStatement); err != nil {
+		return nil, fmt.Errorf("failed to create deleted certificates table: %w", err)
+	}
+
+	historyStatement := `
+	CREATE TABLE IF NOT EXISTS cert_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		event TEXT NOT NULL,
+		type TEXT NOT NULL,
+		issuer TEXT NOT NULL,
+		domains TEXT NOT NULL,
+		last_issued TIMESTAMP,
+		status TEXT NOT NULL,
+		not_after TIMESTAMP,
+		recorded_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS cert_history_name ON cert_history (name, id);`
+
+	if _, err = db.Exec(historyStatement); err != nil {
+		return nil, fmt.Errorf("failed to create certificate history table: %w", err)
+	}
+
+	hookRunsStatement := `
+	CREATE TABLE IF NOT EXISTS hook_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		hook INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		success BOOLEAN NOT NULL,
+		error TEXT,
+		output TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS hook_runs_name ON hook_runs (name, id);`
+
+	if _, err = db.Exec(hookRunsStatement); err != nil {
+		return nil, fmt.Errorf("failed to create hook runs table: %w", err)
+	}
+	// Fails harmlessly if the column already exists.
+	_, _ = db.Exec(`ALTER TABLE hook_runs ADD COLUMN target TEXT NOT NULL DEFAULT ''`)
+
+	hookStatsStatement := `
+	CREATE TABLE IF NOT EXISTS hook_stats (
+		name TEXT NOT NULL,
+		hook INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		target TEXT NOT NULL,
+		runs INTEGER NOT NULL DEFAULT 0,
+		failures INTEGER NOT NULL DEFAULT 0,
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		last_success TIMESTAMP,
+		last_failure TIMESTAMP,
+		PRIMARY KEY (name, hook, type, target)
+	);`
+
+	if _, err = db.Exec(hookStatsStatement); err != nil {
+		return nil, fmt.Errorf("failed to create hook stats table: %w", err)
+	}
+
+	issueRunsStatement := `
+	CREATE TABLE IF NOT EXISTS issue_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		backend TEXT NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		success BOOLEAN NOT NULL,
+		error TEXT,
+		output TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS issue_runs_name ON issue_runs (name, id);`
+
+	if _, err = db.Exec(issueRunsStatement); err != nil {
+		return nil, fmt.Errorf("failed to create issue runs table: %w", err)
+	}
+
+	attemptsStatement := `
+	CREATE TABLE IF NOT EXISTS issue_attempts (
+		name TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL,
+		last_error TEXT,
+		updated_at TIMESTAMP NOT NULL
+	);`
+
+	if _, err = db.Exec(attemptsStatement); err != nil {
+		return nil, fmt.Errorf("failed to create issue attempts table: %w", err)
+	}
+	// Fails harmlessly if the column already exists.
+	_, _ = db.Exec(`ALTER TABLE issue_attempts ADD COLUMN next_retry_at TIMESTAMP`)
+
+	quarantineStatement := `
+	CREATE TABLE IF NOT EXISTS quarantine (
+		name TEXT PRIMARY KEY,
+		since TIMESTAMP NOT NULL,
+		flaps INTEGER NOT NULL,
+		next_retry_at TIMESTAMP NOT NULL,
+		released_at TIMESTAMP
+	);`
+
+	if _, err = db.Exec(quarantineStatement); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine table: %w", err)
+	}
+
+	expiryNoticesStatement := `
+	CREATE TABLE IF NOT EXISTS expiry_notices (
+		name TEXT PRIMARY KEY,
+		days INTEGER NOT NULL,
+		not_after TIMESTAMP NOT NULL
+	);`
+
+	if _, err = db.Exec(expiryNoticesStatement); err != nil {
+		return nil, fmt.Errorf("failed to create expiry notices table: %w", err)
+	}
+
+	warningsStatement := `
+	CREATE TABLE IF NOT EXISTS cert_warnings (
+		name TEXT NOT NULL,
+		code TEXT NOT NULL,
+		message TEXT NOT NULL,
+		first_seen TIMESTAMP NOT NULL,
+		last_seen TIMESTAMP NOT NULL,
+		PRIMARY KEY (name, code)
+	);`
+
+	if _, err = db.Exec(warningsStatement); err != nil {
+		return nil, fmt.Errorf("failed to create warnings table: %w", err)
+	}
+
+	decisionsStatement := `
+	CREATE TABLE IF NOT EXISTS cert_decisions (
+		name TEXT PRIMARY KEY,
+		checked_at TIMESTAMP NOT NULL,
+		action TEXT NOT NULL,
+		reason TEXT NOT NULL
+	);`
+
+	if _, err = db.Exec(decisionsStatement); err != nil {
+		return nil, fmt.Errorf("failed to create decisions table: %w", err)
+	}
+
+	stateStatement := `
+	CREATE TABLE IF NOT EXISTS daemon_state (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);`
+
+	if _, err = db.Exec(stateStatement); err != nil {
+		return nil, fmt.Errorf("failed to create daemon state table: %w", err)
+	}
 
 	return db, nil
 }
 
-// getCertState retrieves the full state of a certificate from the database.
-func getCertState(db *sql.DB, name string) (CertDBRecord, bool, error) {
-	query := "SELECT name, type, issuer, domains, last_issued, status FROM certificates WHERE name = ?"
-	row := db.QueryRow(query, name)
+// certColumns lists the certificates columns read into a CertDBRecord, in scan order.
+const certColumns = "name, type, issuer, domains, last_issued, status, not_after, shared_with, key_type, not_before"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+// scanCertRecord reads a row selected with certColumns into a CertDBRecord.
+func scanCertRecord(row rowScanner) (CertDBRecord, error) {
 	var record CertDBRecord
-	var lastIssued sql.NullTime
+	var lastIssued, notAfter, notBefore sql.NullTime
+	var sharedWith, keyType sql.NullString
+
+	if err := row.Scan(&record.Name, &record.Type, &record.Issuer, &record.Domains, &lastIssued, &record.Status, &notAfter, &sharedWith, &keyType, &notBefore); err != nil {
+		return CertDBRecord{}, err
+	}
+	record.SharedWith, record.KeyType, record.NotBefore = sharedWith.String, keyType.String, notBefore.Time
+
+	if lastIssued.Valid {
+		record.LastIssued = lastIssued.Time
+	}
+	if notAfter.Valid {
+		record.NotAfter = notAfter.Time
+	}
+	return record, nil
+}
 
-	err := row.Scan(&record.Name, &record.Type, &record.Issuer, &record.Domains, &lastIssued, &record.Status)
+// getCertState retrieves the full state of a certificate from the database.
+func getCertState(db *sql.DB, name string) (CertDBRecord, bool, error) {
+	query := "SELECT " + certColumns + " FROM certificates WHERE name = ?"
+	record, err := scanCertRecord(db.QueryRow(query, name))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return CertDBRecord{}, false, nil
@@ -161,42 +538,149 @@ func getCertState(db *sql.DB, name string) (CertDBRecord, bool, error) {
 		return CertDBRecord{}, false, fmt.Errorf("failed to query certificate state for '%s': %w", name, err)
 	}
 
-	if lastIssued.Valid {
-		record.LastIssued = lastIssued.Time
+	return record, true, nil
+}
+
+// listCertStates retrieves the state of all certificates, ordered by name.
+func listCertStates(db *sql.DB) ([]CertDBRecord, error) {
+	rows, err := db.Query("SELECT " + certColumns + " FROM certificates ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query certificates: %w", err)
 	}
+	defer rows.Close()
 
-	return record, true, nil
+	var records []CertDBRecord
+	for rows.Next() {
+		record, err := scanCertRecord(rows)
+		if err != nil {
+			log.Printf("Warning: could not scan row: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
 }
 
 // updateCertState updates or inserts the full state of a certificate in the database.
-func updateCertState(db *sql.DB, name string, config CertConfig, issueTime time.Time, status string) error {
+// A zero notAfter means the real expiry is unknown.
+func updateCertState(db *sql.DB, name string, config CertConfig, issueTime time.Time, status string, notBefore, notAfter time.Time) error {
 	domainsStr := strings.Join(config.Domains, ",")
-	var lastIssued sql.NullTime
+	var lastIssued, notAfterTime sql.NullTime
 	if !issueTime.IsZero() {
 		lastIssued.Time = issueTime
 		lastIssued.Valid = true
 	}
+	if !notAfter.IsZero() {
+		notAfterTime.Time = notAfter
+		notAfterTime.Valid = true
+	}
 
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
+	defer invalidateCertCache()
 
 	query := `
-	INSERT INTO certificates (name, type, issuer, domains, last_issued, status)
-	VALUES (?, ?, ?, ?, ?, ?)
+	INSERT INTO certificates (name, type, issuer, domains, last_issued, status, not_after, key_type, not_before)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(name) DO UPDATE SET
 		type=excluded.type,
 		issuer=excluded.issuer,
 		domains=excluded.domains,
 		last_issued=excluded.last_issued,
-		status=excluded.status;`
+		status=excluded.status,
+		not_after=excluded.not_after,
+		key_type=excluded.key_type,
+		not_before=excluded.not_before;`
 
-	_, err := db.Exec(query, name, config.Type, config.Issuer, domainsStr, lastIssued, status)
+	_, err := db.Exec(query, name, config.Type, config.Issuer, domainsStr, lastIssued, status, notAfterTime, config.KeyType, nullTime(notBefore))
 	if err != nil {
 		return fmt.Errorf("failed to update certificate state for '%s': %w", name, err)
 	}
+	return recordHistory(db, name, status)
+}
+
+// updateCertValidity records the real validity period of a certificate.
+func updateCertValidity(db *sql.DB, name string, notBefore, notAfter time.Time) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	defer invalidateCertCache()
+
+	if _, err := db.Exec("UPDATE certificates SET not_before = ?, not_after = ? WHERE name = ?", nullTime(notBefore), notAfter, name); err != nil {
+		return fmt.Errorf("failed to update expiry for '%s': %w", name, err)
+	}
+	return recordHistory(db, name, "expiry_updated")
+}
+
+// updateCertKeyType records the key type of a certificate.
+func updateCertKeyType(db *sql.DB, name, keyType string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	defer invalidateCertCache()
+
+	if _, err := db.Exec("UPDATE certificates SET key_type = ? WHERE name = ?", keyType, name); err != nil {
+		return fmt.Errorf("failed to update key type for '%s': %w", name, err)
+	}
+	return nil
+}
+
+// setCertStatus changes only the status of a certificate.
+func setCertStatus(db *sql.DB, name, status string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	defer invalidateCertCache()
+
+	if _, err := db.Exec(`UPDATE certificates SET status = ? WHERE name = ?`, status, name); err != nil {
+		return fmt.Errorf("failed to update status of '%s': %w", name, err)
+	}
+	return recordHistory(db, name, status)
+}
+
+// setSharedWith links a certificate to the entry whose certificate it shares,
+// or removes the link if primary is empty.
+func setSharedWith(db *sql.DB, name, primary string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	defer invalidateCertCache()
+
+	var value sql.NullString
+	if primary != "" {
+		value = sql.NullString{String: primary, Valid: true}
+	}
+	if _, err := db.Exec(`UPDATE certificates SET shared_with = ? WHERE name = ?`, value, name); err != nil {
+		return fmt.Errorf("failed to update shared certificate of '%s': %w", name, err)
+	}
+	return nil
+}
+
+// setDaemonState records a daemon-wide value, such as the detected acme.sh version.
+func setDaemonState(db *sql.DB, key, value string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT INTO daemon_state (key, value, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+	`, key, value, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store daemon state '%s': %w", key, err)
+	}
 	return nil
 }
 
+// getDaemonState returns a daemon-wide value and when it was recorded.
+func getDaemonState(db *sql.DB, key string) (string, time.Time, bool, error) {
+	var value string
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT value, updated_at FROM daemon_state WHERE key = ?`, key).Scan(&value, &updatedAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	return value, updatedAt, true, nil
+}
+
 // registerAccount ensures the acme.sh account is registered with the provided email.
 func registerAccount(email string) error {
 	if email == "" {
@@ -219,217 +703,1258 @@ func registerAccount(email string) error {
 	return nil
 }
 
-// issueCertificate runs the acme.sh command to issue or renew a certificate.
-func issueCertificate(name string, config CertConfig, certsBasePath string) error {
-	log.Printf("Issuing/Renewing certificate for '%s' with type '%s' and issuer '%s'\n", name, config.Type, config.Issuer)
-
-	certDir := filepath.Join(certsBasePath, name)
-	certFile := filepath.Join(certDir, "cert.pem")
-	keyFile := filepath.Join(certDir, "key.pem")
-	fullchainFile := filepath.Join(certDir, "fullchain.pem")
+// issueCertificate prepares the certificate directory and issues or renews the
+// certificate with the configured backend. force is only set when asked for
+// explicitly, see Issuer.
+func issueCertificate(name string, config CertConfig, certsBasePath string, force bool) error {
+	certLogger(name, config).Info("Issuing/Renewing certificate", "type", config.Type, "domains", strings.Join(config.Domains, ","))
 
-	if err := os.MkdirAll(certDir, 0755); err != nil {
+	files := certFilesFor(certsBasePath, name)
+	if err := os.MkdirAll(files.Dir, 0755); err != nil {
 		return fmt.Errorf("failed to create certificate directory for '%s': %w", name, err)
 	}
 
-	var domainArgs []string
-	for _, domain := range config.Domains {
-		domainArgs = append(domainArgs, "-d", domain)
+	issuer, err := issuerFor(config)
+	if err != nil {
+		return err
 	}
-	log.Printf("Domains: %s\n", strings.Join(config.Domains, " "))
-
-	args := []string{
-		"--issue", "--dns", config.Type,
-		"--cert-file", certFile, "--key-file", keyFile, "--fullchain-file", fullchainFile,
-		"--server", config.Issuer, "--force",
+	if len(config.KeyTypes) == 0 {
+		return issuer.Issue(name, config, files, force)
 	}
-	args = append(args, domainArgs...)
-
-	cmd := exec.Command(acmeShPath, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 
-	return cmd.Run()
+	// Each key type gets its own certificate for the same domains, stored
+	// side by side; the first one is also copied to the default files.
+	for i, keyType := range config.KeyTypes {
+		typed := config
+		typed.KeyType, typed.KeyTypes = keyType, nil
+		typedFiles := keyTypeFiles(certsBasePath, name, keyType)
+		if err := issuer.Issue(name, typed, typedFiles, force); err != nil {
+			return fmt.Errorf("failed to issue the %s certificate: %w", keyType, err)
+		}
+		if i > 0 {
+			continue
+		}
+		for _, pair := range [][2]string{{typedFiles.Cert, files.Cert}, {typedFiles.Key, files.Key}, {typedFiles.Fullchain, files.Fullchain}} {
+			if _, err := copyIfChanged(pair[0], pair[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-// processSingleCert checks and acts on a single certificate. It's designed to be run in a goroutine.
-func processSingleCert(wg *sync.WaitGroup, name string, config CertConfig, db *sql.DB, certsBasePath string) {
-	defer wg.Done()
-
-	log.Printf("--- Checking certificate: %s ---", name)
-
-	state, found, err := getCertState(db, name)
-	if err != nil {
-		log.Printf("Error getting state for '%s', skipping: %v", name, err)
-		return
+// certExpiry returns the expiry date of a certificate: the recorded NotAfter
+// if known, otherwise the expected expiry based on the last issue time.
+func certExpiry(record CertDBRecord) time.Time {
+	if !record.NotAfter.IsZero() {
+		return record.NotAfter
 	}
+	return record.LastIssued.AddDate(0, 0, certValidityDays)
+}
 
-	needsAction := false
-	if !found {
-		log.Printf("Certificate '%s' not found in database. Issuing for the first time.", name)
-		needsAction = true
-	} else {
-		expiryDate := state.LastIssued.AddDate(0, 0, certValidityDays)
-		remainingDuration := time.Until(expiryDate)
-		remainingDays := int(remainingDuration.Hours() / 24)
-
-		if remainingDays <= renewalThresholdRemainingDays {
-			log.Printf("Certificate '%s' has %d days remaining. Renewing.", name, remainingDays)
-			needsAction = true
-		} else {
-			log.Printf("Certificate '%s' is up to date (%d days remaining). No action needed.", name, remainingDays)
-		}
+// renewCertificate issues a certificate and records the outcome in the database.
+// The previous issue time is kept on failure so the renewal math stays correct.
+func renewCertificate(name string, config CertConfig, state CertDBRecord, db *sql.DB, certsBasePath string, force bool) error {
+	logger := certLogger(name, config)
+	previous, previousFiles := readIssuance(certFilesFor(certsBasePath, name))
+	started := time.Now()
+	issueErr := issueCertificate(name, config, certsBasePath, force)
+	duration := time.Since(started)
+	metricIssuanceDuration.Observe(duration.Seconds(), backendFor(config))
+	if err := recordIssueRun(db, name, backendFor(config), started, duration, takeAcmeOutput(name), issueErr); err != nil {
+		logger.Warn(err.Error())
 	}
 
-	if needsAction {
-		err := issueCertificate(name, config, certsBasePath)
-		var newStatus string
-		var newIssueTime time.Time
+	var newStatus string
+	var newIssueTime time.Time
+	notBefore, notAfter := state.NotBefore, state.NotAfter
+	recorded := config
 
+	if issueErr != nil {
+		logger.Error("Failed to issue certificate", "error", issueErr, "duration", duration.Round(time.Millisecond))
+		newStatus = "failed"
+		if errors.Is(issueErr, errIssueTimeout) {
+			newStatus = statusTimeout
+		}
+		newIssueTime = state.LastIssued
+		// Keep the domains of the existing certificate, so a failed reissue
+		// after a domain change is retried.
+		if state.Domains != "" {
+			recorded.Domains = strings.Split(state.Domains, ",")
+		}
+		recorded.KeyType = state.KeyType
+		metricIssuanceTotal.Inc(name, "failure")
+		event := NotificationEvent{
+			Event:   "failed",
+			Cert:    name,
+			Message: fmt.Sprintf("Failed to issue certificate '%s': %v", name, issueErr),
+		}
+		if !state.LastIssued.IsZero() || !state.NotAfter.IsZero() {
+			event.NotAfter = currentExpiry(state, certsBasePath)
+		}
+		sendNotification(db, event)
+		failures, nextRetry, err := recordIssueFailure(db, name, issueErr)
 		if err != nil {
-			log.Printf("ERROR: Failed to issue certificate for '%s': %v", name, err)
-			newStatus = "failed"
-			newIssueTime = state.LastIssued
+			logger.Warn(err.Error())
+		} else if limit := maxAttemptsFor(config); limit > 0 && failures >= limit {
+			logger.Error(fmt.Sprintf("Giving up until 'gocert retry %s'", name), "failures", failures)
+			newStatus = statusNeedsIntervention
+			sendNotification(db, NotificationEvent{
+				Event:   "needs_intervention",
+				Cert:    name,
+				Message: fmt.Sprintf("Certificate '%s' failed %d times in a row and is no longer retried: %v. Run 'gocert retry %s' after fixing the cause.", name, failures, issueErr, name),
+			})
+		} else {
+			logger.Info("Retrying after backoff", "failures", failures, "next_retry", nextRetry.Format(time.RFC3339))
+		}
+	} else {
+		logger.Info("Successfully issued/renewed certificate", "duration", duration.Round(time.Millisecond))
+		newStatus = "issued"
+		newIssueTime = time.Now()
+		if cert, err := readCertificateFile(certFilesFor(certsBasePath, name).Cert); err != nil {
+			logger.Warn(fmt.Sprintf("Could not read issued certificate, falling back to %d-day validity", certValidityDays), "error", err)
+			notBefore, notAfter = time.Time{}, time.Time{}
+			recorded.KeyType = strings.Join(keyTypesFor(config), ",")
 		} else {
-			log.Printf("Successfully issued/renewed certificate for '%s'", name)
-			newStatus = "issued"
-			newIssueTime = time.Now()
+			notBefore, notAfter = cert.NotBefore, cert.NotAfter
+			recorded.KeyType = issuedKeyType(certsBasePath, name, config, cert)
+		}
+		metricIssuanceTotal.Inc(name, "success")
+		if err := resetIssueFailures(db, name); err != nil {
+			logger.Warn(err.Error())
 		}
+		sendNotification(db, NotificationEvent{
+			Event:   "issued",
+			Cert:    name,
+			Message: fmt.Sprintf("Certificate '%s' was issued for %s", name, strings.Join(config.Domains, ", ")),
+		})
+	}
 
-		if err := updateCertState(db, name, config, newIssueTime, newStatus); err != nil {
-			log.Printf("ERROR: Failed to update database for '%s': %v", name, err)
+	if err := updateCertState(db, name, recorded, newIssueTime, newStatus, notBefore, notAfter); err != nil {
+		logger.Error("Failed to update database", "error", err)
+	}
+	if issueErr == nil {
+		archiveIssuance(name, previous, previousFiles, certsBasePath)
+		writeExports(name, config, certsBasePath)
+		if err := applyFileModes(name, config, certsBasePath); err != nil {
+			logger.Error("Failed to set file permissions", "error", err)
 		}
+		runDeployHooks(db, name, config, certsBasePath, notAfter)
 	}
+	return issueErr
 }
 
-// checkAndProcessCertificates is the core logic loop for the daemon.
-func checkAndProcessCertificates(yamlFile string, db *sql.DB, certsBasePath string, isFirstRun bool) {
-	log.Println("Starting certificate check...")
+// currentExpiry returns the NotAfter of the certificate on disk, falling back
+// to the expiry known from the database if the file can't be read.
+func currentExpiry(record CertDBRecord, certsBasePath string) time.Time {
+	if cert, err := readCertificateFile(certFilesFor(certsBasePath, record.Name).Cert); err == nil {
+		return cert.NotAfter
+	}
+	return certExpiry(record)
+}
 
-	byteValue, err := os.ReadFile(yamlFile)
+// readCertificateFile parses the first PEM-encoded certificate in the given file.
+func readCertificateFile(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Printf("ERROR: Failed to read YAML file '%s': %v", yamlFile, err)
-		return
+		return nil, err
 	}
-
-	// Validate the configuration before proceeding
-	if err := validateConfig(byteValue); err != nil {
-		log.Printf("ERROR: Invalid configuration in %s:\n%v", yamlFile, err)
-		return // Stop processing if config is invalid
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
 	}
+	return x509.ParseCertificate(block.Bytes)
+}
 
-	var fullConfig FullConfig
-	if err := yaml.Unmarshal(byteValue, &fullConfig); err != nil {
-		log.Printf("ERROR: Failed to parse YAML: %v", err)
-		return
-	}
+// processSingleCert checks and acts on a single certificate and reports
+// whether it was renewed. It's designed to be run in a goroutine.
+func processSingleCert(name string, config CertConfig, db *sql.DB, certsBasePath string) (bool, error) {
+	defer metricCertLastCheck.Set(float64(time.Now().Unix()), name)
 
-	// On the first run of the daemon, register the account email.
-	if isFirstRun {
-		if err := registerAccount(fullConfig.Configs.Email); err != nil {
-			// This is not a fatal error, so we just log it.
-			log.Printf("Warning during account registration: %v", err)
-		}
-	}
+	logger := certLogger(name, config)
+	logger.Info("Checking certificate")
 
-	var wg sync.WaitGroup
-	for name, config := range fullConfig.Certificates {
-		wg.Add(1)
-		go processSingleCert(&wg, name, config, db, certsBasePath)
+	if config.Monitor != "" {
+		checkMonitoredCert(name, config, db)
+		return false, nil
 	}
 
-	wg.Wait()
-	log.Printf("Certificate check finished. Next check in %s.", checkInterval)
-}
+	// What this check decides is shown by 'gocert explain'.
+	decide := func(action, reason string, attrs ...any) {
+		recordDecision(db, name, action, reason+formatAttrs(attrs...))
+	}
 
-// displayCertInfo shows the status of all managed certificates from the database.
-func displayCertInfo(db *sql.DB) error {
-	rows, err := db.Query("SELECT name, type, issuer, last_issued, status FROM certificates ORDER BY name")
+	state, found, err := getCertState(db, name)
 	if err != nil {
-		return fmt.Errorf("failed to query certificates: %w", err)
+		logger.Error("Failed to get state, skipping", "error", err)
+		return false, err
 	}
-	defer rows.Close()
-
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "NAME\tSTATUS\tISSUED\tEXPIRES\tREMAINING\tTLS PROVIDER\tDNS PROVIDER")
-	fmt.Fprintln(w, "----\t------\t------\t-------\t---------\t------------\t------------")
 
-	var hasCerts bool
-	for rows.Next() {
-		hasCerts = true
-		var record CertDBRecord
-		var lastIssued sql.NullTime
+	// The entry is configured again after it was orphaned.
+	if found && state.Status == "orphaned" {
+		state.Status = "unknown"
+		if !state.LastIssued.IsZero() {
+			state.Status = "issued"
+		}
+		if err := setCertStatus(db, name, state.Status); err != nil {
+			logger.Warn(err.Error())
+		}
+	}
 
-		if err := rows.Scan(&record.Name, &record.Type, &record.Issuer, &lastIssued, &record.Status); err != nil {
-			log.Printf("Warning: could not scan row: %v", err)
-			continue
+	if found && state.Status == statusNeedsIntervention {
+		failures, lastError, err := issueFailures(db, name)
+		if err != nil {
+			logger.Warn(err.Error())
 		}
+		logger.Error(fmt.Sprintf("Certificate needs intervention, fix the cause and run 'gocert retry %s'", name), "failures", failures, "last_error", lastError)
+		decide("skip", "Certificate needs intervention.", "failures", failures)
+		return false, nil
+	}
 
-		issuedStr, expiresStr, remainingStr := "N/A", "N/A", "N/A"
+	// A quarantined certificate is only retried every 'retry_interval'.
+	if found && evaluateQuarantine(db, name, config, false) {
+		if entry, _, err := getQuarantine(db, name); err == nil && time.Now().Before(entry.NextRetry) {
+			logger.Info("Quarantined for alternating between success and failure", "since", entry.Since.Format(time.RFC3339), "next_retry", entry.NextRetry.Format(time.RFC3339))
+			decide("skip", "Quarantined for alternating between success and failure.", "next_retry", entry.NextRetry.Format(time.RFC3339))
+			return false, nil
+		}
+	}
 
-		if lastIssued.Valid {
-			record.LastIssued = lastIssued.Time
-			expiryDate := record.LastIssued.AddDate(0, 0, certValidityDays)
-			remainingDuration := time.Until(expiryDate)
-			remainingDays := int(remainingDuration.Hours() / 24)
+	// A failed certificate waits for its next retry, unless its domains
+	// changed since.
+	if found && (state.Status == "failed" || state.Status == statusTimeout) && strings.Join(config.Domains, ",") == state.Domains {
+		nextRetry, err := nextIssueRetry(db, name)
+		if err != nil {
+			logger.Warn(err.Error())
+		} else if time.Now().Before(nextRetry) {
+			logger.Info("Backing off after failed issuance", "next_retry", nextRetry.Format(time.RFC3339))
+			decide("skip", "Backing off after failed issuance.", "next_retry", nextRetry.Format(time.RFC3339))
+			return false, nil
+		}
+	}
 
-			issuedStr = record.LastIssued.Format("2006-01-02")
-			expiresStr = expiryDate.Format("2006-01-02")
-			remainingStr = fmt.Sprintf("%d days", remainingDays)
+	due := needsRenewal(name, config, state, found, db, certsBasePath)
+	if !due.Renew {
+		decide("skip", due.Reason, due.Attrs...)
+		// Exports and permissions changed for an issued certificate are
+		// applied right away.
+		writeExports(name, config, certsBasePath)
+		if err := applyFileModes(name, config, certsBasePath); err != nil {
+			logger.Error("Failed to set file permissions", "error", err)
 		}
+		return false, nil
+	}
 
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
-			record.Name, record.Status, issuedStr, expiresStr, remainingStr, record.Issuer, record.Type)
+	// Renewals of certificates in service wait for their windows, unless the
+	// certificate would expire first.
+	if found && time.Now().Before(state.NotAfter) && checkCertFiles(certFilesFor(certsBasePath, name)) == nil {
+		if reason, until, deferred := renewalDeferral(config, time.Now()); deferred {
+			if !until.IsZero() && until.Before(state.NotAfter) {
+				logger.Info("Renewal deferred", "reason", reason, "until", until.Format(time.RFC3339))
+				decide("skip", "Renewal deferred, "+reason+".", "until", until.Format(time.RFC3339))
+				return false, nil
+			}
+			logger.Warn("Renewing despite "+reason+", the certificate would expire before it ends", "not_after", state.NotAfter.Format(time.RFC3339))
+		}
+	}
+	if standbyActive() {
+		logger.Warn("Standby mode, leaving the issuance to the active instance", "promote", "gocert promote")
+		decide("skip", "Standby mode, left to the active instance: "+due.Reason, due.Attrs...)
+		return false, nil
+	}
+	err = renewCertificate(name, config, state, db, certsBasePath, false)
+	evaluateQuarantine(db, name, config, true)
+	if err != nil {
+		decide("failed", due.Reason, append(due.Attrs, "error", err)...)
+	} else {
+		decide("renewed", due.Reason, due.Attrs...)
 	}
+	return true, err
+}
 
-	if !hasCerts {
-		fmt.Println("No certificates found in the database. Run with a config file first.")
-		return nil
+// needsRenewal decides whether a certificate must be issued and logs why.
+// The expiry, key type and source recorded in the database are refreshed
+// from the file on disk.
+func needsRenewal(name string, config CertConfig, state CertDBRecord, found bool, db *sql.DB, certsBasePath string) renewalDecision {
+	logger := certLogger(name, config)
+	if found {
+		refreshed := certStateFromFiles(name, config, state, certsBasePath)
+		// Certificates issued before key types were recorded get theirs from the file.
+		if refreshed.KeyType != state.KeyType {
+			if err := updateCertKeyType(db, name, refreshed.KeyType); err != nil {
+				logger.Warn(err.Error())
+			}
+		}
+		// Certificates rebuilt from their files get type and issuer from the config.
+		if state.Type == "" {
+			if err := updateCertSource(db, name, config.Type, config.Issuer); err != nil {
+				logger.Warn(err.Error())
+			}
+		}
+		if !refreshed.NotAfter.Equal(state.NotAfter) || !refreshed.NotBefore.Equal(state.NotBefore) {
+			if err := updateCertValidity(db, name, refreshed.NotBefore, refreshed.NotAfter); err != nil {
+				logger.Warn("Could not record expiry", "error", err)
+			}
+		}
+		state = refreshed
 	}
 
-	return w.Flush()
+	due := renewalDue(name, config, state, found, certsBasePath)
+	logger.Info(due.Reason, due.Attrs...)
+	return due
 }
 
-// printUsage displays the command-line usage instructions.
-func printUsage() {
-	fmt.Fprintf(os.Stderr, "GoCert Manager: A daemon for automated TLS certificate management.\n\n")
-	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\n", os.Args[0])
-	fmt.Fprintln(os.Stderr, "Commands:")
-	fmt.Fprintf(os.Stderr, "  run <file>    Run the certificate manager as a continuous daemon.\n")
-	fmt.Fprintf(os.Stderr, "                <file>: Path to the YAML configuration file.\n\n")
-	fmt.Fprintf(os.Stderr, "  status        Display the status of all managed certificates from the database.\n\n")
-	fmt.Fprintf(os.Stderr, "  version       Display the build version and commit hash.\n\n")
-	fmt.Fprintf(os.Stderr, "  help          Show this help message.\n")
+// certStateFromFiles returns the database state of a certificate with the
+// expiry of the file on disk, and the key type of the file if none was
+// recorded.
+func certStateFromFiles(name string, config CertConfig, state CertDBRecord, certsBasePath string) CertDBRecord {
+	if cert, err := readCertificateFile(certFilesFor(certsBasePath, name).Cert); err == nil {
+		if state.KeyType == "" {
+			state.KeyType = issuedKeyType(certsBasePath, name, config, cert)
+		}
+		state.NotBefore = cert.NotBefore
+	}
+	state.NotAfter = currentExpiry(state, certsBasePath)
+	return state
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		printUsage()
-		os.Exit(1)
+// renewalDecision is whether a certificate must be issued, and why.
+type renewalDecision struct {
+	Renew  bool
+	Reason string
+	// Attrs are the log attributes of the reason
+	Attrs []any
+}
+
+// renewalDue decides whether a certificate must be issued: it has never
+// been issued or was revoked, its files are missing, its configured domains
+// or key type changed, or it has renewBeforeDays or fewer remaining. It has
+// no side effects; the state is expected to be refreshed by
+// certStateFromFiles.
+func renewalDue(name string, config CertConfig, state CertDBRecord, found bool, certsBasePath string) renewalDecision {
+	if !found {
+		return renewalDecision{Renew: true, Reason: "Certificate not found in database. Issuing for the first time."}
 	}
 
-	dbPath := os.Getenv("GOCERT_DB_PATH")
-	if dbPath == "" {
-		dbPath = defaultDbPath
+	if state.Status == "revoked" {
+		return renewalDecision{Renew: true, Reason: "Certificate was revoked while it wasn't configured. Reissuing."}
 	}
-	certsPath := os.Getenv("GOCERT_CERTS_PATH")
-	if certsPath == "" {
-		certsPath = defaultCertsPath
+
+	// A wiped or damaged volume must not go unnoticed until the next renewal.
+	for _, files := range allCertFiles(certsBasePath, name, config) {
+		if err := checkCertFiles(files); err != nil {
+			return renewalDecision{Renew: true, Reason: "Certificate files are missing or unreadable. Reissuing.", Attrs: []any{"error", err}}
+		}
 	}
 
-	command := os.Args[1]
+	// Order matters too: acme.sh uses the first domain as the main domain.
+	if domains := strings.Join(config.Domains, ","); domains != state.Domains {
+		return renewalDecision{Renew: true, Reason: "Domains changed. Reissuing.", Attrs: []any{"from", state.Domains, "to", domains}}
+	}
+
+	// Other issuer changes wait for the renewal, but a staging certificate
+	// isn't trusted by anyone.
+	if isStagingIssuer(state.Issuer) && !isStagingIssuer(config.Issuer) {
+		return renewalDecision{Renew: true, Reason: "Certificate is from a staging CA. Reissuing.", Attrs: []any{"from", state.Issuer, "to", config.Issuer}}
+	}
+
+	if keyType := configuredKeyType(config); keyType != "" && keyType != state.KeyType {
+		return renewalDecision{Renew: true, Reason: "Key type changed. Reissuing.", Attrs: []any{"from", state.KeyType, "to", keyType}}
+	}
+
+	remainingDays := int(time.Until(state.NotAfter).Hours() / 24)
+	if remainingDays <= renewBeforeDays(config) {
+		return renewalDecision{Renew: true, Reason: "Certificate is due. Renewing.", Attrs: []any{"remaining_days", remainingDays}}
+	}
+	return renewalDecision{Reason: "Certificate is up to date. No action needed.", Attrs: []any{"remaining_days", remainingDays}}
+}
+
+// loadConfigFile reads, validates and parses a single-file configuration.
+func loadConfigFile(yamlFile string) (FullConfig, error) {
+	byteValue, err := os.ReadFile(yamlFile)
+	if err != nil {
+		return FullConfig{}, fmt.Errorf("failed to read YAML file '%s': %w", yamlFile, err)
+	}
+
+	// Files of the earlier flat format have no 'configs:' block.
+	validate := validateConfig
+	if isLegacyConfig(byteValue) {
+		if err := acceptLegacyConfig(yamlFile); err != nil {
+			return FullConfig{}, err
+		}
+		validate = validateLegacyConfig
+	}
+
+	// Validate the configuration before proceeding
+	if err := validate(byteValue); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s:\n%w", yamlFile, err)
+	}
+
+	var fullConfig FullConfig
+	if err := decodeConfig(byteValue, &fullConfig); err != nil {
+		return FullConfig{}, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	return fullConfig, nil
+}
+
+// validateCertConfig checks a certificate entry, from the configuration file
+// or the API, and returns it with its issuer alias resolved and, with
+// 'staging' on, its staging issuer.
+func validateCertConfig(name string, config CertConfig, global GlobalConfig) (CertConfig, error) {
+	// Aliases are stored, shared and passed to acme.sh by their short name.
+	config.Issuer = canonicalIssuer(config.Issuer)
+	if !certNamePattern.MatchString(name) {
+		return config, fmt.Errorf("invalid certificate name")
+	}
+	if err := validateExtraArgs(config.ExtraArgs); err != nil {
+		return config, err
+	}
+	if err := validateAccount(config, global); err != nil {
+		return config, err
+	}
+	if err := validateHooks(name, config); err != nil {
+		return config, err
+	}
+	if err := validateKeyTypes(config); err != nil {
+		return config, err
+	}
+	if err := validateExports(config); err != nil {
+		return config, err
+	}
+	if err := validateCertEnv(config); err != nil {
+		return config, err
+	}
+	if err := validateDNSCredentials(name, config, global); err != nil {
+		return config, err
+	}
+	if err := validateWindows(config.RenewalWindows, config.FreezeWindows); err != nil {
+		return config, err
+	}
+	if err := validateHTTPChallenge(config); err != nil {
+		return config, err
+	}
+	if err := validateIssueTimeout(config.IssueTimeout); err != nil {
+		return config, err
+	}
+	if config.Monitor != "" {
+		if err := validateMonitorSource(config.Monitor); err != nil {
+			return config, err
+		}
+	}
+	if _, err := config.FileModes.resolve(); err != nil {
+		return config, err
+	}
+	// Issuers without a staging CA, such as ZeroSSL or a private CA, are
+	// kept with a warning rather than failing the whole configuration.
+	if global.Staging && config.Issuer != "" {
+		if issuer, err := stagingIssuer(config.Issuer); err != nil {
+			log.Printf("Warning: Certificate '%s': %v, it's issued by '%s' although 'staging' is on", name, err, config.Issuer)
+		} else {
+			config.Issuer = issuer
+		}
+	}
+	return config, nil
+}
+
+// loadConfig reads, validates and parses the YAML configuration: a file, a
+// file with 'include:' patterns or a conf.d directory, whose files are
+// merged.
+func loadConfig(yamlFile string) (FullConfig, error) {
+	var fullConfig FullConfig
+	// The files of the certificates and the 'configs:' block, for errors
+	var sources map[string]string
+	configsFile := yamlFile
+	if isMultiFileConfig(yamlFile) {
+		files, err := configSources(yamlFile)
+		if err != nil {
+			return FullConfig{}, err
+		}
+		if fullConfig, sources, configsFile, err = mergeConfigFiles(yamlFile, files); err != nil {
+			return FullConfig{}, err
+		}
+	} else {
+		var err error
+		if fullConfig, err = loadConfigFile(yamlFile); err != nil {
+			return FullConfig{}, err
+		}
+		sources = map[string]string{}
+		for name := range fullConfig.Certificates {
+			sources[name] = yamlFile
+		}
+	}
+
+	// The certificates' DNS credentials are checked against these.
+	if err := validateZoneCredentials(fullConfig.Configs.DNS); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	for name, config := range fullConfig.Certificates {
+		config, err := validateCertConfig(name, config, fullConfig.Configs)
+		if err != nil {
+			return FullConfig{}, fmt.Errorf("invalid configuration in %s: certificate '%s': %w", sources[name], name, err)
+		}
+		fullConfig.Certificates[name] = config
+	}
+	if _, err := fullConfig.Configs.FileModes.resolve(); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	if err := validateArchive(fullConfig.Configs.Archive); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	if err := validateDNS(fullConfig.Configs.DNS); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	if err := validateRetryBackoff(fullConfig.Configs.RetryBackoff); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	if err := validateQuarantine(fullConfig.Configs.Quarantine); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	if err := validateExpiryLadder(fullConfig.Configs); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	if err := validateWindows(fullConfig.Configs.RenewalWindows, fullConfig.Configs.FreezeWindows); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	if err := validateIssueTimeout(fullConfig.Configs.IssueTimeout); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	if err := validateHTTP01(fullConfig.Configs.HTTP01); err != nil {
+		return FullConfig{}, fmt.Errorf("invalid configuration in %s: %w", configsFile, err)
+	}
+	return fullConfig, nil
+}
+
+// Exit codes of the 'validate' command; usage errors exit with exitUsage
+const (
+	exitValid   = 0
+	exitInvalid = 1
+)
+
+// validateConfigFiles checks configuration files like the daemon does when it
+// loads them, against the schema and the rules beyond it, and returns the
+// process exit code: exitInvalid if any file is unreadable or invalid.
+func validateConfigFiles(yamlFiles []string) int {
+	code := exitValid
+	for _, yamlFile := range yamlFiles {
+		fullConfig, err := loadConfig(yamlFile)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			code = exitInvalid
+			continue
+		}
+		fmt.Printf("%s is valid (%d certificates).\n", yamlFile, len(fullConfig.Certificates))
+	}
+	return code
+}
+
+// Exit codes of the 'issue' command
+const (
+	exitIssued      = 0
+	exitIssueFailed = 1
+	exitUsage       = 2
+)
+
+// issueSingleCert issues or renews one certificate immediately and returns the
+// process exit code. Unless force is set, a certificate that isn't due for
+// renewal yet is left alone, just like in a daemon check cycle.
+func issueSingleCert(yamlFile, name string, db *sql.DB, certsBasePath string, force bool) int {
+	fullConfig, err := loadEffectiveConfig(yamlFile, db)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitUsage
+	}
+	config, ok := fullConfig.Certificates[name]
+	if !ok {
+		log.Printf("ERROR: certificate '%s' is not configured in %s", name, yamlFile)
+		return exitUsage
+	}
+	if config.Monitor != "" {
+		log.Printf("ERROR: certificate '%s' is monitor-only and can't be issued by gocert", name)
+		return exitUsage
+	}
+
+	primaryOf := sharedCertGroups(fullConfig)
+	if primary, ok := primaryOf[name]; ok {
+		log.Printf("Certificate '%s' shares the certificate of '%s', issuing '%s' instead.", name, primary, primary)
+		name, config = primary, fullConfig.Certificates[primary]
+	}
+
+	configureNotifiers(fullConfig.Configs)
+	configureIssuers(fullConfig.Configs)
+	if backendFor(config) == backendAcmeSh {
+		if _, err := detectAcmeShVersion(); err != nil {
+			log.Printf("Warning: could not detect the acme.sh version, feature checks are disabled: %v", err)
+		}
+	}
+
+	unlock := lockCycle(certsBasePath, fmt.Sprintf("renewal of '%s'", name))
+	defer unlock()
+
+	state, found, err := getCertState(db, name)
+	if err != nil {
+		log.Printf("ERROR: failed to get state for '%s': %v", name, err)
+		return exitIssueFailed
+	}
+	if found && state.Status == statusNeedsIntervention {
+		log.Printf("ERROR: certificate '%s' failed too many times, fix the cause and run 'gocert retry %s'", name, name)
+		return exitIssueFailed
+	}
+	if !force && !needsRenewal(name, config, state, found, db, certsBasePath).Renew {
+		return exitIssued
+	}
+	if err := renewCertificate(name, config, state, db, certsBasePath, force); err != nil {
+		return exitIssueFailed
+	}
+	shareWithFollowers(name, fullConfig, primaryOf, db, certsBasePath)
+	return exitIssued
+}
+
+// handleUnconfiguredCerts deals with database records whose entry is no longer
+// in the configuration. With prune they are soft-deleted, so they can still be
+// restored if that was a mistake; otherwise they are only marked 'orphaned'.
+func handleUnconfiguredCerts(fullConfig FullConfig, db *sql.DB, certsBasePath string, prune bool) {
+	records, err := listCertStates(db)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		if _, ok := fullConfig.Certificates[record.Name]; ok {
+			continue
+		}
+		if prune {
+			if err := softDeleteCertificate(db, record.Name, certsBasePath, "removed from configuration"); err != nil {
+				log.Printf("ERROR: Failed to remove '%s': %v", record.Name, err)
+				continue
+			}
+			log.Printf("Certificate '%s' is no longer configured and was removed. Use 'gocert restore %s' to bring it back.", record.Name, record.Name)
+			continue
+		}
+		if record.Status == "orphaned" || record.Status == "revoked" {
+			continue
+		}
+		if err := setCertStatus(db, record.Name, "orphaned"); err != nil {
+			log.Printf("ERROR: %v", err)
+			continue
+		}
+		log.Printf("Certificate '%s' is no longer configured and was marked orphaned. Enable 'prune' or run 'gocert remove %s' to remove it.", record.Name, record.Name)
+	}
+}
+
+// requestReload validates the configuration and, if it is valid, schedules
+// an immediate check cycle in the daemon loop.
+func requestReload(yamlFile string, reload chan<- struct{}) error {
+	if _, err := loadConfig(yamlFile); err != nil {
+		return err
+	}
+
+	select {
+	case reload <- struct{}{}:
+	default:
+		// A reload is already pending.
+	}
+	return nil
+}
+
+// watchReloadSignal reloads the configuration whenever the daemon receives SIGHUP.
+func watchReloadSignal(yamlFile string, reload chan<- struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Received SIGHUP, reloading configuration.")
+			if err := requestReload(yamlFile, reload); err != nil {
+				log.Printf("ERROR: Reload failed, keeping the current schedule: %v", err)
+			}
+		}
+	}()
+}
+
+// checkAndProcessCertificates is the core logic loop for the daemon.
+func checkAndProcessCertificates(yamlFile string, db *sql.DB, certsBasePath string, isFirstRun bool) (*cycleSummary, error) {
+	unlock := lockCycle(certsBasePath, "certificate check")
+	defer unlock()
+
+	log.Println("Starting certificate check...")
+	started := time.Now()
+
+	fullConfig, err := loadEffectiveConfig(yamlFile, db)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return nil, err // Stop processing if config is invalid
+	}
+
+	configureNotifiers(fullConfig.Configs)
+	configureIssuers(fullConfig.Configs)
+
+	// On the first run of the daemon, detect acme.sh and register the account
+	// email. The native backend registers its accounts on first use instead.
+	if isFirstRun && usesBackend(fullConfig, backendAcmeSh) {
+		if v, err := detectAcmeShVersion(); err != nil {
+			log.Printf("Warning: could not detect the acme.sh version, feature checks are disabled: %v", err)
+		} else {
+			log.Printf("Detected acme.sh version %s", v)
+			metricAcmeShInfo.Set(1, v)
+			if err := setDaemonState(db, "acmesh_version", v); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+		if err := registerAccount(fullConfig.Configs.Email); err != nil {
+			// This is not a fatal error, so we just log it.
+			log.Printf("Warning during account registration: %v", err)
+		}
+	}
+
+	if fullConfig.Configs.CheckUpdates {
+		go checkForUpdate(db)
+	}
+
+	handleUnconfiguredCerts(fullConfig, db, certsBasePath, prune || fullConfig.Configs.Prune)
+	if !standbyActive() {
+		revokeOrphanedCerts(fullConfig, db, certsBasePath)
+	}
+	purgeTombstones(db, certsBasePath, deletedRetention(fullConfig.Configs))
+
+	primaryOf := sharedCertGroups(fullConfig)
+	summary := newCycleSummary()
+	logCertSelection(fullConfig)
+
+	workers := newWorkerPool(fullConfig.Configs)
+	var wg sync.WaitGroup
+	for name, config := range fullConfig.Certificates {
+		if _, ok := primaryOf[name]; ok {
+			continue // Handled together with its primary below
+		}
+		if !certSelected(name, primaryOf) {
+			continue
+		}
+		if err := setSharedWith(db, name, ""); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		wg.Add(1)
+		go func(name string, config CertConfig) {
+			defer wg.Done()
+			defer workers.acquire()()
+			renewed, err := processSingleCert(name, config, db, certsBasePath)
+			summary.record(name, config, renewed, err)
+			shareWithFollowers(name, fullConfig, primaryOf, db, certsBasePath)
+			for _, entry := range append([]string{name}, followersOf(primaryOf, name)...) {
+				checkDeployments(entry, fullConfig.Certificates[entry], db, certsBasePath)
+				checkNotRenewed(entry, fullConfig.Certificates[entry], db, certsBasePath)
+				checkWarnings(entry, fullConfig.Certificates[entry], db, certsBasePath)
+			}
+		}(name, config)
+	}
+
+	wg.Wait()
+	summary.Finished = time.Now()
+	runPostCheckHook(fullConfig.Configs.PostCheckHook, summary)
+	metricLastCheck.Set(float64(time.Now().Unix()))
+	if err := setDaemonState(db, "last_check", time.Now().UTC().Format(time.RFC3339)); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	checkInterval = devScaled(checkIntervalFor(fullConfig.Configs))
+	if once {
+		log.Printf("Certificate check finished in %s.", time.Since(started).Round(time.Millisecond))
+	} else {
+		log.Printf("Certificate check finished in %s. Next check in %s.", time.Since(started).Round(time.Millisecond), checkInterval)
+	}
+	return summary, nil
+}
+
+// displayCertInfoJSON prints the state of all certificates from the database as JSON.
+func displayCertInfoJSON(db *sql.DB) error {
+	records, err := listCertStates(db)
+	if err != nil {
+		return err
+	}
+
+	warnings, err := allWarnings(db)
+	if err != nil {
+		return err
+	}
+	views := []certView{}
+	for _, record := range records {
+		view := newCertView(record)
+		view.Warnings = warnings[record.Name]
+		views = append(views, view)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(views)
+}
+
+// daemonInfo is the daemon-wide state shown by 'status --daemon'.
+type daemonInfo struct {
+	Version         string `json:"version"`
+	Commit          string `json:"commit"`
+	AcmeShVersion   string `json:"acmesh_version,omitempty"`
+	LastCheck       string `json:"last_check,omitempty"`
+	Mode            string `json:"mode,omitempty"`
+	LatestVersion   string `json:"latest_version,omitempty"`
+	LatestURL       string `json:"latest_version_url,omitempty"`
+	UpdateAvailable bool   `json:"update_available"`
+}
+
+// displayDaemonInfo prints the state recorded by the daemon, such as the
+// detected acme.sh version and the result of the update check.
+func displayDaemonInfo(db *sql.DB, output string) error {
+	info := daemonInfo{Version: version, Commit: commit}
+	for key, dest := range map[string]*string{
+		"acmesh_version":   &info.AcmeShVersion,
+		"last_check":       &info.LastCheck,
+		"mode":             &info.Mode,
+		stateLatestVersion: &info.LatestVersion,
+		stateLatestURL:     &info.LatestURL,
+	} {
+		value, _, _, err := getDaemonState(db, key)
+		if err != nil {
+			return fmt.Errorf("failed to read daemon state: %w", err)
+		}
+		*dest = value
+	}
+	available, _, _, err := getDaemonState(db, stateUpdateAvailable)
+	if err != nil {
+		return fmt.Errorf("failed to read daemon state: %w", err)
+	}
+	info.UpdateAvailable = available == "true"
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	orNA := func(s string) string {
+		if s == "" {
+			return "N/A"
+		}
+		return s
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "gocert version:\t%s (commit %s)\n", info.Version, info.Commit)
+	fmt.Fprintf(w, "acme.sh version:\t%s\n", orNA(info.AcmeShVersion))
+	fmt.Fprintf(w, "Last check:\t%s\n", orNA(info.LastCheck))
+	fmt.Fprintf(w, "Mode:\t%s\n", orNA(info.Mode))
+	fmt.Fprintf(w, "Latest release:\t%s\n", orNA(info.LatestVersion))
+	if info.UpdateAvailable {
+		fmt.Fprintf(w, "Update available:\tyes, see %s\n", info.LatestURL)
+	} else if info.LatestVersion != "" {
+		fmt.Fprintf(w, "Update available:\tno\n")
+	}
+	return w.Flush()
+}
+
+// displayTombstones lists the removed certificates that can be restored.
+func displayTombstones(db *sql.DB) error {
+	tombstones, err := listTombstones(db)
+	if err != nil {
+		return err
+	}
+	if len(tombstones) == 0 {
+		fmt.Println("No removed certificates.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tDOMAINS\tREMOVED\tREASON")
+	fmt.Fprintln(w, "----\t------\t-------\t-------\t------")
+	for _, t := range tombstones {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			t.Record.Name, t.Record.Status, t.Record.Domains, t.DeletedAt.Format("2006-01-02 15:04"), t.Reason)
+	}
+	return w.Flush()
+}
+
+// displayCertInfo shows the status of all managed certificates from the database.
+// Expiry dates are read from the certificate files when they are available.
+func displayCertInfo(db *sql.DB, certsBasePath string, columns []statusColumn, metadata map[string]map[string]string) error {
+	rows, err := db.Query("SELECT " + certColumns + " FROM certificates ORDER BY name")
+	if err != nil {
+		return fmt.Errorf("failed to query certificates: %w", err)
+	}
+	defer rows.Close()
+
+	warnings, err := allWarnings(db)
+	if err != nil {
+		return err
+	}
+	attempts, err := allIssueAttempts(db)
+	if err != nil {
+		return err
+	}
+	var retried []string
+	held := map[string]bool{}
+	quarantined, err := allQuarantined(db)
+	if err != nil {
+		return err
+	}
+	var flapping []string
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	headers, rules := make([]string, len(columns)), make([]string, len(columns))
+	for i, column := range columns {
+		headers[i] = column.header
+		rules[i] = strings.Repeat("-", len(column.header))
+	}
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	fmt.Fprintln(w, strings.Join(rules, "\t"))
+
+	var hasCerts bool
+	var warned []string
+	for rows.Next() {
+		hasCerts = true
+		record, err := scanCertRecord(rows)
+		if err != nil {
+			log.Printf("Warning: could not scan row: %v", err)
+			continue
+		}
+
+		row := statusRow{record: record, metadata: metadata[record.Name], warnings: warnings[record.Name]}
+		if len(row.warnings) > 0 {
+			warned = append(warned, record.Name)
+		}
+		if _, ok := attempts[record.Name]; ok {
+			retried = append(retried, record.Name)
+			held[record.Name] = record.Status == statusNeedsIntervention
+		}
+		if _, ok := quarantined[record.Name]; ok {
+			flapping = append(flapping, record.Name)
+		}
+		if !record.LastIssued.IsZero() {
+			row.expiry = currentExpiry(record, certsBasePath)
+		}
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = column.value(row)
+		}
+		fmt.Fprintln(w, strings.Join(values, "\t"))
+	}
+
+	if !hasCerts {
+		fmt.Println("No certificates found in the database. Run with a config file first.")
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(warned) > 0 {
+		fmt.Println("\nWarnings:")
+	}
+	for _, name := range warned {
+		for _, warning := range warnings[name] {
+			fmt.Printf("  %s: %s (%s, since %s)\n", name, warning.Message, warning.Code, warning.Since.Format("2006-01-02"))
+		}
+	}
+
+	if len(retried) > 0 {
+		fmt.Println("\nFailed issuances:")
+	}
+	for _, name := range retried {
+		attempt := attempts[name]
+		next := "on the next check"
+		switch {
+		case held[name]:
+			next = fmt.Sprintf("after 'gocert retry %s'", name)
+		case time.Now().Before(attempt.NextRetry):
+			next = "at " + attempt.NextRetry.Format("2006-01-02 15:04")
+		}
+		fmt.Printf("  %s: %d failures, retried %s; last error: %s\n", name, attempt.Failures, next, attempt.LastError)
+	}
+
+	if len(flapping) > 0 {
+		fmt.Println("\nQuarantined:")
+	}
+	for _, name := range flapping {
+		entry := quarantined[name]
+		fmt.Printf("  %s: %d changes between success and failure, quarantined since %s, next retry at %s\n",
+			name, entry.Flaps, entry.Since.Format("2006-01-02 15:04"), entry.NextRetry.Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+// formatRemaining renders the time left until expiry for the status table.
+// Less than a day is shown in hours and minutes, so it doesn't read as 0 days.
+func formatRemaining(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "expired"
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	}
+}
+
+// printUsage displays the command-line usage instructions.
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "GoCert Manager: A daemon for automated TLS certificate management.\n\n")
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintf(os.Stderr, "  run <file> [--prune] [--check-interval <duration>] [--once] [--dry-run] [--only <names>] [--skip <names>] [--exclude <globs>] [--standby]\n")
+	fmt.Fprintf(os.Stderr, "                Run the certificate manager as a continuous daemon.\n")
+	fmt.Fprintf(os.Stderr, "                <file>: Path to the YAML configuration file.\n")
+	fmt.Fprintf(os.Stderr, "                --prune: remove certificates that are no longer configured.\n")
+	fmt.Fprintf(os.Stderr, "                --check-interval: how often to check, e.g. '30m' (overrides 'check_interval').\n")
+	fmt.Fprintf(os.Stderr, "                --once: run a single check and exit, for cron jobs and systemd timers.\n")
+	fmt.Fprintf(os.Stderr, "                Exit code 0 if all certificates are fine, 1 if one is failing, 2 for\n")
+	fmt.Fprintf(os.Stderr, "                configuration errors.\n")
+	fmt.Fprintf(os.Stderr, "                --dry-run: print the plan of the next check and exit, like 'plan'.\n")
+	fmt.Fprintf(os.Stderr, "                --only, --skip: only process, or leave out, these certificates, e.g.\n")
+	fmt.Fprintf(os.Stderr, "                'web,api'. Entries sharing a certificate are processed together.\n")
+	fmt.Fprintf(os.Stderr, "                --exclude: leave out the certificates matching glob patterns, e.g.\n")
+	fmt.Fprintf(os.Stderr, "                'eu-*', to shard a configuration across instances. All three take globs.\n")
+	fmt.Fprintf(os.Stderr, "                --standby: check, record and alert, but don't issue, renew or revoke\n")
+	fmt.Fprintf(os.Stderr, "                until promoted, for the passive host of an active/passive pair.\n\n")
+	fmt.Fprintf(os.Stderr, "  plan <file> [--output table|json] [--only <names>] [--skip <names>] [--exclude <globs>]\n")
+	fmt.Fprintf(os.Stderr, "                Show whether each certificate would be issued, renewed or skipped by the\n")
+	fmt.Fprintf(os.Stderr, "                next check, and why, with the acme.sh command lines. Changes nothing.\n\n")
+	fmt.Fprintf(os.Stderr, "  explain <name> [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Show why a certificate is or isn't renewed: its database state, files,\n")
+	fmt.Fprintf(os.Stderr, "                expiry and threshold, domain and key type changes, windows, backoff and\n")
+	fmt.Fprintf(os.Stderr, "                quarantine, and the resulting decision.\n\n")
+	fmt.Fprintf(os.Stderr, "  doctor [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Check acme.sh, the database, the certificates path, the connection to\n")
+	fmt.Fprintf(os.Stderr, "                the configured issuers and the DNS credentials, and print a pass/fail\n")
+	fmt.Fprintf(os.Stderr, "                report. Changes nothing. Exits with 1 if a check failed.\n\n")
+	fmt.Fprintf(os.Stderr, "  bootstrap <file> [--staging]\n")
+	fmt.Fprintf(os.Stderr, "                Perform the one-time setup (database, directories, ACME accounts, DNS\n")
+	fmt.Fprintf(os.Stderr, "                credentials) and print a readiness report. Safe to run repeatedly.\n")
+	fmt.Fprintf(os.Stderr, "                --staging: also issue every certificate once against a staging CA.\n\n")
+	fmt.Fprintf(os.Stderr, "  issue <name> [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Issue or renew a single certificate now and exit. Exit code 0 on success,\n")
+	fmt.Fprintf(os.Stderr, "                1 if issuance failed, 2 for usage or configuration errors.\n\n")
+	fmt.Fprintf(os.Stderr, "  renew <name> [--force] [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Renew a single certificate if it is due, or regardless of its remaining\n")
+	fmt.Fprintf(os.Stderr, "                days with --force. Uses the same exit codes as 'issue'.\n\n")
+	fmt.Fprintf(os.Stderr, "  retry <name> [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Reset the failed attempts of a certificate in 'needs-intervention' and\n")
+	fmt.Fprintf(os.Stderr, "                issue it again. Uses the same exit codes as 'issue'.\n\n")
+	fmt.Fprintf(os.Stderr, "  logs <name> [--run <id>] [--follow]\n")
+	fmt.Fprintf(os.Stderr, "                Show the captured acme.sh and deploy hook output of a certificate's\n")
+	fmt.Fprintf(os.Stderr, "                stored runs, or of the run --run, e.g. 'issue-12'. With --follow, go on\n")
+	fmt.Fprintf(os.Stderr, "                with the live output of the running daemon.\n\n")
+	fmt.Fprintf(os.Stderr, "  remove <name> [--acme [--config <file>]] [--purge]\n")
+	fmt.Fprintf(os.Stderr, "                Remove a certificate's database state, its files and any API-managed\n")
+	fmt.Fprintf(os.Stderr, "                definition. They are kept for 'restore' unless --purge is given.\n")
+	fmt.Fprintf(os.Stderr, "                --acme: also remove it from acme.sh with 'acme.sh --remove'.\n\n")
+	fmt.Fprintf(os.Stderr, "  restore [<name>]\n")
+	fmt.Fprintf(os.Stderr, "                Bring back a removed certificate, or list the removed certificates.\n\n")
+	fmt.Fprintf(os.Stderr, "  account deactivate [--issuer <issuer>] [--account <name>] [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Deactivate the ACME accounts of all configured issuers, or of --issuer\n")
+	fmt.Fprintf(os.Stderr, "                and --account,\n")
+	fmt.Fprintf(os.Stderr, "                at the CA and archive their keys. Certificates issued so far stay valid.\n\n")
+	fmt.Fprintf(os.Stderr, "  which <hostname> [--output table|json] [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Show which certificates cover a hostname, including wildcards, with their\n")
+	fmt.Fprintf(os.Stderr, "                expiry and deploy targets. Exits with 1 if none does.\n\n")
+	fmt.Fprintf(os.Stderr, "  discover scan --targets <file> [--dry-run] [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Connect to the host[:port] endpoints listed in the file, record their\n")
+	fmt.Fprintf(os.Stderr, "                certificates as monitor-only entries and suggest which could be managed.\n\n")
+	fmt.Fprintf(os.Stderr, "  promote       Make a daemon started with --standby issue and renew certificates, and\n")
+	fmt.Fprintf(os.Stderr, "                run a check right away.\n\n")
+	fmt.Fprintf(os.Stderr, "  demote        Put the running daemon in standby, as if started with --standby.\n\n")
+	fmt.Fprintf(os.Stderr, "  upgrade       Make the running daemon re-execute its binary after it was replaced,\n")
+	fmt.Fprintf(os.Stderr, "                keeping the API listening (same as sending it SIGUSR2).\n\n")
+	fmt.Fprintf(os.Stderr, "  status [--output table|json] [--daemon] [--as-of <date>] [--columns <list>] [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Display the status of all managed certificates from the database.\n")
+	fmt.Fprintf(os.Stderr, "                With --columns, choose the table columns, e.g. 'name,expires,owner'; names\n")
+	fmt.Fprintf(os.Stderr, "                that aren't built in show the 'metadata' field of that name from --config.\n")
+	fmt.Fprintf(os.Stderr, "                With --as-of, show the certificates and their state at a past date.\n")
+	fmt.Fprintf(os.Stderr, "                With --daemon, show the daemon state (versions, last check, available updates).\n\n")
+	fmt.Fprintf(os.Stderr, "  http01 stanza <nginx|apache> [--install <file>] [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Print the web server configuration that proxies the HTTP-01 challenges\n")
+	fmt.Fprintf(os.Stderr, "                of 'type: http' certificates to gocert, or write it to the --install file.\n\n")
+	fmt.Fprintf(os.Stderr, "  notify test <channel> [--config <file>]\n")
+	fmt.Fprintf(os.Stderr, "                Send a test notification to a configured channel.\n\n")
+	fmt.Fprintf(os.Stderr, "  validate <file>...\n")
+	fmt.Fprintf(os.Stderr, "                Check configuration files against the schema and the rules the daemon\n")
+	fmt.Fprintf(os.Stderr, "                applies when loading them, without a database or acme.sh. Exit code 0 if\n")
+	fmt.Fprintf(os.Stderr, "                all are valid, 1 if one is unreadable or invalid, 2 for usage errors.\n\n")
+	fmt.Fprintf(os.Stderr, "  config migrate <file> --email <address> [--write]\n")
+	fmt.Fprintf(os.Stderr, "                Convert a configuration of the legacy flat format, without a 'configs:'\n")
+	fmt.Fprintf(os.Stderr, "                block, to the current one. Prints the result, or with --write replaces\n")
+	fmt.Fprintf(os.Stderr, "                the file and keeps the old one as '<file>.legacy'.\n\n")
+	fmt.Fprintf(os.Stderr, "  version       Display the build version, commit hash and acme.sh version.\n\n")
+	fmt.Fprintf(os.Stderr, "  help          Show this help message.\n\n")
+	fmt.Fprintln(os.Stderr, "Options for all commands:")
+	fmt.Fprintf(os.Stderr, "  --log-level <level>   Minimum level logged: debug, info (default), warn or error.\n")
+	fmt.Fprintf(os.Stderr, "  --log-format <format> Log format: 'text' (default) or 'json'.\n\n")
+	fmt.Fprintln(os.Stderr, "Environment:")
+	fmt.Fprintf(os.Stderr, "  GOCERT_DB_PATH        Path to the SQLite database (default: %s).\n", defaultDbPath)
+	fmt.Fprintf(os.Stderr, "  GOCERT_CERTS_PATH     Base directory for certificate files (default: %s).\n", defaultCertsPath)
+	fmt.Fprintf(os.Stderr, "  GOCERT_ACCOUNTS_PATH  Directory for ACME account keys of the native backend (default: %s).\n", defaultAccountsPath)
+	fmt.Fprintf(os.Stderr, "  GOCERT_API_ADDR       Listen address for the HTTP API of 'run', e.g. ':8080' (disabled if empty).\n")
+	fmt.Fprintf(os.Stderr, "  GOCERT_API_TOKEN      Bearer token required by the HTTP API (no authentication if empty).\n")
+	fmt.Fprintf(os.Stderr, "  GOCERT_CONTROL_SOCKET Control socket of 'run' (default: %s next to the database).\n", controlSocketName)
+	fmt.Fprintf(os.Stderr, "  GOCERT_CHECK_INTERVAL Check interval of 'run', like --check-interval (default: %s).\n", defaultCheckInterval)
+	fmt.Fprintf(os.Stderr, "  GOCERT_STANDBY        Start 'run' in standby when 'true', like --standby.\n")
+	fmt.Fprintf(os.Stderr, "  GOCERT_STARTUP_JITTER Longest random delay of the first check of 'run', like 'startup_jitter'.\n")
+	fmt.Fprintf(os.Stderr, "  GOCERT_LEGACY_CONFIG  Load configurations of the legacy flat format (default: true).\n")
+	fmt.Fprintf(os.Stderr, "  GOCERT_LOG_LEVEL      Default of --log-level.\n")
+	fmt.Fprintf(os.Stderr, "  GOCERT_LOG_FORMAT     Default of --log-format.\n")
+}
+
+// checkIntervalFor returns the check interval of the daemon: the command
+// line or environment override, else 'check_interval', else the default.
+func checkIntervalFor(global GlobalConfig) time.Duration {
+	if checkIntervalOverride > 0 {
+		return checkIntervalOverride
+	}
+	if global.CheckInterval == "" {
+		return defaultCheckInterval
+	}
+	d, err := time.ParseDuration(global.CheckInterval)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid check_interval '%s', using %s", global.CheckInterval, defaultCheckInterval)
+		return defaultCheckInterval
+	}
+	return d
+}
+
+// envOrDefault returns the value of the environment variable, or def if it is unset or empty.
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseInterspersed parses flags that may appear before or after positional
+// arguments and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func main() {
+	args, err := extractDevFast(os.Args)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	args, logLevelName, logFormat, err := extractLogFlags(args)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := configureLogging(logLevelName, logFormat); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	os.Args = args
+	if devFastFactor > 1 {
+		log.Printf("Dev-fast mode: intervals, backoffs and propagation waits are %gx shorter.", devFastFactor)
+	}
+
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+
+	dbPath := envOrDefault("GOCERT_DB_PATH", defaultDbPath)
+	certsPath := envOrDefault("GOCERT_CERTS_PATH", defaultCertsPath)
+
+	command := os.Args[1]
 
 	// Commands that don't need a database connection
 	switch command {
 	case "version":
 		fmt.Printf("gocert version: %s, commit: %s\n", version, commit)
+		if v, err := detectAcmeShVersion(); err == nil {
+			fmt.Printf("acme.sh version: %s\n", v)
+		}
 		os.Exit(0)
 	case "help":
 		printUsage()
 		os.Exit(0)
+	case "doctor":
+		fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		_ = fs.Parse(os.Args[2:])
+		// Runs before the database is opened, which would repair a damaged one.
+		if !runDoctor(*configFile, dbPath, certsPath) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "promote", "demote":
+		if len(os.Args) != 2 {
+			log.Printf("Error: usage is '%s'.", command)
+			printUsage()
+			os.Exit(1)
+		}
+		if err := sendStandbyCommand(controlSocketPath(dbPath), command); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		os.Exit(0)
+	case "http01":
+		fs := flag.NewFlagSet("http01", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		install := fs.String("install", "", "Write the configuration to this file instead of printing it")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 2 || args[0] != "stanza" {
+			log.Println("Error: usage is 'http01 stanza <nginx|apache> [--install <file>] [--config <file>]'.")
+			printUsage()
+			os.Exit(1)
+		}
+		if err := runHTTP01Stanza(*configFile, args[1], *install); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		os.Exit(0)
+	case "notify":
+		fs := flag.NewFlagSet("notify", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 2 || args[0] != "test" {
+			log.Println("Error: usage is 'notify test <channel> [--config <file>]'.")
+			printUsage()
+			os.Exit(1)
+		}
+		fullConfig, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if err := testNotifier(fullConfig, args[1]); err != nil {
+			log.Fatalf("Test notification to '%s' failed: %v", args[1], err)
+		}
+		fmt.Printf("Test notification sent to '%s'.\n", args[1])
+		os.Exit(0)
+	case "validate":
+		args := os.Args[2:]
+		if len(args) == 0 {
+			log.Println("Error: usage is 'validate <file>...'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		os.Exit(validateConfigFiles(args))
+	case "config":
+		fs := flag.NewFlagSet("config", flag.ExitOnError)
+		email := fs.String("email", "", "ACME account email for the 'configs:' block")
+		write := fs.Bool("write", false, "Replace the file, keeping the old one as '<file>.legacy'")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 2 || args[0] != "migrate" {
+			log.Println("Error: usage is 'config migrate <file> --email <address> [--write]'.")
+			printUsage()
+			os.Exit(1)
+		}
+		if err := migrateConfig(args[1], *email, *write); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		os.Exit(0)
 	}
 
 	// Commands that need a database connection
+	if err := checkDatabase(dbPath, certsPath); err != nil {
+		log.Fatalf("Database check failed: %v", err)
+	}
 	db, err := setupDatabase(dbPath)
 	if err != nil {
 		log.Fatalf("Database setup failed: %v", err)
@@ -438,27 +1963,316 @@ func main() {
 
 	switch command {
 	case "status":
-		if err := displayCertInfo(db); err != nil {
+		fs := flag.NewFlagSet("status", flag.ExitOnError)
+		output := fs.String("output", "table", "Output format: 'table' or 'json'")
+		fs.StringVar(output, "o", "table", "Shorthand for --output")
+		daemon := fs.Bool("daemon", false, "Show daemon state instead of certificates")
+		asOf := fs.String("as-of", "", "Show the state as of a past date (YYYY-MM-DD or RFC3339)")
+		columns := fs.String("columns", "", "Comma-separated columns of the table, e.g. 'name,expires,owner'")
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file, for 'status_columns' and metadata")
+		_ = fs.Parse(os.Args[2:])
+
+		switch {
+		case *output != "table" && *output != "json":
+			log.Fatalf("Error: unknown output format '%s', expected 'table' or 'json'", *output)
+		case *asOf != "":
+			t, parseErr := parseAsOf(*asOf)
+			if parseErr != nil {
+				log.Fatalf("Error: %v", parseErr)
+			}
+			err = displayCertInfoAsOf(db, t, *output)
+		case *daemon:
+			err = displayDaemonInfo(db, *output)
+		case *output == "table":
+			tableColumns, metadata, layoutErr := statusTableLayout(*configFile, *columns, db)
+			if layoutErr != nil {
+				log.Fatalf("Error: invalid columns: %v", layoutErr)
+			}
+			err = displayCertInfo(db, certsPath, tableColumns, metadata)
+		default:
+			err = displayCertInfoJSON(db)
+		}
+		if err != nil {
 			log.Fatalf("Failed to display certificate info: %v", err)
 		}
+	case "plan":
+		fs := flag.NewFlagSet("plan", flag.ExitOnError)
+		output := fs.String("output", "table", "Output format: 'table' or 'json'")
+		fs.StringVar(output, "o", "table", "Shorthand for --output")
+		fs.Func("only", "Only plan these certificates (comma-separated, repeatable)", addCertNames(&onlyCerts))
+		fs.Func("skip", "Don't plan these certificates (comma-separated, repeatable)", addCertNames(&skipCerts))
+		fs.Func("exclude", "Don't plan the certificates matching these glob patterns (comma-separated, repeatable)", addCertNames(&excludeCerts))
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 || (*output != "table" && *output != "json") {
+			log.Println("Error: usage is 'plan <file> [--output table|json] [--only <names>] [--skip <names>] [--exclude <globs>]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		if err := runPlan(args[0], db, certsPath, *output); err != nil {
+			log.Printf("ERROR: %v", err)
+			db.Close()
+			os.Exit(exitUsage)
+		}
+	case "explain":
+		fs := flag.NewFlagSet("explain", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 {
+			log.Println("Error: usage is 'explain <name> [--config <file>]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		if err := runExplain(*configFile, args[0], db, certsPath); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	case "bootstrap":
+		fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+		staging := fs.Bool("staging", false, "Issue every certificate once against a staging CA")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 {
+			log.Println("Error: 'bootstrap' command requires a file path.")
+			printUsage()
+			os.Exit(1)
+		}
+		if !runBootstrap(args[0], db, dbPath, certsPath, *staging) {
+			fmt.Println("\nNot ready: fix the failed checks above and run bootstrap again.")
+			os.Exit(1)
+		}
+		fmt.Println("\nReady: start the daemon with 'gocert run " + args[0] + "'.")
+	case "issue":
+		fs := flag.NewFlagSet("issue", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 {
+			log.Println("Error: usage is 'issue <name> [--config <file>]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		code := issueSingleCert(*configFile, args[0], db, certsPath, true)
+		db.Close()
+		os.Exit(code)
+	case "renew":
+		fs := flag.NewFlagSet("renew", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		force := fs.Bool("force", false, "Renew even if the certificate is not due yet")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 {
+			log.Println("Error: usage is 'renew <name> [--force] [--config <file>]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		code := issueSingleCert(*configFile, args[0], db, certsPath, *force)
+		db.Close()
+		os.Exit(code)
+	case "logs":
+		fs := flag.NewFlagSet("logs", flag.ExitOnError)
+		runID := fs.String("run", "", "Only show the run with this ID, e.g. 'issue-12'")
+		follow := fs.Bool("follow", false, "Follow the live output of the running daemon")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 {
+			log.Println("Error: usage is 'logs <name> [--run <id>] [--follow]'.")
+			printUsage()
+			os.Exit(1)
+		}
+		if err := showLogs(db, args[0], *runID, *follow, controlSocketPath(dbPath)); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	case "retry":
+		fs := flag.NewFlagSet("retry", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 {
+			log.Println("Error: usage is 'retry <name> [--config <file>]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		code := retryCertificate(*configFile, args[0], db, certsPath)
+		db.Close()
+		os.Exit(code)
+	case "remove":
+		fs := flag.NewFlagSet("remove", flag.ExitOnError)
+		acme := fs.Bool("acme", false, "Also run 'acme.sh --remove' for the certificate")
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file, to tell the certificate's backend for --acme")
+		purge := fs.Bool("purge", false, "Delete everything right away instead of keeping it for 'restore'")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 {
+			log.Println("Error: usage is 'remove <name> [--acme [--config <file>]] [--purge]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		if err := removeCertificate(db, args[0], certsPath, *configFile, *acme, *purge); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if *purge {
+			fmt.Printf("Certificate '%s' removed permanently.\n", args[0])
+		} else {
+			fmt.Printf("Certificate '%s' removed. Use 'gocert restore %s' to bring it back.\n", args[0], args[0])
+		}
+	case "account":
+		fs := flag.NewFlagSet("account", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		issuer := fs.String("issuer", "", "Only deactivate the account for this issuer")
+		account := fs.String("account", "", "Only deactivate this named account")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 || args[0] != "deactivate" {
+			log.Println("Error: usage is 'account deactivate [--issuer <issuer>] [--account <name>] [--config <file>]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		fullConfig, err := loadEffectiveConfig(*configFile, db)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if err := deactivateAccounts(fullConfig, *issuer, *account); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	case "which":
+		fs := flag.NewFlagSet("which", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		output := fs.String("output", "table", "Output format: 'table' or 'json'")
+		fs.StringVar(output, "o", "table", "Shorthand for --output")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 || (*output != "table" && *output != "json") {
+			log.Println("Error: usage is 'which <hostname> [--output table|json] [--config <file>]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		fullConfig, err := loadEffectiveConfig(*configFile, db)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		covered, err := displayCoverage(fullConfig, db, certsPath, args[0], *output)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if !covered {
+			db.Close()
+			os.Exit(1)
+		}
+	case "discover":
+		fs := flag.NewFlagSet("discover", flag.ExitOnError)
+		configFile := fs.String("config", defaultConfigPath, "Path to the YAML configuration file")
+		targets := fs.String("targets", "", "File with one host[:port] endpoint per line")
+		dryRun := fs.Bool("dry-run", false, "Only report the endpoints, don't record them")
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) != 1 || args[0] != "scan" || *targets == "" {
+			log.Println("Error: usage is 'discover scan --targets <file> [--dry-run] [--config <file>]'.")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		if err := runDiscoverScan(*configFile, *targets, db, *dryRun); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	case "upgrade":
+		pid, err := signalUpgrade(db)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		fmt.Printf("Asked the daemon (pid %d) to restart with the installed binary; see its log for the result.\n", pid)
+	case "restore":
+		args := os.Args[2:]
+		if len(args) == 0 {
+			err = displayTombstones(db)
+		} else {
+			err = restoreCertificate(db, args[0], certsPath)
+			if err == nil {
+				fmt.Printf("Certificate '%s' restored.\n", args[0])
+			}
+		}
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
 	case "run":
-		if len(os.Args) < 3 {
+		fs := flag.NewFlagSet("run", flag.ExitOnError)
+		fs.BoolVar(&prune, "prune", false, "Remove certificates that are no longer configured")
+		if v := os.Getenv("GOCERT_CHECK_INTERVAL"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("Error: invalid GOCERT_CHECK_INTERVAL '%s': %v", v, err)
+			}
+			checkIntervalOverride = d
+		}
+		fs.DurationVar(&checkIntervalOverride, "check-interval", checkIntervalOverride, "How often to check certificates")
+		fs.BoolVar(&once, "once", false, "Run a single check and exit, for cron jobs and timers")
+		dryRun := fs.Bool("dry-run", false, "Print the plan of the next check and exit")
+		standbyFlag := fs.Bool("standby", os.Getenv("GOCERT_STANDBY") == "true", "Check and alert, but leave issuing to the active instance until promoted")
+		fs.Func("only", "Only process these certificates (comma-separated, repeatable)", addCertNames(&onlyCerts))
+		fs.Func("skip", "Don't process these certificates (comma-separated, repeatable)", addCertNames(&skipCerts))
+		fs.Func("exclude", "Don't process the certificates matching these glob patterns (comma-separated, repeatable)", addCertNames(&excludeCerts))
+		args, _ := parseInterspersed(fs, os.Args[2:])
+		if len(args) < 1 {
 			log.Println("Error: 'run' command requires a file path.")
 			printUsage()
 			os.Exit(1)
 		}
-		yamlFile := os.Args[2]
+		if checkIntervalOverride < 0 {
+			log.Fatalf("Error: the check interval must be positive, got %s", checkIntervalOverride)
+		}
+		yamlFile := args[0]
+		if *dryRun {
+			if err := runPlan(yamlFile, db, certsPath, "table"); err != nil {
+				log.Printf("ERROR: %v", err)
+				db.Close()
+				os.Exit(exitUsage)
+			}
+			break
+		}
+		if os.Getenv(upgradedEnv) != "" {
+			// An upgrade keeps the daemon promoted or demoted.
+			if mode, _, found, err := getDaemonState(db, "mode"); err == nil && found {
+				*standbyFlag = mode == "standby"
+			}
+		}
+		setStandby(db, *standbyFlag)
+		if *standbyFlag {
+			log.Printf("Standby mode: checking and alerting, but not issuing until promoted with 'gocert promote'.")
+		}
+		if once {
+			code := runOnce(yamlFile, db, certsPath)
+			db.Close()
+			os.Exit(code)
+		}
 		log.Printf("Starting certificate manager daemon...")
 		log.Printf("Database path: %s", dbPath)
 		log.Printf("Certs path: %s", certsPath)
 
+		reload := make(chan struct{}, 1)
+		if apiAddr := os.Getenv("GOCERT_API_ADDR"); apiAddr != "" {
+			startAPIServer(apiAddr, yamlFile, db, certsPath, reload)
+		}
+		if err := startControlSocket(controlSocketPath(dbPath), db, reload); err != nil {
+			log.Printf("Warning: %v; 'gocert logs --follow' won't work", err)
+		}
+		watchReloadSignal(yamlFile, reload)
+		watchUpgradeSignal()
+		watchConfigFile(yamlFile, reload)
+		startNotificationRetryLoop(db)
+		if err := setDaemonState(db, "pid", strconv.Itoa(os.Getpid())); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+
+		waitStartupJitter(yamlFile, reload)
+		started := time.Now()
 		checkAndProcessCertificates(yamlFile, db, certsPath, true)
+		cycleOverran(time.Since(started), checkInterval)
 
 		ticker := time.NewTicker(checkInterval)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			interval := checkInterval
+			select {
+			case <-ticker.C:
+			case <-reload:
+				log.Println("Reload requested, running certificate check now.")
+				ticker.Reset(checkInterval)
+			}
+			started := time.Now()
 			checkAndProcessCertificates(yamlFile, db, certsPath, false)
+			// Resetting the ticker drops a tick that came due during the cycle.
+			if cycleOverran(time.Since(started), interval) || checkInterval != interval {
+				ticker.Reset(checkInterval)
+			}
 		}
 
 	default:
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Prometheus text exposition implementation. Metrics register
+// themselves on creation and are written in registration order.
+
+// metric is anything that can write itself in the Prometheus text format.
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsMutex      = &sync.Mutex{}
+	registeredMetrics []metric
+)
+
+func registerMetric(m metric) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	registeredMetrics = append(registeredMetrics, m)
+}
+
+// escapeLabelValue escapes a label value for the text exposition format.
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+// formatLabels renders label names and values as '{a="x",b="y"}'.
+func formatLabels(names, values []string, extra ...string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// valueVec stores one float value per label combination. It backs both
+// counters and gauges.
+type valueVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newValueVec(typ, name, help string, labels ...string) *valueVec {
+	v := &valueVec{name: name, help: help, typ: typ, labels: labels, values: map[string]float64{}, keys: map[string][]string{}}
+	registerMetric(v)
+	return v
+}
+
+// newCounter registers a counter with the given label names.
+func newCounter(name, help string, labels ...string) *valueVec {
+	return newValueVec("counter", name, help, labels...)
+}
+
+// newGauge registers a gauge with the given label names.
+func newGauge(name, help string, labels ...string) *valueVec {
+	return newValueVec("gauge", name, help, labels...)
+}
+
+// Add increases the value for the given label values.
+func (v *valueVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] += delta
+	v.keys[key] = labelValues
+}
+
+// Inc increases the value for the given label values by one.
+func (v *valueVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Set replaces the value for the given label values.
+func (v *valueVec) Set(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] = value
+	v.keys[key] = labelValues
+}
+
+// DeleteMatching removes the values whose leading labels equal the given
+// values, e.g. all series of one certificate.
+func (v *valueVec) DeleteMatching(labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, values := range v.keys {
+		if len(values) >= len(labelValues) && slices.Equal(values[:len(labelValues)], labelValues) {
+			delete(v.values, key)
+			delete(v.keys, key)
+		}
+	}
+}
+
+func (v *valueVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.keys[k]), formatFloat(v.values[k]))
+	}
+}
+
+// histogramVec tracks observations in cumulative buckets per label combination.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// newHistogram registers a histogram with the given upper bucket bounds.
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	registerMetric(h)
+	return h
+}
+
+// Observe records a value for the given label values.
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+var (
+	metricIssuanceTotal = newCounter("gocert_issuance_total",
+		"Issuance attempts by certificate and result.", "name", "result")
+	metricIssuanceDuration = newHistogram("gocert_issuance_duration_seconds",
+		"Duration of issuance runs (acme.sh or native) by backend.",
+		[]float64{5, 15, 30, 60, 120, 300, 600, 1200}, "backend")
+	metricLastCheck = newGauge("gocert_last_check_timestamp_seconds",
+		"Unix time of the last completed check cycle.")
+	metricAcmeShInfo = newGauge("gocert_acmesh_info",
+		"Detected acme.sh version (always 1).", "version")
+	metricUpdateAvailable = newGauge("gocert_update_available",
+		"Whether a newer gocert release exists (opt-in update check).", "version", "latest")
+	metricCertLastCheck = newGauge("gocert_certificate_last_check_timestamp_seconds",
+		"Unix time of the last check of each certificate.", "name")
+	metricAuthorizations = newCounter("gocert_acme_authorizations_total",
+		"Authorizations of native backend orders by result: reused while still valid at the CA, or solved.", "result")
+	metricStaleDeployment = newGauge("gocert_stale_deployment",
+		"Whether an endpoint still serves an older certificate than the renewed one on disk.", "name", "endpoint")
+	metricStandby = newGauge("gocert_standby",
+		"Whether the daemon is in standby and leaves issuing to the active instance.")
+	metricCycleDuration = newGauge("gocert_check_cycle_duration_seconds",
+		"Duration of the last check cycle.")
+	metricCycleOverruns = newCounter("gocert_check_cycle_overruns_total",
+		"Check cycles that took longer than the check interval; the overdue tick is skipped.")
+	metricChainExpiry = newGauge("gocert_chain_certificate_expiry_timestamp_seconds",
+		"Unix time at which each intermediate of a certificate's chain expires, from fullchain.pem (source 'file') or as served by an endpoint.", "name", "source", "subject", "issuer")
+)
+
+// writeCertificateMetrics writes per-certificate expiry gauges computed from
+// the cached certificate states at scrape time.
+func writeCertificateMetrics(w io.Writer, db *sql.DB) error {
+	records, err := stateCache.list(db)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	fmt.Fprintf(w, "# HELP gocert_certificate_expiry_days Days until the certificate expires.\n# TYPE gocert_certificate_expiry_days gauge\n")
+	for _, record := range records {
+		if record.LastIssued.IsZero() && record.NotAfter.IsZero() {
+			continue
+		}
+		days := certExpiry(record).Sub(now).Hours() / 24
+		fmt.Fprintf(w, "gocert_certificate_expiry_days%s %s\n",
+			formatLabels([]string{"name", "issuer", "type"}, []string{record.Name, record.Issuer, record.Type}), formatFloat(days))
+	}
+
+	fmt.Fprintf(w, "# HELP gocert_certificate_expiry_timestamp_seconds Unix time at which the certificate expires.\n# TYPE gocert_certificate_expiry_timestamp_seconds gauge\n")
+	for _, record := range records {
+		if record.LastIssued.IsZero() && record.NotAfter.IsZero() {
+			continue
+		}
+		fmt.Fprintf(w, "gocert_certificate_expiry_timestamp_seconds%s %d\n",
+			formatLabels([]string{"name"}, []string{record.Name}), certExpiry(record).Unix())
+	}
+
+	fmt.Fprintf(w, "# HELP gocert_certificate_status Current status of each certificate (always 1).\n# TYPE gocert_certificate_status gauge\n")
+	for _, record := range records {
+		fmt.Fprintf(w, "gocert_certificate_status%s 1\n",
+			formatLabels([]string{"name", "status"}, []string{record.Name, record.Status}))
+	}
+	return nil
+}
+
+// writeHookMetrics writes the totals of the deploy hook runs of each
+// certificate from the database, so success rates and durations per deploy
+// target survive restarts. Totals of removed certificates are left out.
+func writeHookMetrics(w io.Writer, db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT name, hook, type, target, runs, failures, duration_ms, last_success
+		FROM hook_stats WHERE name IN (SELECT name FROM certificates)
+		ORDER BY name, hook, type, target`)
+	if err != nil {
+		return fmt.Errorf("failed to query deploy hook statistics: %w", err)
+	}
+	defer rows.Close()
+
+	type hookStats struct {
+		labels         string
+		runs, failures int64
+		durationMs     int64
+		lastSuccess    sql.NullTime
+	}
+	var stats []hookStats
+	for rows.Next() {
+		var name, typ, target string
+		var hook int
+		var s hookStats
+		if err := rows.Scan(&name, &hook, &typ, &target, &s.runs, &s.failures, &s.durationMs, &s.lastSuccess); err != nil {
+			return err
+		}
+		s.labels = formatLabels([]string{"name", "hook", "type", "target"}, []string{name, strconv.Itoa(hook), typ, target})
+		stats = append(stats, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# HELP gocert_deploy_hook_runs_total Deploy hook runs by certificate, hook and target.\n# TYPE gocert_deploy_hook_runs_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "gocert_deploy_hook_runs_total%s %d\n", s.labels, s.runs)
+	}
+	fmt.Fprintf(w, "# HELP gocert_deploy_hook_failures_total Failed deploy hook runs by certificate, hook and target.\n# TYPE gocert_deploy_hook_failures_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "gocert_deploy_hook_failures_total%s %d\n", s.labels, s.failures)
+	}
+	fmt.Fprintf(w, "# HELP gocert_deploy_hook_duration_seconds_total Total run time of deploy hooks by certificate, hook and target.\n# TYPE gocert_deploy_hook_duration_seconds_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "gocert_deploy_hook_duration_seconds_total%s %s\n", s.labels, formatFloat(float64(s.durationMs)/1000))
+	}
+	fmt.Fprintf(w, "# HELP gocert_deploy_hook_last_success_timestamp_seconds Unix time of the last successful run of each deploy hook.\n# TYPE gocert_deploy_hook_last_success_timestamp_seconds gauge\n")
+	for _, s := range stats {
+		if s.lastSuccess.Valid {
+			fmt.Fprintf(w, "gocert_deploy_hook_last_success_timestamp_seconds%s %d\n", s.labels, s.lastSuccess.Time.Unix())
+		}
+	}
+	return nil
+}
+
+// handleMetrics serves all metrics in the Prometheus text exposition format.
+func (s *apiServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metricsMutex.Lock()
+	metrics := append([]metric(nil), registeredMetrics...)
+	metricsMutex.Unlock()
+
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+	if err := writeCertificateMetrics(w, s.db); err != nil {
+		log.Printf("Warning: failed to collect certificate metrics: %v", err)
+	}
+	if err := writeHookMetrics(w, s.db); err != nil {
+		log.Printf("Warning: failed to collect deploy hook metrics: %v", err)
+	}
+}
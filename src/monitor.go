@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Timeout for connecting to a monitored endpoint
+const monitorDialTimeout = 10 * time.Second
+
+// fetchServedCertificate connects to a host[:port] endpoint (port 443 by
+// default) and returns the leaf certificate it serves. The chain is not
+// verified, so expired or self-signed certificates are still reported.
+func fetchServedCertificate(endpoint string) (*x509.Certificate, error) {
+	chain, err := fetchServedChain(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return chain[0], nil
+}
+
+// fetchServedChain is fetchServedCertificate returning the whole chain as
+// served, leaf first.
+func fetchServedChain(endpoint string) ([]*x509.Certificate, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host, port = endpoint, "443"
+	}
+
+	dialer := &net.Dialer{Timeout: monitorDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", endpoint, err)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s did not present a certificate", endpoint)
+	}
+	return certs, nil
+}
+
+// checkMonitoredCert records the expiry of the certificate of a monitor-only
+// entry, as served or read from its source. gocert never issues these
+// certificates.
+func checkMonitoredCert(name string, config CertConfig, db *sql.DB) {
+	logger := certLogger(name, config)
+	state, _, err := getCertState(db, name)
+	if err != nil {
+		logger.Error("Failed to get state, skipping", "error", err)
+		return
+	}
+
+	record := CertConfig{Type: "monitor", Issuer: state.Issuer, Domains: config.Domains}
+	issued, notBefore, notAfter := state.LastIssued, state.NotBefore, state.NotAfter
+	status := "monitored"
+
+	chain, err := fetchMonitoredChain(config.Monitor)
+	if err != nil {
+		logger.Error("Failed to check monitored certificate", "error", err)
+		status = "unreachable"
+	} else {
+		cert := chain[0]
+		trackChain(name, config.Monitor, chain)
+		raiseWarning(db, name, config, warningServedChainExpiry, chainExpiryWarning(chain))
+		issued, notBefore, notAfter = cert.NotBefore, cert.NotBefore, cert.NotAfter
+		record.Issuer = cert.Issuer.CommonName
+		record.KeyType = certKeyType(cert)
+		raiseWarning(db, name, config, warningWeakKey, weakKeyWarning(cert))
+		if len(record.Domains) == 0 {
+			record.Domains = cert.DNSNames
+		}
+
+		remainingDays := int(time.Until(notAfter).Hours() / 24)
+		switch {
+		case remainingDays < 0:
+			status = "expired"
+		case remainingDays <= renewBeforeDays(config):
+			status = "expiring"
+		}
+		logger.Info("Checked monitored certificate", "domains", strings.Join(record.Domains, ","), "remaining_days", remainingDays)
+	}
+
+	if status != "monitored" && status != state.Status {
+		sendNotification(db, NotificationEvent{
+			Event:   status,
+			Cert:    name,
+			Message: fmt.Sprintf("Monitored certificate '%s' at %s is %s", name, config.Monitor, status),
+		})
+	}
+
+	if err := updateCertState(db, name, record, issued, status, notBefore, notAfter); err != nil {
+		logger.Error("Failed to update database", "error", err)
+	}
+}
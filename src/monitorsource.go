@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum time reading a monitored certificate from a source may take
+	monitorSourceTimeout = 30 * time.Second
+	// Largest PEM bundle or Secret read from a source
+	monitorSourceLimit = 1 << 20
+	// Where Kubernetes mounts the service account of a pod
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// Key of a TLS Secret holding the certificate chain
+	kubeTLSCertKey = "tls.crt"
+)
+
+// monitorSources holds the sources a monitor-only entry can read its
+// certificate from, keyed by the scheme of its 'monitor' value. A value
+// without a scheme is a host[:port] whose served certificate is checked.
+var monitorSources = map[string]func(ctx context.Context, location string) ([]*x509.Certificate, error){
+	"tls":   fetchTLSSource,
+	"file":  fetchFileSource,
+	"https": fetchHTTPSource,
+	"s3":    fetchS3Source,
+	"k8s":   fetchKubernetesSource,
+}
+
+// splitMonitorSource returns the scheme of a 'monitor' value and the location
+// that follows it; plain host[:port] values have the scheme 'tls'.
+func splitMonitorSource(monitor string) (string, string) {
+	scheme, location, ok := strings.Cut(monitor, "://")
+	if !ok {
+		return "tls", monitor
+	}
+	return scheme, location
+}
+
+// validateMonitorSource checks the scheme and location of a 'monitor' value.
+func validateMonitorSource(monitor string) error {
+	scheme, location := splitMonitorSource(monitor)
+	if _, ok := monitorSources[scheme]; !ok {
+		return fmt.Errorf("unknown monitor source '%s://', use a host[:port] or tls://, file://, https://, s3:// or k8s://", scheme)
+	}
+	switch scheme {
+	case "s3":
+		if bucket, key, _ := strings.Cut(location, "/"); bucket == "" || key == "" {
+			return fmt.Errorf("invalid monitor source '%s', expected s3://<bucket>/<key>", monitor)
+		}
+	case "k8s":
+		location, _, _ = strings.Cut(location, "#")
+		if namespace, secret, _ := strings.Cut(location, "/"); namespace == "" || secret == "" || strings.Contains(secret, "/") {
+			return fmt.Errorf("invalid monitor source '%s', expected k8s://<namespace>/<secret>", monitor)
+		}
+	default:
+		if location == "" {
+			return fmt.Errorf("invalid monitor source '%s'", monitor)
+		}
+	}
+	return nil
+}
+
+// fetchMonitoredChain reads the certificate chain of a monitor-only entry,
+// leaf first, from the source its 'monitor' value names.
+func fetchMonitoredChain(monitor string) ([]*x509.Certificate, error) {
+	scheme, location := splitMonitorSource(monitor)
+	fetch, ok := monitorSources[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown monitor source '%s://'", scheme)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), monitorSourceTimeout)
+	defer cancel()
+	return fetch(ctx, location)
+}
+
+// fetchTLSSource returns the chain served at a host[:port] endpoint.
+func fetchTLSSource(_ context.Context, endpoint string) ([]*x509.Certificate, error) {
+	return fetchServedChain(endpoint)
+}
+
+// fetchFileSource reads a local PEM file, e.g. 'file:///etc/ssl/app.pem'.
+func fetchFileSource(_ context.Context, path string) ([]*x509.Certificate, error) {
+	return readCertificateChain(path)
+}
+
+// fetchHTTPSource downloads a PEM bundle, e.g.
+// 'https://pki.example.com/shop.pem'. Credentials in the URL are kept out of
+// errors.
+func fetchHTTPSource(ctx context.Context, location string) ([]*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("failed to download %s: %w", req.URL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, monitorSourceLimit))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", req.URL.Redacted(), resp.Status)
+	}
+	return parseCertificateChain(body, req.URL.Redacted())
+}
+
+// fetchS3Source downloads a PEM object, e.g. 's3://certs/shop/fullchain.pem',
+// with the 'configs.s3' settings.
+func fetchS3Source(ctx context.Context, location string) ([]*x509.Certificate, error) {
+	s3 := currentS3Config()
+	if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no S3 credentials, set 'configs.s3' or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	bucket, key, _ := strings.Cut(location, "/")
+	body, err := s3GetObject(ctx, s3, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificateChain(body, "s3://"+location)
+}
+
+// fetchKubernetesSource reads a TLS Secret, e.g. 'k8s://shop/shop-tls', with
+// the service account of the pod gocert runs in. '#key' picks another key of
+// the Secret than 'tls.crt'.
+func fetchKubernetesSource(ctx context.Context, location string) ([]*x509.Certificate, error) {
+	location, dataKey, ok := strings.Cut(location, "#")
+	if !ok {
+		dataKey = kubeTLSCertKey
+	}
+	namespace, secret, _ := strings.Cut(location, "/")
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" {
+		return nil, fmt.Errorf("not running in Kubernetes, KUBERNETES_SERVICE_HOST is unset")
+	}
+	if port == "" {
+		port = "443"
+	}
+	token, err := os.ReadFile(kubeServiceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the service account token: %w", err)
+	}
+	caPEM, err := os.ReadFile(kubeServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the cluster CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	apiURL := fmt.Sprintf("https://%s/api/v1/namespaces/%s/secrets/%s", net.JoinHostPort(host, port), namespace, secret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Secret %s/%s: %w", namespace, secret, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading Secret %s/%s returned %s", namespace, secret, resp.Status)
+	}
+	// Secret data is base64 in JSON, which []byte fields decode.
+	var body struct {
+		Data map[string][]byte `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, monitorSourceLimit)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode Secret %s/%s: %w", namespace, secret, err)
+	}
+	data, ok := body.Data[dataKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no key '%s'", namespace, secret, dataKey)
+	}
+	return parseCertificateChain(data, fmt.Sprintf("Secret %s/%s", namespace, secret))
+}
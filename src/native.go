@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Upper bound for a complete native issuance, including DNS propagation; it
+// grows with a longer 'propagation_timeout' of the DNS provider
+const nativeIssueTimeout = 15 * time.Minute
+
+// issuerDirectories maps the issuer short names accepted by the schema to
+// their ACME directory URLs, mirroring acme.sh's server names.
+var issuerDirectories = map[string]string{
+	"letsencrypt":      "https://acme-v02.api.letsencrypt.org/directory",
+	"letsencrypt_test": "https://acme-staging-v02.api.letsencrypt.org/directory",
+	"buypass":          "https://api.buypass.com/acme/directory",
+	"buypass_test":     "https://api.test4.buypass.no/acme/directory",
+	"zerossl":          "https://acme.zerossl.com/v2/DV90",
+	"sslcom":           "https://acme.ssl.com/sslcom-dv-rsa",
+	"google":           "https://dv.acme-v02.api.pki.goog/directory",
+	"googletest":       "https://dv.acme-v02.test-api.pki.goog/directory",
+}
+
+// issuerAliases maps friendly issuer names to the short names above.
+var issuerAliases = map[string]string{
+	"le-staging":          "letsencrypt_test",
+	"letsencrypt-staging": "letsencrypt_test",
+	"buypass-staging":     "buypass_test",
+	"google-staging":      "googletest",
+}
+
+// stagingIssuers maps production issuers to their staging counterparts, used
+// by 'staging: true' and 'bootstrap --staging' to test issuance without
+// production rate limits.
+var stagingIssuers = map[string]string{
+	"letsencrypt": "letsencrypt_test",
+	"buypass":     "buypass_test",
+	"google":      "googletest",
+}
+
+// isStagingIssuer reports whether an issuer short name is a staging CA.
+func isStagingIssuer(issuer string) bool {
+	for _, staging := range stagingIssuers {
+		if issuer == staging {
+			return true
+		}
+	}
+	return false
+}
+
+// stagingIssuer returns the staging CA of an issuer, which is the issuer
+// itself for a staging CA.
+func stagingIssuer(issuer string) (string, error) {
+	issuer = canonicalIssuer(issuer)
+	if isStagingIssuer(issuer) {
+		return issuer, nil
+	}
+	if staging, ok := stagingIssuers[issuer]; ok {
+		return staging, nil
+	}
+	return "", fmt.Errorf("issuer '%s' has no staging CA", issuer)
+}
+
+// canonicalIssuer resolves an issuer alias to its short name; short names and
+// URLs are returned unchanged.
+func canonicalIssuer(issuer string) string {
+	if name, ok := issuerAliases[issuer]; ok {
+		return name
+	}
+	return issuer
+}
+
+// directoryURL resolves an issuer short name, alias or URL to an ACME
+// directory URL.
+func directoryURL(issuer string) (string, error) {
+	issuer = canonicalIssuer(issuer)
+	if strings.HasPrefix(issuer, "https://") {
+		return issuer, nil
+	}
+	if u, ok := issuerDirectories[issuer]; ok {
+		return u, nil
+	}
+	return "", fmt.Errorf("unknown issuer '%s'", issuer)
+}
+
+// nativeIssuer issues certificates with the built-in ACME client, solving
+// DNS-01 challenges through the DNS solvers in dns.go.
+type nativeIssuer struct {
+	accountsPath string
+
+	mu          sync.Mutex
+	email       string
+	clients     map[string]*acme.Client
+	authzCaches map[string]*authzCache
+}
+
+func newNativeIssuer(accountsPath string) *nativeIssuer {
+	return &nativeIssuer{accountsPath: accountsPath, clients: map[string]*acme.Client{}, authzCaches: map[string]*authzCache{}}
+}
+
+// setEmail updates the contact address used for new account registrations.
+func (n *nativeIssuer) setEmail(email string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.email = email
+}
+
+// accountKeyPath returns the account key location for an ACME directory.
+// Named accounts keep their keys in a directory of their own.
+func (n *nativeIssuer) accountKeyPath(dirURL, account string) string {
+	host := dirURL
+	if u, err := url.Parse(dirURL); err == nil && u.Host != "" {
+		host = u.Host + strings.ReplaceAll(strings.TrimSuffix(u.Path, "/"), "/", "_")
+	}
+	if account != "" {
+		return filepath.Join(n.accountsPath, "accounts", account, host, "account.key")
+	}
+	return filepath.Join(n.accountsPath, host, "account.key")
+}
+
+// accountKey identifies the client and authorization cache of an account for
+// an ACME directory.
+func accountKey(dirURL, account string) string {
+	if account == "" {
+		return dirURL
+	}
+	return account + " " + dirURL
+}
+
+// loadOrCreateKey reads the ECDSA key at path, generating and storing a new one if it doesn't exist.
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM key found in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// client returns a registered ACME client of an account for the directory,
+// creating the account on first use.
+func (n *nativeIssuer) client(ctx context.Context, dirURL, account string) (*acme.Client, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if c, ok := n.clients[accountKey(dirURL, account)]; ok {
+		return c, nil
+	}
+
+	keyPath := n.accountKeyPath(dirURL, account)
+	key, err := loadOrCreateKey(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load account key %s: %w", keyPath, err)
+	}
+
+	c := &acme.Client{
+		Key:          key,
+		DirectoryURL: dirURL,
+		UserAgent:    "gocert/" + version,
+		HTTPClient:   newACMEHTTPClient(dirURL),
+		RetryBackoff: acmeRetryBackoff,
+	}
+	dir, err := c.Discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ACME directory %s: %w", dirURL, err)
+	}
+	if dir.ExternalAccountRequired {
+		return nil, fmt.Errorf("CA at %s requires external account binding, which the native backend does not support; use backend 'acmesh' instead", dirURL)
+	}
+
+	email := n.email
+	if account != "" {
+		email = accountEmail(account)
+	}
+	registration := &acme.Account{}
+	if email != "" {
+		registration.Contact = []string{"mailto:" + email}
+	}
+	if _, err := c.Register(ctx, registration, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+	log.Printf("Using ACME account key %s for %s", keyPath, dirURL)
+
+	n.clients[accountKey(dirURL, account)] = c
+	return c, nil
+}
+
+// nativeTimeout returns how long an issuance of a certificate by the native
+// backend may take: its 'issue_timeout', else the default extended by the
+// DNS provider's longer propagation waits.
+func nativeTimeout(config CertConfig) time.Duration {
+	if d, ok := issueTimeoutFor(config); ok {
+		return d
+	}
+	tuning := dnsTuningFor(config.Type)
+	timeout := nativeIssueTimeout
+	if extra := tuning.propagationTimeout + tuning.cleanupDelay - dnsPropagationTimeout; extra > 0 {
+		timeout += extra
+	}
+	return timeout
+}
+
+// Issue places a new order, so force makes no difference.
+func (n *nativeIssuer) Issue(name string, config CertConfig, files certFiles, force bool) (err error) {
+	tuning := dnsTuningFor(config.Type)
+	timeout := nativeTimeout(config)
+	// Waiting for the DNS provider doesn't count towards the timeout.
+	release, err := waitForProvider(context.Background(), config.Type)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	defer func() {
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w after %s: %v", errIssueTimeout, timeout, err)
+		}
+	}()
+
+	dirURL, err := directoryURL(config.Issuer)
+	if err != nil {
+		return err
+	}
+	if len(config.ExtraArgs) > 0 {
+		log.Printf("Warning: extra_args of '%s' only apply to the acme.sh backend and are ignored", name)
+	}
+	certEnv, err := resolveCertEnv(config)
+	if err != nil {
+		return err
+	}
+	solver, err := newNativeSolver(config.Type, certEnv)
+	if err != nil {
+		return err
+	}
+	client, err := n.client(ctx, dirURL, config.Account)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(config.Domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create order: %w", err)
+	}
+
+	authzs := n.authzCacheFor(dirURL, config.Account)
+	if err := solveAuthorizations(ctx, client, solver, tuning, authzs, order.AuthzURLs); err != nil {
+		return err
+	}
+
+	authzURLs := order.AuthzURLs
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		// An authorization trusted from the cache may have been deactivated.
+		authzs.forget(authzURLs)
+		return fmt.Errorf("order did not become ready: %w", err)
+	}
+
+	key, err := generateCertKey(keyTypeFor(config))
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	csr, err := certificateRequest(config, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %w", err)
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize order: %w", err)
+	}
+
+	return writeCertFiles(files, key, chain)
+}
+
+// certificateRequest creates the DER-encoded CSR of a certificate for the
+// given key. acme.sh builds the same one: the first domain is the common name.
+func certificateRequest(config CertConfig, key crypto.Signer) ([]byte, error) {
+	return x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: config.Domains[0]},
+		DNSNames: config.Domains,
+	}, key)
+}
+
+// Revoke revokes the certificate in files with the account of its issuer.
+func (n *nativeIssuer) Revoke(name string, config CertConfig, files certFiles) error {
+	ctx, cancel := context.WithTimeout(context.Background(), nativeIssueTimeout)
+	defer cancel()
+
+	dirURL, err := directoryURL(config.Issuer)
+	if err != nil {
+		return err
+	}
+	cert, err := readCertificateFile(files.Cert)
+	if err != nil {
+		return err
+	}
+	client, err := n.client(ctx, dirURL, config.Account)
+	if err != nil {
+		return err
+	}
+	if err := client.RevokeCert(ctx, nil, cert.Raw, acme.CRLReasonCessationOfOperation); err != nil {
+		return fmt.Errorf("failed to revoke certificate: %w", err)
+	}
+	return nil
+}
+
+// DeactivateAccount deactivates the account of an issuer at the CA and
+// renames its key to 'account.key.deactivated-<time>', so a new account is
+// registered if the issuer is used again.
+func (n *nativeIssuer) DeactivateAccount(issuer, account string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), nativeIssueTimeout)
+	defer cancel()
+
+	dirURL, err := directoryURL(issuer)
+	if err != nil {
+		return err
+	}
+	keyPath := n.accountKeyPath(dirURL, account)
+	if _, err := os.Stat(keyPath); err != nil {
+		return fmt.Errorf("no account key for %s: %w", dirURL, err)
+	}
+	key, err := loadOrCreateKey(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load account key %s: %w", keyPath, err)
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: dirURL,
+		UserAgent:    "gocert/" + version,
+		HTTPClient:   newACMEHTTPClient(dirURL),
+		RetryBackoff: acmeRetryBackoff,
+	}
+	if err := client.DeactivateReg(ctx); err != nil {
+		return fmt.Errorf("failed to deactivate ACME account: %w", err)
+	}
+
+	n.mu.Lock()
+	delete(n.clients, accountKey(dirURL, account))
+	n.mu.Unlock()
+	n.authzCacheFor(dirURL, account).clear()
+
+	archived := keyPath + ".deactivated-" + time.Now().UTC().Format(archiveTimeLayout)
+	if err := os.Rename(keyPath, archived); err != nil {
+		return fmt.Errorf("account was deactivated, but its key could not be archived: %w", err)
+	}
+	log.Printf("Account key for %s archived to %s", dirURL, archived)
+	return nil
+}
+
+// pendingChallenge is a DNS-01 challenge whose TXT record has been created,
+// or an HTTP-01 challenge whose token is served; fqdn is the token then.
+type pendingChallenge struct {
+	authz     *acme.Authorization
+	challenge *acme.Challenge
+	fqdn      string
+	value     string
+}
+
+// solveAuthorizations completes the DNS-01 challenges of all pending
+// authorizations of an order. All TXT records are created first and awaited
+// together, then the challenges are accepted at once, so a certificate with
+// many names waits for DNS propagation only once. Authorizations the CA
+// still holds as valid are reused; those known from the cache aren't even
+// fetched. The records are removed once the challenges are done, after the
+// cleanup delay of the DNS provider. With the HTTP-01 solver, the tokens are
+// served instead and there is nothing to wait for.
+func solveAuthorizations(ctx context.Context, client *acme.Client, solver dnsSolver, tuning dnsTuning, cache *authzCache, authzURLs []string) error {
+	_, http01 := solver.(http01Solver)
+	challengeType := "dns-01"
+	if http01 {
+		challengeType = "http-01"
+	}
+
+	var pending []pendingChallenge
+	defer func() {
+		if len(pending) > 0 && tuning.cleanupDelay > 0 && !http01 {
+			time.Sleep(devScaled(tuning.cleanupDelay))
+		}
+		for _, p := range pending {
+			if err := solver.CleanUp(p.fqdn, p.value); err != nil {
+				log.Printf("Warning: failed to remove TXT record %s: %v", p.fqdn, err)
+			}
+		}
+	}()
+
+	for _, authzURL := range authzURLs {
+		if domain, cached, ok := cache.valid(authzURL); ok {
+			log.Printf("Reusing valid authorization for %s (until %s)", domain, cached.Expires.Format(time.RFC3339))
+			metricAuthorizations.Inc("reused")
+			continue
+		}
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch authorization: %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			log.Printf("Reusing valid authorization for %s (until %s)", authz.Identifier.Value, authz.Expires.Format(time.RFC3339))
+			metricAuthorizations.Inc("reused")
+			cache.record(authz)
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return fmt.Errorf("no %s challenge offered for %s", challengeType, authz.Identifier.Value)
+		}
+
+		if http01 {
+			keyAuth, err := client.HTTP01ChallengeResponse(challenge.Token)
+			if err != nil {
+				return err
+			}
+			log.Printf("Serving HTTP-01 token for %s", authz.Identifier.Value)
+			if err := solver.Present(challenge.Token, keyAuth); err != nil {
+				return err
+			}
+			pending = append(pending, pendingChallenge{authz: authz, challenge: challenge, fqdn: challenge.Token, value: keyAuth})
+			continue
+		}
+		value, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		fqdn := "_acme-challenge." + authz.Identifier.Value
+
+		log.Printf("Creating DNS-01 record %s", fqdn)
+		if err := solver.Present(fqdn, value); err != nil {
+			return fmt.Errorf("failed to create TXT record %s: %w", fqdn, err)
+		}
+		pending = append(pending, pendingChallenge{authz: authz, challenge: challenge, fqdn: fqdn, value: value})
+	}
+
+	if !http01 {
+		if err := forEachChallenge(pending, func(p pendingChallenge) error {
+			return waitForTXT(ctx, p.fqdn, p.value, tuning.propagationTimeout)
+		}); err != nil {
+			return err
+		}
+	}
+	for _, p := range pending {
+		if _, err := client.Accept(ctx, p.challenge); err != nil {
+			return fmt.Errorf("failed to accept challenge for %s: %w", p.authz.Identifier.Value, err)
+		}
+	}
+	return forEachChallenge(pending, func(p pendingChallenge) error {
+		authz, err := client.WaitAuthorization(ctx, p.authz.URI)
+		if err != nil {
+			return fmt.Errorf("authorization for %s failed: %w", p.authz.Identifier.Value, err)
+		}
+		metricAuthorizations.Inc("solved")
+		cache.record(authz)
+		return nil
+	})
+}
+
+// forEachChallenge runs fn for all challenges concurrently and returns their joined errors.
+func forEachChallenge(pending []pendingChallenge, fn func(pendingChallenge) error) error {
+	errs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	for i, p := range pending {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(p)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// writeCertFiles stores the private key, leaf certificate and full chain.
+func writeCertFiles(files certFiles, key crypto.Signer, chain [][]byte) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("CA returned an empty certificate chain")
+	}
+
+	keyPEM, err := encodeCertKey(key)
+	if err != nil {
+		return err
+	}
+	var fullchain []byte
+	for _, der := range chain {
+		fullchain = append(fullchain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	if err := os.WriteFile(files.Key, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", files.Key, err)
+	}
+	if err := os.WriteFile(files.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[0]}), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", files.Cert, err)
+	}
+	if err := os.WriteFile(files.Fullchain, fullchain, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", files.Fullchain, err)
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum time an exec notifier plugin may run
+	notifierExecTimeout = 30 * time.Second
+	// Prefix of executables on PATH that provide additional notifier types
+	notifierPluginPrefix = "gocert-notify-"
+	// How long failed deliveries are retried unless 'notify_retry_period' is set
+	defaultNotifyRetryPeriod = 24 * time.Hour
+	// How often the daemon retries queued deliveries
+	notifyRetryInterval = 1 * time.Minute
+	// First retry delay, doubled after every failed attempt up to notifyRetryMaxDelay
+	notifyRetryBaseDelay = 1 * time.Minute
+	notifyRetryMaxDelay  = 1 * time.Hour
+)
+
+// NotificationEvent is the payload delivered to every notification channel.
+// Exec plugins receive it as JSON on stdin.
+type NotificationEvent struct {
+	Event   string    `json:"event"`
+	Cert    string    `json:"cert,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	// NotAfter is the expiry of the certificate, if the event concerns it
+	NotAfter time.Time `json:"not_after,omitzero"`
+}
+
+// Notifier delivers notification events to a single channel.
+type Notifier interface {
+	Notify(event NotificationEvent) error
+}
+
+// NotifierConfig defines a notification channel in the 'configs.notifiers' section.
+type NotifierConfig struct {
+	Type      string   `yaml:"type"`
+	Command   []string `yaml:"command"`
+	RateLimit int      `yaml:"rate_limit"`
+	Events    []string `yaml:"events"`
+	// WebhookURL is the incoming webhook of 'slack' and 'discord' channels
+	WebhookURL string `yaml:"webhook_url"`
+	// Templates override the message of 'slack' and 'discord' channels per
+	// event, '*' for all other events
+	Templates map[string]string `yaml:"templates"`
+}
+
+// notifierFactory builds a Notifier for a configured channel.
+type notifierFactory func(name string, config NotifierConfig) (Notifier, error)
+
+// notifierTypes holds the built-in notifier types, keyed by their 'type' value.
+var notifierTypes = map[string]notifierFactory{}
+
+// registerNotifierType makes a notifier type available to the configuration.
+func registerNotifierType(typ string, factory notifierFactory) {
+	notifierTypes[typ] = factory
+}
+
+func init() {
+	registerNotifierType("exec", newExecNotifier)
+	registerNotifierType("slack", newSlackNotifier)
+	registerNotifierType("discord", newDiscordNotifier)
+}
+
+// channel is a configured notifier together with its delivery policy.
+type channel struct {
+	name     string
+	config   NotifierConfig
+	notifier Notifier
+}
+
+var (
+	// channelsMutex guards the active channels and their rate limit state
+	channelsMutex = &sync.Mutex{}
+	// channels holds the notifiers built from the most recently loaded config
+	channels = map[string]*channel{}
+	// channelSends records recent delivery times per channel for rate limiting
+	channelSends = map[string][]time.Time{}
+	// notifyRetryPeriod is how long queued deliveries are retried before being dropped
+	notifyRetryPeriod = defaultNotifyRetryPeriod
+	// expiryLadder holds the steps of 'configs.expiry_notifications', most
+	// days first
+	expiryLadder []ExpiryNotificationStep
+)
+
+// newNotifier builds the notifier for a channel. Unknown types are resolved to
+// an exec plugin named 'gocert-notify-<type>' on the PATH.
+func newNotifier(name string, config NotifierConfig) (Notifier, error) {
+	if factory, ok := notifierTypes[config.Type]; ok {
+		return factory(name, config)
+	}
+
+	plugin, err := exec.LookPath(notifierPluginPrefix + config.Type)
+	if err != nil {
+		return nil, fmt.Errorf("unknown notifier type '%s' for channel '%s' and no '%s%s' plugin found on PATH", config.Type, name, notifierPluginPrefix, config.Type)
+	}
+	config.Command = append([]string{plugin}, config.Command...)
+	return newExecNotifier(name, config)
+}
+
+// configureNotifiers replaces the active notification channels and retry policy.
+func configureNotifiers(global GlobalConfig) {
+	retryPeriod := defaultNotifyRetryPeriod
+	if global.NotifyRetryPeriod != "" {
+		d, err := time.ParseDuration(global.NotifyRetryPeriod)
+		if err != nil {
+			log.Printf("Warning: invalid notify_retry_period '%s', using %s: %v", global.NotifyRetryPeriod, defaultNotifyRetryPeriod, err)
+		} else {
+			retryPeriod = d
+		}
+	}
+
+	built := map[string]*channel{}
+	for name, config := range global.Notifiers {
+		notifier, err := newNotifier(name, config)
+		if err != nil {
+			log.Printf("ERROR: Failed to set up notification channel '%s': %v", name, err)
+			continue
+		}
+		built[name] = &channel{name: name, config: config, notifier: notifier}
+	}
+
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	channels = built
+	notifyRetryPeriod = retryPeriod
+	expiryLadder = expiryLadderFor(global)
+}
+
+// allowSend reports whether the channel is still within its hourly rate limit
+// and records the send if it is. Callers must hold channelsMutex.
+func allowSend(ch *channel, now time.Time) bool {
+	if ch.config.RateLimit <= 0 {
+		return true
+	}
+
+	var recent []time.Time
+	for _, t := range channelSends[ch.name] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= ch.config.RateLimit {
+		channelSends[ch.name] = recent
+		return false
+	}
+	channelSends[ch.name] = append(recent, now)
+	return true
+}
+
+// wantsEvent reports whether the channel subscribed to the given event type.
+func (ch *channel) wantsEvent(event string) bool {
+	if len(ch.config.Events) == 0 {
+		return true
+	}
+	for _, e := range ch.config.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// sendNotification delivers an event to every subscribed channel. Failed
+// deliveries are queued in the database for retry and never interrupt
+// certificate processing. db may be nil, in which case nothing is queued.
+// Failures of quarantined certificates aren't sent.
+func sendNotification(db *sql.DB, event NotificationEvent) {
+	if quarantinedEvents[event.Event] && db != nil && isQuarantined(db, event.Cert) {
+		log.Printf("Not sending '%s' notification for quarantined certificate '%s'", event.Event, event.Cert)
+		return
+	}
+	sendNotificationTo(db, event, nil)
+}
+
+// sendNotificationTo is sendNotification limited to the named channels, which
+// get the event whatever their 'events'. Without names, every subscribed
+// channel gets it.
+func sendNotificationTo(db *sql.DB, event NotificationEvent, names []string) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	channelsMutex.Lock()
+	var targets []*channel
+	for _, ch := range channels {
+		if len(names) > 0 && !slices.Contains(names, ch.name) {
+			continue
+		}
+		if len(names) == 0 && !ch.wantsEvent(event.Event) {
+			continue
+		}
+		if !allowSend(ch, event.Time) {
+			log.Printf("Warning: Notification channel '%s' exceeded its rate limit of %d per hour, dropping '%s' event", ch.name, ch.config.RateLimit, event.Event)
+			continue
+		}
+		targets = append(targets, ch)
+	}
+	channelsMutex.Unlock()
+
+	for _, ch := range targets {
+		if err := ch.notifier.Notify(event); err != nil {
+			log.Printf("ERROR: Failed to deliver '%s' notification to channel '%s': %v", event.Event, ch.name, err)
+			if db != nil {
+				if qerr := enqueueNotification(db, ch.name, event, err); qerr != nil {
+					log.Printf("ERROR: Failed to queue notification for retry: %v", qerr)
+				}
+			}
+		}
+	}
+}
+
+// retryDelay returns the backoff before the next delivery attempt.
+func retryDelay(attempts int) time.Duration {
+	delay := notifyRetryBaseDelay
+	for i := 1; i < attempts && delay < notifyRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > notifyRetryMaxDelay {
+		delay = notifyRetryMaxDelay
+	}
+	return devScaled(delay)
+}
+
+// enqueueNotification stores a failed delivery for later retry.
+func enqueueNotification(db *sql.DB, channelName string, event NotificationEvent, deliveryErr error) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	now := time.Now()
+	_, err = db.Exec(`
+	INSERT INTO notification_queue (channel, payload, attempts, next_attempt, created_at, last_error)
+	VALUES (?, ?, 1, ?, ?, ?)`, channelName, string(payload), now.Add(retryDelay(1)), now, deliveryErr.Error())
+	return err
+}
+
+// queuedNotification is a pending delivery loaded from the notification_queue table.
+type queuedNotification struct {
+	id          int64
+	channel     string
+	payload     string
+	attempts    int
+	nextAttempt time.Time
+	createdAt   time.Time
+}
+
+// processNotificationQueue retries every queued delivery that is due. Deliveries
+// are dropped once they succeed, their channel disappears from the config, or
+// they have been pending for longer than the retry period.
+func processNotificationQueue(db *sql.DB) {
+	rows, err := db.Query("SELECT id, channel, payload, attempts, next_attempt, created_at FROM notification_queue ORDER BY id")
+	if err != nil {
+		log.Printf("ERROR: Failed to read notification queue: %v", err)
+		return
+	}
+	var pending []queuedNotification
+	for rows.Next() {
+		var q queuedNotification
+		if err := rows.Scan(&q.id, &q.channel, &q.payload, &q.attempts, &q.nextAttempt, &q.createdAt); err != nil {
+			log.Printf("Warning: could not scan queued notification: %v", err)
+			continue
+		}
+		pending = append(pending, q)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, q := range pending {
+		if q.nextAttempt.After(now) {
+			continue
+		}
+
+		channelsMutex.Lock()
+		ch, ok := channels[q.channel]
+		retryPeriod := notifyRetryPeriod
+		channelsMutex.Unlock()
+
+		if !ok {
+			log.Printf("Warning: Dropping queued notification %d, channel '%s' is no longer configured", q.id, q.channel)
+			deleteQueuedNotification(db, q.id)
+			continue
+		}
+
+		var event NotificationEvent
+		if err := json.Unmarshal([]byte(q.payload), &event); err != nil {
+			log.Printf("Warning: Dropping unreadable queued notification %d: %v", q.id, err)
+			deleteQueuedNotification(db, q.id)
+			continue
+		}
+
+		if err := ch.notifier.Notify(event); err != nil {
+			if now.Sub(q.createdAt) >= retryPeriod {
+				log.Printf("ERROR: Giving up on '%s' notification to channel '%s' after %d attempts: %v", event.Event, q.channel, q.attempts+1, err)
+				deleteQueuedNotification(db, q.id)
+				continue
+			}
+
+			log.Printf("Warning: Retry %d of '%s' notification to channel '%s' failed: %v", q.attempts, event.Event, q.channel, err)
+			dbMutex.Lock()
+			_, uerr := db.Exec("UPDATE notification_queue SET attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?",
+				q.attempts+1, now.Add(retryDelay(q.attempts+1)), err.Error(), q.id)
+			dbMutex.Unlock()
+			if uerr != nil {
+				log.Printf("ERROR: Failed to update queued notification %d: %v", q.id, uerr)
+			}
+			continue
+		}
+
+		log.Printf("Delivered queued '%s' notification to channel '%s' after %d attempts", event.Event, q.channel, q.attempts+1)
+		deleteQueuedNotification(db, q.id)
+	}
+}
+
+// deleteQueuedNotification removes a delivery from the queue.
+func deleteQueuedNotification(db *sql.DB, id int64) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	if _, err := db.Exec("DELETE FROM notification_queue WHERE id = ?", id); err != nil {
+		log.Printf("ERROR: Failed to delete queued notification %d: %v", id, err)
+	}
+}
+
+// startNotificationRetryLoop periodically retries queued deliveries in the background.
+func startNotificationRetryLoop(db *sql.DB) {
+	go func() {
+		ticker := time.NewTicker(devScaled(notifyRetryInterval))
+		defer ticker.Stop()
+		for range ticker.C {
+			processNotificationQueue(db)
+		}
+	}()
+}
+
+// execNotifier implements the exec plugin protocol: the command receives the
+// event as JSON on stdin plus GOCERT_EVENT, GOCERT_CERT and GOCERT_MESSAGE in
+// its environment, and must exit with status 0 on successful delivery.
+type execNotifier struct {
+	command []string
+}
+
+func newExecNotifier(name string, config NotifierConfig) (Notifier, error) {
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("channel '%s' requires a 'command'", name)
+	}
+	return &execNotifier{command: config.Command}, nil
+}
+
+func (n *execNotifier) Notify(event NotificationEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifierExecTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, n.command[0], n.command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(),
+		"GOCERT_EVENT="+event.Event,
+		"GOCERT_CERT="+event.Cert,
+		"GOCERT_MESSAGE="+event.Message,
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// testNotifier sends a test event to a single configured channel.
+func testNotifier(config FullConfig, name string) error {
+	notifierConfig, ok := config.Configs.Notifiers[name]
+	if !ok {
+		var names []string
+		for n := range config.Configs.Notifiers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("channel '%s' is not configured (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	notifier, err := newNotifier(name, notifierConfig)
+	if err != nil {
+		return err
+	}
+	return notifier.Notify(NotificationEvent{
+		Event:   "test",
+		Message: fmt.Sprintf("Test notification from gocert %s", version),
+		Time:    time.Now(),
+	})
+}
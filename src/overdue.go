@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ExpiryNotificationStep is a step of the expiry notification ladder: a
+// 'not_renewed' notification once a certificate expires within Days.
+type ExpiryNotificationStep struct {
+	Days int `yaml:"days"`
+	// Channels receive this step, all channels subscribed to 'not_renewed'
+	// if empty
+	Channels []string `yaml:"channels"`
+}
+
+// expiryLadderFor returns the steps of 'expiry_notifications', most days
+// first. Without it, 'not_renewed_days' is a ladder of a single step.
+func expiryLadderFor(global GlobalConfig) []ExpiryNotificationStep {
+	ladder := slices.Clone(global.ExpiryNotifications)
+	if len(ladder) == 0 && global.NotRenewedDays > 0 {
+		ladder = []ExpiryNotificationStep{{Days: global.NotRenewedDays}}
+	}
+	slices.SortFunc(ladder, func(a, b ExpiryNotificationStep) int { return b.Days - a.Days })
+	return ladder
+}
+
+// validateExpiryLadder checks that the steps of 'expiry_notifications' are
+// distinct and only name configured channels.
+func validateExpiryLadder(global GlobalConfig) error {
+	seen := map[int]bool{}
+	for _, step := range global.ExpiryNotifications {
+		if step.Days <= 0 {
+			return fmt.Errorf("expiry_notifications: days must be positive, got %d", step.Days)
+		}
+		if seen[step.Days] {
+			return fmt.Errorf("expiry_notifications: %d days is listed twice", step.Days)
+		}
+		seen[step.Days] = true
+		for _, name := range step.Channels {
+			if _, ok := global.Notifiers[name]; !ok {
+				return fmt.Errorf("expiry_notifications: unknown channel '%s' at %d days", name, step.Days)
+			}
+		}
+	}
+	return nil
+}
+
+// checkNotRenewed walks a managed certificate down the expiry notification
+// ladder: once it still expires within the days of a step after its check,
+// i.e. renewing it failed or was held back, the step's channels get a
+// 'not_renewed' notification. Each step is sent once per expiry and only the
+// closest one when several are due at once. A renewal moves the expiry out of
+// the ladder, which silences it.
+func checkNotRenewed(name string, config CertConfig, db *sql.DB, certsBasePath string) {
+	channelsMutex.Lock()
+	ladder := expiryLadder
+	channelsMutex.Unlock()
+	if len(ladder) == 0 || config.Monitor != "" {
+		return
+	}
+
+	state, found, err := getCertState(db, name)
+	if err != nil || !found || state.Status == "revoked" || (state.LastIssued.IsZero() && state.NotAfter.IsZero()) {
+		return
+	}
+	expiry := currentExpiry(state, certsBasePath)
+	logger := certLogger(name, config)
+
+	var due *ExpiryNotificationStep
+	for i := range ladder {
+		if time.Until(expiry) <= time.Duration(ladder[i].Days)*24*time.Hour {
+			due = &ladder[i]
+		}
+	}
+	if due == nil {
+		if err := clearExpiryNotice(db, name); err != nil {
+			logger.Warn(err.Error())
+		}
+		return
+	}
+	sentDays, sentExpiry, err := expiryNotice(db, name)
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	if sentExpiry.Equal(expiry) && sentDays <= due.Days {
+		return
+	}
+	if err := recordExpiryNotice(db, name, due.Days, expiry); err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Certificate '%s' expires on %s and wasn't renewed", name, expiry.Format("2006-01-02 15:04"))
+	if failures, lastError, err := issueFailures(db, name); err == nil && failures > 0 {
+		message += fmt.Sprintf(" (%d failed attempts, last error: %s)", failures, lastError)
+	}
+	logger.Error(message, "step_days", due.Days)
+	sendNotificationTo(db, NotificationEvent{Event: "not_renewed", Cert: name, Message: message, NotAfter: expiry}, due.Channels)
+}
+
+// expiryNotice returns the ladder step last sent for a certificate and the
+// expiry it was sent for, or zero values.
+func expiryNotice(db *sql.DB, name string) (int, time.Time, error) {
+	var days int
+	var notAfter time.Time
+	err := db.QueryRow(`SELECT days, not_after FROM expiry_notices WHERE name = ?`, name).Scan(&days, &notAfter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to read expiry notifications of '%s': %w", name, err)
+	}
+	return days, notAfter, nil
+}
+
+// recordExpiryNotice remembers the ladder step sent for a certificate.
+func recordExpiryNotice(db *sql.DB, name string, days int, notAfter time.Time) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT INTO expiry_notices (name, days, not_after) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET days = excluded.days, not_after = excluded.not_after`,
+		name, days, notAfter)
+	if err != nil {
+		return fmt.Errorf("failed to record expiry notification of '%s': %w", name, err)
+	}
+	return nil
+}
+
+// clearExpiryNotice forgets the ladder steps sent for a certificate.
+func clearExpiryNotice(db *sql.DB, name string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if _, err := db.Exec(`DELETE FROM expiry_notices WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("failed to clear expiry notifications of '%s': %w", name, err)
+	}
+	return nil
+}
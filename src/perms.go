@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Mode of private keys and PKCS#12 bundles unless 'key_mode' is set
+	defaultKeyMode os.FileMode = 0600
+	// Mode of certificates and chains unless 'cert_mode' is set
+	defaultCertMode os.FileMode = 0644
+)
+
+// FileModes sets the permissions and ownership of the files written for a
+// certificate, in 'configs:' for all certificates or on a single entry.
+// Modes are octal strings such as '0640'; owner and group are names or IDs.
+type FileModes struct {
+	KeyMode  string `yaml:"key_mode" json:"key_mode,omitempty"`
+	CertMode string `yaml:"cert_mode" json:"cert_mode,omitempty"`
+	Owner    string `yaml:"owner" json:"owner,omitempty"`
+	Group    string `yaml:"group" json:"group,omitempty"`
+}
+
+var (
+	// fileModesMutex guards defaultFileModes
+	fileModesMutex = &sync.Mutex{}
+	// defaultFileModes applies to certificates that don't set their own
+	defaultFileModes FileModes
+)
+
+// configureFileModes applies the file permissions of the global configuration.
+func configureFileModes(global GlobalConfig) {
+	fileModesMutex.Lock()
+	defer fileModesMutex.Unlock()
+	defaultFileModes = global.FileModes
+}
+
+// fileModesFor returns the file permissions of a certificate, each field
+// falling back to 'configs:'.
+func fileModesFor(config CertConfig) FileModes {
+	fileModesMutex.Lock()
+	defer fileModesMutex.Unlock()
+
+	modes := config.FileModes
+	if modes.KeyMode == "" {
+		modes.KeyMode = defaultFileModes.KeyMode
+	}
+	if modes.CertMode == "" {
+		modes.CertMode = defaultFileModes.CertMode
+	}
+	if modes.Owner == "" {
+		modes.Owner = defaultFileModes.Owner
+	}
+	if modes.Group == "" {
+		modes.Group = defaultFileModes.Group
+	}
+	return modes
+}
+
+// resolvedModes are FileModes ready to apply; a UID or GID of -1 leaves the
+// owner or group unchanged.
+type resolvedModes struct {
+	keyMode, certMode os.FileMode
+	uid, gid          int
+}
+
+// resolve parses the modes and looks up the owner and group.
+func (m FileModes) resolve() (resolvedModes, error) {
+	r := resolvedModes{keyMode: defaultKeyMode, certMode: defaultCertMode, uid: -1, gid: -1}
+	var err error
+	if m.KeyMode != "" {
+		if r.keyMode, err = parseFileMode(m.KeyMode); err != nil {
+			return r, fmt.Errorf("invalid 'key_mode': %w", err)
+		}
+	}
+	if m.CertMode != "" {
+		if r.certMode, err = parseFileMode(m.CertMode); err != nil {
+			return r, fmt.Errorf("invalid 'cert_mode': %w", err)
+		}
+	}
+	if m.Owner != "" {
+		if r.uid, err = lookupID(m.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return r, fmt.Errorf("invalid 'owner': %w", err)
+		}
+	}
+	if m.Group != "" {
+		if r.gid, err = lookupID(m.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return r, fmt.Errorf("invalid 'group': %w", err)
+		}
+	}
+	return r, nil
+}
+
+// parseFileMode parses an octal permission string such as '0640'.
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("'%s' is not an octal file mode like '0640'", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupID returns a numeric ID as is and looks up names with lookup.
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// applyFileModes sets the permissions and ownership of all files of a
+// certificate: the key files and PKCS#12 bundles get the key mode, the
+// certificates and chains the cert mode. Owner and group also apply to the
+// certificate directory. Files already matching are left alone.
+func applyFileModes(name string, config CertConfig, certsBasePath string) error {
+	modes, err := fileModesFor(config).resolve()
+	if err != nil {
+		return err
+	}
+	if err := applyFileMode(certFilesFor(certsBasePath, name).Dir, 0, modes.uid, modes.gid); err != nil {
+		return err
+	}
+	for _, files := range allCertFiles(certsBasePath, name, config) {
+		for path, mode := range map[string]os.FileMode{
+			files.Key:           modes.keyMode,
+			pfxPath(files.Cert): modes.keyMode,
+			files.Cert:          modes.certMode,
+			files.Fullchain:     modes.certMode,
+		} {
+			if err := applyFileMode(path, mode, modes.uid, modes.gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyFileMode changes the mode (unless 0) and ownership of an existing
+// file where they differ.
+func applyFileMode(path string, mode os.FileMode, uid, gid int) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if mode != 0 && info.Mode().Perm() != mode {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && (uid == -1 || uid == int(st.Uid)) && (gid == -1 || gid == int(st.Gid)) {
+		return nil
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// planEntry is what the next check cycle would do with a certificate, as
+// reported by 'gocert plan'.
+type planEntry struct {
+	Name string `json:"name"`
+	// Action is 'issue' for certificates gocert doesn't know yet, 'renew',
+	// 'skip', or 'shared' for entries that get the certificate of another
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+	Backend string `json:"backend,omitempty"`
+	// Commands are the acme.sh command lines that would run, one per key type
+	Commands []string `json:"commands,omitempty"`
+	// Error is why the issuance would fail before acme.sh runs
+	Error string `json:"error,omitempty"`
+	// Diffs compare the planned CSRs with the deployed certificates, one per
+	// key type
+	Diffs []certDiff `json:"diffs,omitempty"`
+}
+
+// certDiff is how a certificate issued from a planned CSR would differ from
+// the deployed one.
+type certDiff struct {
+	// Cert is the file of the deployed certificate; Deployed is false if
+	// there is none yet
+	Cert     string   `json:"cert"`
+	Deployed bool     `json:"deployed"`
+	SANs     []string `json:"sans"`
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	// KeyTypeFrom and IssuerFrom are those of the deployed certificate
+	KeyTypeFrom string `json:"key_type_from,omitempty"`
+	KeyType     string `json:"key_type"`
+	IssuerFrom  string `json:"issuer_from,omitempty"`
+	Issuer      string `json:"issuer"`
+}
+
+// changes lists the differences in the order the plan prints them.
+func (d certDiff) changes() []string {
+	var changes []string
+	for _, san := range d.Added {
+		changes = append(changes, "+ "+san)
+	}
+	for _, san := range d.Removed {
+		changes = append(changes, "- "+san)
+	}
+	if d.KeyTypeFrom != "" && d.KeyTypeFrom != d.KeyType {
+		changes = append(changes, fmt.Sprintf("key type %s -> %s", d.KeyTypeFrom, d.KeyType))
+	}
+	if d.IssuerFrom != "" && d.IssuerFrom != d.Issuer {
+		changes = append(changes, fmt.Sprintf("issuer %s -> %s", d.IssuerFrom, d.Issuer))
+	}
+	return changes
+}
+
+// diffCertificate builds the CSR a certificate would be issued with and
+// compares it with the certificate deployed in files. The key only signs the
+// CSR and is thrown away.
+func diffCertificate(config CertConfig, files certFiles, recordedIssuer string, key crypto.Signer) (certDiff, error) {
+	der, err := certificateRequest(config, key)
+	if err != nil {
+		return certDiff{}, fmt.Errorf("failed to create CSR: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return certDiff{}, fmt.Errorf("failed to parse CSR: %w", err)
+	}
+	diff := certDiff{Cert: files.Cert, SANs: csr.DNSNames, KeyType: publicKeyType(csr.PublicKey), Issuer: config.Issuer}
+
+	cert, err := readCertificateFile(files.Cert)
+	if err != nil {
+		return diff, nil
+	}
+	diff.Deployed = true
+	diff.KeyTypeFrom = certKeyType(cert)
+	diff.IssuerFrom = recordedIssuer
+
+	deployed := map[string]bool{}
+	for _, san := range cert.DNSNames {
+		deployed[strings.ToLower(san)] = true
+	}
+	planned := map[string]bool{}
+	for _, san := range csr.DNSNames {
+		planned[strings.ToLower(san)] = true
+		if !deployed[strings.ToLower(san)] {
+			diff.Added = append(diff.Added, san)
+		}
+	}
+	for _, san := range cert.DNSNames {
+		if !planned[strings.ToLower(san)] {
+			diff.Removed = append(diff.Removed, san)
+		}
+	}
+	return diff, nil
+}
+
+// planCertificate decides what processSingleCert would do with a
+// certificate, without changing anything. The throwaway keys signing the
+// CSRs are taken from keys, or generated and added to it.
+func planCertificate(name string, config CertConfig, db *sql.DB, certsBasePath string, keys map[string]crypto.Signer) (planEntry, error) {
+	entry := planEntry{Name: name, Action: "skip"}
+	if config.Monitor != "" {
+		entry.Reason = "Monitor-only entry, checked at " + config.Monitor + "."
+		return entry, nil
+	}
+	entry.Backend = backendFor(config)
+
+	state, found, err := getCertState(db, name)
+	if err != nil {
+		return entry, err
+	}
+	if found && state.Status == "orphaned" {
+		state.Status = "unknown"
+		if !state.LastIssued.IsZero() {
+			state.Status = "issued"
+		}
+	}
+
+	if found && state.Status == statusNeedsIntervention {
+		entry.Reason = fmt.Sprintf("Certificate needs intervention, fix the cause and run 'gocert retry %s'.", name)
+		return entry, nil
+	}
+	if found {
+		quarantine, quarantined, err := getQuarantine(db, name)
+		if err != nil {
+			return entry, err
+		}
+		if quarantined && time.Now().Before(quarantine.NextRetry) {
+			entry.Reason = "Quarantined for alternating between success and failure." + formatAttrs("next_retry", quarantine.NextRetry.Format(time.RFC3339))
+			return entry, nil
+		}
+	}
+	if found && (state.Status == "failed" || state.Status == statusTimeout) && strings.Join(config.Domains, ",") == state.Domains {
+		nextRetry, err := nextIssueRetry(db, name)
+		if err != nil {
+			return entry, err
+		}
+		if time.Now().Before(nextRetry) {
+			entry.Reason = "Backing off after failed issuance." + formatAttrs("next_retry", nextRetry.Format(time.RFC3339))
+			return entry, nil
+		}
+	}
+
+	if found {
+		state = certStateFromFiles(name, config, state, certsBasePath)
+	}
+	due := renewalDue(name, config, state, found, certsBasePath)
+	entry.Reason = due.Reason + formatAttrs(due.Attrs...)
+	if !due.Renew {
+		return entry, nil
+	}
+	if found && time.Now().Before(state.NotAfter) && checkCertFiles(certFilesFor(certsBasePath, name)) == nil {
+		if reason, until, deferred := renewalDeferral(config, time.Now()); deferred && !until.IsZero() && until.Before(state.NotAfter) {
+			entry.Reason = "Renewal deferred, " + reason + "." + formatAttrs("until", until.Format(time.RFC3339))
+			return entry, nil
+		}
+	}
+
+	entry.Action = "renew"
+	if !found {
+		entry.Action = "issue"
+	}
+	// Each key type is issued on its own, see issueCertificate.
+	configs, files := []CertConfig{config}, []certFiles{certFilesFor(certsBasePath, name)}
+	if len(config.KeyTypes) > 0 {
+		configs, files = nil, nil
+		for _, keyType := range config.KeyTypes {
+			typed := config
+			typed.KeyType, typed.KeyTypes = keyType, nil
+			configs = append(configs, typed)
+			files = append(files, keyTypeFiles(certsBasePath, name, keyType))
+		}
+	}
+	for i := range configs {
+		keyType := keyTypeFor(configs[i])
+		key, ok := keys[keyType]
+		if !ok {
+			if key, err = generateCertKey(keyType); err != nil {
+				return entry, err
+			}
+			keys[keyType] = key
+		}
+		diff, err := diffCertificate(configs[i], files[i], state.Issuer, key)
+		if err != nil {
+			return entry, err
+		}
+		entry.Diffs = append(entry.Diffs, diff)
+	}
+	if entry.Backend != backendAcmeSh {
+		return entry, nil
+	}
+	for i := range configs {
+		args := acmeShIssueArgs(configs[i], files[i], false)
+		if err := checkAcmeShSupport(args); err != nil && entry.Error == "" {
+			entry.Error = err.Error()
+		}
+		entry.Commands = append(entry.Commands, commandLine(acmeShPath, args))
+	}
+	return entry, nil
+}
+
+// planCertificates returns what the next check cycle would do with each
+// selected certificate of the configuration, sorted by name.
+func planCertificates(fullConfig FullConfig, db *sql.DB, certsBasePath string) ([]planEntry, error) {
+	primaryOf := sharedCertGroups(fullConfig)
+	keys := map[string]crypto.Signer{}
+	entries := []planEntry{}
+	for name, config := range fullConfig.Certificates {
+		if !certSelected(name, primaryOf) {
+			continue
+		}
+		if primary, ok := primaryOf[name]; ok {
+			entries = append(entries, planEntry{Name: name, Action: "shared", Reason: fmt.Sprintf("Gets the certificate of '%s'.", primary)})
+			continue
+		}
+		entry, err := planCertificate(name, config, db, certsBasePath, keys)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// runPlan prints what a check cycle would do with the certificates of a
+// configuration file, without issuing, deploying or recording anything.
+func runPlan(yamlFile string, db *sql.DB, certsBasePath, output string) error {
+	fullConfig, err := loadEffectiveConfig(yamlFile, db)
+	if err != nil {
+		return err
+	}
+	configureIssuers(fullConfig.Configs)
+	if usesBackend(fullConfig, backendAcmeSh) {
+		// Only used to check the options, like the daemon does.
+		_, _ = detectAcmeShVersion()
+	}
+	logCertSelection(fullConfig)
+
+	entries, err := planCertificates(fullConfig, db, certsBasePath)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	if len(entries) == 0 {
+		fmt.Println("No certificates configured.")
+		return nil
+	}
+
+	counts := map[string]int{}
+	for i, e := range entries {
+		if i > 0 {
+			fmt.Println()
+		}
+		counts[e.Action]++
+		fmt.Printf("%s: %s\n", e.Name, e.Action)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintf(w, "  Reason:\t%s\n", e.Reason)
+		if e.Action == "issue" || e.Action == "renew" {
+			fmt.Fprintf(w, "  Backend:\t%s\n", e.Backend)
+		}
+		for j, command := range e.Commands {
+			label := ""
+			if j == 0 {
+				label = "Command:"
+			}
+			fmt.Fprintf(w, "  %s\t%s\n", label, command)
+		}
+		if e.Error != "" {
+			fmt.Fprintf(w, "  Error:\t%s\n", e.Error)
+		}
+		for _, diff := range e.Diffs {
+			fmt.Fprintf(w, "  CSR:\t%s (%s, %s)\n", strings.Join(diff.SANs, ", "), diff.KeyType, diff.Issuer)
+			changes := diff.changes()
+			switch {
+			case !diff.Deployed:
+				changes = []string{"no certificate deployed at " + diff.Cert}
+			case len(changes) == 0:
+				changes = []string{"none, same SANs, key type and issuer as " + diff.Cert}
+			}
+			for j, change := range changes {
+				label := ""
+				if j == 0 {
+					label = "Changes:"
+				}
+				fmt.Fprintf(w, "  %s\t%s\n", label, change)
+			}
+		}
+		w.Flush()
+	}
+	fmt.Printf("\nPlan: %d to issue, %d to renew, %d to skip, %d shared.\n", counts["issue"], counts["renew"], counts["skip"], counts["shared"])
+	return nil
+}
+
+// formatAttrs formats log attributes as ' (key=value, ...)'.
+func formatAttrs(attrs ...any) string {
+	var parts []string
+	for i := 0; i+1 < len(attrs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%v=%v", attrs[i], attrs[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+// plainArg matches arguments that need no quoting in a shell.
+var plainArg = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// commandLine returns a command as it would be typed into a shell.
+func commandLine(command string, args []string) string {
+	quoted := []string{command}
+	for _, arg := range args {
+		if !plainArg.MatchString(arg) {
+			arg = shellQuote(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"sync"
+)
+
+// poolStatus describes what the worker pool of check cycles and maintenance
+// preparation is doing, served by 'GET /pool'.
+type poolStatus struct {
+	// Size is the 'max_parallel' of the running or last cycle
+	Size int `json:"size"`
+	// Processing and Queued count the certificates holding a worker slot and
+	// those waiting for one
+	Processing int `json:"processing"`
+	Queued     int `json:"queued"`
+	// AcmeShRunning counts the acme.sh subprocesses currently running
+	AcmeShRunning int                       `json:"acmesh_running"`
+	Providers     map[string]providerStatus `json:"providers"`
+}
+
+// providerStatus counts the issuances of one DNS provider type that are in
+// flight and those waiting for its 'max_concurrent' or 'per_minute' limit.
+type providerStatus struct {
+	InFlight int `json:"in_flight"`
+	Waiting  int `json:"waiting"`
+}
+
+var (
+	// poolMutex guards pool
+	poolMutex = &sync.Mutex{}
+	// pool is the current state of the worker pool; providers stay listed
+	// once used, with zero counts when idle
+	pool = poolStatus{Providers: map[string]providerStatus{}}
+)
+
+var (
+	metricPoolSize = newGauge("gocert_worker_pool_size",
+		"Certificates a check cycle processes at the same time ('max_parallel').")
+	metricPoolProcessing = newGauge("gocert_certificates_processing",
+		"Certificates currently holding a worker slot.")
+	metricPoolQueued = newGauge("gocert_certificates_queued",
+		"Certificates waiting for a worker slot.")
+	metricAcmeShRunning = newGauge("gocert_acmesh_running",
+		"acme.sh subprocesses currently running.")
+	metricProviderInFlight = newGauge("gocert_dns_provider_in_flight",
+		"Issuances currently using each DNS provider.", "provider")
+	metricProviderWaiting = newGauge("gocert_dns_provider_waiting",
+		"Issuances waiting for the 'max_concurrent' or 'per_minute' limit of each DNS provider.", "provider")
+)
+
+// The gauges are exported as zero before the first check cycle.
+func init() {
+	updatePool(func(p *poolStatus) {})
+}
+
+// updatePool changes the pool state under poolMutex and refreshes the gauges.
+func updatePool(change func(p *poolStatus)) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+	change(&pool)
+	metricPoolSize.Set(float64(pool.Size))
+	metricPoolProcessing.Set(float64(pool.Processing))
+	metricPoolQueued.Set(float64(pool.Queued))
+	metricAcmeShRunning.Set(float64(pool.AcmeShRunning))
+	for typ, provider := range pool.Providers {
+		metricProviderInFlight.Set(float64(provider.InFlight), typ)
+		metricProviderWaiting.Set(float64(provider.Waiting), typ)
+	}
+}
+
+// currentPool returns a copy of the pool state.
+func currentPool() poolStatus {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+	p := pool
+	p.Providers = maps.Clone(pool.Providers)
+	return p
+}
+
+// workerPool bounds how many certificates are processed at the same time.
+type workerPool struct {
+	slots chan struct{}
+}
+
+// newWorkerPool creates a pool of 'max_parallel' workers.
+func newWorkerPool(global GlobalConfig) *workerPool {
+	size := maxParallelFor(global)
+	updatePool(func(p *poolStatus) { p.Size = size })
+	return &workerPool{slots: make(chan struct{}, size)}
+}
+
+// acquire blocks until a worker slot is free and returns the function that
+// frees it again. Certificates waiting for a slot count as queued.
+func (w *workerPool) acquire() func() {
+	updatePool(func(p *poolStatus) { p.Queued++ })
+	w.slots <- struct{}{}
+	updatePool(func(p *poolStatus) { p.Queued--; p.Processing++ })
+	return func() {
+		<-w.slots
+		updatePool(func(p *poolStatus) { p.Processing-- })
+	}
+}
+
+// trackAcmeSh counts an acme.sh subprocess as running until the returned
+// function is called.
+func trackAcmeSh() func() {
+	updatePool(func(p *poolStatus) { p.AcmeShRunning++ })
+	return func() { updatePool(func(p *poolStatus) { p.AcmeShRunning-- }) }
+}
+
+// trackProvider adds delta to the waiting and in-flight issuances of a DNS
+// provider type.
+func trackProvider(typ string, waiting, inFlight int) {
+	updatePool(func(p *poolStatus) {
+		provider := p.Providers[typ]
+		provider.Waiting += waiting
+		provider.InFlight += inFlight
+		p.Providers[typ] = provider
+	})
+}
+
+// handlePool returns the state of the worker pool, the running acme.sh
+// subprocesses and the issuances of each DNS provider.
+func (s *apiServer) handlePool(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentPool())
+}
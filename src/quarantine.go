@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Period in which the changes between success and failure are counted
+	defaultQuarantineWindow = 24 * time.Hour
+	// Wait between two attempts of a quarantined certificate
+	defaultQuarantineRetry = 24 * time.Hour
+)
+
+// QuarantineConfig moves certificates that keep alternating between success
+// and failure into quarantine, where they are retried less often and their
+// failures don't raise alerts.
+type QuarantineConfig struct {
+	// Changes between success and failure within the window that quarantine
+	// a certificate; 0 disables the quarantine
+	Flaps int `yaml:"flaps"`
+	// Window the changes are counted in, e.g. '24h'
+	Within string `yaml:"within"`
+	// Wait between attempts while quarantined, e.g. '12h'
+	RetryInterval string `yaml:"retry_interval"`
+}
+
+var (
+	// quarantineMutex guards the quarantine settings
+	quarantineMutex = &sync.Mutex{}
+	// quarantineFlaps is 'quarantine.flaps', 0 if the quarantine is disabled
+	quarantineFlaps int
+	// quarantineWindow and quarantineRetry are 'within' and 'retry_interval'
+	quarantineWindow = defaultQuarantineWindow
+	quarantineRetry  = defaultQuarantineRetry
+)
+
+// quarantinedEvents are the notifications a quarantined certificate doesn't
+// send, so a noisy entry doesn't drown out new failures.
+var quarantinedEvents = map[string]bool{"failed": true, "deploy_failed": true}
+
+var metricQuarantined = newGauge("gocert_certificate_quarantined",
+	"Whether a certificate is quarantined for alternating between success and failure.", "name")
+
+// quarantineEntry is the quarantine state of a certificate.
+type quarantineEntry struct {
+	Since     time.Time
+	Flaps     int
+	NextRetry time.Time
+	// Released is when the certificate last left quarantine; changes before
+	// it don't count again
+	Released time.Time
+}
+
+// configureQuarantine applies the 'quarantine' settings of the global
+// configuration. They were checked by validateQuarantine.
+func configureQuarantine(global GlobalConfig) {
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+	quarantineFlaps = global.Quarantine.Flaps
+	quarantineWindow, quarantineRetry = defaultQuarantineWindow, defaultQuarantineRetry
+	if d, err := time.ParseDuration(global.Quarantine.Within); err == nil && d > 0 {
+		quarantineWindow = d
+	}
+	if d, err := time.ParseDuration(global.Quarantine.RetryInterval); err == nil && d > 0 {
+		quarantineRetry = d
+	}
+}
+
+// validateQuarantine checks the durations of 'quarantine'.
+func validateQuarantine(config QuarantineConfig) error {
+	for key, value := range map[string]string{"within": config.Within, "retry_interval": config.RetryInterval} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid quarantine %s '%s': must be a positive duration", key, value)
+		}
+	}
+	return nil
+}
+
+// quarantineSettings returns the 'quarantine' settings in effect.
+func quarantineSettings() (int, time.Duration, time.Duration) {
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+	return quarantineFlaps, quarantineWindow, quarantineRetry
+}
+
+// countFlaps counts the changes between success and failure across the
+// issuances and deploy hook runs of a certificate since the given time.
+func countFlaps(db *sql.DB, name string, since time.Time) (int, error) {
+	rows, err := db.Query(`
+		SELECT started_at, success FROM issue_runs WHERE name = ? AND started_at >= ?
+		UNION ALL
+		SELECT started_at, success FROM hook_runs WHERE name = ? AND started_at >= ?
+		ORDER BY started_at`, name, since, name, since)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query runs of '%s': %w", name, err)
+	}
+	defer rows.Close()
+
+	flaps := 0
+	var previous sql.NullBool
+	for rows.Next() {
+		var started time.Time
+		var success bool
+		if err := rows.Scan(&started, &success); err != nil {
+			return 0, err
+		}
+		if previous.Valid && previous.Bool != success {
+			flaps++
+		}
+		previous = sql.NullBool{Bool: success, Valid: true}
+	}
+	return flaps, rows.Err()
+}
+
+// getQuarantine returns the quarantine state of a certificate and whether it
+// is quarantined. Certificates released before keep their release time.
+func getQuarantine(db *sql.DB, name string) (quarantineEntry, bool, error) {
+	var entry quarantineEntry
+	var released sql.NullTime
+	err := db.QueryRow(`SELECT since, flaps, next_retry_at, released_at FROM quarantine WHERE name = ?`, name).
+		Scan(&entry.Since, &entry.Flaps, &entry.NextRetry, &released)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, fmt.Errorf("failed to read quarantine of '%s': %w", name, err)
+	}
+	entry.Released = released.Time
+	return entry, !released.Valid, nil
+}
+
+// allQuarantined returns the quarantine state of all quarantined
+// certificates, keyed by name.
+func allQuarantined(db *sql.DB) (map[string]quarantineEntry, error) {
+	rows, err := db.Query(`SELECT name, since, flaps, next_retry_at FROM quarantine WHERE released_at IS NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quarantined certificates: %w", err)
+	}
+	defer rows.Close()
+
+	entries := map[string]quarantineEntry{}
+	for rows.Next() {
+		var name string
+		var entry quarantineEntry
+		if err := rows.Scan(&name, &entry.Since, &entry.Flaps, &entry.NextRetry); err != nil {
+			return nil, err
+		}
+		entries[name] = entry
+	}
+	return entries, rows.Err()
+}
+
+// evaluateQuarantine quarantines a certificate that changed between success
+// and failure 'quarantine.flaps' times within the window, and releases one
+// that didn't change within a whole window. After an attempt, the next retry
+// of a quarantined certificate is scheduled. It reports whether the
+// certificate is quarantined.
+func evaluateQuarantine(db *sql.DB, name string, config CertConfig, attempted bool) bool {
+	logger := certLogger(name, config)
+	limit, window, retry := quarantineSettings()
+
+	entry, quarantined, err := getQuarantine(db, name)
+	if err != nil {
+		logger.Warn(err.Error())
+		return false
+	}
+	if limit == 0 && !quarantined {
+		return false
+	}
+	since := time.Now().Add(-window)
+	if entry.Released.After(since) {
+		since = entry.Released
+	}
+	flaps, err := countFlaps(db, name, since)
+	if err != nil {
+		logger.Warn(err.Error())
+		return quarantined
+	}
+
+	switch {
+	case !quarantined && flaps >= limit:
+		entry = quarantineEntry{Since: time.Now(), Flaps: flaps, NextRetry: time.Now().Add(retry)}
+		if err := setQuarantine(db, name, entry); err != nil {
+			logger.Warn(err.Error())
+			return false
+		}
+		metricQuarantined.Set(1, name)
+		logger.Error("Certificate alternates between success and failure, quarantined", "flaps", flaps, "within", window, "next_retry", entry.NextRetry.Format(time.RFC3339))
+		sendNotification(db, NotificationEvent{
+			Event: "quarantined",
+			Cert:  name,
+			Message: fmt.Sprintf("Certificate '%s' changed between success and failure %d times within %s and is quarantined: it is retried every %s and its failures are no longer alerted until it is stable for %s, or 'gocert retry %s' is run.",
+				name, flaps, window, retry, window, name),
+		})
+		return true
+	case quarantined && (limit == 0 || (flaps == 0 && time.Since(entry.Since) >= window)):
+		if err := releaseQuarantine(db, name); err != nil {
+			logger.Warn(err.Error())
+			return true
+		}
+		logger.Info("Certificate is stable again, released from quarantine", "since", entry.Since.Format(time.RFC3339))
+		return false
+	case quarantined && attempted:
+		entry.Flaps = max(entry.Flaps, flaps)
+		entry.NextRetry = time.Now().Add(retry)
+		if err := setQuarantine(db, name, entry); err != nil {
+			logger.Warn(err.Error())
+		}
+	}
+	if quarantined {
+		metricQuarantined.Set(1, name)
+	}
+	return quarantined
+}
+
+// isQuarantined reports whether a certificate is quarantined.
+func isQuarantined(db *sql.DB, name string) bool {
+	_, quarantined, err := getQuarantine(db, name)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return quarantined
+}
+
+// setQuarantine stores the quarantine state of a certificate.
+func setQuarantine(db *sql.DB, name string, entry quarantineEntry) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT INTO quarantine (name, since, flaps, next_retry_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			since = excluded.since,
+			flaps = excluded.flaps,
+			next_retry_at = excluded.next_retry_at,
+			released_at = NULL`,
+		name, entry.Since, entry.Flaps, entry.NextRetry)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine '%s': %w", name, err)
+	}
+	return nil
+}
+
+// releaseQuarantine takes a certificate out of quarantine.
+func releaseQuarantine(db *sql.DB, name string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if _, err := db.Exec(`UPDATE quarantine SET released_at = ? WHERE name = ?`, time.Now(), name); err != nil {
+		return fmt.Errorf("failed to release '%s' from quarantine: %w", name, err)
+	}
+	metricQuarantined.DeleteMatching(name)
+	return nil
+}
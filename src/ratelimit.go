@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits the requests sent to each ACME directory.
+type RateLimitConfig struct {
+	// Sustained requests per second
+	RPS float64 `yaml:"rps"`
+	// Requests that may be sent at once after a quiet period
+	Burst int `yaml:"burst"`
+}
+
+// tokenBucket is a token bucket rate limiter shared by all goroutines.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rps float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rps, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a token is available or the context is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+var (
+	// rateLimitMutex guards the limiter configuration and buckets
+	rateLimitMutex = &sync.Mutex{}
+	// rateLimit is the configured limit, applied to each ACME directory separately
+	rateLimit RateLimitConfig
+	// rateLimiters holds one bucket per ACME directory URL
+	rateLimiters = map[string]*tokenBucket{}
+)
+
+// configureRateLimits applies the 'rate_limit' setting. Buckets are only
+// recreated when the setting changes.
+func configureRateLimits(global GlobalConfig) {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	if global.RateLimit != rateLimit {
+		rateLimit = global.RateLimit
+		rateLimiters = map[string]*tokenBucket{}
+	}
+}
+
+// waitForDirectory blocks until a request to the ACME directory is allowed.
+// Without a configured limit it returns immediately.
+func waitForDirectory(ctx context.Context, dirURL string) error {
+	rateLimitMutex.Lock()
+	if rateLimit.RPS <= 0 {
+		rateLimitMutex.Unlock()
+		return nil
+	}
+	bucket, ok := rateLimiters[dirURL]
+	if !ok {
+		bucket = newTokenBucket(rateLimit.RPS, rateLimit.Burst)
+		rateLimiters[dirURL] = bucket
+	}
+	rateLimitMutex.Unlock()
+
+	return bucket.wait(ctx)
+}
+
+// providerLimiter throttles the issuances using one DNS provider.
+type providerLimiter struct {
+	maxConcurrent int
+	perMinute     int
+	// slots holds a token per running issuance, nil without a limit
+	slots chan struct{}
+	// bucket spaces out the start of issuances, nil without a limit
+	bucket *tokenBucket
+}
+
+// providerLimiters holds one limiter per DNS provider type, guarded by
+// rateLimitMutex
+var providerLimiters = map[string]*providerLimiter{}
+
+// waitForProvider blocks until an issuance may use the DNS provider of the
+// given type, as limited by its 'max_concurrent' and 'per_minute' settings in
+// 'configs.dns', and returns the function that ends the issuance.
+func waitForProvider(ctx context.Context, typ string) (func(), error) {
+	dnsSettingsMutex.Lock()
+	provider := dnsSettings[typ]
+	dnsSettingsMutex.Unlock()
+
+	rateLimitMutex.Lock()
+	limiter, ok := providerLimiters[typ]
+	if !ok || limiter.maxConcurrent != provider.MaxConcurrent || limiter.perMinute != provider.PerMinute {
+		// Issuances still holding a slot of the replaced limiter release it there.
+		limiter = &providerLimiter{maxConcurrent: provider.MaxConcurrent, perMinute: provider.PerMinute}
+		if provider.MaxConcurrent > 0 {
+			limiter.slots = make(chan struct{}, provider.MaxConcurrent)
+		}
+		if provider.PerMinute > 0 {
+			limiter.bucket = newTokenBucket(float64(provider.PerMinute)/60, 1)
+		}
+		providerLimiters[typ] = limiter
+	}
+	rateLimitMutex.Unlock()
+
+	trackProvider(typ, 1, 0)
+	release := func() {}
+	if limiter.slots != nil {
+		select {
+		case limiter.slots <- struct{}{}:
+		case <-ctx.Done():
+			trackProvider(typ, -1, 0)
+			return nil, ctx.Err()
+		}
+		release = func() { <-limiter.slots }
+	}
+	if limiter.bucket != nil {
+		if err := limiter.bucket.wait(ctx); err != nil {
+			release()
+			trackProvider(typ, -1, 0)
+			return nil, err
+		}
+	}
+	trackProvider(typ, -1, 1)
+	return func() {
+		release()
+		trackProvider(typ, 0, -1)
+	}, nil
+}
+
+// throttledTransport applies the rate limit of an ACME directory to every
+// request of the native backend's ACME client.
+type throttledTransport struct {
+	dirURL string
+	base   http.RoundTripper
+}
+
+func (t throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := waitForDirectory(req.Context(), t.dirURL); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// How long removed certificates can be restored by default
+	defaultDeletedRetention = 30 * 24 * time.Hour
+	// Directory under the certs path holding the files of removed certificates
+	deletedDirName = ".deleted"
+)
+
+// tombstone is the saved state of a removed certificate.
+type tombstone struct {
+	Record     CertDBRecord
+	Definition *CertConfig
+	DeletedAt  time.Time
+	Reason     string
+}
+
+// deletedFilesDir returns where the files of a removed certificate are kept.
+func deletedFilesDir(certsBasePath, name string) string {
+	return filepath.Join(certsBasePath, deletedDirName, name)
+}
+
+// deletedRetention returns the configured tombstone retention.
+func deletedRetention(global GlobalConfig) time.Duration {
+	if global.DeletedRetention == "" {
+		return defaultDeletedRetention
+	}
+	d, err := time.ParseDuration(global.DeletedRetention)
+	if err != nil {
+		log.Printf("Warning: invalid deleted_retention '%s', using %s: %v", global.DeletedRetention, defaultDeletedRetention, err)
+		return defaultDeletedRetention
+	}
+	return d
+}
+
+// softDeleteCertificate moves a certificate's database state and API-managed
+// definition into a tombstone and its files into the deleted directory, so
+// 'gocert restore' can bring it back until the retention period has passed.
+func softDeleteCertificate(db *sql.DB, name, certsBasePath, reason string) error {
+	state, found, err := getCertState(db, name)
+	if err != nil {
+		return err
+	}
+	def, hasDefinition, err := getDefinition(db, name)
+	if err != nil {
+		return err
+	}
+	if !found && !hasDefinition {
+		return fmt.Errorf("certificate '%s' not found", name)
+	}
+	if !found {
+		state = CertDBRecord{Name: name, Status: "unknown"}
+	}
+
+	var definition sql.NullString
+	if hasDefinition {
+		raw, err := json.Marshal(def.Definition)
+		if err != nil {
+			return err
+		}
+		definition = sql.NullString{String: string(raw), Valid: true}
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	defer invalidateCertCache()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO deleted_certificates
+			(name, type, issuer, domains, last_issued, status, not_after, shared_with, definition, deleted_at, reason, key_type, not_before)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		name, state.Type, state.Issuer, state.Domains, nullTime(state.LastIssued), state.Status,
+		nullTime(state.NotAfter), state.SharedWith, definition, time.Now(), reason, state.KeyType, nullTime(state.NotBefore))
+	if err != nil {
+		return fmt.Errorf("failed to store tombstone of '%s': %w", name, err)
+	}
+	if err := recordHistory(tx, name, "deleted"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM certificates WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("failed to delete state of '%s': %w", name, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM cert_definitions WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("failed to delete definition of '%s': %w", name, err)
+	}
+
+	trash := deletedFilesDir(certsBasePath, name)
+	if err := os.RemoveAll(trash); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(trash), 0700); err != nil {
+		return err
+	}
+	dir := certFilesFor(certsBasePath, name).Dir
+	moved := true
+	if err := os.Rename(dir, trash); os.IsNotExist(err) {
+		moved = false
+	} else if err != nil {
+		return fmt.Errorf("failed to move certificate files of '%s': %w", name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		// The certificate stays, so its files go back.
+		if moved {
+			if err := os.Rename(trash, dir); err != nil {
+				log.Printf("ERROR: Could not move the files of '%s' back from %s: %v", name, trash, err)
+			}
+		}
+		return fmt.Errorf("failed to remove '%s': %w", name, err)
+	}
+	return nil
+}
+
+// restoreCertificate brings back a soft-deleted certificate with its state,
+// definition and files.
+func restoreCertificate(db *sql.DB, name, certsBasePath string) error {
+	t, found, err := getTombstone(db, name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no removed certificate '%s' found", name)
+	}
+	if _, exists, err := getCertState(db, name); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("certificate '%s' already exists again", name)
+	}
+
+	dir := certFilesFor(certsBasePath, name).Dir
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("certificate directory %s already exists", dir)
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	defer invalidateCertCache()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	r := t.Record
+	var sharedWith sql.NullString
+	if r.SharedWith != "" {
+		sharedWith = sql.NullString{String: r.SharedWith, Valid: true}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO certificates (name, type, issuer, domains, last_issued, status, not_after, shared_with, key_type, not_before)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		name, r.Type, r.Issuer, r.Domains, nullTime(r.LastIssued), r.Status, nullTime(r.NotAfter), sharedWith, r.KeyType, nullTime(r.NotBefore))
+	if err != nil {
+		return fmt.Errorf("failed to restore state of '%s': %w", name, err)
+	}
+	if err := recordHistory(tx, name, "restored"); err != nil {
+		return err
+	}
+	if t.Definition != nil {
+		raw, err := json.Marshal(t.Definition)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		_, err = tx.Exec(`INSERT INTO cert_definitions (name, definition, created_at, updated_at) VALUES (?, ?, ?, ?)`,
+			name, string(raw), now, now)
+		if err != nil {
+			return fmt.Errorf("failed to restore definition of '%s': %w", name, err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM deleted_certificates WHERE name = ?`, name); err != nil {
+		return err
+	}
+
+	trash := deletedFilesDir(certsBasePath, name)
+	moved := true
+	if err := os.Rename(trash, dir); os.IsNotExist(err) {
+		moved = false
+	} else if err != nil {
+		return fmt.Errorf("failed to restore certificate files of '%s': %w", name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		// The certificate stays removed, so its files go back.
+		if moved {
+			if err := os.Rename(dir, trash); err != nil {
+				log.Printf("ERROR: Could not move the files of '%s' back to %s: %v", name, trash, err)
+			}
+		}
+		return fmt.Errorf("failed to restore '%s': %w", name, err)
+	}
+	return nil
+}
+
+// getTombstone returns the tombstone of a removed certificate.
+func getTombstone(db *sql.DB, name string) (tombstone, bool, error) {
+	tombstones, err := queryTombstones(db, "WHERE name = ?", name)
+	if err != nil || len(tombstones) == 0 {
+		return tombstone{}, false, err
+	}
+	return tombstones[0], true, nil
+}
+
+// listTombstones returns all removed certificates that can still be restored.
+func listTombstones(db *sql.DB) ([]tombstone, error) {
+	return queryTombstones(db, "ORDER BY name")
+}
+
+func queryTombstones(db *sql.DB, clause string, args ...interface{}) ([]tombstone, error) {
+	rows, err := db.Query(`
+		SELECT name, type, issuer, domains, last_issued, status, not_after, shared_with, definition, deleted_at, reason, key_type, not_before
+		FROM deleted_certificates `+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query removed certificates: %w", err)
+	}
+	defer rows.Close()
+
+	var tombstones []tombstone
+	for rows.Next() {
+		var t tombstone
+		var lastIssued, notAfter, notBefore sql.NullTime
+		var sharedWith, definition, reason, keyType sql.NullString
+		if err := rows.Scan(&t.Record.Name, &t.Record.Type, &t.Record.Issuer, &t.Record.Domains, &lastIssued,
+			&t.Record.Status, &notAfter, &sharedWith, &definition, &t.DeletedAt, &reason, &keyType, &notBefore); err != nil {
+			return nil, err
+		}
+		t.Record.LastIssued, t.Record.NotAfter, t.Record.NotBefore = lastIssued.Time, notAfter.Time, notBefore.Time
+		t.Record.SharedWith, t.Record.KeyType, t.Reason = sharedWith.String, keyType.String, reason.String
+		if definition.Valid {
+			var def CertConfig
+			if err := json.Unmarshal([]byte(definition.String), &def); err != nil {
+				return nil, fmt.Errorf("invalid stored definition for '%s': %w", t.Record.Name, err)
+			}
+			t.Definition = &def
+		}
+		tombstones = append(tombstones, t)
+	}
+	return tombstones, rows.Err()
+}
+
+// purgeTombstones permanently deletes removed certificates older than the retention period.
+func purgeTombstones(db *sql.DB, certsBasePath string, retention time.Duration) {
+	tombstones, err := listTombstones(db)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	for _, t := range tombstones {
+		if time.Since(t.DeletedAt) < retention {
+			continue
+		}
+		if err := purgeTombstone(db, t.Record.Name, certsBasePath); err != nil {
+			log.Printf("Warning: failed to purge removed certificate '%s': %v", t.Record.Name, err)
+			continue
+		}
+		log.Printf("Purged removed certificate '%s' after %s.", t.Record.Name, retention)
+	}
+}
+
+// purgeTombstone permanently deletes a removed certificate, its files and
+// its archived previous issuances.
+func purgeTombstone(db *sql.DB, name, certsBasePath string) error {
+	dbMutex.Lock()
+	_, err := db.Exec(`DELETE FROM deleted_certificates WHERE name = ?`, name)
+	dbMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(archiveDir(certsBasePath, name)); err != nil {
+		return err
+	}
+	return os.RemoveAll(deletedFilesDir(certsBasePath, name))
+}
+
+// removeCertificate removes a certificate. By default it is soft-deleted and
+// can be restored; with purge, everything is deleted right away. With acme,
+// the certificate is also removed from acme.sh's renewal list, unless the
+// configuration in configFile has it issued by the native backend. Entries
+// still present in the YAML file are issued again on the next check.
+func removeCertificate(db *sql.DB, name, certsBasePath, configFile string, acme, purge bool) error {
+	state, found, err := getCertState(db, name)
+	if err != nil {
+		return err
+	}
+
+	// Monitor-only and shared entries were never issued by acme.sh.
+	if acme && found && state.Type != "monitor" && state.SharedWith == "" && state.Domains != "" {
+		removeFromAcmeSh(db, name, certsBasePath, configFile, state)
+	}
+
+	if err := softDeleteCertificate(db, name, certsBasePath, "removed via CLI"); err != nil {
+		return err
+	}
+	if purge {
+		return purgeTombstone(db, name, certsBasePath)
+	}
+	return nil
+}
+
+// removeFromAcmeSh removes a certificate from acme.sh's renewal list, once
+// for each of its key types: acme.sh keeps ECDSA certificates apart, so they
+// need '--ecc'.
+func removeFromAcmeSh(db *sql.DB, name, certsBasePath, configFile string, state CertDBRecord) {
+	// The entry may be gone from the configuration, then its default applies.
+	config := CertConfig{}
+	if fullConfig, err := loadEffectiveConfig(configFile, db); err != nil {
+		log.Printf("Warning: could not load %s, assuming '%s' was issued by acme.sh: %v", configFile, name, err)
+	} else {
+		configureIssuers(fullConfig.Configs)
+		config = fullConfig.Certificates[name]
+	}
+	if backendFor(config) == backendNative {
+		log.Printf("Certificate '%s' was issued by the native backend, not acme.sh; skipping 'acme.sh --remove'", name)
+		return
+	}
+
+	keyTypes := strings.Split(state.KeyType, ",")
+	if state.KeyType == "" {
+		keyTypes = []string{defaultKeyType}
+		if cert, err := readCertificateFile(certFilesFor(certsBasePath, name).Cert); err == nil {
+			keyTypes = []string{certKeyType(cert)}
+		}
+	}
+	domain := strings.Split(state.Domains, ",")[0]
+	for _, keyType := range keyTypes {
+		args := []string{"--remove", "-d", domain}
+		args = append(args, acmeShAccountArgs(config.Account)...)
+		if keyTypeFamily(keyType) == "ecdsa" {
+			args = append(args, "--ecc")
+		}
+		log.Printf("Removing '%s' (%s) from acme.sh", domain, keyType)
+		cmd := exec.Command(acmeShPath, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("Warning: 'acme.sh --remove' for '%s' failed: %v", domain, err)
+		}
+	}
+}
+
+// nullTime converts a zero time to NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
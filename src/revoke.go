@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// RevokeOrphanedConfig revokes certificates that stayed orphaned, i.e.
+// removed from the configuration, for a number of days.
+type RevokeOrphanedConfig struct {
+	// Days a certificate must be orphaned before it is revoked, 0 disables revocation
+	AfterDays int `yaml:"after_days"`
+	// Only log and notify which certificates would be revoked
+	DryRun bool `yaml:"dry_run"`
+}
+
+// revokeOrphanedCerts applies the 'revoke_orphaned' policy. Revoked
+// certificates keep their state with status 'revoked' and are issued again if
+// their entry is added back to the configuration.
+func revokeOrphanedCerts(fullConfig FullConfig, db *sql.DB, certsBasePath string) {
+	policy := fullConfig.Configs.RevokeOrphaned
+	if policy.AfterDays <= 0 {
+		return
+	}
+	records, err := listCertStates(db)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		if record.Status != "orphaned" || record.Type == "monitor" || record.SharedWith != "" || record.LastIssued.IsZero() {
+			continue
+		}
+		since, found, err := statusSince(db, record.Name, "orphaned")
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		if !found {
+			// Orphaned before history was recorded; start counting now.
+			dbMutex.Lock()
+			err := recordHistory(db, record.Name, "orphaned")
+			dbMutex.Unlock()
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			continue
+		}
+		if time.Since(since) < time.Duration(policy.AfterDays)*24*time.Hour {
+			continue
+		}
+
+		if inUse := certInUseBy(record.Name, records, certsBasePath); inUse != "" {
+			log.Printf("Warning: Not revoking orphaned certificate '%s': '%s' still uses the same certificate.", record.Name, inUse)
+			continue
+		}
+		if policy.DryRun {
+			log.Printf("Dry run: would revoke certificate '%s' (%s), orphaned since %s.", record.Name, record.Domains, since.Format(time.RFC3339))
+			continue
+		}
+		revokeOrphanedCert(record, db, certsBasePath, since)
+	}
+}
+
+// revokeOrphanedCert revokes a single orphaned certificate and notifies the outcome.
+func revokeOrphanedCert(record CertDBRecord, db *sql.DB, certsBasePath string, since time.Time) {
+	config := CertConfig{Type: record.Type, Issuer: record.Issuer, Domains: strings.Split(record.Domains, ",")}
+	err := func() error {
+		issuer, err := issuerFor(config)
+		if err != nil {
+			return err
+		}
+		if err := issuer.Revoke(record.Name, config, certFilesFor(certsBasePath, record.Name)); err != nil {
+			return err
+		}
+		return setCertStatus(db, record.Name, "revoked")
+	}()
+	if err != nil {
+		log.Printf("ERROR: Failed to revoke orphaned certificate '%s': %v", record.Name, err)
+		sendNotification(db, NotificationEvent{
+			Event:   "revoke_failed",
+			Cert:    record.Name,
+			Message: fmt.Sprintf("Failed to revoke orphaned certificate '%s': %v", record.Name, err),
+		})
+		return
+	}
+
+	log.Printf("Revoked certificate '%s', orphaned since %s.", record.Name, since.Format(time.RFC3339))
+	sendNotification(db, NotificationEvent{
+		Event:   "revoked",
+		Cert:    record.Name,
+		Message: fmt.Sprintf("Certificate '%s' for %s was revoked after being removed from the configuration on %s", record.Name, record.Domains, since.Format("2006-01-02")),
+	})
+}
+
+// certInUseBy returns another certificate that is still managed and has the
+// same certificate file as name, e.g. an entry that shared it, or "".
+func certInUseBy(name string, records []CertDBRecord, certsBasePath string) string {
+	data, err := os.ReadFile(certFilesFor(certsBasePath, name).Cert)
+	if err != nil {
+		return ""
+	}
+	for _, other := range records {
+		if other.Name == name || other.Status == "orphaned" || other.Status == "revoked" {
+			continue
+		}
+		if otherData, err := os.ReadFile(certFilesFor(certsBasePath, other.Name).Cert); err == nil && bytes.Equal(data, otherData) {
+			return other.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Region signed for unless 'region' or AWS_REGION is set
+const defaultS3Region = "us-east-1"
+
+// S3Config holds the S3-compatible object storage used by 's3' deploy hooks.
+// The credentials and region default to AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION.
+type S3Config struct {
+	// Endpoint replaces AWS, e.g. 'https://minio.example.com:9000'; buckets
+	// are then addressed by path
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+}
+
+var (
+	// s3Mutex guards s3Settings
+	s3Mutex = &sync.Mutex{}
+	// s3Settings is the object storage configuration of the current cycle
+	s3Settings S3Config
+)
+
+// configureS3 applies the object storage settings of the global configuration.
+func configureS3(global GlobalConfig) {
+	s3Mutex.Lock()
+	defer s3Mutex.Unlock()
+
+	s3Settings = global.S3
+	if s3Settings.Region == "" {
+		s3Settings.Region = os.Getenv("AWS_REGION")
+	}
+	if s3Settings.Region == "" {
+		s3Settings.Region = defaultS3Region
+	}
+	if s3Settings.AccessKeyID == "" {
+		s3Settings.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3Settings.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s3Settings.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+}
+
+// currentS3Config returns the object storage settings of the current cycle.
+func currentS3Config() S3Config {
+	s3Mutex.Lock()
+	defer s3Mutex.Unlock()
+	return s3Settings
+}
+
+// runS3Hook uploads the certificate, key and fullchain to a bucket as
+// '<prefix>/cert.pem', '<prefix>/key.pem' and '<prefix>/fullchain.pem'. The
+// prefix defaults to the name of the certificate.
+func runS3Hook(ctx context.Context, hook HookConfig, data hookData) (string, error) {
+	s3 := currentS3Config()
+	if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+		return "", fmt.Errorf("no S3 credentials, set 'configs.s3' or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	prefix := strings.Trim(hook.Prefix, "/")
+	if prefix == "" {
+		prefix = data.Name
+	}
+	var keys []string
+	for _, file := range []string{data.CertFile, data.KeyFile, data.FullchainFile} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		key := prefix + "/" + path.Base(file)
+		if err := s3PutObject(ctx, s3, hook, key, content); err != nil {
+			return "", err
+		}
+		keys = append(keys, key)
+	}
+	return fmt.Sprintf("Uploaded %s to bucket %s", strings.Join(keys, ", "), hook.Bucket), nil
+}
+
+// s3ObjectURL returns the URL of an object in a bucket of AWS or of the
+// configured endpoint.
+func s3ObjectURL(s3 S3Config, bucket, key string) (*url.URL, error) {
+	objectURL := &url.URL{Scheme: "https", Host: bucket + ".s3." + s3.Region + ".amazonaws.com", Path: "/" + key}
+	if s3.Endpoint != "" {
+		endpoint, err := url.Parse(strings.TrimSuffix(s3.Endpoint, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint '%s': %w", s3.Endpoint, err)
+		}
+		objectURL = endpoint.JoinPath(bucket, key)
+	}
+	// Signatures cover the path encoded as AWS does it, which escapes more
+	// than net/url.
+	objectURL.RawPath = s3EscapePath(objectURL.Path)
+	return objectURL, nil
+}
+
+// s3GetObject downloads one object, signed with AWS Signature Version 4.
+func s3GetObject(ctx context.Context, s3 S3Config, bucket, key string) ([]byte, error) {
+	objectURL, err := s3ObjectURL(s3, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s3.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s3.SessionToken)
+	}
+	signS3Request(req, s3, nil, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, monitorSourceLimit))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET s3://%s/%s returned %s", bucket, key, resp.Status)
+	}
+	return body, nil
+}
+
+// s3PutObject uploads one object, signed with AWS Signature Version 4.
+func s3PutObject(ctx context.Context, s3 S3Config, hook HookConfig, key string, content []byte) error {
+	objectURL, err := s3ObjectURL(s3, hook.Bucket, key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-pem-file")
+	if hook.SSE != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption", hook.SSE)
+	}
+	if hook.KMSKeyID != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", hook.KMSKeyID)
+	}
+	if s3.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s3.SessionToken)
+	}
+	signS3Request(req, s3, content, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, hookOutputLimit))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			return fmt.Errorf("PUT %s returned %s: %s: %s", key, resp.Status, s3Err.Code, s3Err.Message)
+		}
+		return fmt.Errorf("PUT %s returned %s", key, resp.Status)
+	}
+	return nil
+}
+
+// signS3Request adds the AWS Signature Version 4 authorization to a request
+// for the 's3' service, signing all headers set so far.
+func signS3Request(req *http.Request, s3 S3Config, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s3.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s3.SecretAccessKey)
+	for _, part := range []string{date, s3.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3EscapePath percent-encodes everything in a path but unreserved characters
+// and slashes.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// runSCPHook copies the certificate, key and fullchain to a remote host over
+// SSH with the SCP protocol, then runs Command there if it is set. The host
+// key must be listed in KnownHosts (default: ~/.ssh/known_hosts).
+func runSCPHook(ctx context.Context, hook HookConfig, data hookData) (string, error) {
+	client, err := dialSSH(ctx, hook)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	// Closing the connection aborts a copy or command that runs too long.
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	var copied []string
+	for _, file := range scpFiles(hook, data) {
+		if err := scpCopy(client, file.local, file.remote, file.mode); err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", fmt.Errorf("failed to copy %s to %s:%s: %w", filepath.Base(file.local), hook.Host, file.remote, err)
+		}
+		copied = append(copied, file.remote)
+	}
+	output := fmt.Sprintf("Copied %s to %s", strings.Join(copied, ", "), hook.Host)
+	if len(hook.Command) == 0 {
+		return output, nil
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return output, err
+	}
+	defer session.Close()
+	var out limitedBuffer
+	session.Stdout = &out
+	session.Stderr = &out
+	err = session.Run(remoteCommand(hook.Command))
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return output + "\n" + out.String(), err
+}
+
+// dialSSH connects and authenticates to the host of an 'scp' hook.
+func dialSSH(ctx context.Context, hook HookConfig) (*ssh.Client, error) {
+	source := hook.Key
+	var pemKey []byte
+	if hook.KeySecret != "" {
+		source = hook.KeySecret
+		key, err := resolveSecret(ctx, hook.KeySecret)
+		if err != nil {
+			return nil, err
+		}
+		pemKey = []byte(key + "\n")
+	} else {
+		var err error
+		if pemKey, err = os.ReadFile(hook.Key); err != nil {
+			return nil, err
+		}
+	}
+	signer, err := ssh.ParsePrivateKey(pemKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH key %s (keys with a passphrase aren't supported): %w", source, err)
+	}
+
+	knownHostsFile := hook.KnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %w", err)
+	}
+
+	addr := hook.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            hook.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH connection to %s failed: %w", addr, err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// scpFile is a file copied by an 'scp' hook.
+type scpFile struct {
+	local  string
+	remote string
+	mode   os.FileMode
+}
+
+// scpFiles returns where the files of a certificate are copied: CertPath,
+// KeyPath and FullchainPath, or their names in the directory Path.
+func scpFiles(hook HookConfig, data hookData) []scpFile {
+	remote := func(set, local string) string {
+		if set != "" {
+			return set
+		}
+		return path.Join(hook.Path, filepath.Base(local))
+	}
+	return []scpFile{
+		{data.CertFile, remote(hook.CertPath, data.CertFile), 0644},
+		{data.KeyFile, remote(hook.KeyPath, data.KeyFile), 0600},
+		{data.FullchainFile, remote(hook.FullchainPath, data.FullchainFile), 0644},
+	}
+}
+
+// scpCopy writes one file to the remote path by running 'scp -t' there.
+func scpCopy(client *ssh.Client, local, remote string, mode os.FileMode) error {
+	content, err := os.ReadFile(local)
+	if err != nil {
+		return err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr limitedBuffer
+	session.Stderr = &stderr
+	if err := session.Start("scp -t " + shellQuote(remote)); err != nil {
+		return err
+	}
+
+	acks := bufio.NewReader(stdout)
+	err = scpAck(acks)
+	if err == nil {
+		fmt.Fprintf(stdin, "C%04o %d %s\n", mode.Perm(), len(content), path.Base(remote))
+		err = scpAck(acks)
+	}
+	if err == nil {
+		stdin.Write(content)
+		stdin.Write([]byte{0})
+		err = scpAck(acks)
+	}
+	stdin.Close()
+	if waitErr := session.Wait(); err == nil && waitErr != nil {
+		err = waitErr
+	}
+	if err != nil && stderr.String() != "" {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// scpAck reads the reply of the remote scp to the last message.
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err == io.EOF {
+		return fmt.Errorf("scp exited unexpectedly")
+	}
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	// The remote scp explains the failure, e.g. "scp: /dir: No such file
+	// or directory".
+	msg, _ := r.ReadString('\n')
+	return errors.New(strings.TrimSpace(msg))
+}
+
+// remoteCommand turns the command of an 'scp' hook into a command line for
+// the remote shell. A single element is passed as is, so it may use shell
+// syntax; several are quoted as separate arguments.
+func remoteCommand(command []string) string {
+	if len(command) == 1 {
+		return command[0]
+	}
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
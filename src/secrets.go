@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Field read from a Vault secret with several fields unless the reference
+// names one with '#field'
+const defaultSecretField = "value"
+
+// Secret references point to a secret in a secret backend and are resolved
+// only when a hook runs, so deployment credentials never sit in the YAML
+// file or the database:
+//
+//	vault:<mount>/<path>[#field]  a field of a KV secret in 'configs.vault'
+//	env:<NAME>                    an environment variable of gocert
+//	file:<path>                   the content of a file, e.g. a mounted secret
+
+// secretBackends holds the supported secret backends, keyed by the prefix
+// of a reference.
+var secretBackends = map[string]func(ctx context.Context, path string) (string, error){
+	"vault": readVaultSecret,
+	"env":   readEnvSecret,
+	"file":  readFileSecret,
+}
+
+// validateSecretRef checks the syntax of a secret reference.
+func validateSecretRef(ref string) error {
+	backend, path, ok := strings.Cut(ref, ":")
+	if _, known := secretBackends[backend]; !ok || !known {
+		return fmt.Errorf("invalid secret reference '%s', expected 'vault:<path>', 'env:<name>' or 'file:<path>'", ref)
+	}
+	if path == "" {
+		return fmt.Errorf("secret reference '%s' has no path", ref)
+	}
+	return nil
+}
+
+// resolveSecret fetches the value of a secret reference.
+func resolveSecret(ctx context.Context, ref string) (string, error) {
+	if err := validateSecretRef(ref); err != nil {
+		return "", err
+	}
+	backend, path, _ := strings.Cut(ref, ":")
+	value, err := secretBackends[backend](ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve secret '%s': %w", ref, err)
+	}
+	return value, nil
+}
+
+// resolveSecrets fetches the secrets of a hook, keyed by their name.
+func resolveSecrets(ctx context.Context, refs map[string]string) (map[string]string, error) {
+	secrets := make(map[string]string, len(refs))
+	for name, ref := range refs {
+		value, err := resolveSecret(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		secrets[name] = value
+	}
+	return secrets, nil
+}
+
+// readEnvSecret returns a non-empty environment variable.
+func readEnvSecret(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return "", fmt.Errorf("%s is not set", name)
+	}
+	return value, nil
+}
+
+// readFileSecret returns the content of a file without a trailing newline.
+func readFileSecret(_ context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// readVaultSecret reads one field of a KV secret, e.g. 'kv/prod/ssh-key#key'
+// from the mount 'kv'. Without a field, a secret with a single field yields
+// that field, others the field 'value'.
+func readVaultSecret(ctx context.Context, ref string) (string, error) {
+	vault := currentVaultConfig()
+	if vault.Address == "" {
+		return "", fmt.Errorf("no Vault address, set 'configs.vault.address' or VAULT_ADDR")
+	}
+	ref, field, _ := strings.Cut(ref, "#")
+	mount, path, ok := strings.Cut(strings.Trim(ref, "/"), "/")
+	if !ok || path == "" {
+		return "", fmt.Errorf("expected '<mount>/<path>'")
+	}
+
+	token, err := vaultToken(ctx, vault)
+	if err != nil {
+		return "", err
+	}
+	apiPath := mount + "/" + path
+	if vault.KVVersion != 1 {
+		apiPath = mount + "/data/" + path
+	}
+	resp, err := vaultRequest(ctx, vault, token, http.MethodGet, apiPath, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return "", err
+	}
+	data := result.Data
+	if vault.KVVersion != 1 {
+		var v2 struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &v2); err != nil {
+			return "", err
+		}
+		data = v2.Data
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil || len(fields) == 0 {
+		return "", fmt.Errorf("secret %s has no fields", ref)
+	}
+
+	if field == "" {
+		field = defaultSecretField
+		if len(fields) == 1 {
+			for name := range fields {
+				field = name
+			}
+		}
+	}
+	value, ok := fields[field]
+	if !ok {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("secret %s has no field '%s' (fields: %s)", ref, field, strings.Join(names, ", "))
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Entries with identical SAN sets (and the same issuer, DNS provider, backend
+// and key type) share one certificate: the alphabetically first entry, the primary,
+// is issued and its files are copied to the others. This is common when an
+// entry is copied for a different deploy target.
+
+// sanKey identifies the certificate an entry would be issued as.
+func sanKey(config CertConfig) string {
+	domains := append([]string(nil), config.Domains...)
+	for i, d := range domains {
+		domains[i] = strings.ToLower(d)
+	}
+	sort.Strings(domains)
+	return strings.Join([]string{strings.Join(domains, ","), config.Issuer, config.Account, config.Type, config.Backend, strings.Join(keyTypesFor(config), ","), strings.Join(config.ExtraArgs, " ")}, "|")
+}
+
+// sharedCertGroups maps each entry that shares another entry's certificate to
+// the name of that primary entry. Monitor-only entries are never shared.
+func sharedCertGroups(fullConfig FullConfig) map[string]string {
+	names := make([]string, 0, len(fullConfig.Certificates))
+	for name, config := range fullConfig.Certificates {
+		if config.Monitor == "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	primaries := map[string]string{}
+	primaryOf := map[string]string{}
+	for _, name := range names {
+		key := sanKey(fullConfig.Certificates[name])
+		if primary, ok := primaries[key]; ok {
+			primaryOf[name] = primary
+		} else {
+			primaries[key] = name
+		}
+	}
+	return primaryOf
+}
+
+// followersOf returns the entries sharing the certificate of primary, sorted by name.
+func followersOf(primaryOf map[string]string, primary string) []string {
+	var followers []string
+	for follower, p := range primaryOf {
+		if p == primary {
+			followers = append(followers, follower)
+		}
+	}
+	sort.Strings(followers)
+	return followers
+}
+
+// shareCertificate copies the files of the primary's certificate to a
+// follower and records the follower's state, linked to its primary.
+func shareCertificate(primary, follower string, config CertConfig, db *sql.DB, certsBasePath string) error {
+	state, found, err := getCertState(db, primary)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("certificate '%s' has not been issued yet", primary)
+	}
+
+	if err := os.MkdirAll(certFilesFor(certsBasePath, follower).Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create certificate directory for '%s': %w", follower, err)
+	}
+	changed := false
+	dstFiles := allCertFiles(certsBasePath, follower, config)
+	for i, src := range allCertFiles(certsBasePath, primary, config) {
+		dst := dstFiles[i]
+		for _, pair := range [][2]string{{src.Cert, dst.Cert}, {src.Key, dst.Key}, {src.Fullchain, dst.Fullchain}} {
+			copied, err := copyIfChanged(pair[0], pair[1])
+			if err != nil {
+				return err
+			}
+			changed = changed || copied
+		}
+	}
+
+	config.KeyType = state.KeyType
+	if err := updateCertState(db, follower, config, state.LastIssued, state.Status, state.NotBefore, state.NotAfter); err != nil {
+		return err
+	}
+	if err := setSharedWith(db, follower, primary); err != nil {
+		return err
+	}
+	writeExports(follower, config, certsBasePath)
+	if err := applyFileModes(follower, config, certsBasePath); err != nil {
+		log.Printf("ERROR: Failed to set file permissions of '%s': %v", follower, err)
+	}
+	// The follower's own deploy hooks run whenever it received new files.
+	if changed {
+		runDeployHooks(db, follower, config, certsBasePath, state.NotAfter)
+	}
+	return nil
+}
+
+// shareWithFollowers updates all entries sharing the certificate of primary.
+func shareWithFollowers(primary string, fullConfig FullConfig, primaryOf map[string]string, db *sql.DB, certsBasePath string) {
+	for _, follower := range followersOf(primaryOf, primary) {
+		if err := shareCertificate(primary, follower, fullConfig.Certificates[follower], db, certsBasePath); err != nil {
+			log.Printf("ERROR: Failed to share certificate '%s' with '%s': %v", primary, follower, err)
+			continue
+		}
+		log.Printf("Certificate '%s' shares the certificate of '%s'.", follower, primary)
+	}
+}
+
+// copyIfChanged copies src to dst unless dst already has the same content,
+// and reports whether it did. New files get the mode of src, so private keys
+// stay private.
+func copyIfChanged(src, dst string) (bool, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	if existing, err := os.ReadFile(dst); err == nil && bytes.Equal(existing, data) {
+		return false, nil
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(dst, data, info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	// standbyMutex guards standby
+	standbyMutex = &sync.Mutex{}
+	// standby is set by 'run --standby' or GOCERT_STANDBY and cleared by
+	// 'gocert promote': the daemon checks, records and alerts as usual, but
+	// leaves issuing, renewing and revoking to the active instance
+	standby bool
+)
+
+// standbyActive reports whether the daemon is in standby.
+func standbyActive() bool {
+	standbyMutex.Lock()
+	defer standbyMutex.Unlock()
+	return standby
+}
+
+// setStandby switches the daemon between standby and active and records the
+// mode for 'status --daemon'. It reports whether the mode changed.
+func setStandby(db *sql.DB, on bool) bool {
+	standbyMutex.Lock()
+	changed := standby != on
+	standby = on
+	standbyMutex.Unlock()
+
+	mode, gauge := "active", 0.0
+	if on {
+		mode, gauge = "standby", 1
+	}
+	metricStandby.Set(gauge)
+	if err := setDaemonState(db, "mode", mode); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return changed
+}
+
+// handleStandbyCommand serves the 'promote' and 'demote' control commands.
+// A promotion runs a check right away, so certificates the standby held back
+// are renewed without waiting for the next tick.
+func handleStandbyCommand(conn net.Conn, command string, db *sql.DB, reload chan<- struct{}) {
+	promote := command == "promote"
+	if !setStandby(db, !promote) {
+		fmt.Fprintln(conn, "OK unchanged")
+		return
+	}
+	if promote {
+		log.Println("Promoted to active, issuing and renewing certificates from now on.")
+		select {
+		case reload <- struct{}{}:
+		default:
+			// A check is already pending.
+		}
+	} else {
+		log.Println("Demoted to standby, no longer issuing or renewing certificates.")
+	}
+	fmt.Fprintln(conn, "OK")
+}
+
+// sendStandbyCommand asks the running daemon to leave ('promote') or enter
+// ('demote') standby.
+func sendStandbyCommand(socketPath, command string) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("can't reach the daemon at %s, is 'gocert run' running? %w", socketPath, err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no reply from the daemon: %w", err)
+	}
+	switch reply = strings.TrimSpace(reply); reply {
+	case "OK":
+		if command == "promote" {
+			fmt.Println("The daemon is active now and runs a check.")
+		} else {
+			fmt.Println("The daemon is in standby now.")
+		}
+	case "OK unchanged":
+		fmt.Println("The daemon already was in that mode.")
+	default:
+		return fmt.Errorf("the daemon refused to %s: %s", command, reply)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Longest an acme.sh run may take unless 'issue_timeout' is set; the
+	// native backend derives its default from the DNS provider's tuning
+	defaultIssueTimeout = 30 * time.Minute
+	// How long to wait for the output of a killed acme.sh run to close
+	acmeShKillGrace = 10 * time.Second
+	// Status of a certificate whose last issuance was killed after its timeout
+	statusTimeout = "timeout"
+)
+
+// errIssueTimeout marks an issuance that didn't finish within its timeout.
+var errIssueTimeout = errors.New("issuance timed out")
+
+var (
+	// issueTimeoutMutex guards issueTimeout
+	issueTimeoutMutex = &sync.Mutex{}
+	// issueTimeout is the 'issue_timeout' of 'configs:', 0 if unset
+	issueTimeout time.Duration
+)
+
+// configureIssueTimeout applies 'issue_timeout' of the global configuration,
+// checked by validateIssueTimeout.
+func configureIssueTimeout(global GlobalConfig) {
+	issueTimeoutMutex.Lock()
+	defer issueTimeoutMutex.Unlock()
+	issueTimeout, _ = time.ParseDuration(global.IssueTimeout)
+}
+
+// validateIssueTimeout checks an 'issue_timeout' value.
+func validateIssueTimeout(value string) error {
+	if value == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+		return fmt.Errorf("invalid issue_timeout '%s': must be a positive duration", value)
+	}
+	return nil
+}
+
+// issueTimeoutFor returns the 'issue_timeout' of a certificate, or of
+// 'configs:', and whether one is set at all.
+func issueTimeoutFor(config CertConfig) (time.Duration, bool) {
+	if d, err := time.ParseDuration(config.IssueTimeout); err == nil && d > 0 {
+		return d, true
+	}
+	issueTimeoutMutex.Lock()
+	defer issueTimeoutMutex.Unlock()
+	return issueTimeout, issueTimeout > 0
+}
+
+// acmeShTimeout returns how long an acme.sh run of a certificate may take.
+func acmeShTimeout(config CertConfig) time.Duration {
+	if d, ok := issueTimeoutFor(config); ok {
+		return d
+	}
+	return defaultIssueTimeout
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// GitHub API endpoint for the latest gocert release
+	latestReleaseURL = "https://api.github.com/repos/frnimh/gocert/releases/latest"
+	// How often the opt-in update check queries GitHub
+	updateCheckInterval = 24 * time.Hour
+	// Timeout for the GitHub API request
+	updateCheckTimeout = 10 * time.Second
+)
+
+// Keys of the update check in the daemon_state table
+const (
+	stateLatestVersion   = "latest_version"
+	stateLatestURL       = "latest_version_url"
+	stateUpdateAvailable = "update_available"
+)
+
+// fetchLatestRelease returns the tag and page URL of the latest gocert release.
+func fetchLatestRelease(ctx context.Context) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, latestReleaseURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "gocert/"+version)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("GitHub API returned %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", "", fmt.Errorf("failed to decode release: %w", err)
+	}
+	if release.TagName == "" {
+		return "", "", fmt.Errorf("release has no tag")
+	}
+	return release.TagName, release.HTMLURL, nil
+}
+
+// checkForUpdate queries GitHub for a newer gocert release, at most once per
+// updateCheckInterval, and records the result. It never updates anything.
+func checkForUpdate(db *sql.DB) {
+	if latest, checkedAt, ok, err := getDaemonState(db, stateLatestVersion); err == nil && ok && time.Since(checkedAt) < updateCheckInterval {
+		available, _, _, _ := getDaemonState(db, stateUpdateAvailable)
+		setUpdateMetric(latest, available == "true")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateCheckTimeout)
+	defer cancel()
+
+	tag, url, err := fetchLatestRelease(ctx)
+	if err != nil {
+		log.Printf("Warning: update check failed: %v", err)
+		return
+	}
+
+	latest := strings.TrimPrefix(tag, "v")
+	current := strings.TrimPrefix(version, "v")
+	// Development builds have no comparable version and never report updates.
+	available := parseVersion(current) != nil && parseVersion(latest) != nil && !versionAtLeast(current, latest)
+
+	for key, value := range map[string]string{
+		stateLatestVersion:   latest,
+		stateLatestURL:       url,
+		stateUpdateAvailable: fmt.Sprint(available),
+	} {
+		if err := setDaemonState(db, key, value); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	setUpdateMetric(latest, available)
+	if available {
+		log.Printf("A newer gocert version is available: %s (running %s), see %s", latest, version, url)
+	}
+}
+
+// setUpdateMetric exposes the result of the last update check.
+func setUpdateMetric(latest string, available bool) {
+	value := 0.0
+	if available {
+		value = 1
+	}
+	metricUpdateAvailable.Set(value, version, latest)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Environment variable passing the API listener to the re-executed daemon
+	listenFDEnv = "GOCERT_LISTEN_FD"
+	// Environment variable telling the re-executed daemon it was upgraded
+	// rather than restarted
+	upgradedEnv = "GOCERT_UPGRADED"
+	// Maximum time in-flight API requests get to finish before an upgrade
+	upgradeShutdownTimeout = 30 * time.Second
+)
+
+// originalArgs is the command line the daemon was started with, including
+// flags removed before parsing, such as '--dev-fast'
+var originalArgs = os.Args
+
+var (
+	// apiServerMutex guards the active API server
+	apiServerMutex = &sync.Mutex{}
+	// activeAPIServer, activeAPIListener and activeAPIHandler are the running
+	// API server, handed over to the new binary on upgrade
+	activeAPIServer   *http.Server
+	activeAPIListener net.Listener
+	activeAPIHandler  http.Handler
+)
+
+// apiListener returns the listener of the API: the one inherited from the
+// previous binary after an upgrade, or a new one on addr.
+func apiListener(addr string) (net.Listener, error) {
+	v := os.Getenv(listenFDEnv)
+	if v == "" {
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(listenFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s '%s'", listenFDEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "api-listener")
+	defer f.Close()
+	log.Printf("Taking over the API listener from the previous binary.")
+	return net.FileListener(f)
+}
+
+// watchUpgradeSignal re-executes the daemon binary on SIGUSR2, e.g. after a
+// package upgrade replaced it.
+func watchUpgradeSignal() {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			log.Println("Received SIGUSR2, upgrading to the installed binary.")
+			if err := reexecDaemon(); err != nil {
+				log.Printf("ERROR: Upgrade failed, keeping the running binary: %v", err)
+			}
+		}
+	}()
+}
+
+// reexecDaemon replaces the running daemon with the binary now installed at
+// its path, keeping the process ID. The new binary must run 'version'
+// successfully first. In-flight API requests and a running check cycle are
+// finished before the switch; the API socket stays open throughout, so
+// clients connecting meanwhile are only delayed.
+func reexecDaemon() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command(exe, "version").Output()
+	if err != nil {
+		return fmt.Errorf("%s doesn't run: %w", exe, err)
+	}
+	log.Printf("Upgrading to %s", strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0])
+
+	// Wait for a running check cycle or renewal, and keep new ones from
+	// starting while the API shuts down; the lock is never released if the
+	// exec succeeds.
+	cycleMutex.Lock()
+
+	apiServerMutex.Lock()
+	srv, listener, handler := activeAPIServer, activeAPIListener, activeAPIHandler
+	apiServerMutex.Unlock()
+
+	env := append(os.Environ(), upgradedEnv+"=1")
+	var inherited *os.File
+	if srv != nil {
+		if inherited, err = listenerFile(listener); err != nil {
+			cycleMutex.Unlock()
+			return fmt.Errorf("failed to pass on the API listener: %w", err)
+		}
+		defer inherited.Close()
+		// Requests waiting for the cycle lock can't finish, so the exec
+		// drops them after the timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), upgradeShutdownTimeout)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Warning: API server shutdown: %v", err)
+		}
+		cancel()
+		env = append(env, listenFDEnv+"="+strconv.Itoa(int(inherited.Fd())))
+	}
+
+	err = syscall.Exec(exe, originalArgs, env)
+	cycleMutex.Unlock()
+
+	// The exec failed, so serve the API again.
+	if inherited != nil {
+		if listener, listenErr := net.FileListener(inherited); listenErr != nil {
+			log.Printf("ERROR: API server stopped: %v", listenErr)
+		} else {
+			serveAPI(listener, handler)
+		}
+	}
+	return err
+}
+
+// listenerFile duplicates the socket of a listener into a file that is
+// inherited across exec.
+func listenerFile(listener net.Listener) (*os.File, error) {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("unsupported listener %T", listener)
+	}
+	f, err := tcp.File()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_SETFD, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// signalUpgrade asks the running daemon to re-execute its binary.
+func signalUpgrade(db *sql.DB) (int, error) {
+	value, _, found, err := getDaemonState(db, "pid")
+	if err != nil {
+		return 0, err
+	}
+	pid, convErr := strconv.Atoi(value)
+	if !found || convErr != nil {
+		return 0, fmt.Errorf("no daemon PID recorded; is 'gocert run' running with this database?")
+	}
+	if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+		return pid, fmt.Errorf("failed to signal the daemon (pid %d): %w", pid, err)
+	}
+	return pid, nil
+}
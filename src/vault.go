@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Mount of the KV secrets engine unless 'mount' is set
+	defaultVaultMount = "secret"
+	// Mount of the AppRole auth method unless 'approle_mount' is set
+	defaultVaultAppRoleMount = "approle"
+)
+
+// VaultConfig holds the Vault server used by 'vault' deploy hooks. Address,
+// Token and SecretID default to the VAULT_ADDR, VAULT_TOKEN and
+// VAULT_SECRET_ID environment variables.
+type VaultConfig struct {
+	Address   string `yaml:"address"`
+	Namespace string `yaml:"namespace"`
+	Token     string `yaml:"token"`
+	// RoleID and SecretID log in with AppRole instead of using a token
+	RoleID       string `yaml:"role_id"`
+	SecretID     string `yaml:"secret_id"`
+	AppRoleMount string `yaml:"approle_mount"`
+	// Mount and KVVersion (1 or 2, default 2) describe the KV secrets engine
+	Mount     string `yaml:"mount"`
+	KVVersion int    `yaml:"kv_version"`
+}
+
+var (
+	// vaultMutex guards vaultSettings
+	vaultMutex = &sync.Mutex{}
+	// vaultSettings is the Vault configuration of the current cycle
+	vaultSettings VaultConfig
+)
+
+// configureVault applies the Vault settings of the global configuration.
+func configureVault(global GlobalConfig) {
+	vaultMutex.Lock()
+	defer vaultMutex.Unlock()
+
+	vaultSettings = global.Vault
+	if vaultSettings.Address == "" {
+		vaultSettings.Address = os.Getenv("VAULT_ADDR")
+	}
+	if vaultSettings.Token == "" {
+		vaultSettings.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if vaultSettings.SecretID == "" {
+		vaultSettings.SecretID = os.Getenv("VAULT_SECRET_ID")
+	}
+	if vaultSettings.AppRoleMount == "" {
+		vaultSettings.AppRoleMount = defaultVaultAppRoleMount
+	}
+	if vaultSettings.Mount == "" {
+		vaultSettings.Mount = defaultVaultMount
+	}
+	if vaultSettings.KVVersion == 0 {
+		vaultSettings.KVVersion = 2
+	}
+}
+
+// currentVaultConfig returns the Vault settings of the current cycle.
+func currentVaultConfig() VaultConfig {
+	vaultMutex.Lock()
+	defer vaultMutex.Unlock()
+	return vaultSettings
+}
+
+// runVaultHook writes the certificate, key and fullchain to a KV path. The
+// secret has the fields 'cert', 'key', 'fullchain' and 'not_after'.
+func runVaultHook(ctx context.Context, hook HookConfig, data hookData) (string, error) {
+	vault := currentVaultConfig()
+	if vault.Address == "" {
+		return "", fmt.Errorf("no Vault address, set 'configs.vault.address' or VAULT_ADDR")
+	}
+
+	secret := map[string]string{"not_after": data.NotAfter.UTC().Format(time.RFC3339)}
+	for field, path := range map[string]string{"cert": data.CertFile, "key": data.KeyFile, "fullchain": data.FullchainFile} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		secret[field] = string(content)
+	}
+
+	token, err := vaultToken(ctx, vault)
+	if err != nil {
+		return "", err
+	}
+
+	mount := strings.Trim(vault.Mount, "/")
+	if hook.Mount != "" {
+		mount = strings.Trim(hook.Mount, "/")
+	}
+	path := strings.Trim(hook.Path, "/")
+	var body interface{} = secret
+	apiPath := mount + "/" + path
+	if vault.KVVersion != 1 {
+		body = map[string]interface{}{"data": secret}
+		apiPath = mount + "/data/" + path
+	}
+	if _, err := vaultRequest(ctx, vault, token, http.MethodPost, apiPath, body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Stored in %s/%s", mount, path), nil
+}
+
+// vaultToken returns the token to authenticate with, logging in with AppRole
+// if a role ID is configured.
+func vaultToken(ctx context.Context, vault VaultConfig) (string, error) {
+	if vault.RoleID == "" {
+		if vault.Token == "" {
+			return "", fmt.Errorf("no Vault token, set 'configs.vault.token', VAULT_TOKEN or an AppRole")
+		}
+		return vault.Token, nil
+	}
+
+	login := map[string]string{"role_id": vault.RoleID, "secret_id": vault.SecretID}
+	resp, err := vaultRequest(ctx, vault, "", http.MethodPost, "auth/"+strings.Trim(vault.AppRoleMount, "/")+"/login", login)
+	if err != nil {
+		return "", fmt.Errorf("AppRole login failed: %w", err)
+	}
+	var result struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil || result.Auth.ClientToken == "" {
+		return "", fmt.Errorf("AppRole login returned no token")
+	}
+	return result.Auth.ClientToken, nil
+}
+
+// vaultRequest sends a request to the Vault API, with body as JSON unless it
+// is nil, and returns the response body. Errors reported by Vault are
+// included in the returned error.
+func vaultRequest(ctx context.Context, vault VaultConfig, token, method, path string, body interface{}) ([]byte, error) {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	url := strings.TrimSuffix(vault.Address, "/") + "/v1/" + path
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if vault.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vault.Namespace)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, hookOutputLimit))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return nil, fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.Join(vaultErr.Errors, "; "))
+		}
+		return nil, fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+	}
+	return data, nil
+}
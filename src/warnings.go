@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Warnings are non-fatal issues of a certificate, kept in the database until
+// the check that raised them passes again. Unlike the status, they never
+// trigger a renewal.
+const (
+	warningCAAMissing        = "caa_missing"
+	warningWeakKey           = "weak_key"
+	warningChainExpiry       = "chain_expiry"
+	warningServedChainExpiry = "served_chain_expiry"
+	warningHookSlow          = "hook_slow"
+)
+
+const (
+	// Smallest RSA key size that isn't reported as weak
+	minRSAKeyBits = 2048
+	// Intermediates expiring within this many days are reported
+	chainExpiryWarningDays = 30
+)
+
+// certWarning is a warning of a certificate as shown by 'status' and the API.
+type certWarning struct {
+	Code    string    `json:"code"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+}
+
+// setWarning raises a warning of a certificate, or clears it if message is
+// empty. It reports whether the warning is new.
+func setWarning(db *sql.DB, name, code, message string) (bool, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if message == "" {
+		if _, err := db.Exec(`DELETE FROM cert_warnings WHERE name = ? AND code = ?`, name, code); err != nil {
+			return false, fmt.Errorf("failed to clear warning '%s' of '%s': %w", code, name, err)
+		}
+		return false, nil
+	}
+	var existing int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM cert_warnings WHERE name = ? AND code = ?`, name, code).Scan(&existing); err != nil {
+		return false, fmt.Errorf("failed to read warnings of '%s': %w", name, err)
+	}
+	now := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO cert_warnings (name, code, message, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (name, code) DO UPDATE SET
+			message = excluded.message,
+			last_seen = excluded.last_seen`,
+		name, code, message, now, now)
+	if err != nil {
+		return false, fmt.Errorf("failed to record warning '%s' of '%s': %w", code, name, err)
+	}
+	return existing == 0, nil
+}
+
+// raiseWarning sets or clears a warning and logs warnings that are new.
+func raiseWarning(db *sql.DB, name string, config CertConfig, code, message string) {
+	logger := certLogger(name, config)
+	isNew, err := setWarning(db, name, code, message)
+	if err != nil {
+		logger.Warn(err.Error())
+	} else if isNew {
+		logger.Warn(message, "warning", code)
+	}
+}
+
+// allWarnings returns the warnings of all certificates, keyed by name.
+func allWarnings(db *sql.DB) (map[string][]certWarning, error) {
+	rows, err := db.Query(`SELECT name, code, message, first_seen FROM cert_warnings ORDER BY name, code`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query warnings: %w", err)
+	}
+	defer rows.Close()
+
+	warnings := map[string][]certWarning{}
+	for rows.Next() {
+		var name string
+		var w certWarning
+		if err := rows.Scan(&name, &w.Code, &w.Message, &w.Since); err != nil {
+			return nil, err
+		}
+		warnings[name] = append(warnings[name], w)
+	}
+	return warnings, rows.Err()
+}
+
+// listWarnings returns the warnings of a certificate.
+func listWarnings(db *sql.DB, name string) ([]certWarning, error) {
+	warnings, err := allWarnings(db)
+	if err != nil {
+		return nil, err
+	}
+	return warnings[name], nil
+}
+
+// checkWarnings refreshes the warnings a check cycle can tell about a
+// managed certificate: a weak key, intermediates expiring soon and domains
+// without CAA records. Slow deploy hooks are reported when they run.
+func checkWarnings(name string, config CertConfig, db *sql.DB, certsBasePath string) {
+	if config.Monitor != "" {
+		return
+	}
+	files := certFilesFor(certsBasePath, name)
+	chain, err := readCertificateChain(files.Fullchain)
+	if err != nil || len(chain) == 0 {
+		return
+	}
+	raiseWarning(db, name, config, warningWeakKey, weakKeyWarning(chain[0]))
+	trackChain(name, "file", chain)
+	raiseWarning(db, name, config, warningChainExpiry, chainExpiryWarning(chain))
+
+	var missing []string
+	for _, domain := range config.Domains {
+		found, err := hasCAARecord(domain)
+		if err != nil {
+			// Keep the last result while DNS can't be queried
+			return
+		}
+		if !found {
+			missing = append(missing, domain)
+		}
+	}
+	message := ""
+	if len(missing) > 0 {
+		message = fmt.Sprintf("No CAA record restricts which CAs may issue for %s", strings.Join(missing, ", "))
+	}
+	raiseWarning(db, name, config, warningCAAMissing, message)
+}
+
+// weakKeyWarning describes a weak key or signature of a certificate, or
+// returns "".
+func weakKeyWarning(cert *x509.Certificate) string {
+	if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && key.N.BitLen() < minRSAKeyBits {
+		return fmt.Sprintf("Weak RSA key of %d bits, use at least %d bits or an EC key", key.N.BitLen(), minRSAKeyBits)
+	}
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.ECDSAWithSHA1, x509.DSAWithSHA1:
+		return fmt.Sprintf("Signed with the deprecated algorithm %s", cert.SignatureAlgorithm)
+	}
+	return ""
+}
+
+// chainExpiryWarning describes intermediates of a chain that expire before
+// its leaf or within chainExpiryWarningDays, or returns "". For an expiring
+// cross-sign, such as 'ISRG Root X1' signed by 'DST Root CA X3', it suggests
+// the CA's alternative chain, which ends at the cross-signed root instead.
+func chainExpiryWarning(chain []*x509.Certificate) string {
+	leaf := chain[0]
+	soon := time.Now().AddDate(0, 0, chainExpiryWarningDays)
+	var issues []string
+	for _, cert := range chain[1:] {
+		var issue string
+		switch {
+		case cert.NotAfter.Before(leaf.NotAfter):
+			issue = fmt.Sprintf("'%s' expires %s, before the certificate", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02"))
+		case cert.NotAfter.Before(soon):
+			issue = fmt.Sprintf("'%s' expires %s", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02"))
+		default:
+			continue
+		}
+		if isAvoidableCrossSign(chain, cert) {
+			issue += fmt.Sprintf(" (cross-signed by '%s'; prefer the chain to '%s', e.g. extra_args: [\"--preferred-chain\", \"%s\"])",
+				cert.Issuer.CommonName, cert.Subject.CommonName, cert.Subject.CommonName)
+		}
+		issues = append(issues, issue)
+	}
+	if len(issues) == 0 {
+		return ""
+	}
+	return "Intermediate " + strings.Join(issues, "; ")
+}
+
+// isAvoidableCrossSign reports whether a certificate of a chain is a
+// cross-sign the chain doesn't need: the leaf is trusted by the system roots
+// without it, because the root it cross-signs is trusted on its own.
+func isAvoidableCrossSign(chain []*x509.Certificate, cert *x509.Certificate) bool {
+	if !cert.IsCA || cert.Subject.String() == cert.Issuer.String() {
+		return false
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		if c != cert {
+			intermediates.AddCert(c)
+		}
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	return err == nil
+}
+
+// trackChain exports the expiry of the intermediates of a certificate's
+// chain, as found in fullchain.pem (source 'file') or served by an endpoint.
+func trackChain(name, source string, chain []*x509.Certificate) {
+	metricChainExpiry.DeleteMatching(name, source)
+	for _, cert := range chain[1:] {
+		metricChainExpiry.Set(float64(cert.NotAfter.Unix()), name, source, cert.Subject.CommonName, cert.Issuer.CommonName)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// hostCoverage is a certificate entry covering a hostname, as reported by
+// 'gocert which'.
+type hostCoverage struct {
+	Name      string    `json:"name"`
+	MatchedBy string    `json:"matched_by"`
+	Monitor   string    `json:"monitor,omitempty"`
+	Domains   []string  `json:"domains"`
+	Status    string    `json:"status"`
+	Expires   time.Time `json:"expires,omitzero"`
+	Fullchain string    `json:"fullchain,omitempty"`
+	Deploy    []string  `json:"deploy,omitempty"`
+	Endpoints []string  `json:"endpoints,omitempty"`
+}
+
+// findCoverage returns the entries whose domains cover a hostname, exact
+// matches before wildcards. Monitor-only entries are matched by the domains
+// recorded from their last check.
+func findCoverage(fullConfig FullConfig, db *sql.DB, certsBasePath, host string) ([]hostCoverage, error) {
+	var matches []hostCoverage
+	for name, config := range fullConfig.Certificates {
+		state, found, err := getCertState(db, name)
+		if err != nil {
+			return nil, err
+		}
+		domains := config.Domains
+		if config.Monitor != "" && found && state.Domains != "" {
+			domains = strings.Split(state.Domains, ",")
+		}
+		matchedBy := ""
+		for _, domain := range domains {
+			if hostMatches(domain, host) && (matchedBy == "" || !strings.HasPrefix(domain, "*.")) {
+				matchedBy = domain
+			}
+		}
+		if matchedBy == "" {
+			continue
+		}
+
+		coverage := hostCoverage{Name: name, MatchedBy: matchedBy, Monitor: config.Monitor, Domains: domains, Status: "unknown", Endpoints: config.Endpoints}
+		if found {
+			coverage.Status = state.Status
+			if !state.LastIssued.IsZero() || !state.NotAfter.IsZero() {
+				coverage.Expires = currentExpiry(state, certsBasePath)
+			}
+		}
+		if config.Monitor == "" {
+			files := certFilesFor(certsBasePath, name)
+			coverage.Fullchain = files.Fullchain
+			data := hookData{Name: name, Domains: config.Domains, CertFile: files.Cert, KeyFile: files.Key, FullchainFile: files.Fullchain}
+			for _, hook := range config.Deploy {
+				coverage.Deploy = append(coverage.Deploy, strings.TrimSpace(hookType(hook)+" "+hookTarget(hook, data)))
+			}
+		}
+		matches = append(matches, coverage)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		wi, wj := strings.HasPrefix(matches[i].MatchedBy, "*."), strings.HasPrefix(matches[j].MatchedBy, "*.")
+		if wi != wj {
+			return !wi
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	return matches, nil
+}
+
+// displayCoverage prints which certificates cover a hostname. It returns
+// false if none does.
+func displayCoverage(fullConfig FullConfig, db *sql.DB, certsBasePath, host, output string) (bool, error) {
+	matches, err := findCoverage(fullConfig, db, certsBasePath, host)
+	if err != nil {
+		return false, err
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if matches == nil {
+			matches = []hostCoverage{}
+		}
+		return len(matches) > 0, enc.Encode(matches)
+	}
+	if len(matches) == 0 {
+		fmt.Printf("No configured certificate covers %s.\n", host)
+		return false, nil
+	}
+
+	for i, m := range matches {
+		if i > 0 {
+			fmt.Println()
+		}
+		kind := "managed"
+		if m.Monitor != "" {
+			kind = "monitor-only"
+		}
+		fmt.Printf("%s is covered by '%s' (%s, matched by %s):\n", host, m.Name, kind, m.MatchedBy)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintf(w, "  Domains:\t%s\n", strings.Join(m.Domains, ", "))
+		fmt.Fprintf(w, "  Status:\t%s\n", m.Status)
+		if m.Expires.IsZero() {
+			fmt.Fprintf(w, "  Expires:\tN/A\n")
+		} else {
+			fmt.Fprintf(w, "  Expires:\t%s (%s)\n", m.Expires.Format("2006-01-02 15:04"), formatRemaining(time.Until(m.Expires)))
+		}
+		if m.Monitor != "" {
+			fmt.Fprintf(w, "  Served at:\t%s\n", m.Monitor)
+		} else {
+			fmt.Fprintf(w, "  Fullchain:\t%s\n", m.Fullchain)
+		}
+		for j, target := range m.Deploy {
+			label := ""
+			if j == 0 {
+				label = "Deploy:"
+			}
+			fmt.Fprintf(w, "  %s\t%d. %s\n", label, j+1, target)
+		}
+		if len(m.Endpoints) > 0 {
+			fmt.Fprintf(w, "  Endpoints:\t%s\n", strings.Join(m.Endpoints, ", "))
+		}
+		w.Flush()
+	}
+	return true, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	// Time zones of windows must resolve on hosts and images without a
+	// zoneinfo database.
+	_ "time/tzdata"
+)
+
+// ScheduleWindow is a recurring time of day, optionally limited to weekdays
+// and a date range, in an IANA time zone. Its bounds are wall-clock times, so
+// a window keeps its local hours across DST changes: '02:00' to '04:00' is
+// an hour shorter on the night clocks skip from 02:00 to 03:00.
+type ScheduleWindow struct {
+	// Start and End are 'HH:MM'; a window ending at or before its start
+	// runs past midnight, one with equal bounds lasts the whole day
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+	// Days limits the window to the weekdays it starts on, e.g. 'sat'
+	Days []string `yaml:"days" json:"days,omitempty"`
+	// From and Until limit the window to the days it starts on between these
+	// 'YYYY-MM-DD' dates, both included
+	From  string `yaml:"from" json:"from,omitempty"`
+	Until string `yaml:"until" json:"until,omitempty"`
+	// Timezone is an IANA time zone such as 'Europe/Berlin' (default: local)
+	Timezone string `yaml:"timezone" json:"timezone,omitempty"`
+}
+
+var (
+	// windowsMutex guards the default windows
+	windowsMutex = &sync.Mutex{}
+	// renewalWindows and freezeWindows apply to certificates that don't set their own
+	renewalWindows []ScheduleWindow
+	freezeWindows  []ScheduleWindow
+)
+
+// weekdays maps the day names of 'days' to weekdays.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// configureWindows sets the default renewal and freeze windows.
+func configureWindows(global GlobalConfig) {
+	windowsMutex.Lock()
+	defer windowsMutex.Unlock()
+	renewalWindows = global.RenewalWindows
+	freezeWindows = global.FreezeWindows
+}
+
+// windowsFor returns the renewal and freeze windows of a certificate.
+func windowsFor(config CertConfig) ([]ScheduleWindow, []ScheduleWindow) {
+	windowsMutex.Lock()
+	defer windowsMutex.Unlock()
+	renewal, freeze := renewalWindows, freezeWindows
+	if config.RenewalWindows != nil {
+		renewal = config.RenewalWindows
+	}
+	if config.FreezeWindows != nil {
+		freeze = config.FreezeWindows
+	}
+	return renewal, freeze
+}
+
+// validateWindows checks the times, days, dates and time zones of renewal
+// and freeze windows.
+func validateWindows(renewal, freeze []ScheduleWindow) error {
+	for field, windows := range map[string][]ScheduleWindow{"renewal_windows": renewal, "freeze_windows": freeze} {
+		for i, w := range windows {
+			if _, err := w.parse(); err != nil {
+				return fmt.Errorf("%s[%d]: %w", field, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parsedWindow is a ScheduleWindow with its fields parsed.
+type parsedWindow struct {
+	start, end  int // minutes after midnight
+	days        map[time.Weekday]bool
+	from, until time.Time // zero if unbounded
+	loc         *time.Location
+}
+
+// parse checks and parses a window.
+func (w ScheduleWindow) parse() (parsedWindow, error) {
+	p := parsedWindow{loc: time.Local}
+	var err error
+	if p.start, err = parseClock(w.Start); err != nil {
+		return p, fmt.Errorf("invalid start: %w", err)
+	}
+	if p.end, err = parseClock(w.End); err != nil {
+		return p, fmt.Errorf("invalid end: %w", err)
+	}
+	if w.Timezone != "" {
+		if p.loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return p, fmt.Errorf("unknown time zone '%s'", w.Timezone)
+		}
+	}
+	if len(w.Days) > 0 {
+		p.days = map[time.Weekday]bool{}
+		for _, day := range w.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return p, fmt.Errorf("unknown day '%s', use mon, tue, wed, thu, fri, sat or sun", day)
+			}
+			p.days[weekday] = true
+		}
+	}
+	if w.From != "" {
+		if p.from, err = time.ParseInLocation("2006-01-02", w.From, p.loc); err != nil {
+			return p, fmt.Errorf("invalid from date '%s', expected YYYY-MM-DD", w.From)
+		}
+	}
+	if w.Until != "" {
+		if p.until, err = time.ParseInLocation("2006-01-02", w.Until, p.loc); err != nil {
+			return p, fmt.Errorf("invalid until date '%s', expected YYYY-MM-DD", w.Until)
+		}
+	}
+	if !p.from.IsZero() && !p.until.IsZero() && p.until.Before(p.from) {
+		return p, fmt.Errorf("until %s is before from %s", w.Until, w.From)
+	}
+	return p, nil
+}
+
+// parseClock parses 'HH:MM' into minutes after midnight.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' isn't a time of day, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// occurrence returns the window starting on the given day, if the window
+// runs on that day.
+func (p parsedWindow) occurrence(year int, month time.Month, day int) (time.Time, time.Time, bool) {
+	date := time.Date(year, month, day, 0, 0, 0, 0, p.loc)
+	if p.days != nil && !p.days[date.Weekday()] {
+		return time.Time{}, time.Time{}, false
+	}
+	if (!p.from.IsZero() && date.Before(p.from)) || (!p.until.IsZero() && date.After(p.until)) {
+		return time.Time{}, time.Time{}, false
+	}
+	endDay := day
+	if p.end <= p.start {
+		endDay++
+	}
+	start := time.Date(year, month, day, p.start/60, p.start%60, 0, 0, p.loc)
+	end := time.Date(year, month, endDay, p.end/60, p.end%60, 0, 0, p.loc)
+	return start, end, end.After(start)
+}
+
+// containing returns the end of the occurrence of the window that t falls
+// into, if any. Occurrences may start the day before and run past midnight.
+func (p parsedWindow) containing(t time.Time) (time.Time, bool) {
+	local := t.In(p.loc)
+	for _, offset := range []int{0, -1} {
+		start, end, ok := p.occurrence(local.Year(), local.Month(), local.Day()+offset)
+		if ok && !t.Before(start) && t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// next returns the start of the window's next occurrence after t, searching
+// a year ahead.
+func (p parsedWindow) next(t time.Time) (time.Time, bool) {
+	local := t.In(p.loc)
+	for offset := 0; offset <= 366; offset++ {
+		start, _, ok := p.occurrence(local.Year(), local.Month(), local.Day()+offset)
+		if ok && start.After(t) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// renewalDeferral reports whether a due renewal must wait because t falls
+// into a freeze window or outside the renewal windows, the reason and when
+// the wait ends. The zero time means no window opens within a year.
+func renewalDeferral(config CertConfig, t time.Time) (string, time.Time, bool) {
+	renewal, freeze := windowsFor(config)
+
+	// A freeze lasts until no freeze window continues it, e.g. through the
+	// days of a holiday freeze.
+	var parsed []parsedWindow
+	for _, w := range freeze {
+		if p, err := w.parse(); err == nil {
+			parsed = append(parsed, p)
+		}
+	}
+	frozenUntil := t
+	for extended := true; extended && frozenUntil.Before(t.AddDate(1, 0, 0)); {
+		extended = false
+		for _, p := range parsed {
+			if end, ok := p.containing(frozenUntil); ok && end.After(frozenUntil) {
+				frozenUntil, extended = end, true
+			}
+		}
+	}
+	if frozenUntil.After(t) {
+		return "freeze window", frozenUntil, true
+	}
+
+	if len(renewal) == 0 {
+		return "", time.Time{}, false
+	}
+	var opens time.Time
+	for _, w := range renewal {
+		p, err := w.parse()
+		if err != nil {
+			continue
+		}
+		if _, ok := p.containing(t); ok {
+			return "", time.Time{}, false
+		}
+		if start, ok := p.next(t); ok && (opens.IsZero() || start.Before(opens)) {
+			opens = start
+		}
+	}
+	return "outside renewal windows", opens, true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// schemaPathDelimiter separates the elements of a schema error's path. Keys
+// of the configuration may contain dots, so the default '.' is ambiguous.
+const schemaPathDelimiter = "\x00"
+
+// schemaErrorPosition returns the line and column in the YAML document that a
+// schema error refers to: the offending key for properties that aren't
+// allowed or badly named, the key of an object, the value otherwise, or the closest
+// enclosing one that exists.
+func schemaErrorPosition(doc *yaml.Node, desc gojsonschema.ResultError) (int, int, bool) {
+	if doc == nil || len(doc.Content) == 0 {
+		return 0, 0, false
+	}
+	path := splitSchemaPath(desc.Context().String(schemaPathDelimiter))
+	property, _ := desc.Details()["property"].(string)
+	keyError := desc.Type() == "additional_property_not_allowed" || desc.Type() == "invalid_property_name"
+	if keyError && property != "" {
+		path = append(path, property)
+	}
+
+	node := doc.Content[0]
+	var key *yaml.Node
+	for _, element := range path {
+		childKey, child := yamlChild(node, element)
+		if child == nil {
+			break
+		}
+		key, node = childKey, child
+	}
+	if key != nil && (keyError || node.Kind == yaml.MappingNode) {
+		return key.Line, key.Column, true
+	}
+	return node.Line, node.Column, true
+}
+
+// splitSchemaPath splits a path like '(root)<del>web<del>domains' into its
+// elements below the root.
+func splitSchemaPath(path string) []string {
+	var elements []string
+	start := 0
+	for i := 0; i <= len(path); i++ {
+		if i == len(path) || path[i:i+1] == schemaPathDelimiter {
+			elements = append(elements, path[start:i])
+			start = i + 1
+		}
+	}
+	if len(elements) > 0 && elements[0] == gojsonschema.STRING_CONTEXT_ROOT {
+		elements = elements[1:]
+	}
+	return elements
+}
+
+// yamlChild returns the key and value of a mapping entry, or the item of a
+// sequence, following aliases and merge keys. It returns nil values if the
+// node has no such child.
+func yamlChild(node *yaml.Node, element string) (*yaml.Node, *yaml.Node) {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == element {
+				return node.Content[i], node.Content[i+1]
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value != "<<" {
+				continue
+			}
+			merged := []*yaml.Node{node.Content[i+1]}
+			if merged[0].Kind == yaml.SequenceNode {
+				merged = merged[0].Content
+			}
+			for _, m := range merged {
+				if key, value := yamlChild(m, element); value != nil {
+					return key, value
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		if i, err := strconv.Atoi(element); err == nil && i >= 0 && i < len(node.Content) {
+			return nil, node.Content[i]
+		}
+	}
+	return nil, nil
+}
+
+// formatSchemaError formats a schema error, prefixed with its position in the
+// YAML document if it is known.
+func formatSchemaError(doc *yaml.Node, desc gojsonschema.ResultError) string {
+	if line, column, ok := schemaErrorPosition(doc, desc); ok {
+		return fmt.Sprintf("line %d, column %d: %s", line, column, desc)
+	}
+	return desc.String()
+}
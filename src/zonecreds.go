@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ZoneCredentials are credentials of a DNS provider that only apply to the
+// domains in some zones, such as the API token of a team that only has
+// access to its own delegated subzone.
+type ZoneCredentials struct {
+	// Zones the credentials are for, including their subdomains
+	Zones []string `yaml:"zones"`
+	// Env holds the credential variables; values may be secret references
+	Env map[string]string `yaml:"env"`
+}
+
+// validateZoneCredentials checks the zones and variables of the scoped
+// credentials of the DNS providers. A zone may only be listed once per
+// provider, so every domain has one set with the longest matching zone.
+func validateZoneCredentials(providers map[string]DNSProviderConfig) error {
+	for typ, provider := range providers {
+		seen := map[string]bool{}
+		for i, creds := range provider.Credentials {
+			if len(creds.Zones) == 0 || len(creds.Env) == 0 {
+				return fmt.Errorf("dns.%s.credentials[%d]: both 'zones' and 'env' are required", typ, i)
+			}
+			for _, zone := range creds.Zones {
+				zone = normalizeZone(zone)
+				if zone == "" || strings.Contains(zone, "*") {
+					return fmt.Errorf("dns.%s.credentials[%d]: invalid zone '%s'", typ, i, zone)
+				}
+				if seen[zone] {
+					return fmt.Errorf("dns.%s.credentials[%d]: zone '%s' is listed more than once", typ, i, zone)
+				}
+				seen[zone] = true
+			}
+			for name, value := range creds.Env {
+				if !envNamePattern.MatchString(name) {
+					return fmt.Errorf("dns.%s.credentials[%d]: invalid variable name '%s'", typ, i, name)
+				}
+				if v, ok := credentialCaseMismatch(typ, name); ok {
+					return fmt.Errorf("dns.%s.credentials[%d]: '%s' isn't a credential of %s, did you mean %s? Variable names are case-sensitive", typ, i, name, typ, v)
+				}
+				if isSecretRef(value) {
+					if err := validateSecretRef(value); err != nil {
+						return fmt.Errorf("dns.%s.credentials[%d].env.%s: %w", typ, i, name, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeZone lowercases a zone or domain and strips a wildcard label and
+// the trailing dot.
+func normalizeZone(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "*."), ".")
+}
+
+// zoneCredentialsIndex returns the index of the credentials with the longest
+// zone containing the domain, or -1 if no zone does.
+func zoneCredentialsIndex(credentials []ZoneCredentials, domain string) int {
+	domain = normalizeZone(domain)
+	best, bestLen := -1, 0
+	for i, creds := range credentials {
+		for _, zone := range creds.Zones {
+			zone = normalizeZone(zone)
+			if (domain == zone || strings.HasSuffix(domain, "."+zone)) && len(zone) > bestLen {
+				best, bestLen = i, len(zone)
+			}
+		}
+	}
+	return best
+}
+
+// zoneCredentialsFor returns the scoped credentials of a DNS provider type.
+func zoneCredentialsFor(typ string) []ZoneCredentials {
+	dnsSettingsMutex.Lock()
+	defer dnsSettingsMutex.Unlock()
+	return dnsSettings[typ].Credentials
+}
+
+// credentialGroups groups the domains of a certificate by the index of the
+// scoped credentials they use, -1 for none.
+func credentialGroups(credentials []ZoneCredentials, domains []string) map[int][]string {
+	groups := map[int][]string{}
+	for _, domain := range domains {
+		i := zoneCredentialsIndex(credentials, domain)
+		groups[i] = append(groups[i], domain)
+	}
+	return groups
+}
+
+// certZoneCredentials returns the scoped credentials an acme.sh run of a
+// certificate uses, nil if none. acme.sh has one environment per run, so all
+// domains of the certificate must use the same credentials.
+func certZoneCredentials(config CertConfig, credentials []ZoneCredentials) (*ZoneCredentials, error) {
+	groups := credentialGroups(credentials, config.Domains)
+	if len(groups) > 1 {
+		var parts []string
+		for _, domain := range config.Domains {
+			i := zoneCredentialsIndex(credentials, domain)
+			domains, ok := groups[i]
+			if !ok {
+				continue
+			}
+			delete(groups, i)
+			zones := "no scoped credentials"
+			if i >= 0 {
+				zones = "the credentials for " + strings.Join(credentials[i].Zones, ", ")
+			}
+			parts = append(parts, fmt.Sprintf("%s use %s", strings.Join(domains, ", "), zones))
+		}
+		return nil, fmt.Errorf("domains need different %s credentials, which acme.sh can't use in one run (%s); split the certificate or use the native backend", config.Type, strings.Join(parts, "; "))
+	}
+	for i := range groups {
+		if i >= 0 {
+			return &credentials[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// resolveZoneEnv returns the variables of scoped credentials with their
+// secret references resolved.
+func resolveZoneEnv(ctx context.Context, creds ZoneCredentials) (map[string]string, error) {
+	env := make(map[string]string, len(creds.Env))
+	for key, value := range creds.Env {
+		if isSecretRef(value) {
+			resolved, err := resolveSecret(ctx, value)
+			if err != nil {
+				return nil, fmt.Errorf("credentials for %s, '%s': %w", strings.Join(creds.Zones, ", "), key, err)
+			}
+			value = resolved
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// zoneSolver routes the challenge records of the native backend to a solver
+// with the credentials of the record's zone, or the daemon's environment if
+// no scoped credentials cover it. Solvers are created on first use.
+type zoneSolver struct {
+	typ         string
+	credentials []ZoneCredentials
+	// certEnv is the certificate's resolved 'env', which takes precedence
+	certEnv map[string]string
+
+	mu      sync.Mutex
+	solvers map[int]dnsSolver
+}
+
+// solverFor returns the solver for a challenge record name.
+func (z *zoneSolver) solverFor(fqdn string) (dnsSolver, error) {
+	i := zoneCredentialsIndex(z.credentials, strings.TrimPrefix(fqdn, "_acme-challenge."))
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if solver, ok := z.solvers[i]; ok {
+		return solver, nil
+	}
+	getenv := credentialGetenv
+	if i >= 0 {
+		env, err := resolveZoneEnv(context.Background(), z.credentials[i])
+		if err != nil {
+			return nil, err
+		}
+		getenv = func(key string) string { return env[key] }
+	}
+	solver, err := newDNSSolver(z.typ, withCertEnv(z.certEnv, getenv))
+	if err != nil {
+		if i >= 0 {
+			return nil, fmt.Errorf("credentials for %s: %w", strings.Join(z.credentials[i].Zones, ", "), err)
+		}
+		return nil, err
+	}
+	z.solvers[i] = solver
+	return solver, nil
+}
+
+func (z *zoneSolver) Present(fqdn, value string) error {
+	solver, err := z.solverFor(fqdn)
+	if err != nil {
+		return err
+	}
+	return solver.Present(fqdn, value)
+}
+
+func (z *zoneSolver) CleanUp(fqdn, value string) error {
+	solver, err := z.solverFor(fqdn)
+	if err != nil {
+		return err
+	}
+	return solver.CleanUp(fqdn, value)
+}
+
+// newNativeSolver returns the solver of the native backend for a DNS
+// provider type, using scoped credentials where configured. The variables of
+// a certificate's resolved 'env' take precedence, like with acme.sh.
+func newNativeSolver(typ string, certEnv map[string]string) (dnsSolver, error) {
+	if typ == challengeHTTP {
+		return http01Solver{}, nil
+	}
+	credentials := zoneCredentialsFor(typ)
+	if _, ok := dnsSolvers[typ]; !ok || len(credentials) == 0 {
+		return newDNSSolver(typ, withCertEnv(certEnv, credentialGetenv))
+	}
+	return &zoneSolver{typ: typ, credentials: credentials, certEnv: certEnv, solvers: map[int]dnsSolver{}}, nil
+}
+
+// withCertEnv returns a lookup of credential variables that prefers a
+// certificate's 'env' over getenv.
+func withCertEnv(certEnv map[string]string, getenv func(string) string) func(string) string {
+	return func(key string) string {
+		if value, ok := certEnv[key]; ok {
+			return value
+		}
+		return getenv(key)
+	}
+}